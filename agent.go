@@ -0,0 +1,310 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"log/slog"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+const DEFAULT_COORDINATOR_URL = "http://127.0.0.1:8420"
+
+// results are uploaded once this many are queued, or after RESULT_FLUSH_INTERVAL
+const RESULT_BATCH_SIZE = 100
+const RESULT_FLUSH_INTERVAL = time.Second
+
+// how many times in a row the coordinator may be unreachable before an agent gives up
+const MAX_COORDINATOR_FAILURES = 10
+
+var errNoMoreShards = errors.New("no more shards")
+
+// AgentClient speaks the coordinator protocol
+type AgentClient struct {
+	base   string
+	name   string
+	client *http.Client
+}
+
+func NewAgentClient(base, name string) *AgentClient {
+	return &AgentClient{
+		base:   strings.TrimSuffix(base, "/"),
+		name:   name,
+		client: &http.Client{Timeout: 30 * time.Second},
+	}
+}
+
+func (a *AgentClient) post(ctx context.Context, path string, in any, out any) (int, error) {
+	body, err := json.Marshal(in)
+	if err != nil {
+		return 0, err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, a.base+path, bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := a.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	if out != nil && resp.StatusCode == http.StatusOK {
+		if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+			return resp.StatusCode, err
+		}
+	}
+	return resp.StatusCode, nil
+}
+
+// Lease asks for a shard, returning nil when none is free right now
+func (a *AgentClient) Lease(ctx context.Context) (*LeaseResponse, error) {
+	var resp LeaseResponse
+	status, err := a.post(ctx, "/lease", LeaseRequest{Agent: a.name}, &resp)
+	if err != nil {
+		return nil, err
+	}
+	switch status {
+	case http.StatusOK:
+		return &resp, nil
+	case http.StatusNoContent:
+		return nil, nil
+	case http.StatusGone:
+		return nil, errNoMoreShards
+	default:
+		return nil, fmt.Errorf("lease: unexpected status %d", status)
+	}
+}
+
+func (a *AgentClient) shardCall(ctx context.Context, path string, shardID int) error {
+	status, err := a.post(ctx, path, ShardRequest{Agent: a.name, ShardID: shardID}, nil)
+	if err != nil {
+		return err
+	}
+	switch status {
+	case http.StatusOK, http.StatusNoContent:
+		return nil
+	case http.StatusConflict:
+		return errLeaseLost
+	default:
+		return fmt.Errorf("%s: unexpected status %d", path, status)
+	}
+}
+
+func (a *AgentClient) Heartbeat(ctx context.Context, shardID int) error {
+	return a.shardCall(ctx, "/heartbeat", shardID)
+}
+
+func (a *AgentClient) Complete(ctx context.Context, shardID int) error {
+	return a.shardCall(ctx, "/complete", shardID)
+}
+
+func (a *AgentClient) Release(ctx context.Context, shardID int) error {
+	return a.shardCall(ctx, "/release", shardID)
+}
+
+// SendResults uploads a batch, retrying with backoff until it succeeds or ctx is cancelled
+func (a *AgentClient) SendResults(ctx context.Context, shardID int, results []*ServerStatus) error {
+	backoff := time.Second
+	for {
+		status, err := a.post(ctx, "/results", ResultsRequest{Agent: a.name, ShardID: shardID, Results: results}, nil)
+		if err == nil && status == http.StatusNoContent {
+			return nil
+		}
+		if err == nil {
+			err = fmt.Errorf("results: unexpected status %d", status)
+		}
+		slog.Warn("Failed to upload results, retrying", "count", len(results), "error", err, "backoff", backoff)
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		backoff = min(backoff*2, time.Minute)
+	}
+}
+
+// uploadResults streams annotated results to the coordinator until both channels are closed
+func (a *AgentClient) uploadResults(ctx context.Context, shardID int, results <-chan *ServerStatus, errors <-chan ErrorWithIP) error {
+	ticker := time.NewTicker(RESULT_FLUSH_INTERVAL)
+	defer ticker.Stop()
+	var batch []*ServerStatus
+	flush := func() error {
+		if len(batch) == 0 {
+			return nil
+		}
+		err := a.SendResults(ctx, shardID, batch)
+		batch = nil
+		return err
+	}
+
+	for results != nil || errors != nil {
+		select {
+		case result, ok := <-results:
+			if !ok {
+				results = nil
+				continue
+			}
+			slog.Info("Result", "Address", result.Address, "Version", result.Version.Name)
+			result.Source = a.name
+			batch = append(batch, result)
+			if len(batch) >= RESULT_BATCH_SIZE {
+				if err := flush(); err != nil {
+					return err
+				}
+			}
+		case err, ok := <-errors:
+			if !ok {
+				errors = nil
+				continue
+			}
+			slog.Error(err.Err.Error(), "IP", err.IP.String(), "Port", err.Port)
+		case <-ticker.C:
+			if err := flush(); err != nil {
+				return err
+			}
+		}
+	}
+	return flush()
+}
+
+// keepLease renews the lease until ctx is done, cancelling the shard if the lease is lost
+func (a *AgentClient) keepLease(ctx context.Context, cancelShard context.CancelFunc, lease *LeaseResponse) {
+	interval := time.Until(lease.Expires) / 3
+	if interval <= 0 {
+		interval = time.Second
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			err := a.Heartbeat(ctx, lease.Shard.ID)
+			if errors.Is(err, errLeaseLost) {
+				slog.Warn("Lost lease, abandoning shard", "shard", lease.Shard.ID)
+				cancelShard()
+				return
+			}
+			if err != nil && ctx.Err() == nil {
+				slog.Warn("Heartbeat failed", "shard", lease.Shard.ID, "error", err)
+			}
+		}
+	}
+}
+
+// scanShard runs the worker pool over one shard and streams its results back
+func (a *AgentClient) scanShard(ctx context.Context, cfg ScanConfig, lease *LeaseResponse, enricher *Enricher, rdns *ReverseDNS, limiter *Limiter) error {
+	shardCtx, cancelShard := context.WithCancel(ctx)
+	defer cancelShard()
+	go a.keepLease(shardCtx, cancelShard, lease)
+
+	jobs := make(chan Target, 100)
+	go func() {
+		defer close(jobs)
+		targets := &uniformTargets{ranges: lease.Shard.IPRanges()}
+		for {
+			t, ok := targets.next()
+			if !ok {
+				return
+			}
+			select {
+			case jobs <- t:
+				metricTargets.WithLabelValues(portLabel(t.Port)).Inc()
+			case <-shardCtx.Done():
+				return
+			}
+		}
+	}()
+
+	results, errors := startWorkers(shardCtx, cfg.Workers, jobs, limiter, nil, nil)
+	annotated := make(chan *ServerStatus, 100)
+	go annotator(results, annotated, enricher, rdns)
+
+	// uploads use the parent context so a lost lease still delivers what was found
+	if err := a.uploadResults(ctx, lease.Shard.ID, annotated, errors); err != nil {
+		return err
+	}
+	return shardCtx.Err()
+}
+
+func runAgent(args []string) {
+	fs := flag.NewFlagSet("agent", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s agent [flags] [workers]\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	var cfg ScanConfig
+	coordinatorURL := fs.String("coordinator", DEFAULT_COORDINATOR_URL, "base URL of the coordinator")
+	hostname, _ := os.Hostname()
+	name := fs.String("name", fmt.Sprintf("%s-%d", hostname, os.Getpid()), "agent name reported to the coordinator")
+	addProbeFlags(fs, &cfg)
+	fs.Parse(args)
+	parseWorkerCount(fs, &cfg)
+
+	slog.Info(fmt.Sprintf("Starting agent %s with %d workers", *name, cfg.Workers))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	done := make(chan struct{})
+	stopSignals := handleShutdownSignals(cancel, done)
+	defer stopSignals()
+
+	defer setupTracing(ctx, cfg.Tracing)()
+	enricher, rdns, limiter := setupProbing(ctx, cfg)
+	if enricher != nil {
+		defer enricher.Close()
+	}
+	client := NewAgentClient(*coordinatorURL, *name)
+
+	failures := 0
+	for ctx.Err() == nil {
+		lease, err := client.Lease(ctx)
+		if errors.Is(err, errNoMoreShards) {
+			slog.Info("Coordinator has no more shards")
+			return
+		}
+		if err != nil {
+			failures++
+			if failures >= MAX_COORDINATOR_FAILURES {
+				log.Fatalf("giving up on coordinator: %v", err)
+			}
+			slog.Warn("Failed to lease shard", "error", err)
+		} else {
+			failures = 0
+		}
+		if lease == nil {
+			select {
+			case <-time.After(AGENT_POLL_INTERVAL):
+			case <-ctx.Done():
+			}
+			continue
+		}
+
+		slog.Info("Scanning shard", "shard", lease.Shard.ID, "ranges", len(lease.Shard.Ranges))
+		err = client.scanShard(ctx, cfg, lease, enricher, rdns, limiter)
+		switch {
+		case err == nil:
+			if err := client.Complete(ctx, lease.Shard.ID); err != nil {
+				slog.Warn("Failed to complete shard", "shard", lease.Shard.ID, "error", err)
+			}
+		case ctx.Err() != nil:
+			// shutting down, hand the shard back straight away instead of waiting for the lease to expire
+			releaseCtx, releaseCancel := context.WithTimeout(context.Background(), 5*time.Second)
+			if err := client.Release(releaseCtx, lease.Shard.ID); err != nil {
+				slog.Warn("Failed to release shard", "shard", lease.Shard.ID, "error", err)
+			}
+			releaseCancel()
+		default:
+			slog.Warn("Shard abandoned", "shard", lease.Shard.ID, "error", err)
+		}
+	}
+}
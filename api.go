@@ -0,0 +1,710 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	badger "github.com/dgraph-io/badger/v4"
+	"github.com/google/uuid"
+)
+
+const DEFAULT_API_ADDR = "localhost:8080"
+
+// page sizes for the list endpoints
+const DEFAULT_PAGE_SIZE = 50
+const MAX_PAGE_SIZE = 1000
+
+// computing stats reads every server, so they are only recomputed this often
+const STATS_CACHE_TTL = time.Minute
+
+// how many of each breakdown the stats list
+const STATS_TOP = 20
+
+// servers a search collects from the index for one page, past this it's truncated
+const MAX_SEARCH_CANDIDATES = 10000
+
+// API serves the scan database as JSON, and the dashboard in web/ on top of it.
+// Everything goes through Storage, so it works the same on every backend, and it
+// only reads, so it can share a store with a writer.
+type API struct {
+	store Storage
+	// most servers a search looks at per page, MAX_SEARCH_CANDIDATES outside tests
+	searchLimit int
+
+	mu      sync.Mutex
+	stats   *APIStats
+	statsAt time.Time
+}
+
+func NewAPI(store Storage) *API {
+	return &API{store: store, searchLimit: MAX_SEARCH_CANDIDATES}
+}
+
+// APIRecord is a record as the API returns it. Favicons are data URLs of up to a
+// few KB, so instead of inlining them it has their hash for /api/favicons/{hash}.
+type APIRecord struct {
+	*ServerRecord
+	FaviconHash string `json:"faviconHash,omitempty"`
+}
+
+func newAPIRecord(r *ServerRecord) APIRecord {
+	record := *r
+	out := APIRecord{ServerRecord: &record}
+	if record.Favicon != nil {
+		out.FaviconHash = FaviconHash(*record.Favicon)
+		record.Favicon = nil
+	}
+	return out
+}
+
+// ServerPage is one page of a server listing, next is the cursor for the following one
+type ServerPage struct {
+	Servers []APIRecord `json:"servers"`
+	Next    string      `json:"next,omitempty"`
+	Plan    *QueryPlan  `json:"plan,omitempty"` // how q was run
+	// a search matched more than MAX_SEARCH_CANDIDATES servers past the cursor and
+	// this page only looked at the first of them, next goes on from there
+	Truncated bool `json:"truncated,omitempty"`
+}
+
+type HistoryPage struct {
+	Observations []APIRecord `json:"observations"`
+	Next         string      `json:"next,omitempty"` // pass as since for the following page
+}
+
+type PlayerResponse struct {
+	UUIDs   []uuid.UUID     `json:"uuids"`
+	Servers []PlayerSummary `json:"servers"`
+}
+
+type NameCount struct {
+	Name  string `json:"name"`
+	Count int    `json:"count"`
+}
+
+type APIStats struct {
+	GeneratedAt   time.Time   `json:"generatedAt"`
+	Servers       int         `json:"servers"`
+	PlayersOnline int         `json:"playersOnline"`
+	PlayerSlots   int         `json:"playerSlots"`
+	OnlineMode    int         `json:"onlineMode"`
+	Modded        int         `json:"modded"`
+	FakeSample    int         `json:"fakeSample"`
+	Versions      []NameCount `json:"versions"`
+	Software      []NameCount `json:"software"`
+	// only filled in for servers scanned with enrichment
+	Countries []NameCount `json:"countries"`
+	ASNs      []NameCount `json:"asns"`
+}
+
+type apiError struct {
+	Error string `json:"error"`
+}
+
+func writeAPIError(w http.ResponseWriter, status int, err error) {
+	writeJSONStatus(w, status, apiError{err.Error()})
+}
+
+// filterFromQuery reads the same filters the query command takes as flags, so
+// ?min-online=10&version=1.20* works like -min-online 10 -version '1.20*'
+func filterFromQuery(values url.Values) (RecordFilter, error) {
+	filter := NewRecordFilter()
+	fs := flag.NewFlagSet("filter", flag.ContinueOnError)
+	finish := addFilterFlags(fs, &filter)
+	for name, value := range values {
+		if fs.Lookup(name) == nil {
+			continue
+		}
+		if err := fs.Set(name, value[0]); err != nil {
+			return filter, fmt.Errorf("invalid %s: %w", name, err)
+		}
+	}
+	return filter, finish()
+}
+
+func pageSize(values url.Values) (int, error) {
+	limit := values.Get("limit")
+	if limit == "" {
+		return DEFAULT_PAGE_SIZE, nil
+	}
+	n, err := strconv.Atoi(limit)
+	if err != nil || n <= 0 {
+		return 0, fmt.Errorf("invalid limit %q", limit)
+	}
+	return min(n, MAX_PAGE_SIZE), nil
+}
+
+// listServers writes a page of the latest observation of each server matching the
+// filters and the q query, restricted to the servers search finds when it isn't nil
+func (a *API) listServers(w http.ResponseWriter, r *http.Request, search *IndexLookup) {
+	values := r.URL.Query()
+	filter, err := filterFromQuery(values)
+	if err != nil {
+		writeAPIError(w, http.StatusBadRequest, err)
+		return
+	}
+	query, err := ParseQuery(values.Get("q"), filter)
+	if err != nil {
+		writeAPIError(w, http.StatusBadRequest, fmt.Errorf("invalid q: %w", err))
+		return
+	}
+	limit, err := pageSize(values)
+	if err != nil {
+		writeAPIError(w, http.StatusBadRequest, err)
+		return
+	}
+	if cursor := values.Get("cursor"); cursor != "" {
+		ip, port, err := parseServerArg(cursor)
+		if err != nil {
+			writeAPIError(w, http.StatusBadRequest, fmt.Errorf("invalid cursor: %w", err))
+			return
+		}
+		// the scan starts after it instead of skipping its way there
+		query.Filter.After = &net.TCPAddr{IP: ip, Port: int(port)}
+	}
+
+	page := ServerPage{Servers: []APIRecord{}}
+	var only []uint64
+	if search != nil {
+		if only, page.Truncated, err = searchCandidates(a.store, *search, &query.Filter, a.searchLimit); err != nil {
+			writeAPIError(w, http.StatusInternalServerError, err)
+			return
+		}
+	}
+	if len(query.Terms) > 0 {
+		plan := query.Plan()
+		page.Plan = &plan
+	}
+	err = query.Run(a.store, true, func(record *ServerRecord) error {
+		if search != nil {
+			if _, ok := slices.BinarySearch(only, serverOrder(record.IP, record.Port)); !ok {
+				return nil
+			}
+		}
+		if len(page.Servers) == limit {
+			// there is at least one more, so the client gets a cursor
+			page.Next = page.Servers[limit-1].Addr().String()
+			return errStopScan
+		}
+		page.Servers = append(page.Servers, newAPIRecord(record))
+		return nil
+	})
+	if err != nil && !errors.Is(err, errStopScan) {
+		writeAPIError(w, http.StatusInternalServerError, err)
+		return
+	}
+	if page.Truncated && page.Next == "" {
+		// the rest of the search carries on after the last server this page looked at
+		last := only[len(only)-1]
+		page.Next = (&net.TCPAddr{IP: uint32ToIP(uint32(last >> 16)), Port: int(uint16(last))}).String()
+	}
+	writeJSON(w, page)
+}
+
+func (a *API) handleServers(w http.ResponseWriter, r *http.Request) {
+	a.listServers(w, r, nil)
+}
+
+// handleSearch lists servers that have ever matched an index term, e.g.
+// ?kind=software&term=paper or ?kind=player-name&term=notch
+func (a *API) handleSearch(w http.ResponseWriter, r *http.Request) {
+	values := r.URL.Query()
+	kind, term := values.Get("kind"), values.Get("term")
+	if !slices.Contains(INDEX_KINDS, kind) {
+		writeAPIError(w, http.StatusBadRequest, fmt.Errorf("kind must be one of %s", strings.Join(INDEX_KINDS, ", ")))
+		return
+	}
+	if term == "" {
+		writeAPIError(w, http.StatusBadRequest, errors.New("missing term"))
+		return
+	}
+	// every term is indexed in lower case
+	a.listServers(w, r, &IndexLookup{Kind: kind, Term: strings.ToLower(term), Prefix: values.Get("prefix") == "true"})
+}
+
+// searchCandidates finds the first limit servers past the filter's cursor, in server
+// order, with an entry under lookup, and reports whether there were more after them
+func searchCandidates(store Storage, lookup IndexLookup, filter *RecordFilter, limit int) ([]uint64, bool, error) {
+	var found []uint64
+	truncated := false
+	err := store.LookupIndex(lookup.Kind, lookup.Term, lookup.Prefix, func(entry IndexEntry) error {
+		if !filter.pastCursor(entry.IP, entry.Port) {
+			return nil
+		}
+		order := serverOrder(entry.IP, entry.Port)
+		i, seen := slices.BinarySearch(found, order)
+		if seen {
+			return nil
+		}
+		if len(found) == limit {
+			truncated = true
+			if i == limit {
+				// an exact term comes in server order, so nothing after this can fit
+				if !lookup.Prefix {
+					return errStopScan
+				}
+				return nil
+			}
+			found = found[:limit-1]
+		}
+		found = slices.Insert(found, i, order)
+		return nil
+	})
+	if err != nil && !errors.Is(err, errStopScan) {
+		return nil, false, err
+	}
+	return found, truncated, nil
+}
+
+// serverFromPath parses the {addr} path value, ip or ip:port
+func serverFromPath(w http.ResponseWriter, r *http.Request) (net.IP, uint16, bool) {
+	ip, port, err := parseServerArg(r.PathValue("addr"))
+	if err != nil {
+		writeAPIError(w, http.StatusBadRequest, err)
+		return nil, 0, false
+	}
+	return ip, port, true
+}
+
+// timeWindow reads since and until, which take the same times and ages as the query flags
+func timeWindow(values url.Values) (since, until time.Time, err error) {
+	if since, err = ParseTimeArg(values.Get("since")); err != nil {
+		return since, until, err
+	}
+	until, err = ParseTimeArg(values.Get("until"))
+	return since, until, err
+}
+
+func (a *API) handleServer(w http.ResponseWriter, r *http.Request) {
+	ip, port, ok := serverFromPath(w, r)
+	if !ok {
+		return
+	}
+	record, err := a.store.Latest(ip, port)
+	if err != nil {
+		writeAPIError(w, http.StatusInternalServerError, err)
+		return
+	}
+	if record == nil {
+		writeAPIError(w, http.StatusNotFound, errors.New("server has never been seen"))
+		return
+	}
+	writeJSON(w, newAPIRecord(record))
+}
+
+func (a *API) handleHistory(w http.ResponseWriter, r *http.Request) {
+	ip, port, ok := serverFromPath(w, r)
+	if !ok {
+		return
+	}
+	values := r.URL.Query()
+	since, until, err := timeWindow(values)
+	if err != nil {
+		writeAPIError(w, http.StatusBadRequest, err)
+		return
+	}
+	limit, err := pageSize(values)
+	if err != nil {
+		writeAPIError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	page := HistoryPage{Observations: []APIRecord{}}
+	err = a.store.History(ip, port, since, until, func(record *ServerRecord) error {
+		if len(page.Observations) == limit {
+			page.Next = record.ObservedAt.Format(time.RFC3339Nano)
+			return errStopScan
+		}
+		page.Observations = append(page.Observations, newAPIRecord(record))
+		return nil
+	})
+	if err != nil && !errors.Is(err, errStopScan) {
+		writeAPIError(w, http.StatusInternalServerError, err)
+		return
+	}
+	writeJSON(w, page)
+}
+
+func (a *API) handleServerPlayers(w http.ResponseWriter, r *http.Request) {
+	ip, port, ok := serverFromPath(w, r)
+	if !ok {
+		return
+	}
+	since, until, err := timeWindow(r.URL.Query())
+	if err != nil {
+		writeAPIError(w, http.StatusBadRequest, err)
+		return
+	}
+	var sightings []Sighting
+	err = a.store.ServerPlayers(ip, port, since, until, func(s Sighting) error {
+		sightings = append(sightings, s)
+		return nil
+	})
+	if err != nil {
+		writeAPIError(w, http.StatusInternalServerError, err)
+		return
+	}
+	writeJSON(w, SummarizeSightings(sightings))
+}
+
+// handlePlayer takes a UUID or a name, a name can belong to several players over time
+func (a *API) handlePlayer(w http.ResponseWriter, r *http.Request) {
+	since, until, err := timeWindow(r.URL.Query())
+	if err != nil {
+		writeAPIError(w, http.StatusBadRequest, err)
+		return
+	}
+	player := r.PathValue("player")
+	var ids []uuid.UUID
+	if id, err := uuid.Parse(player); err == nil {
+		ids = []uuid.UUID{id}
+	} else if ids, err = a.store.ResolvePlayerName(player); err != nil {
+		writeAPIError(w, http.StatusInternalServerError, err)
+		return
+	}
+	if len(ids) == 0 {
+		writeAPIError(w, http.StatusNotFound, errors.New("player has never been seen"))
+		return
+	}
+
+	var sightings []Sighting
+	for _, id := range ids {
+		err := a.store.PlayerSightings(id, since, until, func(s Sighting) error {
+			sightings = append(sightings, s)
+			return nil
+		})
+		if err != nil {
+			writeAPIError(w, http.StatusInternalServerError, err)
+			return
+		}
+	}
+	writeJSON(w, PlayerResponse{UUIDs: ids, Servers: SummarizeSightings(sightings)})
+}
+
+// WatchRequest adds a server or player to the watchlist, Target is anything `watch add` takes
+type WatchRequest struct {
+	Target   string `json:"target"`
+	Note     string `json:"note,omitempty"`
+	Interval string `json:"interval,omitempty"` // e.g. 30s
+}
+
+// watchDB is the badger database the watchlist lives in, it writes the error when there isn't one
+func (a *API) watchDB(w http.ResponseWriter) *badger.DB {
+	badgerStore, ok := a.store.(*BadgerStorage)
+	if !ok {
+		writeAPIError(w, http.StatusNotImplemented, errors.New("watchlists only work with badger storage"))
+		return nil
+	}
+	return badgerStore.DB
+}
+
+// watchError picks the status for a failed watchlist change
+func watchError(w http.ResponseWriter, err error) {
+	if errors.Is(err, badger.ErrReadOnlyTxn) {
+		writeAPIError(w, http.StatusMethodNotAllowed, errors.New("the database is open read only, use a scanner's -api to change the watchlist"))
+		return
+	}
+	writeAPIError(w, http.StatusInternalServerError, err)
+}
+
+func (a *API) handleWatches(w http.ResponseWriter, r *http.Request) {
+	db := a.watchDB(w)
+	if db == nil {
+		return
+	}
+	entries, err := ListWatches(db)
+	if err != nil {
+		writeAPIError(w, http.StatusInternalServerError, err)
+		return
+	}
+	writeJSON(w, append([]WatchEntry{}, entries...))
+}
+
+func (a *API) handleAddWatch(w http.ResponseWriter, r *http.Request) {
+	db := a.watchDB(w)
+	if db == nil {
+		return
+	}
+	var req WatchRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeAPIError(w, http.StatusBadRequest, err)
+		return
+	}
+	kind, target, err := ParseWatchTarget(req.Target)
+	if err != nil {
+		writeAPIError(w, http.StatusBadRequest, err)
+		return
+	}
+	entry := WatchEntry{Kind: kind, Target: target, Note: req.Note, Added: time.Now()}
+	if req.Interval != "" {
+		if entry.Interval, err = time.ParseDuration(req.Interval); err != nil {
+			writeAPIError(w, http.StatusBadRequest, err)
+			return
+		}
+		if entry.Interval < MIN_WATCH_INTERVAL {
+			writeAPIError(w, http.StatusBadRequest, fmt.Errorf("watch interval can't be under %s", MIN_WATCH_INTERVAL))
+			return
+		}
+	}
+	if err := AddWatch(db, entry); err != nil {
+		watchError(w, err)
+		return
+	}
+	writeJSONStatus(w, http.StatusCreated, entry)
+}
+
+func (a *API) handleRemoveWatch(w http.ResponseWriter, r *http.Request) {
+	db := a.watchDB(w)
+	if db == nil {
+		return
+	}
+	kind, target, err := ParseWatchTarget(r.PathValue("target"))
+	if err != nil {
+		writeAPIError(w, http.StatusBadRequest, err)
+		return
+	}
+	found, err := RemoveWatch(db, kind, target)
+	if err != nil {
+		watchError(w, err)
+		return
+	}
+	if !found {
+		writeAPIError(w, http.StatusNotFound, errors.New("not on the watchlist"))
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// handleTimeline works for anything that has been watched, even after it's removed
+func (a *API) handleTimeline(w http.ResponseWriter, r *http.Request) {
+	db := a.watchDB(w)
+	if db == nil {
+		return
+	}
+	since, until, err := timeWindow(r.URL.Query())
+	if err != nil {
+		writeAPIError(w, http.StatusBadRequest, err)
+		return
+	}
+	kind, target, err := ParseWatchTarget(r.PathValue("target"))
+	if err != nil {
+		writeAPIError(w, http.StatusBadRequest, err)
+		return
+	}
+	events := []Event{}
+	err = Timeline(db, kind, target, since, until, func(e Event) error {
+		events = append(events, e)
+		return nil
+	})
+	if err != nil {
+		writeAPIError(w, http.StatusInternalServerError, err)
+		return
+	}
+	writeJSON(w, events)
+}
+
+// topCounts sorts counts, largest first, and keeps the first n
+func topCounts(counts map[string]int, n int) []NameCount {
+	out := make([]NameCount, 0, len(counts))
+	for name, count := range counts {
+		out = append(out, NameCount{name, count})
+	}
+	sort.Slice(out, func(i, j int) bool {
+		if out[i].Count != out[j].Count {
+			return out[i].Count > out[j].Count
+		}
+		return out[i].Name < out[j].Name
+	})
+	if len(out) > n {
+		out = out[:n]
+	}
+	return out
+}
+
+// ComputeStats aggregates the latest observation of every server
+func ComputeStats(store Storage) (*APIStats, error) {
+	stats := &APIStats{GeneratedAt: time.Now()}
+	versions := make(map[string]int)
+	software := make(map[string]int)
+	countries := make(map[string]int)
+	asns := make(map[string]int)
+	filter := NewRecordFilter()
+	err := store.Scan(&filter, true, func(r *ServerRecord) error {
+		stats.Servers++
+		if r.Players != nil {
+			stats.PlayersOnline += r.Players.Online
+			stats.PlayerSlots += r.Players.Max
+		}
+		if r.IsOnlineMode != nil && *r.IsOnlineMode {
+			stats.OnlineMode++
+		}
+		if r.Modded() {
+			stats.Modded++
+		}
+		if r.IsFakeSample {
+			stats.FakeSample++
+		}
+		versions[r.Version.Name]++
+		software[SoftwareFamily(r)]++
+		if e := r.Enrichment; e != nil {
+			if e.Country != "" {
+				countries[e.Country]++
+			}
+			if e.ASN != 0 {
+				asns[strings.TrimSpace(fmt.Sprintf("AS%d %s", e.ASN, e.ASName))]++
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	stats.Versions = topCounts(versions, STATS_TOP)
+	stats.Software = topCounts(software, STATS_TOP)
+	// there are few enough countries to list all of them
+	stats.Countries = topCounts(countries, len(countries))
+	stats.ASNs = topCounts(asns, STATS_TOP)
+	return stats, nil
+}
+
+func (a *API) handleStats(w http.ResponseWriter, r *http.Request) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.stats == nil || time.Since(a.statsAt) > STATS_CACHE_TTL {
+		stats, err := ComputeStats(a.store)
+		if err != nil {
+			writeAPIError(w, http.StatusInternalServerError, err)
+			return
+		}
+		a.stats, a.statsAt = stats, time.Now()
+	}
+	writeJSON(w, a.stats)
+}
+
+// decodeFavicon splits a data URL like data:image/png;base64,... into its type and bytes
+func decodeFavicon(favicon string) (string, []byte, error) {
+	header, data, ok := strings.Cut(favicon, ",")
+	if !ok || !strings.HasPrefix(header, "data:") || !strings.HasSuffix(header, ";base64") {
+		return "", nil, errors.New("favicon isn't a base64 data URL")
+	}
+	image, err := base64.StdEncoding.DecodeString(data)
+	if err != nil {
+		return "", nil, err
+	}
+	return strings.TrimSuffix(strings.TrimPrefix(header, "data:"), ";base64"), image, nil
+}
+
+// handleFavicon serves a favicon by the hash it is indexed under
+func (a *API) handleFavicon(w http.ResponseWriter, r *http.Request) {
+	hash := strings.ToLower(strings.TrimSuffix(r.PathValue("hash"), ".png"))
+	var entries []IndexEntry
+	err := a.store.LookupIndex(INDEX_FAVICON, hash, false, func(entry IndexEntry) error {
+		entries = append(entries, entry)
+		return nil
+	})
+	if err != nil {
+		writeAPIError(w, http.StatusInternalServerError, err)
+		return
+	}
+	// the index points at observations, which have the data. They're looked up after
+	// the index so the SQL backends don't need a second connection for it.
+	var favicon string
+	for _, entry := range entries {
+		err := a.store.History(entry.IP, entry.Port, entry.Time, entry.Time.Add(time.Second), func(record *ServerRecord) error {
+			if record.Favicon != nil && FaviconHash(*record.Favicon) == hash {
+				favicon = *record.Favicon
+				return errStopScan
+			}
+			return nil
+		})
+		if err != nil && !errors.Is(err, errStopScan) {
+			writeAPIError(w, http.StatusInternalServerError, err)
+			return
+		}
+		if favicon != "" {
+			break
+		}
+	}
+	if favicon == "" {
+		writeAPIError(w, http.StatusNotFound, errors.New("no favicon with that hash"))
+		return
+	}
+	contentType, image, err := decodeFavicon(favicon)
+	if err != nil {
+		writeAPIError(w, http.StatusInternalServerError, err)
+		return
+	}
+	w.Header().Set("Content-Type", contentType)
+	// the URL is the hash of the content, so it never changes
+	w.Header().Set("Cache-Control", "public, max-age=31536000, immutable")
+	w.Write(image)
+}
+
+func (a *API) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /api/servers", a.handleServers)
+	mux.HandleFunc("GET /api/search", a.handleSearch)
+	mux.HandleFunc("GET /api/servers/{addr}", a.handleServer)
+	mux.HandleFunc("GET /api/servers/{addr}/history", a.handleHistory)
+	mux.HandleFunc("GET /api/servers/{addr}/players", a.handleServerPlayers)
+	mux.HandleFunc("GET /api/players/{player}", a.handlePlayer)
+	mux.HandleFunc("GET /api/stats", a.handleStats)
+	mux.HandleFunc("GET /api/favicons/{hash}", a.handleFavicon)
+	mux.HandleFunc("GET /api/watches", a.handleWatches)
+	mux.HandleFunc("POST /api/watches", a.handleAddWatch)
+	mux.HandleFunc("DELETE /api/watches/{target}", a.handleRemoveWatch)
+	mux.HandleFunc("GET /api/watches/{target}/timeline", a.handleTimeline)
+	mux.Handle("GET /", webHandler())
+	return mux
+}
+
+// serveAPI runs the API until ctx is done, for modes that already have the store open
+func serveAPI(ctx context.Context, addr string, store Storage) {
+	server := &http.Server{Addr: addr, Handler: NewAPI(store).Handler()}
+	go func() {
+		<-ctx.Done()
+		server.Close()
+	}()
+	slog.Info("API listening", "addr", addr)
+	if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+		slog.Error("API server failed", "error", err)
+	}
+}
+
+func runServe(args []string) {
+	fs := flag.NewFlagSet("serve", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s serve [flags]\n", os.Args[0])
+		fmt.Fprintln(fs.Output(), "A running scanner keeps badger locked, use its -api flag to serve from the same process instead.")
+		fs.PrintDefaults()
+	}
+	addr := fs.String("listen", DEFAULT_API_ADDR, "address to serve the API on")
+	storage, location := addStorageFlags(fs)
+	fs.Parse(args)
+
+	store := openStorageReadOnly(*storage, *location)
+	defer store.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	done := make(chan struct{})
+	stopSignals := handleShutdownSignals(cancel, done)
+	defer stopSignals()
+
+	serveAPI(ctx, *addr, store)
+}
@@ -0,0 +1,277 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testAPI serves seven servers seen twice each, odd ones on paper with i players
+// online by the second ping and even ones on 1.8.9
+func testAPI(t *testing.T) (*BadgerStorage, *httptest.Server) {
+	t.Helper()
+	store := openTestBadger(t)
+	var records []*ServerRecord
+	for i := 1; i <= 7; i++ {
+		for ping := 0; ping < 2; ping++ {
+			r := fullRecord()
+			r.IP = net.IPv4(192, 0, 2, byte(i)).To4()
+			r.Port = 25565
+			r.ObservedAt = r.ObservedAt.Add(time.Duration(ping) * time.Hour)
+			r.Players.Online = ping * i
+			if i%2 == 0 {
+				r.Version = VersionInfo{Name: "1.8.9", Protocol: 47}
+				r.Favicon = nil
+			}
+			records = append(records, r)
+		}
+	}
+	if err := store.PutObservations(records); err != nil {
+		t.Fatal(err)
+	}
+	server := httptest.NewServer(NewAPI(store).Handler())
+	t.Cleanup(server.Close)
+	return store, server
+}
+
+// getJSON fetches path and decodes the body into v when the status is 200
+func getJSON(t *testing.T, server *httptest.Server, path string, v any) int {
+	t.Helper()
+	resp, err := http.Get(server.URL + path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if ct := resp.Header.Get("Content-Type"); !strings.HasPrefix(ct, "application/json") {
+		t.Errorf("%s: content type %q", path, ct)
+	}
+	if resp.StatusCode == http.StatusOK && v != nil {
+		if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+			t.Fatalf("%s: %v", path, err)
+		}
+	}
+	return resp.StatusCode
+}
+
+// listAll follows next cursors from path until the last page, returning every address in order
+func listAll(t *testing.T, server *httptest.Server, path string) (addrs []string, pages int) {
+	t.Helper()
+	cursor := ""
+	for {
+		var page ServerPage
+		p := path
+		if cursor != "" {
+			p += "&cursor=" + url.QueryEscape(cursor)
+		}
+		if status := getJSON(t, server, p, &page); status != http.StatusOK {
+			t.Fatalf("%s: status %d", p, status)
+		}
+		pages++
+		for _, r := range page.Servers {
+			addrs = append(addrs, r.Addr().String())
+		}
+		if page.Next == "" {
+			return addrs, pages
+		}
+		cursor = page.Next
+		if pages > 10 {
+			t.Fatal("pagination doesn't end")
+		}
+	}
+}
+
+func TestAPIPagination(t *testing.T) {
+	_, server := testAPI(t)
+	for _, c := range []struct {
+		path  string
+		want  string
+		pages int
+	}{
+		{"/api/servers?limit=3", "[192.0.2.1:25565 192.0.2.2:25565 192.0.2.3:25565 192.0.2.4:25565 192.0.2.5:25565 192.0.2.6:25565 192.0.2.7:25565]", 3},
+		{"/api/servers?limit=7", "[192.0.2.1:25565 192.0.2.2:25565 192.0.2.3:25565 192.0.2.4:25565 192.0.2.5:25565 192.0.2.6:25565 192.0.2.7:25565]", 1},
+		// paging through the index
+		{"/api/servers?limit=2&q=software:paper", "[192.0.2.1:25565 192.0.2.3:25565 192.0.2.5:25565 192.0.2.7:25565]", 2},
+		{"/api/search?kind=protocol&term=47&limit=2", "[192.0.2.2:25565 192.0.2.4:25565 192.0.2.6:25565]", 2},
+	} {
+		addrs, pages := listAll(t, server, c.path)
+		if fmt.Sprint(addrs) != c.want || pages != c.pages {
+			t.Errorf("%s listed %v in %d pages, want %s in %d", c.path, addrs, pages, c.want, c.pages)
+		}
+	}
+}
+
+func TestAPIFilters(t *testing.T) {
+	_, server := testAPI(t)
+	for _, c := range []struct {
+		path string
+		want string
+	}{
+		{"/api/servers?protocol=47&min-online=4", "[192.0.2.4:25565 192.0.2.6:25565]"},
+		{"/api/servers?ip=192.0.2.0/30", "[192.0.2.1:25565 192.0.2.2:25565 192.0.2.3:25565]"},
+		// latest observation only, the first pings had nobody online
+		{"/api/servers?max-online=2", "[192.0.2.1:25565 192.0.2.2:25565]"},
+		{"/api/servers?q=" + url.QueryEscape("software:paper players>4"), "[192.0.2.5:25565 192.0.2.7:25565]"},
+		{"/api/servers?q=" + url.QueryEscape("-software:paper players<4"), "[192.0.2.2:25565]"},
+	} {
+		addrs, _ := listAll(t, server, c.path)
+		if fmt.Sprint(addrs) != c.want {
+			t.Errorf("%s listed %v, want %s", c.path, addrs, c.want)
+		}
+	}
+
+	var history HistoryPage
+	if status := getJSON(t, server, "/api/servers/192.0.2.3:25565/history?limit=1", &history); status != http.StatusOK {
+		t.Fatalf("history: status %d", status)
+	}
+	if len(history.Observations) != 1 || history.Next == "" {
+		t.Errorf("history page %+v, want one observation and a next", history)
+	}
+}
+
+func TestAPISearchTruncated(t *testing.T) {
+	store, _ := testAPI(t)
+	api := NewAPI(store)
+	api.searchLimit = 2
+	server := httptest.NewServer(api.Handler())
+	t.Cleanup(server.Close)
+
+	var page ServerPage
+	if status := getJSON(t, server, "/api/search?kind=protocol&term=47", &page); status != http.StatusOK {
+		t.Fatalf("status %d", status)
+	}
+	if !page.Truncated || len(page.Servers) != 2 || page.Next != "192.0.2.4:25565" {
+		t.Errorf("page %+v, want 2 servers, truncated, and a next", page)
+	}
+	// a page that runs out of candidates before it fills still goes on from them
+	for _, c := range []struct {
+		path  string
+		want  string
+		pages int
+	}{
+		{"/api/search?kind=protocol&term=47&limit=5", "[192.0.2.2:25565 192.0.2.4:25565 192.0.2.6:25565]", 2},
+		{"/api/search?kind=software&term=pa&prefix=true&min-online=3", "[192.0.2.3:25565 192.0.2.5:25565 192.0.2.7:25565]", 2},
+	} {
+		addrs, pages := listAll(t, server, c.path)
+		if fmt.Sprint(addrs) != c.want || pages != c.pages {
+			t.Errorf("%s listed %v in %d pages, want %s in %d", c.path, addrs, pages, c.want, c.pages)
+		}
+	}
+}
+
+func TestAPIErrors(t *testing.T) {
+	_, server := testAPI(t)
+	for _, c := range []struct {
+		path   string
+		status int
+	}{
+		{"/api/servers/203.0.113.1:25565", http.StatusNotFound},
+		{"/api/players/jeb_", http.StatusNotFound},
+		{"/api/favicons/0123456789abcdef", http.StatusNotFound},
+		{"/api/servers/not-an-ip", http.StatusBadRequest},
+		{"/api/servers?limit=0", http.StatusBadRequest},
+		{"/api/servers?cursor=nowhere", http.StatusBadRequest},
+		{"/api/servers?q=" + url.QueryEscape("players>>"), http.StatusBadRequest},
+		{"/api/search?kind=colour&term=red", http.StatusBadRequest},
+	} {
+		var apiErr apiError
+		resp, err := http.Get(server.URL + c.path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		json.NewDecoder(resp.Body).Decode(&apiErr)
+		resp.Body.Close()
+		if resp.StatusCode != c.status || apiErr.Error == "" {
+			t.Errorf("%s: status %d %q, want %d with an error", c.path, resp.StatusCode, apiErr.Error, c.status)
+		}
+		if ct := resp.Header.Get("Content-Type"); ct != "application/json" {
+			t.Errorf("%s: content type %q", c.path, ct)
+		}
+	}
+}
+
+func TestAPIWatches(t *testing.T) {
+	_, server := testAPI(t)
+	do := func(method, path, body string) *http.Response {
+		t.Helper()
+		req, err := http.NewRequest(method, server.URL+path, strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { resp.Body.Close() })
+		return resp
+	}
+
+	resp := do(http.MethodPost, "/api/watches", `{"target": "192.0.2.3", "interval": "30s", "note": "friend's server"}`)
+	if resp.StatusCode != http.StatusCreated || resp.Header.Get("Content-Type") != "application/json" {
+		t.Fatalf("adding a watch: status %d, content type %q", resp.StatusCode, resp.Header.Get("Content-Type"))
+	}
+	var added WatchEntry
+	if err := json.NewDecoder(resp.Body).Decode(&added); err != nil {
+		t.Fatal(err)
+	}
+	if added.Kind != WATCH_SERVER || added.Target != "192.0.2.3:25565" || added.Interval != 30*time.Second {
+		t.Errorf("added %+v", added)
+	}
+	if resp := do(http.MethodPost, "/api/watches", `{"target": "192.0.2.3", "interval": "1ms"}`); resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("too short an interval: status %d", resp.StatusCode)
+	}
+
+	var watches []WatchEntry
+	if status := getJSON(t, server, "/api/watches", &watches); status != http.StatusOK || len(watches) != 1 || watches[0].Note != "friend's server" {
+		t.Errorf("watchlist %d %+v", status, watches)
+	}
+	var events []Event
+	if status := getJSON(t, server, "/api/watches/192.0.2.3:25565/timeline", &events); status != http.StatusOK || events == nil {
+		t.Errorf("timeline %d %+v", status, events)
+	}
+
+	if resp := do(http.MethodDelete, "/api/watches/192.0.2.3:25565", ""); resp.StatusCode != http.StatusNoContent {
+		t.Errorf("removing the watch: status %d", resp.StatusCode)
+	}
+	if resp := do(http.MethodDelete, "/api/watches/192.0.2.3:25565", ""); resp.StatusCode != http.StatusNotFound {
+		t.Errorf("removing it again: status %d", resp.StatusCode)
+	}
+}
+
+func TestAPIFavicons(t *testing.T) {
+	_, server := testAPI(t)
+	resp, err := http.Get(server.URL + "/api/servers?limit=2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var raw struct {
+		Servers []map[string]any `json:"servers"`
+	}
+	err = json.NewDecoder(resp.Body).Decode(&raw)
+	resp.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// listings carry the hash, never the data URL
+	want := FaviconHash(*fullRecord().Favicon)
+	if _, ok := raw.Servers[0]["favicon"]; ok || raw.Servers[0]["faviconHash"] != want {
+		t.Errorf("server with a favicon listed as %v", raw.Servers[0])
+	}
+	if _, ok := raw.Servers[1]["faviconHash"]; ok {
+		t.Errorf("server without a favicon has a hash: %v", raw.Servers[1])
+	}
+
+	resp, err = http.Get(server.URL + "/api/favicons/" + want)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("Content-Type") != "image/png" {
+		t.Errorf("favicon: status %d, content type %q", resp.StatusCode, resp.Header.Get("Content-Type"))
+	}
+}
@@ -0,0 +1,492 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	badger "github.com/dgraph-io/badger/v4"
+)
+
+// Backups are badger's stream format, the same thing `badger backup` writes,
+// so they can be loaded with either tool.
+const BACKUP_SUFFIX = ".bak"
+const BACKUP_TIME_FORMAT = "20060102T150405Z"
+
+// writes badger keeps in flight while loading a backup
+const RESTORE_PENDING_WRITES = 256
+
+// observations imported per transaction by merge
+const MERGE_BATCH = 256
+
+// How merge resolves two different observations of a server stored under the same key
+const (
+	MERGE_NEWEST  = "newest"  // the one observed later wins, ours on a tie
+	MERGE_KEEP    = "keep"    // ours always wins
+	MERGE_REPLACE = "replace" // theirs always wins
+	MERGE_RICHER  = "richer"  // the one with more fields set wins, ours on a tie
+)
+
+var MERGE_POLICIES = []string{MERGE_NEWEST, MERGE_KEEP, MERGE_REPLACE, MERGE_RICHER}
+
+// BackupConfig takes periodic backups of the database while scanning
+type BackupConfig struct {
+	Dir      string // empty disables them
+	Interval time.Duration
+	Keep     int // older backups are deleted, 0 keeps all of them
+}
+
+func addBackupFlags(fs *flag.FlagSet, cfg *BackupConfig) {
+	fs.StringVar(&cfg.Dir, "backup-dir", "", "write periodic online backups of the badger database here, empty disables them")
+	fs.DurationVar(&cfg.Interval, "backup-interval", 24*time.Hour, "time between online backups")
+	fs.IntVar(&cfg.Keep, "backup-keep", 7, "online backups to keep, 0 keeps all of them")
+}
+
+// BackupDB writes everything newer than since to path, or stdout for "-". The backup
+// is read from a single transaction so it's consistent even while scanning. It returns
+// the version to pass as since for an incremental backup on top of this one.
+func BackupDB(db *badger.DB, path string, since uint64) (uint64, error) {
+	if path == "-" {
+		w := bufio.NewWriter(os.Stdout)
+		version, err := db.Backup(w, since)
+		if err != nil {
+			return 0, err
+		}
+		return version, w.Flush()
+	}
+
+	// written next to the target and renamed, so a backup that exists is a complete one
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return 0, err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	w := bufio.NewWriter(tmp)
+	version, err := db.Backup(w, since)
+	if err != nil {
+		return 0, err
+	}
+	if err := w.Flush(); err != nil {
+		return 0, err
+	}
+	if err := tmp.Sync(); err != nil {
+		return 0, err
+	}
+	if err := tmp.Close(); err != nil {
+		return 0, err
+	}
+	return version, os.Rename(tmp.Name(), path)
+}
+
+// backupPath is where an online backup taken at t goes
+func backupPath(dir string, t time.Time) string {
+	return filepath.Join(dir, "backup-"+t.UTC().Format(BACKUP_TIME_FORMAT)+BACKUP_SUFFIX)
+}
+
+// pruneBackups deletes all but the newest keep online backups in dir
+func pruneBackups(dir string, keep int) error {
+	matches, err := filepath.Glob(filepath.Join(dir, "backup-*"+BACKUP_SUFFIX))
+	if err != nil || keep <= 0 || len(matches) <= keep {
+		return err
+	}
+	// the timestamps sort the same way as the times
+	sort.Strings(matches)
+	for _, path := range matches[:len(matches)-keep] {
+		if err := os.Remove(path); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// backupPeriodically takes a full backup every interval until ctx is done
+func backupPeriodically(ctx context.Context, db *badger.DB, cfg BackupConfig) {
+	if err := os.MkdirAll(cfg.Dir, 0o755); err != nil {
+		slog.Error("Failed to create backup directory", "dir", cfg.Dir, "error", err)
+		return
+	}
+	ticker := time.NewTicker(cfg.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+		start := time.Now()
+		path := backupPath(cfg.Dir, start)
+		if _, err := BackupDB(db, path, 0); err != nil {
+			slog.Error("Failed to back up database", "path", path, "error", err)
+			continue
+		}
+		slog.Info("Backed up database", "path", path, "took", time.Since(start))
+		if err := pruneBackups(cfg.Dir, cfg.Keep); err != nil {
+			slog.Error("Failed to delete old backups", "dir", cfg.Dir, "error", err)
+		}
+	}
+}
+
+// RestoreDB loads backups into db in the order given, incremental ones after the full one they build on
+func RestoreDB(db *badger.DB, paths []string) error {
+	for _, path := range paths {
+		if err := loadBackup(db, path); err != nil {
+			return fmt.Errorf("loading %s: %w", path, err)
+		}
+	}
+	return nil
+}
+
+func loadBackup(db *badger.DB, path string) error {
+	var r io.Reader = os.Stdin
+	if path != "-" {
+		f, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		r = f
+	}
+	return db.Load(bufio.NewReader(r), RESTORE_PENDING_WRITES)
+}
+
+// isEmptyDB checks that db has no keys at all
+func isEmptyDB(db *badger.DB) (bool, error) {
+	empty := true
+	err := db.View(func(txn *badger.Txn) error {
+		opts := badger.DefaultIteratorOptions
+		opts.PrefetchValues = false
+		it := txn.NewIterator(opts)
+		defer it.Close()
+		it.Rewind()
+		empty = !it.Valid()
+		return nil
+	})
+	return empty, err
+}
+
+var errLegacySource = errors.New("source still has legacy keys, run migrate on it first")
+
+// hasLegacyKeys checks for observations stored without a port, which ScanRecords skips
+func hasLegacyKeys(db *badger.DB) (bool, error) {
+	legacy := false
+	err := db.View(func(txn *badger.Txn) error {
+		opts := badger.DefaultIteratorOptions
+		opts.Prefix = []byte(SERVER_PREFIX)
+		opts.PrefetchValues = false
+		it := txn.NewIterator(opts)
+		defer it.Close()
+		for it.Rewind(); it.Valid() && !legacy; it.Next() {
+			legacy = len(it.Item().Key()) == legacyServerKeyLength
+		}
+		return nil
+	})
+	return legacy, err
+}
+
+type MergeReport struct {
+	Imported   int // observations ours didn't have
+	Duplicates int // observations both had, wherever they were made from
+	Conflicts  int // different observations under the same key
+	Replaced   int // conflicts theirs won
+}
+
+// preferTheirs decides a conflict between our observation and theirs
+func preferTheirs(ours, theirs *ServerRecord, policy string) (bool, error) {
+	switch policy {
+	case MERGE_KEEP:
+		return false, nil
+	case MERGE_REPLACE:
+		return true, nil
+	case MERGE_RICHER:
+		ourFields, err := recordFields(ours)
+		if err != nil {
+			return false, err
+		}
+		theirFields, err := recordFields(theirs)
+		if err != nil {
+			return false, err
+		}
+		if len(theirFields) != len(ourFields) {
+			return len(theirFields) > len(ourFields), nil
+		}
+		return false, nil
+	default:
+		return theirs.ObservedAt.After(ours.ObservedAt), nil
+	}
+}
+
+// sameObservation compares what two scanners saw, not where they saw it from or how
+// fast. Both are under the same key, so they were made in the same second.
+func sameObservation(a, b *ServerRecord) (bool, error) {
+	ca, cb := *a, *b
+	ca.Source, cb.Source = "", ""
+	ca.Latency, cb.Latency = 0, 0
+	ca.ObservedAt, cb.ObservedAt = time.Time{}, time.Time{}
+	aVal, err := EncodeRecord(&ca)
+	if err != nil {
+		return false, err
+	}
+	bVal, err := EncodeRecord(&cb)
+	if err != nil {
+		return false, err
+	}
+	return bytes.Equal(aVal, bVal), nil
+}
+
+// mergeRecord imports one observation into txn, going through storeRecord so the
+// chain it lands in is re-encoded around it
+func mergeRecord(txn *badger.Txn, r *ServerRecord, policy string, ttl time.Duration, report *MergeReport) error {
+	ours, err := LoadRecordAt(txn, r.IP, r.Port, r.ObservedAt)
+	if err != nil {
+		return err
+	}
+	if ours != nil && bytes.Equal(ours.Key(), r.Key()) {
+		same, err := sameObservation(ours, r)
+		if err != nil {
+			return err
+		}
+		if same {
+			report.Duplicates++
+			return nil
+		}
+		report.Conflicts++
+		replace, err := preferTheirs(ours, r, policy)
+		if err != nil || !replace {
+			return err
+		}
+		// the new record writes its own, so only ours have to go
+		for _, key := range derivedKeys(ours) {
+			if err := txn.Delete(key); err != nil {
+				return err
+			}
+		}
+		report.Replaced++
+	} else {
+		report.Imported++
+	}
+
+	if err := storeRecord(txn, r, nil, ttl); err != nil {
+		return err
+	}
+	return writeSightings(txn, r, ttl)
+}
+
+// mergeBatch imports records in one transaction, splitting the batch when it's too big for one
+func mergeBatch(db *badger.DB, records []*ServerRecord, policy string, ttl time.Duration, report *MergeReport) error {
+	var batch MergeReport
+	err := db.Update(func(txn *badger.Txn) error {
+		batch = MergeReport{}
+		for _, r := range records {
+			if err := mergeRecord(txn, r, policy, ttl, &batch); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if errors.Is(err, badger.ErrTxnTooBig) && len(records) > 1 {
+		half := len(records) / 2
+		if err := mergeBatch(db, records[:half], policy, ttl, report); err != nil {
+			return err
+		}
+		return mergeBatch(db, records[half:], policy, ttl, report)
+	}
+	if err != nil {
+		return err
+	}
+	report.Imported += batch.Imported
+	report.Duplicates += batch.Duplicates
+	report.Conflicts += batch.Conflicts
+	report.Replaced += batch.Replaced
+	return nil
+}
+
+// MergeDB imports every observation of src into dst. Indexes and sightings are
+// written for what gets imported, so dst needs no rebuild afterwards. A src with
+// legacy keys is refused rather than half imported. What's imported expires ttl after
+// it was observed, 0 keeps it.
+func MergeDB(dst, src *badger.DB, policy string, ttl time.Duration) (MergeReport, error) {
+	var report MergeReport
+	if legacy, err := hasLegacyKeys(src); err != nil || legacy {
+		if err == nil {
+			err = errLegacySource
+		}
+		return report, err
+	}
+	var batch []*ServerRecord
+	filter := NewRecordFilter()
+	err := ScanRecords(src, &filter, false, func(r *ServerRecord) error {
+		batch = append(batch, r)
+		if len(batch) < MERGE_BATCH {
+			return nil
+		}
+		err := mergeBatch(dst, batch, policy, ttl, &report)
+		batch = batch[:0]
+		return err
+	})
+	if err != nil {
+		return report, err
+	}
+	if len(batch) > 0 {
+		err = mergeBatch(dst, batch, policy, ttl, &report)
+	}
+	return report, err
+}
+
+// openMergeSource opens another scanner's badger directory read only, or loads a
+// backup file into a temporary one and migrates it. close cleans up either way.
+func openMergeSource(path string) (db *badger.DB, close func(), err error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	if info.IsDir() {
+		db, err := badger.Open(badger.DefaultOptions(path).WithReadOnly(true).WithLogger(nil))
+		if err != nil {
+			return nil, nil, fmt.Errorf("opening %s: %w", path, err)
+		}
+		return db, func() { db.Close() }, nil
+	}
+
+	dir, err := os.MkdirTemp("", "merge-*")
+	if err != nil {
+		return nil, nil, err
+	}
+	db, err = badger.Open(badger.DefaultOptions(dir).WithLogger(nil))
+	if err != nil {
+		os.RemoveAll(dir)
+		return nil, nil, err
+	}
+	close = func() {
+		db.Close()
+		os.RemoveAll(dir)
+	}
+	if err := RestoreDB(db, []string{path}); err != nil {
+		close()
+		return nil, nil, err
+	}
+	// the copy is ours, so an old backup can be brought up to date here
+	if migrated, err := MigrateRecords(db); err != nil {
+		close()
+		return nil, nil, fmt.Errorf("migrating %s: %w", path, err)
+	} else if migrated > 0 {
+		slog.Info("Migrated merge source", "source", path, "migrated", migrated)
+	}
+	return db, close, nil
+}
+
+func runBackup(args []string) {
+	flags := flag.NewFlagSet("backup", flag.ExitOnError)
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: %s backup [flags]\n", os.Args[0])
+		flags.PrintDefaults()
+	}
+	dir := flags.String("db", BADGER_DIR, "badger directory")
+	out := flags.String("out", "", "backup file, - for stdout (default backup-<time>.bak)")
+	since := flags.Uint64("since", 0, "only back up what changed after this version, as printed by a previous backup")
+	flags.Parse(args)
+
+	if *out == "" {
+		*out = backupPath(".", time.Now())
+	}
+	db, err := badger.Open(badger.DefaultOptions(*dir).WithReadOnly(true).WithLogger(nil))
+	if err != nil {
+		log.Fatalf("opening %s: %v (a running scanner keeps it locked, use -backup-dir on it instead)", *dir, err)
+	}
+	defer db.Close()
+
+	version, err := BackupDB(db, *out, *since)
+	if err != nil {
+		log.Fatal(err)
+	}
+	slog.Info("Backup written", "out", *out, "since", *since, "version", version)
+}
+
+func runRestore(args []string) {
+	flags := flag.NewFlagSet("restore", flag.ExitOnError)
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: %s restore [flags] backup... (- for stdin)\n", os.Args[0])
+		flags.PrintDefaults()
+	}
+	dir := flags.String("db", BADGER_DIR, "badger directory to restore into")
+	force := flags.Bool("force", false, "load into a database that already has data, backed up keys overwrite existing ones")
+	flags.Parse(args)
+	if flags.NArg() == 0 {
+		flags.Usage()
+		os.Exit(2)
+	}
+
+	db, err := badger.Open(badger.DefaultOptions(*dir))
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer db.Close()
+
+	empty, err := isEmptyDB(db)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if !empty && !*force {
+		log.Fatalf("%s already has data, use merge to combine databases or -force to load over it", *dir)
+	}
+	if err := RestoreDB(db, flags.Args()); err != nil {
+		log.Fatal(err)
+	}
+	slog.Info("Restore finished", "db", *dir, "backups", flags.NArg())
+}
+
+func runMerge(args []string) {
+	flags := flag.NewFlagSet("merge", flag.ExitOnError)
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: %s merge [flags] source...\n", os.Args[0])
+		fmt.Fprintln(flags.Output(), "Sources are badger directories or backup files.")
+		flags.PrintDefaults()
+	}
+	dir := flags.String("db", BADGER_DIR, "badger directory to merge into")
+	policy := flags.String("conflict", MERGE_NEWEST, "what wins when both have a different observation under the same key: "+strings.Join(MERGE_POLICIES, ", "))
+	finishTTL := addTTLFlag(flags)
+	flags.Parse(args)
+	ttl := finishTTL()
+	if flags.NArg() == 0 {
+		flags.Usage()
+		os.Exit(2)
+	}
+	known := false
+	for _, p := range MERGE_POLICIES {
+		known = known || p == *policy
+	}
+	if !known {
+		log.Fatalf("unknown conflict policy %q", *policy)
+	}
+
+	db, err := badger.Open(badger.DefaultOptions(*dir))
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer db.Close()
+
+	for _, path := range flags.Args() {
+		src, closeSrc, err := openMergeSource(path)
+		if err != nil {
+			log.Fatal(err)
+		}
+		report, err := MergeDB(db, src, *policy, ttl)
+		closeSrc()
+		if err != nil {
+			log.Fatalf("merging %s: %v", path, err)
+		}
+		slog.Info("Merged", "source", path, "imported", report.Imported, "duplicates", report.Duplicates, "conflicts", report.Conflicts, "replaced", report.Replaced)
+	}
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+
+	badger "github.com/dgraph-io/badger/v4"
+)
+
+func TestMergeDeduplicatesAcrossVantagePoints(t *testing.T) {
+	ours, theirs := openTestBadger(t), openTestBadger(t)
+	if err := ours.PutObservations(history()); err != nil {
+		t.Fatal(err)
+	}
+	// the same pings made from somewhere else, one of which saw something different
+	records := history()
+	for _, r := range records {
+		r.Source = "agent-2"
+		r.Latency = 180 * time.Millisecond
+	}
+	records[5].Players.Online = 7
+	extra := fullRecord()
+	extra.ObservedAt = records[5].ObservedAt.Add(10 * time.Minute)
+	records = append(records, extra)
+	if err := theirs.PutObservations(records); err != nil {
+		t.Fatal(err)
+	}
+
+	report, err := MergeDB(ours.DB, theirs.DB, MERGE_KEEP, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := (MergeReport{Imported: 1, Duplicates: 5, Conflicts: 1}); report != want {
+		t.Errorf("merge report %+v, want %+v", report, want)
+	}
+	latest, err := ours.Latest(extra.IP, extra.Port)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertSameRecord(t, latest, extra)
+}
+
+func TestMergeRefusesLegacySource(t *testing.T) {
+	ours, theirs := openTestBadger(t), openTestBadger(t)
+	r := legacyRecord()
+	key := append([]byte(SERVER_PREFIX), r.IP...)
+	key = append(key, ':')
+	key = binary.BigEndian.AppendUint64(key, uint64(r.ObservedAt.Unix()))
+	err := theirs.DB.Update(func(txn *badger.Txn) error {
+		return txn.Set(key, legacyValue(t, r))
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := MergeDB(ours.DB, theirs.DB, MERGE_NEWEST, 0); !errors.Is(err, errLegacySource) {
+		t.Fatalf("merging a legacy source: %v, want %v", err, errLegacySource)
+	}
+	// once migrated it goes through
+	if _, err := MigrateRecords(theirs.DB); err != nil {
+		t.Fatal(err)
+	}
+	report, err := MergeDB(ours.DB, theirs.DB, MERGE_NEWEST, 0)
+	if err != nil || report.Imported != 1 {
+		t.Errorf("merging the migrated source: %+v %v", report, err)
+	}
+}
+
+func TestRestoreIncrementalBackups(t *testing.T) {
+	source := openTestBadger(t)
+	dir := t.TempDir()
+	records := history()
+	if err := source.PutObservations(records[:3]); err != nil {
+		t.Fatal(err)
+	}
+	full := filepath.Join(dir, "full"+BACKUP_SUFFIX)
+	version, err := BackupDB(source.DB, full, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := source.PutObservations(records[3:]); err != nil {
+		t.Fatal(err)
+	}
+	incremental := filepath.Join(dir, "incremental"+BACKUP_SUFFIX)
+	if _, err := BackupDB(source.DB, incremental, version); err != nil {
+		t.Fatal(err)
+	}
+
+	restored := openTestBadger(t)
+	if err := RestoreDB(restored.DB, []string{full, incremental}); err != nil {
+		t.Fatal(err)
+	}
+	i := 0
+	err = restored.History(records[0].IP, records[0].Port, time.Time{}, END_OF_TIME, func(r *ServerRecord) error {
+		assertSameRecord(t, r, records[i])
+		i++
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if i != len(records) {
+		t.Errorf("restored history has %d records, want %d", i, len(records))
+	}
+}
@@ -0,0 +1,648 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	badger "github.com/dgraph-io/badger/v4"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const DEFAULT_COORDINATOR_ADDR = ":8420"
+const DEFAULT_SHARD_SIZE = 1 << 16
+const DEFAULT_LEASE_TTL = 2 * time.Minute
+
+// shorter leases would expire between an agent's heartbeats
+const MIN_LEASE_TTL = time.Second
+
+// agents that find no free shard retry after this long
+const AGENT_POLL_INTERVAL = 5 * time.Second
+
+// Shards are contiguous slices of the allowed address space
+type Shard struct {
+	ID     int          `json:"id"`
+	Ranges []ShardRange `json:"ranges"`
+}
+
+type ShardRange struct {
+	Start net.IP `json:"start"`
+	End   net.IP `json:"end"`
+}
+
+// IPRanges converts the shard for the target generators, leaving out anything that isn't IPv4
+func (s Shard) IPRanges() []IPRange {
+	ranges := make([]IPRange, 0, len(s.Ranges))
+	for _, r := range s.Ranges {
+		start, end := r.Start.To4(), r.End.To4()
+		if start == nil || end == nil {
+			slog.Warn("Skipping shard range that isn't IPv4", "shard", s.ID, "start", r.Start, "end", r.End)
+			continue
+		}
+		ranges = append(ranges, IPRange{start: start, end: end})
+	}
+	return ranges
+}
+
+// key is stable across coordinator runs as long as the shard size and ranges don't change
+func (s Shard) key() []byte {
+	key := []byte("shard:")
+	for _, r := range s.Ranges {
+		key = append(key, r.Start.To4()...)
+		key = append(key, r.End.To4()...)
+	}
+	return key
+}
+
+// Messages exchanged between agents and the coordinator
+type LeaseRequest struct {
+	Agent string `json:"agent"`
+}
+
+type LeaseResponse struct {
+	Shard   Shard     `json:"shard"`
+	Expires time.Time `json:"expires"`
+}
+
+type ShardRequest struct {
+	Agent   string `json:"agent"`
+	ShardID int    `json:"shardId"`
+}
+
+type ResultsRequest struct {
+	Agent   string          `json:"agent"`
+	ShardID int             `json:"shardId"`
+	Results []*ServerStatus `json:"results"`
+}
+
+type CoordinatorStatus struct {
+	Pending int            `json:"pending"`
+	Leased  int            `json:"leased"`
+	Done    int            `json:"done"`
+	Agents  map[string]int `json:"agents"` // results received per agent
+}
+
+// SplitIntoShards cuts ranges into shards of at most size addresses
+func SplitIntoShards(ranges []IPRange, size uint32) []Shard {
+	var shards []Shard
+	current := Shard{ID: 0}
+	var filled uint32
+	for _, r := range ranges {
+		start, _ := ipv4ToUint32(r.start)
+		end, _ := ipv4ToUint32(r.end)
+		for {
+			remaining := size - filled
+			// end of this piece, careful not to overflow at the top of the address space
+			pieceEnd := end
+			if end-start >= remaining {
+				pieceEnd = start + remaining - 1
+			}
+			current.Ranges = append(current.Ranges, ShardRange{Start: uint32ToIP(start), End: uint32ToIP(pieceEnd)})
+			filled += pieceEnd - start + 1
+			if filled == size {
+				shards = append(shards, current)
+				current = Shard{ID: len(shards)}
+				filled = 0
+			}
+			if pieceEnd == end {
+				break
+			}
+			start = pieceEnd + 1
+		}
+	}
+	if len(current.Ranges) > 0 {
+		shards = append(shards, current)
+	}
+	return shards
+}
+
+// ParseCIDRs turns a comma separated list of IPv4 CIDRs into ranges
+func ParseCIDRs(list string) ([]IPRange, error) {
+	var ranges []IPRange
+	for _, part := range strings.Split(list, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		_, network, err := net.ParseCIDR(part)
+		if err != nil {
+			return nil, err
+		}
+		start, ok := ipv4ToUint32(network.IP)
+		if !ok {
+			return nil, fmt.Errorf("%s is not an IPv4 network", part)
+		}
+		ones, _ := network.Mask.Size()
+		end := start | (uint32(0xFFFFFFFF) >> ones)
+		ranges = append(ranges, IPRange{start: uint32ToIP(start), end: uint32ToIP(end)})
+	}
+	return ranges, nil
+}
+
+type shardState struct {
+	shard   Shard
+	agent   string
+	expires time.Time
+	done    bool
+}
+
+// Coordinator hands out shard leases to agents and writes their results into one database
+type Coordinator struct {
+	mu       sync.Mutex
+	shards   []*shardState
+	pending  []int
+	leaseTTL time.Duration
+	received map[string]int
+	db       *badger.DB
+	// results go through writer, the shard isn't marked done until they're committed
+	results chan<- *ServerStatus
+	writer  *BatchWriter
+	sent    uint64
+	// handlers that may still send to results, which is closed once they're all gone
+	sending       sync.WaitGroup
+	resultsClosed bool
+	// agents that have asked for a lease, true once they've been told there's nothing left
+	agents map[string]bool
+	// closed once every shard is done
+	finished chan struct{}
+}
+
+func NewCoordinator(shards []Shard, leaseTTL time.Duration, db *badger.DB, results chan<- *ServerStatus, writer *BatchWriter, resume bool) (*Coordinator, error) {
+	c := &Coordinator{
+		leaseTTL: leaseTTL,
+		received: make(map[string]int),
+		db:       db,
+		results:  results,
+		writer:   writer,
+		agents:   make(map[string]bool),
+		finished: make(chan struct{}),
+	}
+
+	err := db.Update(func(txn *badger.Txn) error {
+		for _, shard := range shards {
+			state := &shardState{shard: shard}
+			key := shard.key()
+			if resume {
+				_, err := txn.Get(key)
+				if err == nil {
+					state.done = true
+				} else if !errors.Is(err, badger.ErrKeyNotFound) {
+					return err
+				}
+			} else if err := txn.Delete(key); err != nil {
+				return err
+			}
+			c.shards = append(c.shards, state)
+			if !state.done {
+				c.pending = append(c.pending, shard.ID)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(c.pending) == 0 {
+		close(c.finished)
+	}
+	return c, nil
+}
+
+func (c *Coordinator) lease(agent string) (LeaseResponse, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, ok := c.agents[agent]; !ok {
+		c.agents[agent] = false
+	}
+	if len(c.pending) == 0 {
+		return LeaseResponse{}, false
+	}
+	state := c.shards[c.pending[0]]
+	c.pending = c.pending[1:]
+	state.agent = agent
+	state.expires = time.Now().Add(c.leaseTTL)
+	slog.Info("Leased shard", "shard", state.shard.ID, "agent", agent)
+	return LeaseResponse{Shard: state.shard, Expires: state.expires}, true
+}
+
+// owned returns the shard if agent still holds its lease
+func (c *Coordinator) owned(agent string, id int) (*shardState, bool) {
+	if id < 0 || id >= len(c.shards) {
+		return nil, false
+	}
+	state := c.shards[id]
+	return state, !state.done && state.agent == agent
+}
+
+func (c *Coordinator) renew(agent string, id int) (time.Time, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	state, ok := c.owned(agent, id)
+	if !ok {
+		return time.Time{}, false
+	}
+	state.expires = time.Now().Add(c.leaseTTL)
+	return state.expires, true
+}
+
+func (c *Coordinator) complete(ctx context.Context, agent string, id int) error {
+	c.mu.Lock()
+	_, ok := c.owned(agent, id)
+	sent := c.sent
+	c.mu.Unlock()
+	if !ok {
+		return errLeaseLost
+	}
+	// the agent's results were all sent before it asked, they have to be on disk
+	// before the shard is, or a crash now would lose them for good
+	if err := c.writer.WaitCommitted(ctx, sent); err != nil {
+		return err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	state, ok := c.owned(agent, id)
+	if !ok {
+		return errLeaseLost
+	}
+	err := c.db.Update(func(txn *badger.Txn) error {
+		ts := make([]byte, 8)
+		binary.BigEndian.PutUint64(ts, uint64(time.Now().Unix()))
+		return txn.Set(state.shard.key(), ts)
+	})
+	if err != nil {
+		return err
+	}
+	state.done = true
+	state.agent = ""
+	slog.Info("Completed shard", "shard", id, "agent", agent)
+	c.checkFinished()
+	return nil
+}
+
+// release puts a shard back in the queue, used by agents shutting down early
+func (c *Coordinator) release(agent string, id int) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	state, ok := c.owned(agent, id)
+	if !ok {
+		return false
+	}
+	state.agent = ""
+	c.pending = append(c.pending, id)
+	slog.Info("Released shard", "shard", id, "agent", agent)
+	return true
+}
+
+func (c *Coordinator) checkFinished() {
+	if len(c.pending) > 0 {
+		return
+	}
+	for _, state := range c.shards {
+		if !state.done {
+			return
+		}
+	}
+	close(c.finished)
+}
+
+// reapLeases reassigns shards whose agent stopped renewing
+func (c *Coordinator) reapLeases(ctx context.Context) {
+	ticker := time.NewTicker(c.leaseTTL / 4)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			c.mu.Lock()
+			for _, state := range c.shards {
+				if state.done || state.agent == "" || now.Before(state.expires) {
+					continue
+				}
+				slog.Warn("Lease expired, reassigning shard", "shard", state.shard.ID, "agent", state.agent)
+				state.agent = ""
+				c.pending = append(c.pending, state.shard.ID)
+			}
+			c.mu.Unlock()
+		}
+	}
+}
+
+// CloseResults waits for the handlers still sending results, then closes the
+// results channel. Later uploads are turned away so the agents retry elsewhere.
+func (c *Coordinator) CloseResults() {
+	c.mu.Lock()
+	if c.resultsClosed {
+		c.mu.Unlock()
+		return
+	}
+	c.resultsClosed = true
+	c.mu.Unlock()
+	c.sending.Wait()
+	close(c.results)
+}
+
+// waitForAgents gives agents that are still polling up to timeout to hear that
+// every shard is done, so they exit instead of finding the coordinator gone
+func (c *Coordinator) waitForAgents(timeout time.Duration) {
+	deadline := time.Now().Add(timeout)
+	for time.Now().Before(deadline) {
+		c.mu.Lock()
+		left := 0
+		for _, told := range c.agents {
+			if !told {
+				left++
+			}
+		}
+		c.mu.Unlock()
+		if left == 0 {
+			return
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
+
+func (c *Coordinator) Status() CoordinatorStatus {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	status := CoordinatorStatus{Agents: make(map[string]int)}
+	for _, state := range c.shards {
+		switch {
+		case state.done:
+			status.Done++
+		case state.agent != "":
+			status.Leased++
+		default:
+			status.Pending++
+		}
+	}
+	for agent, n := range c.received {
+		status.Agents[agent] = n
+	}
+	return status
+}
+
+var errLeaseLost = errors.New("lease lost")
+
+func decodeRequest(w http.ResponseWriter, r *http.Request, v any) bool {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return false
+	}
+	if err := json.NewDecoder(r.Body).Decode(v); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return false
+	}
+	return true
+}
+
+func writeJSON(w http.ResponseWriter, v any) {
+	writeJSONStatus(w, http.StatusOK, v)
+}
+
+// writeJSONStatus is writeJSON with a status other than 200, the headers go out with it
+func writeJSONStatus(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		slog.Error("Failed to write response", "error", err)
+	}
+}
+
+func (c *Coordinator) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/lease", func(w http.ResponseWriter, r *http.Request) {
+		var req LeaseRequest
+		if !decodeRequest(w, r, &req) {
+			return
+		}
+		select {
+		case <-c.finished:
+			// tells the agent there is nothing left to do
+			c.mu.Lock()
+			c.agents[req.Agent] = true
+			c.mu.Unlock()
+			w.WriteHeader(http.StatusGone)
+			return
+		default:
+		}
+		resp, ok := c.lease(req.Agent)
+		if !ok {
+			// everything is leased, but leases may still expire
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		writeJSON(w, resp)
+	})
+	mux.HandleFunc("/heartbeat", func(w http.ResponseWriter, r *http.Request) {
+		var req ShardRequest
+		if !decodeRequest(w, r, &req) {
+			return
+		}
+		expires, ok := c.renew(req.Agent, req.ShardID)
+		if !ok {
+			http.Error(w, errLeaseLost.Error(), http.StatusConflict)
+			return
+		}
+		writeJSON(w, LeaseResponse{Shard: Shard{ID: req.ShardID}, Expires: expires})
+	})
+	mux.HandleFunc("/results", func(w http.ResponseWriter, r *http.Request) {
+		var req ResultsRequest
+		if !decodeRequest(w, r, &req) {
+			return
+		}
+		c.mu.Lock()
+		if c.resultsClosed {
+			c.mu.Unlock()
+			http.Error(w, "shutting down", http.StatusServiceUnavailable)
+			return
+		}
+		c.sending.Add(1)
+		c.mu.Unlock()
+		defer c.sending.Done()
+
+		// results from an expired lease are still real servers, so they are kept
+		for _, result := range req.Results {
+			if result == nil || result.Address == nil {
+				continue
+			}
+			select {
+			case c.results <- result:
+				c.mu.Lock()
+				c.sent++
+				c.mu.Unlock()
+			case <-r.Context().Done():
+				return
+			}
+		}
+		c.mu.Lock()
+		c.received[req.Agent] += len(req.Results)
+		c.mu.Unlock()
+		w.WriteHeader(http.StatusNoContent)
+	})
+	mux.HandleFunc("/complete", func(w http.ResponseWriter, r *http.Request) {
+		var req ShardRequest
+		if !decodeRequest(w, r, &req) {
+			return
+		}
+		if err := c.complete(r.Context(), req.Agent, req.ShardID); err != nil {
+			status := http.StatusInternalServerError
+			if errors.Is(err, errLeaseLost) {
+				status = http.StatusConflict
+			}
+			http.Error(w, err.Error(), status)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+	mux.HandleFunc("/release", func(w http.ResponseWriter, r *http.Request) {
+		var req ShardRequest
+		if !decodeRequest(w, r, &req) {
+			return
+		}
+		if !c.release(req.Agent, req.ShardID) {
+			http.Error(w, errLeaseLost.Error(), http.StatusConflict)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+	mux.HandleFunc("/status", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, c.Status())
+	})
+	mux.Handle("/metrics", promhttp.Handler())
+	return mux
+}
+
+func runCoordinator(args []string) {
+	fs := flag.NewFlagSet("coordinator", flag.ExitOnError)
+	addr := fs.String("listen", DEFAULT_COORDINATOR_ADDR, "address to serve the agent protocol on")
+	shardSize := fs.Uint("shard-size", DEFAULT_SHARD_SIZE, "addresses per shard")
+	leaseTTL := fs.Duration("lease", DEFAULT_LEASE_TTL, "how long an agent may go without a heartbeat before its shard is reassigned")
+	cidrs := fs.String("cidr", "", "comma separated networks to scan instead of the whole allowed address space")
+	resume := fs.Bool("resume", false, "skip shards completed by a previous coordinator run")
+	var writerCfg WriterConfig
+	addWriterFlags(fs, &writerCfg)
+	var backupCfg BackupConfig
+	addBackupFlags(fs, &backupCfg)
+	apiAddr := fs.String("api", "", "also serve the HTTP API on this address, e.g. "+DEFAULT_API_ADDR)
+	notifyConfig := fs.String("notify", "", "JSON file of webhooks to notify about new servers, watched servers and players, and MOTD matches")
+	finishTTL := addTTLFlag(fs)
+	storage, location := addStorageFlags(fs)
+	stateDir := fs.String("state", BADGER_DIR, "badger directory for shard progress when -storage isn't badger")
+	fs.Parse(args)
+	ttl := finishTTL()
+	if ttl > 0 && *storage != STORAGE_BADGER {
+		log.Fatal("-ttl only works with badger storage")
+	}
+	if backupCfg.Interval <= 0 {
+		log.Fatalf("invalid backup interval %v", backupCfg.Interval)
+	}
+
+	ranges := GenerateAllowedRanges()
+	if *cidrs != "" {
+		var err error
+		if ranges, err = ParseCIDRs(*cidrs); err != nil {
+			log.Fatal(err)
+		}
+	}
+	if *shardSize == 0 || *shardSize > 1<<31 {
+		log.Fatalf("invalid shard size %d", *shardSize)
+	}
+	if *leaseTTL < MIN_LEASE_TTL {
+		log.Fatalf("lease can't be under %s, got %s", MIN_LEASE_TTL, *leaseTTL)
+	}
+	shards := SplitIntoShards(ranges, uint32(*shardSize))
+
+	store, err := OpenStorage(*storage, *location, false)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer store.Close()
+	// shard progress lives next to the results when they are in badger anyway
+	var db *badger.DB
+	if badgerStore, ok := store.(*BadgerStorage); ok {
+		db = badgerStore.DB
+		badgerStore.TTL = ttl
+	} else {
+		if db, err = badger.Open(badger.DefaultOptions(*stateDir)); err != nil {
+			log.Fatal(err)
+		}
+		defer db.Close()
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	done := make(chan struct{})
+	stopSignals := handleShutdownSignals(cancel, done)
+	defer stopSignals()
+
+	results := make(chan *ServerStatus, 100)
+	errors := make(chan ErrorWithIP)
+	var readWg sync.WaitGroup
+	readWg.Add(1)
+	registerChannelDepth("results", func() int { return len(results) })
+	if _, ok := store.(*BadgerStorage); ok {
+		registerBadgerMetrics(db)
+	}
+	notifier := startNotifier(ctx, *notifyConfig, store)
+	defer notifier.Close()
+	batchWriter := NewBatchWriter(store, writerCfg)
+	if err := batchWriter.OpenSinks(); err != nil {
+		log.Fatal(err)
+	}
+	defer batchWriter.CloseSinks()
+	go LogWriterStats(ctx, batchWriter)
+	go writer(notifyStage(results, notifier), errors, batchWriter, &readWg)
+
+	coordinator, err := NewCoordinator(shards, *leaseTTL, db, results, batchWriter, *resume)
+	if err != nil {
+		log.Fatal(err)
+	}
+	go coordinator.reapLeases(ctx)
+	if backupCfg.Dir != "" {
+		// shard progress is backed up too, so a restored coordinator can -resume
+		go backupPeriodically(ctx, db, backupCfg)
+	}
+	if *apiAddr != "" {
+		go serveAPI(ctx, *apiAddr, store)
+	}
+
+	server := &http.Server{Addr: *addr, Handler: coordinator.Handler()}
+	go func() {
+		if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			log.Fatal(err)
+		}
+	}()
+	slog.Info("Coordinator listening", "addr", *addr, "shards", len(shards), "pending", coordinator.Status().Pending)
+
+	select {
+	case <-coordinator.finished:
+		slog.Info("All shards done")
+		coordinator.waitForAgents(2 * AGENT_POLL_INTERVAL)
+	case <-done:
+	}
+
+	shutdownCtx, shutdownCancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer shutdownCancel()
+	if err := server.Shutdown(shutdownCtx); err != nil {
+		slog.Error("Failed to shut down HTTP server", "error", err)
+	}
+	// handlers that outlived the shutdown timeout may still be sending results
+	coordinator.CloseResults()
+	close(errors)
+	readWg.Wait()
+	slog.Info("Writer has finished.")
+	fmt.Fprintf(os.Stderr, "Coordinator status: %+v\n", coordinator.Status())
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+func testStatus(ip net.IP, port int, source string) *ServerStatus {
+	status := &ServerStatus{
+		Address: &net.TCPAddr{IP: ip, Port: port},
+		Time:    time.Now().Truncate(time.Second),
+		Source:  source,
+	}
+	status.Version.Name = "1.21.1"
+	status.Version.Protocol = 767
+	return status
+}
+
+// testCoordinator serves a coordinator over shards of 192.0.2.0/24 with a writer
+// that only commits on its ticker, so completions have to wait for it
+func testCoordinator(t *testing.T, shardSize uint32, leaseTTL time.Duration) (*Coordinator, *BadgerStorage, *httptest.Server) {
+	t.Helper()
+	ranges, err := ParseCIDRs("192.0.2.0/24")
+	if err != nil {
+		t.Fatal(err)
+	}
+	store := openTestBadger(t)
+	results := make(chan *ServerStatus, 100)
+	errs := make(chan ErrorWithIP)
+	writer := NewBatchWriter(store, WriterConfig{BatchSize: 1000, FlushInterval: 50 * time.Millisecond})
+	go writer.Run(results, errs)
+
+	c, err := NewCoordinator(SplitIntoShards(ranges, shardSize), leaseTTL, store.DB, results, writer, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	go c.reapLeases(ctx)
+	server := httptest.NewServer(c.Handler())
+	t.Cleanup(func() {
+		server.Close()
+		cancel()
+		c.CloseResults()
+		close(errs)
+	})
+	return c, store, server
+}
+
+func TestCoordinatorReassignsDeadAgentsShard(t *testing.T) {
+	c, store, server := testCoordinator(t, 64, 300*time.Millisecond)
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
+	defer cancel()
+
+	// this agent takes a shard, uploads a result and is never heard from again
+	doomed := NewAgentClient(server.URL, "doomed")
+	lost, err := doomed.Lease(ctx)
+	if err != nil || lost == nil {
+		t.Fatalf("doomed agent got no lease: %v %v", lost, err)
+	}
+	lostIP := lost.Shard.Ranges[0].Start
+	if err := doomed.SendResults(ctx, lost.Shard.ID, []*ServerStatus{testStatus(lostIP, 25565, "doomed")}); err != nil {
+		t.Fatal(err)
+	}
+
+	var mu sync.Mutex
+	completedBy := make(map[int]string)
+	var wg sync.WaitGroup
+	for _, name := range []string{"steady-1", "steady-2"} {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			agent := NewAgentClient(server.URL, name)
+			for ctx.Err() == nil {
+				lease, err := agent.Lease(ctx)
+				if errors.Is(err, errNoMoreShards) {
+					return
+				}
+				if err != nil {
+					t.Errorf("%s: lease: %v", name, err)
+					return
+				}
+				if lease == nil {
+					time.Sleep(20 * time.Millisecond)
+					continue
+				}
+				ip := lease.Shard.Ranges[0].Start
+				if err := agent.SendResults(ctx, lease.Shard.ID, []*ServerStatus{testStatus(ip, 25565, name)}); err != nil {
+					t.Errorf("%s: results: %v", name, err)
+					return
+				}
+				if err := agent.Complete(ctx, lease.Shard.ID); err != nil {
+					t.Errorf("%s: complete: %v", name, err)
+					return
+				}
+				// a completed shard's results are already on disk
+				record, err := store.Latest(ip, 25565)
+				if err != nil || record == nil {
+					t.Errorf("shard %d completed before its result was written: %v %v", lease.Shard.ID, record, err)
+				}
+				mu.Lock()
+				completedBy[lease.Shard.ID] = name
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+
+	select {
+	case <-c.finished:
+	default:
+		t.Fatalf("coordinator isn't finished: %+v", c.Status())
+	}
+	if by, ok := completedBy[lost.Shard.ID]; !ok || by == "doomed" {
+		t.Errorf("shard %d of the dead agent wasn't reassigned, completed by %q", lost.Shard.ID, by)
+	}
+	if len(completedBy) != 4 {
+		t.Errorf("completed %d shards, want 4", len(completedBy))
+	}
+	// the dead agent's late completion is refused, but what it uploaded was kept
+	if err := doomed.Complete(ctx, lost.Shard.ID); !errors.Is(err, errLeaseLost) {
+		t.Errorf("dead agent completing its old shard: %v, want %v", err, errLeaseLost)
+	}
+	if status := c.Status(); status.Agents["doomed"] != 1 || status.Done != 4 {
+		t.Errorf("unexpected status %+v", status)
+	}
+}
+
+func TestCoordinatorCloseResultsWaitsForHandlers(t *testing.T) {
+	ranges, _ := ParseCIDRs("192.0.2.0/24")
+	store := openTestBadger(t)
+	// unbuffered and nobody reading yet, so the upload blocks inside its handler
+	results := make(chan *ServerStatus)
+	writer := NewBatchWriter(store, WriterConfig{BatchSize: 1, FlushInterval: time.Second})
+	c, err := NewCoordinator(SplitIntoShards(ranges, 256), time.Minute, store.DB, results, writer, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := httptest.NewServer(c.Handler())
+	defer server.Close()
+
+	agent := NewAgentClient(server.URL, "agent")
+	uploaded := make(chan error, 1)
+	go func() {
+		ip := net.IPv4(192, 0, 2, 1)
+		uploaded <- agent.SendResults(context.Background(), 0, []*ServerStatus{testStatus(ip, 25565, "agent")})
+	}()
+	// give the handler time to get stuck sending
+	time.Sleep(200 * time.Millisecond)
+
+	closed := make(chan struct{})
+	go func() {
+		c.CloseResults()
+		close(closed)
+	}()
+	select {
+	case <-closed:
+		t.Fatal("results were closed while a handler was still sending")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	// draining lets the handler finish, and only then is the channel closed
+	received := 0
+	for range results {
+		received++
+	}
+	<-closed
+	if received != 1 {
+		t.Errorf("received %d results, want 1", received)
+	}
+	if err := <-uploaded; err != nil {
+		t.Errorf("upload failed: %v", err)
+	}
+}
@@ -0,0 +1,623 @@
+package main
+
+import (
+	"bytes"
+	"container/list"
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"sync"
+	"time"
+
+	badger "github.com/dgraph-io/badger/v4"
+	"github.com/fxamacker/cbor/v2"
+)
+
+// Most pings of a server return what the previous one did, so only the first
+// observation of a chain (the keyframe) is a full ServerRecord. Later ones are
+// RecordDeltas holding the top level fields that changed since the previous
+// observation, which for an unchanged server is little more than the latency.
+//
+// A new keyframe is written once the chain gets long or old, so reconstructing
+// a state never has to replay much.
+const MAX_DELTA_CHAIN = 64
+const KEYFRAME_INTERVAL = 7 * 24 * time.Hour
+
+// RecordDelta is an observation stored relative to the one before it
+type RecordDelta struct {
+	SchemaVersion int                        `cbor:"schema"`
+	Delta         bool                       `cbor:"delta"`
+	ObservedAt    time.Time                  `cbor:"observedAt"`
+	Set           map[string]cbor.RawMessage `cbor:"set,omitempty"`
+	Unset         []string                   `cbor:"unset,omitempty"`
+}
+
+// Fields lists the fields that changed, observation metadata included
+func (d *RecordDelta) Fields() []string {
+	fields := make([]string, 0, len(d.Set)+len(d.Unset))
+	for field := range d.Set {
+		fields = append(fields, field)
+	}
+	fields = append(fields, d.Unset...)
+	sort.Strings(fields)
+	return fields
+}
+
+// errDeltaRecord is returned by DecodeRecord for deltas, which need the observations before them
+var errDeltaRecord = errors.New("record is a delta")
+
+// errOrphanDelta is a delta whose keyframe has already expired, it will follow shortly
+var errOrphanDelta = errors.New("delta without a keyframe before it")
+
+// fields that differ on every observation and don't count as a change of the server
+var VOLATILE_FIELDS = map[string]bool{"observedAt": true, "latency": true, "source": true}
+
+// recordFields splits an encoded record into its top level fields
+func recordFields(r *ServerRecord) (map[string]cbor.RawMessage, error) {
+	data, err := EncodeRecord(r)
+	if err != nil {
+		return nil, err
+	}
+	var fields map[string]cbor.RawMessage
+	return fields, cbor.Unmarshal(data, &fields)
+}
+
+func diffFields(prev, next map[string]cbor.RawMessage) (set map[string]cbor.RawMessage, unset []string) {
+	set = make(map[string]cbor.RawMessage)
+	for field, value := range next {
+		if field == "observedAt" {
+			continue
+		}
+		if old, ok := prev[field]; !ok || !bytes.Equal(old, value) {
+			set[field] = value
+		}
+	}
+	for field := range prev {
+		if _, ok := next[field]; !ok {
+			unset = append(unset, field)
+		}
+	}
+	sort.Strings(unset)
+	return set, unset
+}
+
+// RecordChanges lists the fields that differ between two observations of a server,
+// ignoring the ones that change on every ping
+func RecordChanges(prev, next *ServerRecord) ([]string, error) {
+	prevFields, err := recordFields(prev)
+	if err != nil {
+		return nil, err
+	}
+	nextFields, err := recordFields(next)
+	if err != nil {
+		return nil, err
+	}
+	set, unset := diffFields(prevFields, nextFields)
+	var changes []string
+	for field := range set {
+		if !VOLATILE_FIELDS[field] {
+			changes = append(changes, field)
+		}
+	}
+	for _, field := range unset {
+		if !VOLATILE_FIELDS[field] {
+			changes = append(changes, field)
+		}
+	}
+	sort.Strings(changes)
+	return changes, nil
+}
+
+// serverChain is the reconstructed state of a server at some point of its history
+type serverChain struct {
+	fields     map[string]cbor.RawMessage
+	keyframeAt time.Time
+	deltas     int // deltas applied since the keyframe
+}
+
+func (c *serverChain) record() (*ServerRecord, error) {
+	data, err := recordEncMode.Marshal(c.fields)
+	if err != nil {
+		return nil, err
+	}
+	record := &ServerRecord{}
+	return record, cbor.Unmarshal(data, record)
+}
+
+// apply moves the chain forward by one stored value
+func (c *serverChain) apply(val []byte) error {
+	var probe struct {
+		Delta bool `cbor:"delta"`
+	}
+	if err := cbor.Unmarshal(val, &probe); err != nil {
+		return err
+	}
+	if !probe.Delta {
+		record, err := DecodeRecord(val)
+		if err != nil {
+			return err
+		}
+		if c.fields, err = recordFields(record); err != nil {
+			return err
+		}
+		c.keyframeAt = record.ObservedAt
+		c.deltas = 0
+		return nil
+	}
+
+	if c.fields == nil {
+		return errOrphanDelta
+	}
+	var delta RecordDelta
+	if err := cbor.Unmarshal(val, &delta); err != nil {
+		return err
+	}
+	// the previous state may be shared with records handed out already
+	fields := make(map[string]cbor.RawMessage, len(c.fields)+len(delta.Set))
+	for field, value := range c.fields {
+		fields[field] = value
+	}
+	for field, value := range delta.Set {
+		fields[field] = value
+	}
+	for _, field := range delta.Unset {
+		delete(fields, field)
+	}
+	observedAt, err := recordEncMode.Marshal(delta.ObservedAt)
+	if err != nil {
+		return err
+	}
+	fields["observedAt"] = observedAt
+	c.fields = fields
+	c.deltas++
+	return nil
+}
+
+// encode stores next relative to the chain, starting a new keyframe when the chain is long or old
+func (c *serverChain) encode(next *ServerRecord) ([]byte, error) {
+	if c == nil || c.fields == nil || c.deltas >= MAX_DELTA_CHAIN || next.ObservedAt.Sub(c.keyframeAt) >= KEYFRAME_INTERVAL {
+		return EncodeRecord(next)
+	}
+	nextFields, err := recordFields(next)
+	if err != nil {
+		return nil, err
+	}
+	set, unset := diffFields(c.fields, nextFields)
+	return recordEncMode.Marshal(RecordDelta{
+		SchemaVersion: RECORD_SCHEMA_VERSION,
+		Delta:         true,
+		ObservedAt:    next.ObservedAt,
+		Set:           set,
+		Unset:         unset,
+	})
+}
+
+// loadChain reconstructs a server's state as of its last observation at or before t,
+// it returns nil when the server hadn't been seen by then, or only by expiring deltas
+func loadChain(txn *badger.Txn, ip net.IP, port uint16, t time.Time) (*serverChain, error) {
+	opts := badger.DefaultIteratorOptions
+	opts.Reverse = true
+	opts.Prefix = ServerKeyPrefix(ip, port)
+	it := txn.NewIterator(opts)
+	defer it.Close()
+
+	// walk back to the keyframe, then replay forwards
+	var values [][]byte
+	keyframe := false
+	for it.Seek(ServerKey(ip, port, t)); it.Valid(); it.Next() {
+		val, err := it.Item().ValueCopy(nil)
+		if err != nil {
+			return nil, err
+		}
+		values = append(values, val)
+		var probe struct {
+			Delta bool `cbor:"delta"`
+		}
+		if err := cbor.Unmarshal(val, &probe); err != nil {
+			return nil, fmt.Errorf("key %x: %w", it.Item().Key(), err)
+		}
+		if !probe.Delta {
+			keyframe = true
+			break
+		}
+	}
+	if !keyframe {
+		return nil, nil
+	}
+
+	chain := &serverChain{}
+	for i := len(values) - 1; i >= 0; i-- {
+		if err := chain.apply(values[i]); err != nil {
+			return nil, fmt.Errorf("%s:%d: %w", ip, port, err)
+		}
+	}
+	return chain, nil
+}
+
+// LoadRecordAt reconstructs the state of a server as of t, nil if it hadn't been seen by then
+func LoadRecordAt(txn *badger.Txn, ip net.IP, port uint16, t time.Time) (*ServerRecord, error) {
+	chain, err := loadChain(txn, ip, port, t)
+	if chain == nil || err != nil {
+		return nil, err
+	}
+	return chain.record()
+}
+
+// storeRecord writes an observation relative to the one before it, along with its
+// index entries. Observations can arrive out of order from agents, so an observation
+// that lands in the middle of a chain turns the one after it into a keyframe, which no
+// longer depends on what came before. chains can be nil, otherwise the newest state of
+// the server is taken from it when it's still current, instead of replaying the chain.
+// Everything written expires ttl after the observation it's for, see observationEntry.
+func storeRecord(txn *badger.Txn, r *ServerRecord, chains *chainTxn, ttl time.Duration) error {
+	server := string(ServerKeyPrefix(r.IP, r.Port))
+	var chain *serverChain
+	var prev *ServerRecord
+	newest := true
+	if cached := chains.get(server); cached != nil && cached.at.Unix() < r.ObservedAt.Unix() && cached.current(txn, r.IP, r.Port) {
+		chain, prev = cached.chain, cached.record
+	} else {
+		opts := badger.DefaultIteratorOptions
+		opts.Prefix = []byte(server)
+		it := txn.NewIterator(opts)
+		it.Seek(ServerKey(r.IP, r.Port, r.ObservedAt.Add(time.Second)))
+		var nextKey []byte
+		if it.Valid() {
+			nextKey = it.Item().KeyCopy(nil)
+		}
+		it.Close()
+
+		if nextKey != nil {
+			newest = false
+			_, _, nextAt, _ := ParseServerKey(nextKey)
+			next, err := LoadRecordAt(txn, r.IP, r.Port, nextAt)
+			if err != nil {
+				return err
+			}
+			if next != nil {
+				val, err := EncodeRecord(next)
+				if err != nil {
+					return err
+				}
+				if err := txn.SetEntry(observationEntry(nextKey, val, next.ObservedAt, ttl)); err != nil {
+					return err
+				}
+				// it was indexed against whatever came before r
+				if err := writeIndexes(txn, r, next, ttl); err != nil {
+					return err
+				}
+			}
+		}
+
+		var err error
+		if chain, err = loadChain(txn, r.IP, r.Port, r.ObservedAt.Add(-time.Second)); err != nil {
+			return err
+		}
+		if chain != nil {
+			if prev, err = chain.record(); err != nil {
+				return err
+			}
+		}
+	}
+
+	val, err := chain.encode(r)
+	if err != nil {
+		return err
+	}
+	if err := txn.SetEntry(observationEntry(r.Key(), val, r.ObservedAt, ttl)); err != nil {
+		return err
+	}
+	// indexes are updated in the same transaction so they never disagree with the data
+	if err := writeIndexes(txn, prev, r, ttl); err != nil {
+		return err
+	}
+
+	if !newest {
+		chains.forget(server)
+		return nil
+	}
+	latest := &serverChain{}
+	if chain != nil {
+		*latest = *chain
+	}
+	if err := latest.apply(val); err != nil {
+		return err
+	}
+	chains.set(&latestState{server: server, at: r.ObservedAt, chain: latest, record: r})
+	return nil
+}
+
+// How many servers chainCache keeps the newest state of. Each one holds a decoded
+// record, favicon included, so this is kept small.
+const CHAIN_CACHE_SIZE = 16384
+
+// latestState is a server's chain as of its newest stored observation
+type latestState struct {
+	server string
+	at     time.Time
+	chain  *serverChain
+	record *ServerRecord
+}
+
+// current checks that nothing has been stored after the state since it was cached,
+// and that its keyframe hasn't expired
+func (s *latestState) current(txn *badger.Txn, ip net.IP, port uint16) bool {
+	opts := badger.DefaultIteratorOptions
+	opts.PrefetchValues = false
+	opts.Prefix = []byte(s.server)
+	it := txn.NewIterator(opts)
+	defer it.Close()
+	key := ServerKey(ip, port, s.at)
+	it.Seek(key)
+	if !it.Valid() || !bytes.Equal(it.Item().Key(), key) {
+		return false
+	}
+	if it.Next(); it.Valid() {
+		return false
+	}
+	_, err := txn.Get(ServerKey(ip, port, s.chain.keyframeAt))
+	return err == nil
+}
+
+// chainCache is an LRU of the newest state of recently written servers, so the
+// next observation of one is stored without reading its chain back
+type chainCache struct {
+	mu      sync.Mutex
+	size    int
+	entries map[string]*list.Element
+	order   *list.List // of *latestState, most recently used first
+}
+
+func newChainCache(size int) *chainCache {
+	return &chainCache{size: size, entries: make(map[string]*list.Element), order: list.New()}
+}
+
+func (c *chainCache) get(server string) *latestState {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.entries[server]
+	if !ok {
+		return nil
+	}
+	c.order.MoveToFront(e)
+	return e.Value.(*latestState)
+}
+
+// begin starts collecting the states written by one transaction
+func (c *chainCache) begin() *chainTxn {
+	return &chainTxn{cache: c, written: make(map[string]*latestState)}
+}
+
+// chainTxn is the cache as seen from inside a transaction. What the transaction
+// writes is only cached once it has committed.
+type chainTxn struct {
+	cache   *chainCache
+	written map[string]*latestState // nil for servers whose state isn't known any more
+}
+
+func (t *chainTxn) get(server string) *latestState {
+	if t == nil {
+		return nil
+	}
+	if state, ok := t.written[server]; ok {
+		return state
+	}
+	return t.cache.get(server)
+}
+
+func (t *chainTxn) set(state *latestState) {
+	if t != nil {
+		t.written[state.server] = state
+	}
+}
+
+func (t *chainTxn) forget(server string) {
+	if t != nil {
+		t.written[server] = nil
+	}
+}
+
+// commit caches everything the transaction wrote, call it once the transaction has been committed
+func (t *chainTxn) commit() {
+	c := t.cache
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for server, state := range t.written {
+		if e, ok := c.entries[server]; ok {
+			if state == nil {
+				c.order.Remove(e)
+				delete(c.entries, server)
+				continue
+			}
+			e.Value = state
+			c.order.MoveToFront(e)
+			continue
+		}
+		if state == nil {
+			continue
+		}
+		c.entries[server] = c.order.PushFront(state)
+		if c.order.Len() > c.size {
+			oldest := c.order.Back()
+			c.order.Remove(oldest)
+			delete(c.entries, oldest.Value.(*latestState).server)
+		}
+	}
+}
+
+// recordReplay turns stored values into full records while iterating keys in order
+type recordReplay struct {
+	server []byte
+	chain  *serverChain
+}
+
+// decode reconstructs the record stored under a current layout key. The replay only
+// continues from the previous key when it was the previous observation of the same server,
+// otherwise the state before the key is loaded from the database.
+func (rp *recordReplay) decode(txn *badger.Txn, item *badger.Item, contiguous bool) (*ServerRecord, error) {
+	key := item.Key()
+	server := key[:serverKeyLength-8]
+	err := item.Value(func(val []byte) error {
+		var probe struct {
+			Delta bool `cbor:"delta"`
+		}
+		if err := cbor.Unmarshal(val, &probe); err != nil {
+			return err
+		}
+		if probe.Delta && (!contiguous || rp.chain == nil || !bytes.Equal(server, rp.server)) {
+			ip, port, t, _ := ParseServerKey(key)
+			chain, err := loadChain(txn, ip, port, t.Add(-time.Second))
+			if err != nil {
+				return err
+			}
+			rp.chain = chain
+			if rp.chain == nil {
+				rp.chain = &serverChain{}
+			}
+		} else if rp.chain == nil {
+			rp.chain = &serverChain{}
+		}
+		rp.server = append(rp.server[:0], server...)
+		return rp.chain.apply(val)
+	})
+	if err != nil {
+		rp.chain = nil
+		return nil, fmt.Errorf("key %x: %w", key, err)
+	}
+	return rp.chain.record()
+}
+
+// What RewriteHistory does with an observation
+type RewriteAction int
+
+const (
+	REWRITE_KEEP RewriteAction = iota
+	REWRITE_UPDATE
+	REWRITE_DELETE
+)
+
+// derivedKeys are the index and sighting keys an observation can have
+func derivedKeys(r *ServerRecord) [][]byte {
+	return append(indexKeys(r), sightingKeys(r)...)
+}
+
+func sightingKeys(r *ServerRecord) [][]byte {
+	var keys [][]byte
+	for _, s := range RecordSightings(r) {
+		keys = append(keys, sightingKey(s), serverPlayersKey(s))
+	}
+	return keys
+}
+
+// RewriteHistory calls fn with every observation in key order, fn can edit the record
+// and ask for it to be updated, or ask for it to be deleted. Chains are re-encoded around
+// the changes and the indexes and sightings follow along. It returns how many observations
+// were updated and deleted.
+func RewriteHistory(db *badger.DB, fn func(r *ServerRecord) (RewriteAction, error)) (updated, deleted int, err error) {
+	wb := db.NewWriteBatch()
+	defer wb.Cancel()
+
+	err = db.View(func(txn *badger.Txn) error {
+		opts := badger.DefaultIteratorOptions
+		opts.Prefix = []byte(SERVER_PREFIX)
+		it := txn.NewIterator(opts)
+		defer it.Close()
+
+		replay := &recordReplay{}
+		var server []byte
+		var out *serverChain
+		// the last observation of the server that was kept
+		var prev *ServerRecord
+		dirty := false
+		for it.Rewind(); it.Valid(); it.Next() {
+			item := it.Item()
+			if _, _, _, ok := ParseServerKey(item.Key()); !ok {
+				continue
+			}
+			if !bytes.Equal(item.Key()[:serverKeyLength-8], server) {
+				server = append(server[:0], item.Key()[:serverKeyLength-8]...)
+				out = &serverChain{}
+				prev = nil
+				dirty = false
+			}
+			record, err := replay.decode(txn, item, true)
+			if errors.Is(err, errOrphanDelta) {
+				continue
+			}
+			if err != nil {
+				return err
+			}
+			before := derivedKeys(record)
+
+			action, err := fn(record)
+			if err != nil {
+				return err
+			}
+			switch {
+			case action == REWRITE_DELETE:
+				if err := wb.Delete(item.KeyCopy(nil)); err != nil {
+					return err
+				}
+				for _, key := range before {
+					if err := wb.Delete(key); err != nil {
+						return err
+					}
+				}
+				dirty = true
+				deleted++
+				continue
+
+			case action == REWRITE_UPDATE:
+				after := make(map[string]bool)
+				for _, key := range derivedKeys(record) {
+					after[string(key)] = true
+				}
+				for _, key := range before {
+					if !after[string(key)] {
+						if err := wb.Delete(key); err != nil {
+							return err
+						}
+					}
+				}
+				for _, key := range sightingKeys(record) {
+					if err := wb.SetEntry(observationEntry(key, nil, record.ObservedAt, 0)); err != nil {
+						return err
+					}
+				}
+				updated++
+				fallthrough
+
+			case dirty:
+				// what came before changed, so it's indexed against the new previous observation
+				if err := writeIndexes(wb, prev, record, 0); err != nil {
+					return err
+				}
+				// the stored value is relative to something that changed, so encode it again
+				val, err := out.encode(record)
+				if err != nil {
+					return err
+				}
+				if err := wb.SetEntry(observationEntry(item.KeyCopy(nil), val, record.ObservedAt, 0)); err != nil {
+					return err
+				}
+				if err := out.apply(val); err != nil {
+					return err
+				}
+				dirty = action == REWRITE_UPDATE
+
+			default:
+				// unchanged, and so is everything before it
+				if err := item.Value(out.apply); err != nil {
+					return err
+				}
+			}
+			prev = record
+		}
+		return nil
+	})
+	if err != nil {
+		return updated, deleted, err
+	}
+	return updated, deleted, wb.Flush()
+}
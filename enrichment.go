@@ -0,0 +1,379 @@
+package main
+
+import (
+	"bufio"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/oschwald/maxminddb-golang"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Enrichment is the network metadata stored alongside a result
+type Enrichment struct {
+	ASN     uint32 `json:"asn,omitempty"`
+	ASName  string `json:"asName,omitempty"`
+	Prefix  string `json:"prefix,omitempty"`
+	Country string `json:"country,omitempty"`
+}
+
+// EnrichmentConfig points at the offline datasets, every file is optional
+type EnrichmentConfig struct {
+	// pyasn IPASN file ("prefix\tasn" per line, optionally gzipped), e.g. from pyasn_util_convert.py
+	IPASNFile string
+	// pyasn AS names JSON ({"13335": "CLOUDFLARENET - Cloudflare, Inc., US"}), e.g. from pyasn_util_asnames.py
+	ASNamesFile string
+	// MaxMind format databases, GeoLite2-ASN and GeoLite2-Country compatible
+	ASNMMDB     string
+	CountryMMDB string
+}
+
+func (c EnrichmentConfig) Enabled() bool {
+	return c.IPASNFile != "" || c.ASNMMDB != "" || c.CountryMMDB != ""
+}
+
+// prefixTable does longest prefix matching over IPv4 prefixes
+type prefixTable struct {
+	// one map per prefix length, keyed by the masked network address
+	byLength [33]map[uint32]uint32
+	lengths  []int // prefix lengths in use, longest first
+}
+
+func (t *prefixTable) insert(network uint32, length int, asn uint32) {
+	if t.byLength[length] == nil {
+		t.byLength[length] = make(map[uint32]uint32)
+	}
+	t.byLength[length][network] = asn
+}
+
+func (t *prefixTable) finalize() {
+	t.lengths = t.lengths[:0]
+	for length := 32; length >= 0; length-- {
+		if t.byLength[length] != nil {
+			t.lengths = append(t.lengths, length)
+		}
+	}
+}
+
+func (t *prefixTable) lookup(ip net.IP) (asn uint32, prefix string, ok bool) {
+	n, ok := ipv4ToUint32(ip)
+	if !ok {
+		return 0, "", false
+	}
+	for _, length := range t.lengths {
+		network := n & ^(uint32(0xFFFFFFFF) >> length)
+		if asn, ok := t.byLength[length][network]; ok {
+			return asn, fmt.Sprintf("%s/%d", uint32ToIP(network), length), true
+		}
+	}
+	return 0, "", false
+}
+
+type enrichmentData struct {
+	prefixes *prefixTable
+	asNames  map[uint32]string
+	asnDB    *maxminddb.Reader
+	geoDB    *maxminddb.Reader
+}
+
+func (d *enrichmentData) Close() {
+	if d.asnDB != nil {
+		d.asnDB.Close()
+	}
+	if d.geoDB != nil {
+		d.geoDB.Close()
+	}
+}
+
+// Enricher annotates results with ASN, prefix and country data, and can be reloaded while in use
+type Enricher struct {
+	cfg  EnrichmentConfig
+	mu   sync.RWMutex
+	data *enrichmentData
+}
+
+func NewEnricher(cfg EnrichmentConfig) (*Enricher, error) {
+	e := &Enricher{cfg: cfg}
+	if err := e.Reload(); err != nil {
+		return nil, err
+	}
+	return e, nil
+}
+
+// Reload reads every dataset from disk again, keeping the old data if anything fails
+func (e *Enricher) Reload() error {
+	data, err := loadEnrichmentData(e.cfg)
+	if err != nil {
+		return err
+	}
+	e.mu.Lock()
+	old := e.data
+	e.data = data
+	e.mu.Unlock()
+	if old != nil {
+		old.Close()
+	}
+	return nil
+}
+
+func (e *Enricher) Close() {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.data != nil {
+		e.data.Close()
+		e.data = nil
+	}
+}
+
+func openMaybeGzipped(path string) (io.ReadCloser, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	if !strings.HasSuffix(path, ".gz") {
+		return f, nil
+	}
+	gz, err := gzip.NewReader(f)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return struct {
+		io.Reader
+		io.Closer
+	}{gz, f}, nil
+}
+
+func loadIPASN(path string) (*prefixTable, error) {
+	r, err := openMaybeGzipped(path)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	table := &prefixTable{}
+	scanner := bufio.NewScanner(r)
+	line := 0
+	for scanner.Scan() {
+		line++
+		text := strings.TrimSpace(scanner.Text())
+		// pyasn files start with ; comments
+		if text == "" || strings.HasPrefix(text, ";") {
+			continue
+		}
+		fields := strings.Fields(text)
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("%s:%d: expected prefix and ASN", path, line)
+		}
+		_, network, err := net.ParseCIDR(fields[0])
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %w", path, line, err)
+		}
+		// IPv6 prefixes are ignored, as is the scanner
+		start, ok := ipv4ToUint32(network.IP)
+		if !ok {
+			continue
+		}
+		asn, err := strconv.ParseUint(fields[1], 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %w", path, line, err)
+		}
+		length, _ := network.Mask.Size()
+		table.insert(start, length, uint32(asn))
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	table.finalize()
+	return table, nil
+}
+
+func loadASNames(path string) (map[uint32]string, error) {
+	r, err := openMaybeGzipped(path)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	var raw map[string]string
+	if err := json.NewDecoder(r).Decode(&raw); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	names := make(map[uint32]string, len(raw))
+	for k, v := range raw {
+		asn, err := strconv.ParseUint(strings.TrimPrefix(strings.ToUpper(k), "AS"), 10, 32)
+		if err != nil {
+			continue
+		}
+		names[uint32(asn)] = v
+	}
+	return names, nil
+}
+
+func loadEnrichmentData(cfg EnrichmentConfig) (*enrichmentData, error) {
+	data := &enrichmentData{}
+	var err error
+	if cfg.IPASNFile != "" {
+		if data.prefixes, err = loadIPASN(cfg.IPASNFile); err != nil {
+			return nil, err
+		}
+	}
+	if cfg.ASNamesFile != "" {
+		if data.asNames, err = loadASNames(cfg.ASNamesFile); err != nil {
+			return nil, err
+		}
+	}
+	if cfg.ASNMMDB != "" {
+		if data.asnDB, err = maxminddb.Open(cfg.ASNMMDB); err != nil {
+			return nil, err
+		}
+	}
+	if cfg.CountryMMDB != "" {
+		if data.geoDB, err = maxminddb.Open(cfg.CountryMMDB); err != nil {
+			data.Close()
+			return nil, err
+		}
+	}
+	return data, nil
+}
+
+type mmdbASNRecord struct {
+	ASN          uint32 `maxminddb:"autonomous_system_number"`
+	Organization string `maxminddb:"autonomous_system_organization"`
+}
+
+type mmdbCountryRecord struct {
+	Country struct {
+		ISOCode string `maxminddb:"iso_code"`
+	} `maxminddb:"country"`
+	RegisteredCountry struct {
+		ISOCode string `maxminddb:"iso_code"`
+	} `maxminddb:"registered_country"`
+}
+
+// countryFromASName takes the trailing country code pyasn AS names usually end with
+func countryFromASName(name string) string {
+	i := strings.LastIndex(name, ", ")
+	if i < 0 || len(name)-i-2 != 2 {
+		return ""
+	}
+	return strings.ToUpper(name[i+2:])
+}
+
+func (e *Enricher) Lookup(ip net.IP) Enrichment {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	var result Enrichment
+	data := e.data
+	if data == nil {
+		return result
+	}
+
+	// pyasn data is the routing table view, so it takes precedence for the prefix and ASN
+	if data.prefixes != nil {
+		if asn, prefix, ok := data.prefixes.lookup(ip); ok {
+			result.ASN = asn
+			result.Prefix = prefix
+		}
+	}
+	if data.asnDB != nil {
+		var record mmdbASNRecord
+		network, ok, err := data.asnDB.LookupNetwork(ip, &record)
+		if err != nil {
+			slog.Debug("ASN database lookup failed", "ip", ip, "error", err)
+		} else if ok {
+			if result.ASN == 0 {
+				result.ASN = record.ASN
+				result.Prefix = network.String()
+			}
+			if result.ASN == record.ASN {
+				result.ASName = record.Organization
+			}
+		}
+	}
+	if result.ASName == "" && data.asNames != nil {
+		result.ASName = data.asNames[result.ASN]
+	}
+	if data.geoDB != nil {
+		var record mmdbCountryRecord
+		if err := data.geoDB.Lookup(ip, &record); err != nil {
+			slog.Debug("Country database lookup failed", "ip", ip, "error", err)
+		} else if record.Country.ISOCode != "" {
+			result.Country = record.Country.ISOCode
+		} else {
+			result.Country = record.RegisteredCountry.ISOCode
+		}
+	}
+	if result.Country == "" {
+		result.Country = countryFromASName(result.ASName)
+	}
+	return result
+}
+
+// ASN is the cheaper lookup used by the per-ASN connection cap
+func (e *Enricher) ASN(ip net.IP) uint32 {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	if e.data == nil {
+		return 0
+	}
+	if e.data.prefixes != nil {
+		if asn, _, ok := e.data.prefixes.lookup(ip); ok {
+			return asn
+		}
+	}
+	if e.data.asnDB != nil {
+		var record mmdbASNRecord
+		if err := e.data.asnDB.Lookup(ip, &record); err == nil {
+			return record.ASN
+		}
+	}
+	return 0
+}
+
+// annotator adds enrichment data and hostnames to every result on its way to the writer.
+// Reverse DNS lookups run concurrently, so results may leave in a different order.
+func annotator(results <-chan *ServerStatus, annotated chan<- *ServerStatus, enricher *Enricher, rdns *ReverseDNS) {
+	defer close(annotated)
+	var wg sync.WaitGroup
+	defer wg.Wait()
+
+	for result := range results {
+		tcpAddr, ok := result.Address.(*net.TCPAddr)
+		if !ok {
+			annotated <- result
+			continue
+		}
+		ctx, span := tracer.Start(trace.ContextWithSpanContext(context.Background(), result.span), "enrich")
+		if enricher != nil {
+			enrichment := enricher.Lookup(tcpAddr.IP)
+			if enrichment != (Enrichment{}) {
+				result.Enrichment = &enrichment
+			}
+		}
+		if rdns == nil {
+			span.End()
+			annotated <- result
+			continue
+		}
+
+		rdns.sem <- struct{}{}
+		wg.Add(1)
+		go func(result *ServerStatus, ip net.IP) {
+			defer wg.Done()
+			result.Hostnames = rdns.Lookup(ctx, ip)
+			span.End()
+			<-rdns.sem
+			annotated <- result
+		}(result, tcpAddr.IP)
+	}
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"compress/gzip"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const testIPASN = `; IP-ASN32-DAT file
+192.0.0.0/16	64497
+192.0.2.0/24	64496
+2001:db8::/32	64498
+`
+
+const testASNames = `{"64496": "EXAMPLE-AS - Example Networks, NL", "AS64497": "BIGGER-NET"}`
+
+func writeTestFile(t *testing.T, name, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), name)
+	if !strings.HasSuffix(name, ".gz") {
+		if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	gz := gzip.NewWriter(f)
+	gz.Write([]byte(content))
+	if err := gz.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestEnricherWithoutMMDB(t *testing.T) {
+	e, err := NewEnricher(EnrichmentConfig{
+		IPASNFile:   writeTestFile(t, "ipasn.dat.gz", testIPASN),
+		ASNamesFile: writeTestFile(t, "asnames.json", testASNames),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer e.Close()
+
+	// without the MaxMind databases names come from pyasn, and countries from the names
+	for ip, want := range map[string]Enrichment{
+		"192.0.2.10":   {ASN: 64496, ASName: "EXAMPLE-AS - Example Networks, NL", Prefix: "192.0.2.0/24", Country: "NL"},
+		"192.0.3.1":    {ASN: 64497, ASName: "BIGGER-NET", Prefix: "192.0.0.0/16"},
+		"198.51.100.1": {},
+		"2001:db8::1":  {},
+	} {
+		if got := e.Lookup(net.ParseIP(ip)); got != want {
+			t.Errorf("%s is %+v, want %+v", ip, got, want)
+		}
+		if asn := e.ASN(net.ParseIP(ip)); asn != want.ASN {
+			t.Errorf("%s is in AS%d, want AS%d", ip, asn, want.ASN)
+		}
+	}
+}
+
+func TestEnricherMissingData(t *testing.T) {
+	ipasn := writeTestFile(t, "ipasn.dat", testIPASN)
+	for name, cfg := range map[string]EnrichmentConfig{
+		"missing ipasn":   {IPASNFile: filepath.Join(t.TempDir(), "nowhere.dat")},
+		"missing mmdb":    {IPASNFile: ipasn, CountryMMDB: filepath.Join(t.TempDir(), "nowhere.mmdb")},
+		"broken ipasn":    {IPASNFile: writeTestFile(t, "broken.dat", "192.0.2.0/24\n")},
+		"broken as names": {IPASNFile: ipasn, ASNamesFile: writeTestFile(t, "asnames.json", "{")},
+	} {
+		if _, err := NewEnricher(cfg); err == nil {
+			t.Errorf("%s: no error", name)
+		}
+	}
+
+	e, err := NewEnricher(EnrichmentConfig{IPASNFile: ipasn})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// a reload that can't read the data keeps what was loaded before
+	if err := os.Remove(ipasn); err != nil {
+		t.Fatal(err)
+	}
+	if err := e.Reload(); err == nil {
+		t.Error("reloaded a file that's gone")
+	}
+	if asn := e.ASN(net.ParseIP("192.0.2.10")); asn != 64496 {
+		t.Errorf("AS%d after a failed reload, want AS64496", asn)
+	}
+	// and once closed, nothing is known about anything
+	e.Close()
+	if got := e.Lookup(net.ParseIP("192.0.2.10")); got != (Enrichment{}) || e.ASN(net.ParseIP("192.0.2.10")) != 0 {
+		t.Errorf("closed enricher found %+v", got)
+	}
+}
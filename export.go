@@ -0,0 +1,312 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/parquet-go/parquet-go"
+)
+
+const DEFAULT_WATERMARK_FILE = "export.watermark"
+
+// An incremental export stops this long before now, and the next one starts where
+// it stopped. Observations are written with the time they were made, which can be a
+// while before they reach the database (agent uploads retry for minutes, batches sit in
+// the writer), so an observation is only exported if it's written less than this long
+// after it was made. Anything later is never picked up by an incremental export.
+const DEFAULT_EXPORT_LATENESS = 10 * time.Minute
+
+// rows buffered before they are handed to the parquet writer
+const PARQUET_BATCH_SIZE = 1024
+
+// parquetRecord is the export schema, a flattened ServerRecord with the
+// player sample, mods and hostnames kept as nested lists
+type parquetRecord struct {
+	IP         string    `parquet:"ip"`
+	Port       int32     `parquet:"port"`
+	ObservedAt time.Time `parquet:"observed_at,timestamp(millisecond)"`
+	Source     string    `parquet:"source"`
+	LatencyMs  int64     `parquet:"latency_ms"`
+
+	VersionName   string          `parquet:"version_name"`
+	Protocol      int32           `parquet:"protocol"`
+	PlayersOnline *int32          `parquet:"players_online,optional"`
+	PlayersMax    *int32          `parquet:"players_max,optional"`
+	Sample        []parquetPlayer `parquet:"sample,list"`
+	Description   string          `parquet:"description"`
+	HasFavicon    bool            `parquet:"has_favicon"`
+
+	EnforcesSecureChat  *bool `parquet:"enforces_secure_chat,optional"`
+	PreventsChatReports *bool `parquet:"prevents_chat_reports,optional"`
+	OnlineMode          *bool `parquet:"online_mode,optional"`
+	FakeSample          bool  `parquet:"fake_sample"`
+
+	Modded  bool         `parquet:"modded"`
+	Mods    []parquetMod `parquet:"mods,list"`
+	Modpack *string      `parquet:"modpack,optional"`
+
+	ASN       *int64   `parquet:"asn,optional"`
+	ASName    *string  `parquet:"as_name,optional"`
+	Prefix    *string  `parquet:"prefix,optional"`
+	Country   *string  `parquet:"country,optional"`
+	Hostnames []string `parquet:"hostnames,list"`
+}
+
+type parquetPlayer struct {
+	Name string `parquet:"name"`
+	UUID string `parquet:"uuid"`
+}
+
+type parquetMod struct {
+	ID      string `parquet:"id"`
+	Version string `parquet:"version"`
+}
+
+func optionalString(s string) *string {
+	if s == "" {
+		return nil
+	}
+	return &s
+}
+
+func newParquetRecord(r *ServerRecord) parquetRecord {
+	row := parquetRecord{
+		IP:         r.IP.String(),
+		Port:       int32(r.Port),
+		ObservedAt: r.ObservedAt.UTC(),
+		Source:     r.Source,
+		LatencyMs:  r.Latency.Milliseconds(),
+
+		VersionName: r.Version.Name,
+		Protocol:    int32(r.Version.Protocol),
+		Description: r.Description,
+		HasFavicon:  r.Favicon != nil,
+
+		EnforcesSecureChat:  r.EnforcesSecureChat,
+		PreventsChatReports: r.PreventsChatReports,
+		OnlineMode:          r.IsOnlineMode,
+		FakeSample:          r.IsFakeSample,
+		Modded:              r.Modded(),
+	}
+	if r.Players != nil {
+		online, max := int32(r.Players.Online), int32(r.Players.Max)
+		row.PlayersOnline, row.PlayersMax = &online, &max
+		if r.Players.Sample != nil {
+			for _, player := range *r.Players.Sample {
+				var p parquetPlayer
+				if player.Name != nil {
+					p.Name = *player.Name
+				}
+				if player.ID != nil {
+					p.UUID = player.ID.String()
+				}
+				row.Sample = append(row.Sample, p)
+			}
+		}
+	}
+	if r.ForgeData != nil {
+		for _, mod := range r.ForgeData.Mods {
+			row.Mods = append(row.Mods, parquetMod{ID: mod.ID, Version: mod.Marker})
+		}
+	}
+	if r.ModInfo != nil {
+		for _, mod := range r.ModInfo.ModList {
+			row.Mods = append(row.Mods, parquetMod{ID: mod.ID, Version: mod.Version})
+		}
+	}
+	if r.ModpackData != nil {
+		row.Modpack = optionalString(r.ModpackData.Name)
+	}
+	if r.Enrichment != nil {
+		if r.Enrichment.ASN != 0 {
+			asn := int64(r.Enrichment.ASN)
+			row.ASN = &asn
+		}
+		row.ASName = optionalString(r.Enrichment.ASName)
+		row.Prefix = optionalString(r.Enrichment.Prefix)
+		row.Country = optionalString(r.Enrichment.Country)
+	}
+	for _, h := range r.Hostnames {
+		row.Hostnames = append(row.Hostnames, h.Name)
+	}
+	return row
+}
+
+type parquetWriter struct {
+	w     *parquet.GenericWriter[parquetRecord]
+	batch []parquetRecord
+}
+
+func newParquetWriter(w io.Writer) *parquetWriter {
+	return &parquetWriter{w: parquet.NewGenericWriter[parquetRecord](w)}
+}
+
+func (w *parquetWriter) Write(r *ServerRecord) error {
+	w.batch = append(w.batch, newParquetRecord(r))
+	if len(w.batch) >= PARQUET_BATCH_SIZE {
+		return w.writeBatch()
+	}
+	return nil
+}
+
+func (w *parquetWriter) writeBatch() error {
+	_, err := w.w.Write(w.batch)
+	w.batch = w.batch[:0]
+	return err
+}
+
+// Flush writes the footer, so nothing can be written afterwards
+func (w *parquetWriter) Flush() error {
+	if err := w.writeBatch(); err != nil {
+		return err
+	}
+	return w.w.Close()
+}
+
+// exportFormat picks the format from the flag, falling back to the output file's extension
+func exportFormat(format, output string) string {
+	if format != "" {
+		return format
+	}
+	switch strings.ToLower(filepath.Ext(output)) {
+	case ".csv":
+		return "csv"
+	case ".parquet":
+		return "parquet"
+	default:
+		return "jsonl"
+	}
+}
+
+// Watermarks record where the window of the last incremental export ended, the
+// next one starts there
+func readWatermark(path string) (time.Time, error) {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return time.Time{}, nil
+	}
+	if err != nil {
+		return time.Time{}, err
+	}
+	return time.Parse(time.RFC3339Nano, strings.TrimSpace(string(data)))
+}
+
+func writeWatermark(path string, t time.Time) error {
+	// written next to the destination first so a crash never leaves half a watermark
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, []byte(t.UTC().Format(time.RFC3339Nano)+"\n"), 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+func runExport(args []string) {
+	fs := flag.NewFlagSet("export", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s export [flags]\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	storage, location := addStorageFlags(fs)
+	output := fs.String("o", "", "output file, stdout when empty")
+	format := fs.String("format", "", "jsonl, csv or parquet, defaults to the output file extension")
+	at := fs.String("at", "", "export the latest state of every server as of this time (or this long ago) instead of every observation")
+	incremental := fs.Bool("incremental", false, "only export observations made since the watermark and more than -late ago, then advance it")
+	watermarkPath := fs.String("watermark", DEFAULT_WATERMARK_FILE, "watermark file used by -incremental")
+	late := fs.Duration("late", DEFAULT_EXPORT_LATENESS, "how long -incremental leaves for observations to be written, anything written later than this after it was made is never exported")
+	filter := NewRecordFilter()
+	finishFilter := addFilterFlags(fs, &filter)
+	fs.Parse(args)
+	if err := finishFilter(); err != nil {
+		log.Fatal(err)
+	}
+
+	snapshot := *at != ""
+	if snapshot {
+		t, err := ParseTimeArg(*at)
+		if err != nil {
+			log.Fatal(err)
+		}
+		filter.Until = t
+	}
+	if *incremental && snapshot {
+		log.Fatal("-incremental exports new observations, it can't be combined with -at")
+	}
+	if *incremental && !filter.Until.IsZero() {
+		log.Fatal("-incremental decides where its window ends, it can't be combined with -until")
+	}
+
+	// the window is [watermark, windowEnd), ending on a whole second because keys
+	// only have second precision
+	var windowEnd time.Time
+	if *incremental {
+		watermark, err := readWatermark(*watermarkPath)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if watermark.After(filter.Since) {
+			filter.Since = watermark
+		}
+		windowEnd = time.Now().Add(-*late).Truncate(time.Second)
+		if !windowEnd.After(filter.Since) {
+			slog.Info("Nothing to export yet", "watermark", watermark, "late", *late)
+			return
+		}
+		filter.Until = windowEnd.Add(-time.Nanosecond)
+	}
+
+	var w io.Writer = os.Stdout
+	if *output != "" {
+		f, err := os.Create(*output)
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer f.Close()
+		w = f
+	}
+	buffered := bufio.NewWriter(w)
+
+	var out RecordWriter
+	switch exportFormat(*format, *output) {
+	case "parquet":
+		out = newParquetWriter(buffered)
+	default:
+		var err error
+		if out, err = NewRecordWriter(exportFormat(*format, *output), buffered); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	store := openStorageReadOnly(*storage, *location)
+	defer store.Close()
+
+	rows := 0
+	err := store.Scan(&filter, snapshot, func(r *ServerRecord) error {
+		rows++
+		return out.Write(r)
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+	if err := out.Flush(); err != nil {
+		log.Fatal(err)
+	}
+	if err := buffered.Flush(); err != nil {
+		log.Fatal(err)
+	}
+
+	if *incremental {
+		if err := writeWatermark(*watermarkPath, windowEnd); err != nil {
+			log.Fatal(err)
+		}
+	}
+	slog.Info("Export finished", "rows", rows, "watermark", windowEnd)
+}
@@ -0,0 +1,444 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"log/slog"
+	"net"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+
+	badger "github.com/dgraph-io/badger/v4"
+)
+
+// Index keys are "idx:<kind>:<term>\x00<ip><port><timestamp>" with empty values.
+// The suffix points back at the "server:" key of the indexed observation.
+const INDEX_PREFIX = "idx:"
+
+const (
+	INDEX_PROTOCOL    = "protocol"
+	INDEX_SOFTWARE    = "software"
+	INDEX_PLAYER_UUID = "player-uuid"
+	INDEX_PLAYER_NAME = "player-name"
+	INDEX_MOTD        = "motd"
+	INDEX_FAVICON     = "favicon"
+)
+
+var INDEX_KINDS = []string{INDEX_PROTOCOL, INDEX_SOFTWARE, INDEX_PLAYER_UUID, INDEX_PLAYER_NAME, INDEX_MOTD, INDEX_FAVICON}
+
+// Index entries only mark where a term starts to apply: an observation is indexed
+// under the terms the observation before it didn't have, so a server pinged every few
+// minutes doesn't add the same entries every time. The first observation of each
+// period is indexed under everything, so any observation with a term has an entry
+// for it earlier in the same period, and a lookup for observations since some time
+// only needs the entries from the start of that time's period on.
+const INDEX_PERIOD = 24 * time.Hour
+
+// MOTD tokens outside these lengths are too noisy to be worth indexing
+const MIN_MOTD_TOKEN = 3
+const MAX_MOTD_TOKEN = 32
+const MAX_MOTD_TOKENS = 64
+
+// IndexEntry is one observation found through an index
+type IndexEntry struct {
+	IP   net.IP
+	Port uint16
+	Time time.Time
+}
+
+func (e IndexEntry) ServerKey() []byte {
+	return ServerKey(e.IP, e.Port, e.Time)
+}
+
+func indexTermPrefix(kind, term string) []byte {
+	key := make([]byte, 0, len(INDEX_PREFIX)+len(kind)+1+len(term)+1)
+	key = append(key, INDEX_PREFIX...)
+	key = append(key, kind...)
+	key = append(key, ':')
+	key = append(key, term...)
+	return append(key, 0)
+}
+
+func indexKey(kind, term string, r *ServerRecord) []byte {
+	key := indexTermPrefix(kind, term)
+	key = append(key, r.IP.To4()...)
+	key = binary.BigEndian.AppendUint16(key, r.Port)
+	return binary.BigEndian.AppendUint64(key, uint64(r.ObservedAt.Unix()))
+}
+
+func parseIndexKey(key []byte) (kind, term string, entry IndexEntry, ok bool) {
+	if !bytes.HasPrefix(key, []byte(INDEX_PREFIX)) || len(key) < len(INDEX_PREFIX)+4+2+8+1 {
+		return "", "", IndexEntry{}, false
+	}
+	suffix := key[len(key)-14:]
+	head := key[len(INDEX_PREFIX) : len(key)-15]
+	if key[len(key)-15] != 0 {
+		return "", "", IndexEntry{}, false
+	}
+	kindBytes, termBytes, found := bytes.Cut(head, []byte(":"))
+	if !found {
+		return "", "", IndexEntry{}, false
+	}
+	entry = IndexEntry{
+		IP:   net.IP(append([]byte(nil), suffix[:4]...)),
+		Port: binary.BigEndian.Uint16(suffix[4:6]),
+		Time: time.Unix(int64(binary.BigEndian.Uint64(suffix[6:])), 0),
+	}
+	return string(kindBytes), string(termBytes), entry, true
+}
+
+// SOFTWARE_FAMILIES are matched against the version name in order, the first hit wins
+var SOFTWARE_FAMILIES = []struct {
+	family string
+	match  *regexp.Regexp
+}{
+	{"velocity", regexp.MustCompile(`(?i)velocity`)},
+	{"waterfall", regexp.MustCompile(`(?i)waterfall`)},
+	{"bungeecord", regexp.MustCompile(`(?i)bungee`)},
+	{"folia", regexp.MustCompile(`(?i)folia`)},
+	{"purpur", regexp.MustCompile(`(?i)purpur`)},
+	{"pufferfish", regexp.MustCompile(`(?i)pufferfish`)},
+	{"paper", regexp.MustCompile(`(?i)paper`)},
+	{"spigot", regexp.MustCompile(`(?i)spigot`)},
+	{"craftbukkit", regexp.MustCompile(`(?i)bukkit`)},
+	{"neoforge", regexp.MustCompile(`(?i)neoforge`)},
+	{"forge", regexp.MustCompile(`(?i)forge`)},
+	{"fabric", regexp.MustCompile(`(?i)fabric`)},
+	{"vanilla", regexp.MustCompile(`^\d+\.\d+(\.\d+)?$`)},
+}
+
+// SoftwareFamily guesses the server software, from the version name first and mod metadata second
+func SoftwareFamily(r *ServerRecord) string {
+	for _, f := range SOFTWARE_FAMILIES {
+		if f.match.MatchString(r.Version.Name) {
+			return f.family
+		}
+	}
+	switch {
+	case r.IsModded != nil && *r.IsModded:
+		return "neoforge"
+	case r.ForgeData != nil:
+		return "forge"
+	case r.ModInfo != nil:
+		return strings.ToLower(r.ModInfo.Type)
+	}
+	return "unknown"
+}
+
+// motdWords splits the MOTD into lowercase words, dropping formatting and punctuation
+func motdWords(motd string) []string {
+	return strings.FieldsFunc(strings.ToLower(PlainMOTD(motd)), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+}
+
+// MOTDTokens splits the MOTD into lowercase words for the token index
+func MOTDTokens(motd string) []string {
+	words := motdWords(motd)
+	seen := make(map[string]bool)
+	var tokens []string
+	for _, word := range words {
+		n := len([]rune(word))
+		if n < MIN_MOTD_TOKEN || n > MAX_MOTD_TOKEN || seen[word] {
+			continue
+		}
+		seen[word] = true
+		tokens = append(tokens, word)
+		if len(tokens) >= MAX_MOTD_TOKENS {
+			break
+		}
+	}
+	return tokens
+}
+
+// FaviconHash identifies a favicon, it is the hex SHA-256 of the data URI
+func FaviconHash(favicon string) string {
+	sum := sha256.Sum256([]byte(favicon))
+	return hex.EncodeToString(sum[:])
+}
+
+// indexTerms lists every (kind, term) an observation is indexed under
+func indexTerms(r *ServerRecord) [][2]string {
+	terms := [][2]string{
+		{INDEX_PROTOCOL, strconv.Itoa(r.Version.Protocol)},
+		{INDEX_SOFTWARE, SoftwareFamily(r)},
+	}
+	// fake samples are made up names, so they would only pollute the player index
+	if !r.IsFakeSample && r.Players != nil && r.Players.Sample != nil {
+		for _, player := range *r.Players.Sample {
+			if player.ID != nil {
+				terms = append(terms, [2]string{INDEX_PLAYER_UUID, player.ID.String()})
+			}
+			if player.Name != nil && *player.Name != "" {
+				terms = append(terms, [2]string{INDEX_PLAYER_NAME, strings.ToLower(*player.Name)})
+			}
+		}
+	}
+	for _, token := range MOTDTokens(r.Description) {
+		terms = append(terms, [2]string{INDEX_MOTD, token})
+	}
+	if r.Favicon != nil {
+		terms = append(terms, [2]string{INDEX_FAVICON, FaviconHash(*r.Favicon)})
+	}
+	return terms
+}
+
+func indexKeys(r *ServerRecord) [][]byte {
+	terms := indexTerms(r)
+	keys := make([][]byte, 0, len(terms))
+	for _, term := range terms {
+		keys = append(keys, indexKey(term[0], term[1], r))
+	}
+	return keys
+}
+
+// indexPeriodStart is the earliest an entry for an observation made at t can be
+func indexPeriodStart(t time.Time) time.Time {
+	return t.Truncate(INDEX_PERIOD)
+}
+
+// newIndexKeys are the index entries of r, given prev is the observation of the
+// same server before it, nil if there's none
+func newIndexKeys(prev, r *ServerRecord) [][]byte {
+	if prev == nil || !indexPeriodStart(prev.ObservedAt).Equal(indexPeriodStart(r.ObservedAt)) {
+		return indexKeys(r)
+	}
+	had := make(map[[2]string]bool)
+	for _, term := range indexTerms(prev) {
+		had[term] = true
+	}
+	var keys [][]byte
+	for _, term := range indexTerms(r) {
+		if !had[term] {
+			keys = append(keys, indexKey(term[0], term[1], r))
+		}
+	}
+	return keys
+}
+
+// entrySetter is a transaction or a write batch
+type entrySetter interface {
+	SetEntry(e *badger.Entry) error
+}
+
+// writeIndexes adds r to the indexes where prev doesn't cover it, along with whatever stores r
+func writeIndexes(w entrySetter, prev, r *ServerRecord, ttl time.Duration) error {
+	for _, key := range newIndexKeys(prev, r) {
+		if err := w.SetEntry(observationEntry(key, nil, r.ObservedAt, ttl)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// deleteIndexes removes r from every index, for when the observation itself is deleted
+func deleteIndexes(txn *badger.Txn, r *ServerRecord) error {
+	for _, key := range indexKeys(r) {
+		if err := txn.Delete(key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// LookupIndex calls fn for every observation indexed under term, or under any term starting with it when prefix is set.
+// Those are the observations where the term started to apply, see INDEX_PERIOD.
+func LookupIndex(txn *badger.Txn, kind, term string, prefix bool, fn func(IndexEntry) error) error {
+	seek := indexTermPrefix(kind, term)
+	if prefix {
+		// drop the terminator so longer terms match too
+		seek = seek[:len(seek)-1]
+	}
+	opts := badger.DefaultIteratorOptions
+	opts.PrefetchValues = false
+	opts.Prefix = seek
+	it := txn.NewIterator(opts)
+	defer it.Close()
+
+	for it.Rewind(); it.Valid(); it.Next() {
+		_, _, entry, ok := parseIndexKey(it.Item().Key())
+		if !ok {
+			continue
+		}
+		if err := fn(entry); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// RebuildIndexes drops every index and builds them again from the stored observations
+func RebuildIndexes(db *badger.DB) (int, error) {
+	if err := db.DropPrefix([]byte(INDEX_PREFIX)); err != nil {
+		return 0, err
+	}
+
+	wb := db.NewWriteBatch()
+	defer wb.Cancel()
+	indexed := 0
+	all := NewRecordFilter()
+	err := ScanRecords(db, &all, false, withPrevious(func(prev, r *ServerRecord) error {
+		indexed++
+		return writeIndexes(wb, prev, r, 0)
+	}))
+	if err != nil {
+		return indexed, err
+	}
+	return indexed, wb.Flush()
+}
+
+// withPrevious wraps fn for ScanRecords, passing along the observation of the same server before each one
+func withPrevious(fn func(prev, r *ServerRecord) error) func(*ServerRecord) error {
+	var prev *ServerRecord
+	return func(r *ServerRecord) error {
+		if prev != nil && (!prev.IP.Equal(r.IP) || prev.Port != r.Port) {
+			prev = nil
+		}
+		err := fn(prev, r)
+		prev = r
+		return err
+	}
+}
+
+type IndexReport struct {
+	Observations int
+	Entries      int
+	Missing      int // index entries an observation should have but doesn't
+	Orphaned     int // index entries pointing at observations that don't exist
+}
+
+func (r IndexReport) Consistent() bool {
+	return r.Missing == 0 && r.Orphaned == 0
+}
+
+// CheckIndexes compares the indexes against the stored observations
+func CheckIndexes(db *badger.DB) (IndexReport, error) {
+	var report IndexReport
+	err := db.View(func(txn *badger.Txn) error {
+		// every observation has all of its entries
+		all := NewRecordFilter()
+		err := ScanRecords(db, &all, false, withPrevious(func(prev, r *ServerRecord) error {
+			report.Observations++
+			for _, key := range newIndexKeys(prev, r) {
+				if _, err := txn.Get(key); errors.Is(err, badger.ErrKeyNotFound) {
+					report.Missing++
+					slog.Warn("Missing index entry", "server", r.Addr(), "time", r.ObservedAt, "key", string(key[:len(key)-14]))
+				} else if err != nil {
+					return err
+				}
+			}
+			return nil
+		}))
+		if err != nil {
+			return err
+		}
+
+		// every entry points at an observation
+		opts := badger.DefaultIteratorOptions
+		opts.PrefetchValues = false
+		opts.Prefix = []byte(INDEX_PREFIX)
+		it := txn.NewIterator(opts)
+		defer it.Close()
+		for it.Rewind(); it.Valid(); it.Next() {
+			report.Entries++
+			kind, term, entry, ok := parseIndexKey(it.Item().Key())
+			if !ok {
+				report.Orphaned++
+				continue
+			}
+			if _, err := txn.Get(entry.ServerKey()); errors.Is(err, badger.ErrKeyNotFound) {
+				report.Orphaned++
+				slog.Warn("Orphaned index entry", "kind", kind, "term", term, "server", net.JoinHostPort(entry.IP.String(), strconv.Itoa(int(entry.Port))), "time", entry.Time)
+			} else if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	return report, err
+}
+
+func runIndex(args []string) {
+	usage := func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s index rebuild|check|lookup [flags]\n", os.Args[0])
+		os.Exit(2)
+	}
+	if len(args) == 0 {
+		usage()
+	}
+	fs := flag.NewFlagSet("index "+args[0], flag.ExitOnError)
+	dir := fs.String("db", BADGER_DIR, "badger directory")
+
+	switch args[0] {
+	case "rebuild":
+		fs.Parse(args[1:])
+		db, err := badger.Open(badger.DefaultOptions(*dir))
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer db.Close()
+		indexed, err := RebuildIndexes(db)
+		if err != nil {
+			log.Fatal(err)
+		}
+		slog.Info("Rebuilt indexes", "observations", indexed)
+
+	case "check":
+		fs.Parse(args[1:])
+		db := openReadOnly(*dir)
+		defer db.Close()
+		report, err := CheckIndexes(db)
+		if err != nil {
+			log.Fatal(err)
+		}
+		fmt.Printf("%d observations, %d index entries, %d missing, %d orphaned\n", report.Observations, report.Entries, report.Missing, report.Orphaned)
+		if !report.Consistent() {
+			fmt.Println("indexes are inconsistent, run index rebuild")
+			db.Close()
+			os.Exit(1)
+		}
+
+	case "lookup":
+		kind := fs.String("kind", INDEX_PLAYER_NAME, "index to look in: "+strings.Join(INDEX_KINDS, ", "))
+		prefix := fs.Bool("prefix", false, "match every term starting with the given one")
+		fs.Parse(args[1:])
+		if fs.NArg() != 1 {
+			log.Fatal("index lookup needs exactly one term")
+		}
+		term := fs.Arg(0)
+		if *kind == INDEX_PLAYER_NAME || *kind == INDEX_MOTD {
+			term = strings.ToLower(term)
+		}
+		db := openReadOnly(*dir)
+		defer db.Close()
+
+		var entries []IndexEntry
+		err := db.View(func(txn *badger.Txn) error {
+			return LookupIndex(txn, *kind, term, *prefix, func(e IndexEntry) error {
+				entries = append(entries, e)
+				return nil
+			})
+		})
+		if err != nil {
+			log.Fatal(err)
+		}
+		sort.Slice(entries, func(i, j int) bool { return entries[i].Time.Before(entries[j].Time) })
+		for _, e := range entries {
+			fmt.Printf("%s\t%s\n", e.Time.Format(time.DateTime), net.JoinHostPort(e.IP.String(), strconv.Itoa(int(e.Port))))
+		}
+
+	default:
+		usage()
+	}
+}
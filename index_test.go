@@ -0,0 +1,84 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func countIndex(t *testing.T, store Storage, kind, term string) int {
+	t.Helper()
+	n := 0
+	err := store.LookupIndex(kind, term, false, func(IndexEntry) error {
+		n++
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return n
+}
+
+func TestIndexesOnlyChangedTerms(t *testing.T) {
+	store := openTestBadger(t)
+	start := time.Date(2025, 3, 14, 0, 0, 0, 0, time.UTC)
+	var records []*ServerRecord
+	// a day and a half of pings every ten minutes, with a software change half way
+	for i := 0; i < 216; i++ {
+		r := fullRecord()
+		r.ObservedAt = start.Add(time.Duration(i) * 10 * time.Minute)
+		if i >= 100 {
+			r.Version.Name = "Purpur 1.21.1"
+		}
+		records = append(records, r)
+	}
+	if err := store.PutObservations(records); err != nil {
+		t.Fatal(err)
+	}
+
+	// once at the start of each day
+	if n := countIndex(t, store, INDEX_PROTOCOL, "767"); n != 2 {
+		t.Errorf("protocol has %d entries, want 2", n)
+	}
+	// until the change, and not again the next day
+	if n := countIndex(t, store, INDEX_SOFTWARE, "paper"); n != 1 {
+		t.Errorf("paper has %d entries, want 1", n)
+	}
+	// from the change, then the next day
+	if n := countIndex(t, store, INDEX_SOFTWARE, "purpur"); n != 2 {
+		t.Errorf("purpur has %d entries, want 2", n)
+	}
+
+	report, err := CheckIndexes(store.DB)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !report.Consistent() || report.Observations != len(records) {
+		t.Errorf("unexpected index report %+v", report)
+	}
+	if _, err := RebuildIndexes(store.DB); err != nil {
+		t.Fatal(err)
+	}
+	if n := countIndex(t, store, INDEX_SOFTWARE, "purpur"); n != 2 {
+		t.Errorf("purpur has %d entries after a rebuild, want 2", n)
+	}
+
+	// a window that starts after the term's entry still finds the server
+	filter := NewRecordFilter()
+	filter.Since = start.Add(20 * time.Hour)
+	filter.Until = start.Add(21 * time.Hour)
+	q, err := ParseQuery("software:purpur", filter)
+	if err != nil {
+		t.Fatal(err)
+	}
+	found := 0
+	err = q.Run(store, false, func(r *ServerRecord) error {
+		found++
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if found != 7 {
+		t.Errorf("found %d observations in the window, want 7", found)
+	}
+}
@@ -2,7 +2,7 @@ package main
 
 import (
 	"bytes"
-	"fmt"
+	"log/slog"
 	"net"
 )
 
@@ -111,17 +111,24 @@ func GenerateAllowedRanges() []IPRange {
 	return allowed
 }
 
-func SendIPsToChannel(ips chan<- net.IP, ranges []IPRange, done <-chan struct{}) {
+func SendIPsToChannel(ips chan<- Target, ranges []IPRange, done <-chan struct{}, progress *ScanProgress) {
 	defer close(ips)
+	progress.SetTotal(rangeSize(ranges))
+	generated := metricTargets.WithLabelValues(portLabel(DEFAULT_PORT))
 	counter := 0
 	for _, r := range ranges {
 		for ip := r.start; bytes.Compare(ip, r.end) <= 0; ip = incrementIP(ip) {
+			if !progress.wait(done) {
+				slog.Info("Stopping IP generation", "sent", counter)
+				return
+			}
 			select {
-			case ips <- ip:
+			case ips <- Target{IP: ip, Port: DEFAULT_PORT}:
 				counter++
-				fmt.Printf("Sent: %d\r", counter)
+				progress.CountSent()
+				generated.Inc()
 			case <-done:
-				fmt.Printf("\nStopping IP generation at %d IPs sent\n", counter)
+				slog.Info("Stopping IP generation", "sent", counter)
 				return
 			}
 		}
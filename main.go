@@ -2,21 +2,20 @@ package main
 
 import (
 	"context"
-	"encoding/binary"
+	"flag"
 	"fmt"
 	"log"
 	"log/slog"
+	"math"
 	"net"
 	"os"
 	"os/signal"
+	"slices"
 	"strconv"
 	"strings"
 	"sync"
 	"syscall"
 	"time"
-
-	badger "github.com/dgraph-io/badger/v4"
-	"github.com/fxamacker/cbor/v2"
 )
 
 const DEFAULT_PORT = 25565
@@ -28,74 +27,352 @@ const DEFAULT_WORKERS = 10000
 
 var DEBUG_IP = net.IP{5, 161, 74, 148}
 
-func main() {
+type ScanConfig struct {
+	Workers    int
+	Strategy   StrategyConfig
+	RateLimit  RateLimitConfig
+	Enrichment EnrichmentConfig
+	ReverseDNS ReverseDNSConfig
+	Writer     WriterConfig
+	Storage    string // backend kind, see STORAGE_KINDS
+	Location   string // where the backend keeps its data
+	// observations expire this long after they were made, 0 keeps them
+	TTL time.Duration
+	// sightings older than this are forgotten while scanning, 0 keeps them forever
+	PlayerRetention time.Duration
+	Backup          BackupConfig
+	APIAddr         string // serve the API from the scanner when set
+	TUI             bool
+	MetricsAddr     string // serve /metrics when set
+	Tracing         TracingConfig
+	NotifyConfig    string // webhook and watch configuration, see NotifyConfig
+}
+
+// subcommands, anything else runs a scan
+var COMMANDS = map[string]func(args []string){
+	"coordinator": runCoordinator,
+	"agent":       runAgent,
+	"migrate":     runMigrate,
+	"query":       runQuery,
+	"export":      runExport,
+	"index":       runIndex,
+	"players":     runPlayers,
+	"maintain":    runMaintain,
+	"backup":      runBackup,
+	"restore":     runRestore,
+	"merge":       runMerge,
+	"serve":       runServe,
+	"watch":       runWatch,
+	"report":      runReport,
+}
+
+// addProbeFlags registers the flags shared by every mode that probes targets
+func addProbeFlags(fs *flag.FlagSet, cfg *ScanConfig) {
+	fs.Float64Var(&cfg.RateLimit.Rate, "rate", DEFAULT_RATE, "new connections per second, 0 for unlimited")
+	fs.IntVar(&cfg.RateLimit.Burst, "burst", 0, "token bucket size, defaults to one second of -rate")
+	fs.DurationVar(&cfg.RateLimit.RampUp, "ramp-up", DEFAULT_RAMP_UP, "time taken to ramp up to -rate")
+	fs.IntVar(&cfg.RateLimit.MaxPer24, "max-per-24", DEFAULT_MAX_PER_24, "concurrent connections per /24, 0 for unlimited")
+	fs.IntVar(&cfg.RateLimit.MaxPerASN, "max-per-asn", DEFAULT_MAX_PER_ASN, "concurrent connections per origin ASN, 0 for unlimited")
+	fs.StringVar(&cfg.Enrichment.IPASNFile, "ipasn", "", "pyasn IPASN data file for prefix and ASN annotation")
+	fs.StringVar(&cfg.Enrichment.ASNamesFile, "asnames", "", "pyasn AS names JSON file")
+	fs.StringVar(&cfg.Enrichment.ASNMMDB, "asn-mmdb", "", "MaxMind format ASN database")
+	fs.StringVar(&cfg.Enrichment.CountryMMDB, "country-mmdb", "", "MaxMind format country database")
+	fs.BoolVar(&cfg.ReverseDNS.Enabled, "rdns", false, "look up and forward-confirm PTR records of responding servers")
+	fs.StringVar(&cfg.ReverseDNS.Resolver, "rdns-resolver", "", "host:port of the DNS server for -rdns, defaults to the system resolver")
+	fs.IntVar(&cfg.ReverseDNS.Concurrency, "rdns-concurrency", DEFAULT_RDNS_CONCURRENCY, "concurrent reverse DNS lookups")
+	fs.DurationVar(&cfg.ReverseDNS.Timeout, "rdns-timeout", DEFAULT_RDNS_TIMEOUT, "timeout for each server's reverse DNS lookups")
+	fs.StringVar(&cfg.MetricsAddr, "metrics", "", "serve Prometheus metrics on this address, e.g. localhost:9100")
+	addTracingFlags(fs, &cfg.Tracing)
+}
+
+// parseWorkerCount reads the optional worker count left after the flags
+func parseWorkerCount(fs *flag.FlagSet, cfg *ScanConfig) {
 	// Parse worker count from args or use default
-	workerCount := DEFAULT_WORKERS
-	if len(os.Args) > 1 {
-		if count, err := strconv.Atoi(os.Args[1]); err == nil && count > 0 {
-			workerCount = count
+	cfg.Workers = DEFAULT_WORKERS
+	if fs.NArg() > 0 {
+		if count, err := strconv.Atoi(fs.Arg(0)); err == nil && count > 0 {
+			cfg.Workers = count
 		}
 	}
+	if cfg.RateLimit.Burst <= 0 {
+		cfg.RateLimit.Burst = int(math.Max(1, cfg.RateLimit.Rate))
+	}
+}
 
-	slog.Info(fmt.Sprintf("Starting with %d workers", workerCount))
+// parseScanFlags reads the scanner flags, followed by an optional worker count
+func parseScanFlags(args []string) ScanConfig {
+	fs := flag.NewFlagSet("scanner", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s [flags] [workers]\n", os.Args[0])
+		fmt.Fprintf(fs.Output(), "       %s coordinator|agent|migrate|query|export|index|players|maintain|backup|restore|merge|serve|watch|report [flags]\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	var cfg ScanConfig
+	fs.StringVar(&cfg.Strategy.Name, "strategy", STRATEGY_UNIFORM, "target selection strategy: uniform or adaptive")
+	fs.Float64Var(&cfg.Strategy.ExploreFraction, "explore", DEFAULT_EXPLORE_FRACTION, "fraction of targets the adaptive strategy takes from the uniform sweep")
+	retention := fs.String("player-retention", "", "forget player sightings and names older than this (e.g. 90d), empty keeps them forever. Old samples stay in the observations until players prune -scrub-samples")
+	addProbeFlags(fs, &cfg)
+	addWriterFlags(fs, &cfg.Writer)
+	addBackupFlags(fs, &cfg.Backup)
+	fs.BoolVar(&cfg.TUI, "tui", false, "show live progress full screen, with keys to pause and change the rate")
+	fs.StringVar(&cfg.APIAddr, "api", "", "also serve the HTTP API on this address, e.g. "+DEFAULT_API_ADDR)
+	fs.StringVar(&cfg.NotifyConfig, "notify", "", "JSON file of webhooks to notify about new servers, watched servers and players, and MOTD matches")
+	finishTTL := addTTLFlag(fs)
+	storage, location := addStorageFlags(fs)
+	fs.Parse(args)
+	parseWorkerCount(fs, &cfg)
+	cfg.TTL = finishTTL()
+	cfg.Storage, cfg.Location = *storage, *location
+	if cfg.TTL > 0 && cfg.Storage != STORAGE_BADGER {
+		log.Fatal("-ttl only works with badger storage")
+	}
 
-	db, err := badger.Open(badger.DefaultOptions(BADGER_DIR))
-	if err != nil {
-		log.Fatal(err)
+	if *retention != "" {
+		age, err := ParseAge(*retention)
+		if err != nil || age <= 0 {
+			log.Fatalf("invalid player retention %q", *retention)
+		}
+		cfg.PlayerRetention = age
+		if cfg.Storage != STORAGE_BADGER {
+			log.Fatal("-player-retention only works with badger storage")
+		}
+	}
+	if cfg.TUI && slices.Contains(cfg.Writer.Sinks, SINK_STDOUT) {
+		log.Fatal("-sink stdout and -tui both want the terminal")
+	}
+	if cfg.Backup.Dir != "" && cfg.Storage != STORAGE_BADGER {
+		log.Fatal("-backup-dir only works with badger storage, use the database's own tools otherwise")
+	}
+	if cfg.Backup.Interval <= 0 {
+		log.Fatalf("invalid backup interval %v", cfg.Backup.Interval)
 	}
-	defer db.Close()
 
-	ctx, cancel := context.WithCancel(context.Background())
-	defer cancel()
+	if cfg.Strategy.Name != STRATEGY_UNIFORM && cfg.Strategy.Name != STRATEGY_ADAPTIVE {
+		log.Fatalf("unknown strategy %q", cfg.Strategy.Name)
+	}
+	if cfg.Strategy.ExploreFraction < 0 || cfg.Strategy.ExploreFraction > 1 {
+		log.Fatalf("explore fraction must be between 0 and 1, got %v", cfg.Strategy.ExploreFraction)
+	}
+	return cfg
+}
 
-	done := make(chan struct{})
-	jobs := make(chan net.IP, 100)
-	results := make(chan *ServerStatus, 100)
-	errors := make(chan ErrorWithIP, 100)
-	var wg sync.WaitGroup
+func main() {
+	if len(os.Args) > 1 {
+		if command, ok := COMMANDS[os.Args[1]]; ok {
+			command(os.Args[2:])
+			return
+		}
+	}
+	runScan(os.Args[1:])
+}
 
-	// Set up signal handling first to avoid race conditions
+// handleShutdownSignals cancels ctx and closes done on SIGINT or SIGTERM, the returned func stops listening
+func handleShutdownSignals(cancel context.CancelFunc, done chan struct{}) func() {
 	sigs := make(chan os.Signal, 1)
 	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
 
 	go func() {
 		slog.Info("Signal handler goroutine started")
-		sig := <-sigs
+		sig, ok := <-sigs
+		if !ok {
+			return
+		}
 		fmt.Printf("\nReceived signal: %s. Shutting down...\n", sig)
 		cancel() // Cancel context to stop workers
 		close(done)
 		slog.Info("Shutdown signal sent to all components")
 	}()
 
+	return func() {
+		signal.Stop(sigs)
+		close(sigs)
+		slog.Info("Signal handler cleaned up.")
+	}
+}
+
+// setupProbing loads the annotation stages and the limiter used by the workers
+func setupProbing(ctx context.Context, cfg ScanConfig) (*Enricher, *ReverseDNS, *Limiter) {
+	var enricher *Enricher
+	if cfg.Enrichment.Enabled() {
+		var err error
+		enricher, err = NewEnricher(cfg.Enrichment)
+		if err != nil {
+			log.Fatal(err)
+		}
+		slog.Info("Loaded enrichment data")
+	}
+
+	// SIGHUP reloads the enrichment data without stopping the scan
+	hups := make(chan os.Signal, 1)
+	signal.Notify(hups, syscall.SIGHUP)
+	go func() {
+		defer signal.Stop(hups)
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-hups:
+				if enricher == nil {
+					continue
+				}
+				if err := enricher.Reload(); err != nil {
+					slog.Error("Failed to reload enrichment data", "error", err)
+				} else {
+					slog.Info("Reloaded enrichment data")
+				}
+			}
+		}
+	}()
+
+	var rdns *ReverseDNS
+	if cfg.ReverseDNS.Enabled {
+		rdns = NewReverseDNS(cfg.ReverseDNS)
+	}
+
+	limiter := NewLimiter(cfg.RateLimit)
+	if cfg.RateLimit.MaxPerASN > 0 {
+		if enricher != nil {
+			limiter.SetASNLookup(enricher.ASN)
+		} else {
+			slog.Warn("-max-per-asn has no effect without -ipasn or -asn-mmdb")
+		}
+	}
+	go LogRateLimitStats(ctx, limiter)
+	registerLimiterMetrics(limiter)
+	if cfg.MetricsAddr != "" {
+		go serveMetrics(ctx, cfg.MetricsAddr)
+	}
+
+	return enricher, rdns, limiter
+}
+
+// startWorkers runs the worker pool over jobs, results and errors are closed once every worker is done
+func startWorkers(ctx context.Context, workerCount int, jobs <-chan Target, limiter *Limiter, progress *ScanProgress, notifier *Notifier) (<-chan *ServerStatus, <-chan ErrorWithIP) {
+	results := make(chan *ServerStatus, 100)
+	errors := make(chan ErrorWithIP, 100)
+	var wg sync.WaitGroup
+
 	for _ = range workerCount {
 		wg.Add(1)
-		go worker(ctx, jobs, results, errors, &wg)
+		go worker(ctx, jobs, results, errors, limiter, progress, notifier, &wg)
 	}
 
 	go func() {
-		jobs <- DEBUG_IP
-		SendIPsToChannel(jobs, GenerateAllowedRanges(), done)
+		wg.Wait()
+		slog.Info("All workers finished.")
+		// can now safely close these channels
+		close(results)
+		close(errors)
+		slog.Info("Results and errors channels closed.")
+	}()
+	return results, errors
+}
+
+func runScan(args []string) {
+	cfg := parseScanFlags(args)
+	workerCount := cfg.Workers
+
+	slog.Info(fmt.Sprintf("Starting with %d workers", workerCount))
+
+	store, err := OpenStorage(cfg.Storage, cfg.Location, false)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer store.Close()
+	if cfg.TTL > 0 {
+		store.(*BadgerStorage).TTL = cfg.TTL
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	done := make(chan struct{})
+	jobs := make(chan Target, 100)
+
+	// Set up signal handling first to avoid race conditions
+	stopSignals := handleShutdownSignals(cancel, done)
+
+	defer setupTracing(ctx, cfg.Tracing)()
+	enricher, rdns, limiter := setupProbing(ctx, cfg)
+	if enricher != nil {
+		defer enricher.Close()
+	}
+
+	notifier := startNotifier(ctx, cfg.NotifyConfig, store)
+	defer notifier.Close()
+
+	progress := NewScanProgress()
+	results, errors := startWorkers(ctx, workerCount, jobs, limiter, progress, notifier)
+
+	if cfg.PlayerRetention > 0 {
+		go prunePlayersPeriodically(ctx, store.(*BadgerStorage).DB, cfg.PlayerRetention)
+	}
+	if cfg.Backup.Dir != "" {
+		go backupPeriodically(ctx, store.(*BadgerStorage).DB, cfg.Backup)
+	}
+	if cfg.APIAddr != "" {
+		go serveAPI(ctx, cfg.APIAddr, store)
+	}
+
+	var stats *HitStats
+	if cfg.Strategy.Name == STRATEGY_ADAPTIVE {
+		stats, err = LoadHitStats(store)
+		if err != nil {
+			log.Fatal(err)
+		}
+		slog.Info("Loaded hit stats", "servers", len(stats.Servers), "/24s", len(stats.Slash24), "/16s", len(stats.Slash16))
+	}
+
+	go func() {
+		jobs <- Target{IP: DEBUG_IP, Port: DEFAULT_PORT}
+		if stats != nil {
+			SendAdaptiveTargetsToChannel(jobs, GenerateAllowedRanges(), stats, cfg.Strategy.ExploreFraction, done, progress)
+		} else {
+			SendIPsToChannel(jobs, GenerateAllowedRanges(), done, progress)
+		}
 	}()
 
 	var readWg sync.WaitGroup
 	readWg.Add(1)
 
-	go writer(results, errors, db, &readWg)
-	// Keep signal handler alive and wait for workers to finish
-	wg.Wait()
-	slog.Info("All workers finished.")
-	// can now safely close these channels
-	close(results)
-	close(errors)
-	slog.Info("Results and errors channels closed.")
-	// wait for writer to finish processing everything
+	// watched servers are pinged alongside the sweep until it's done
+	probed := results
+	if notifier != nil {
+		watchCtx, stopWatches := context.WithCancel(ctx)
+		probed = mergeResults(results, watchServers(watchCtx, notifier, limiter), stopWatches)
+	}
+
+	annotated := make(chan *ServerStatus, 100)
+	go annotator(probed, annotated, enricher, rdns)
+	registerChannelDepth("jobs", func() int { return len(jobs) })
+	registerChannelDepth("results", func() int { return len(results) })
+	registerChannelDepth("annotated", func() int { return len(annotated) })
+	registerChannelDepth("errors", func() int { return len(errors) })
+	if badgerStore, ok := store.(*BadgerStorage); ok {
+		registerBadgerMetrics(badgerStore.DB)
+	}
+	batchWriter := NewBatchWriter(store, cfg.Writer)
+	if err := batchWriter.OpenSinks(); err != nil {
+		log.Fatal(err)
+	}
+	defer batchWriter.CloseSinks()
+	go LogWriterStats(ctx, batchWriter)
+	if cfg.TUI {
+		tui, err := StartTUI(ctx, progress, limiter, batchWriter)
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer tui.Close()
+	} else {
+		go LogProgress(ctx, progress)
+	}
+	go writer(notifyStage(annotated, notifier), errors, batchWriter, &readWg)
+	// Keep signal handler alive and wait for the writer to finish processing everything
 	readWg.Wait()
 	slog.Info("Writer has finished.")
 
 	// Clean up signal handler
-	signal.Stop(sigs)
-	close(sigs)
-	slog.Info("Signal handler cleaned up.")
+	stopSignals()
 }
 
 var OKAY_ERRORS = []string{
@@ -112,68 +389,13 @@ type ErrorWithIP struct {
 	Err  error
 }
 
-func writer(results <-chan *ServerStatus, errors <-chan ErrorWithIP, db *badger.DB, wg *sync.WaitGroup) {
+// writer commits results until the workers are done, wg is released once everything is on disk
+func writer(results <-chan *ServerStatus, errors <-chan ErrorWithIP, w *BatchWriter, wg *sync.WaitGroup) {
 	defer wg.Done()
-	for {
-		select {
-		case result, ok := <-results:
-			if !ok {
-				results = nil
-			} else {
-				processResult(result, db)
-			}
-		case err, ok := <-errors:
-			if !ok {
-				errors = nil
-			} else {
-				slog.Error(err.Err.Error(), "IP", err.IP.String(), "Port", err.Port)
-			}
-		}
-
-		if results == nil && errors == nil {
-			break
-		}
-	}
-}
-
-func processResult(result *ServerStatus, db *badger.DB) {
-	slog.Info("Result", "Address", result.Address, "Version", result.Version.Name, "Online", result.Players.Online, "Max", result.Players.Max)
-
-	// key format is "server:<ip>:<timestamp>"
-	tcpAddr, ok := result.Address.(*net.TCPAddr)
-	if !ok {
-		slog.Error("Address is not a TCPAddr", "address", result.Address.String())
-		return
-	}
-
-	// 6 + len + 1 + 8 because 'server' (6 bytes) + IP + ':' + timestamp (8 bytes)
-	key := make([]byte, 0, 6+len(tcpAddr.IP)+1+8)
-	key = append(key, []byte("server:")...)
-	key = append(key, tcpAddr.IP...)
-	key = append(key, ':')
-
-	// timestamp stuff
-	ts := make([]byte, 8)
-	binary.BigEndian.PutUint64(ts, uint64(result.Time.Unix()))
-	key = append(key, ts...)
-
-	bytes, err := cbor.Marshal(result)
-	if err != nil {
-		slog.Error("Failed to marshal result", "error", err)
-		return
-	}
-
-	// write tuah
-	// set on that thang
-	err = db.Update(func(txn *badger.Txn) error {
-		return txn.Set(key, bytes)
-	})
-	if err != nil {
-		slog.Error("Failed to write to database", "error", err)
-	}
+	w.Run(results, errors)
 }
 
-func worker(ctx context.Context, jobs <-chan net.IP, results chan<- *ServerStatus, errors chan<- ErrorWithIP, wg *sync.WaitGroup) {
+func worker(ctx context.Context, jobs <-chan Target, results chan<- *ServerStatus, errors chan<- ErrorWithIP, limiter *Limiter, progress *ScanProgress, notifier *Notifier, wg *sync.WaitGroup) {
 	defer wg.Done()
 WorkLoop:
 	for {
@@ -181,13 +403,26 @@ WorkLoop:
 		case <-ctx.Done():
 			// Context cancelled, exit
 			return
-		case ip, ok := <-jobs:
+		case target, ok := <-jobs:
 			if !ok {
 				// Channel closed, exit
 				return
 			}
-			status, err := GetServerStatus(ctx, ip, DEFAULT_PORT)
+			release, err := limiter.Acquire(ctx, target.IP)
 			if err != nil {
+				// only fails once the context is cancelled
+				return
+			}
+			probeCtx, span := tracer.Start(ctx, "probe", targetAttributes(target.IP.String(), target.Port))
+			status, err := GetServerStatus(probeCtx, target.IP, target.Port)
+			release()
+			endSpan(span, err)
+			if err != nil {
+				if ctx.Err() == nil {
+					progress.CountError(err)
+					notifier.ProbeFailed(target.IP, target.Port)
+					metricErrors.WithLabelValues(portLabel(target.Port), errorCategory(err)).Inc()
+				}
 				for _, err_name := range OKAY_ERRORS {
 					if strings.HasPrefix(err.Error(), err_name) {
 						continue WorkLoop
@@ -195,12 +430,14 @@ WorkLoop:
 				}
 				// Send error with context cancellation check
 				select {
-				case errors <- ErrorWithIP{IP: ip, Port: DEFAULT_PORT, Err: err}:
+				case errors <- ErrorWithIP{IP: target.IP, Port: target.Port, Err: err}:
 				case <-ctx.Done():
 					return
 				}
 				continue
 			}
+			metricResponses.WithLabelValues(portLabel(target.Port), protocolLabel(status.Version.Protocol)).Inc()
+			status.span = span.SpanContext()
 			// Send result with context cancellation check
 			select {
 			case results <- status:
@@ -214,6 +451,7 @@ WorkLoop:
 func GetServerStatus(ctx context.Context, ip net.IP, port int) (*ServerStatus, error) {
 	address := ip.String()
 	tcpAddr := &net.TCPAddr{IP: ip, Port: port}
+	start := time.Now()
 
 	// Check if context was cancelled before starting
 	if ctx.Err() != nil {
@@ -231,10 +469,15 @@ func GetServerStatus(ctx context.Context, ip net.IP, port int) (*ServerStatus, e
 	// brackets are there for IPv6
 	var d net.Dialer
 	d.Timeout = time.Second * 1
-	conn, err := d.DialContext(ctx, "tcp", fmt.Sprintf("[%s]:%d", address, DEFAULT_PORT))
+	metricDials.WithLabelValues(portLabel(port)).Inc()
+	_, span := tracer.Start(ctx, "dial")
+	conn, err := d.DialContext(ctx, "tcp", fmt.Sprintf("[%s]:%d", address, port))
+	endSpan(span, err)
 	if err != nil {
 		return nil, err
 	}
+	metricConnects.WithLabelValues(portLabel(port)).Inc()
+	metricConnectLatency.WithLabelValues(portLabel(port)).Observe(time.Since(start).Seconds())
 	defer conn.Close()
 
 	// force close connection if cancelled
@@ -254,17 +497,39 @@ func GetServerStatus(ctx context.Context, ip net.IP, port int) (*ServerStatus, e
 	default:
 	}
 
-	hs := CreateHandshakePacket(address, uint16(DEFAULT_PORT), 1).ToBytes()
+	_, span = tracer.Start(ctx, "handshake")
+	hs := CreateHandshakePacket(address, uint16(port), 1).ToBytes()
 	_, err = conn.Write(hs)
+	if err == nil {
+		sr := CreateStatusRequestPacket().ToBytes()
+		_, err = conn.Write(sr)
+	}
+	endSpan(span, err)
 	if err != nil {
 		return nil, err
 	}
-	sr := CreateStatusRequestPacket().ToBytes()
-	_, err = conn.Write(sr)
+
+	buf, err := readStatusResponse(ctx, conn)
 	if err != nil {
 		return nil, err
 	}
 
+	_, span = tracer.Start(ctx, "parse")
+	status, err := parseStatusResponse(buf, tcpAddr)
+	endSpan(span, err)
+	if err != nil {
+		return nil, err
+	}
+	status.Latency = time.Since(start)
+	metricResponseLatency.WithLabelValues(portLabel(port)).Observe(status.Latency.Seconds())
+	return status, nil
+}
+
+// readStatusResponse reads until the whole status response packet has arrived
+func readStatusResponse(ctx context.Context, conn net.Conn) (_ []byte, err error) {
+	_, span := tracer.Start(ctx, "read")
+	defer func() { endSpan(span, err) }()
+
 	// Read the response from the server
 	// This is done in a loop to ensure that the entire packet is read
 	// tmp is continuously copied into buf until the entire packet is read
@@ -303,6 +568,11 @@ func GetServerStatus(ctx context.Context, ip net.IP, port int) (*ServerStatus, e
 		}
 	}
 
+	return buf, nil
+}
+
+// parseStatusResponse decodes the status JSON out of a whole response packet
+func parseStatusResponse(buf []byte, addr net.Addr) (*ServerStatus, error) {
 	// Decode the response
 	// extract packet data from the full packet
 	data, _, err := ReadPacket(buf)
@@ -315,5 +585,5 @@ func GetServerStatus(ctx context.Context, ip net.IP, port int) (*ServerStatus, e
 		return nil, err
 	}
 
-	return ProcessJsonResponse(response, tcpAddr)
+	return ProcessJsonResponse(response, addr)
 }
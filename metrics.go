@@ -0,0 +1,153 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+	"slices"
+	"strconv"
+
+	badger "github.com/dgraph-io/badger/v4"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// Everything the scanner exports for Prometheus. They're registered with the default
+// registry as soon as the binary starts, and only served when -metrics is set.
+var (
+	metricTargets = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "scanner_targets_generated_total",
+		Help: "Targets handed to the workers.",
+	}, []string{"port"})
+	metricDials = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "scanner_dials_total",
+		Help: "Connections attempted.",
+	}, []string{"port"})
+	metricConnects = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "scanner_dials_succeeded_total",
+		Help: "Connections that were accepted.",
+	}, []string{"port"})
+	metricResponses = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "scanner_responses_total",
+		Help: "Status responses parsed, by the protocol version the server reports, or other for one no release uses.",
+	}, []string{"port", "protocol"})
+	metricErrors = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "scanner_errors_total",
+		Help: "Failed probes by kind, see ERROR_CATEGORIES.",
+	}, []string{"port", "type"})
+
+	metricConnectLatency = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "scanner_connect_seconds",
+		Help:    "Time for a connection to be accepted.",
+		Buckets: prometheus.ExponentialBuckets(0.005, 2, 9),
+	}, []string{"port"})
+	metricResponseLatency = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "scanner_response_seconds",
+		Help:    "Time from dialing to a parsed status response.",
+		Buckets: prometheus.ExponentialBuckets(0.01, 2, 11),
+	}, []string{"port"})
+
+	metricWriteLatency = promauto.NewHistogram(prometheus.HistogramOpts{
+		Name:    "scanner_db_write_seconds",
+		Help:    "Time to commit one batch of observations.",
+		Buckets: prometheus.ExponentialBuckets(0.001, 2, 12),
+	})
+	metricWritten = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "scanner_db_observations_total",
+		Help: "Observations committed, or given up on after retries.",
+	}, []string{"result"})
+)
+
+// metric labels are strings, ports are the same few numbers over and over
+func portLabel(port int) string {
+	return strconv.Itoa(port)
+}
+
+// Protocol versions of releases since 1.7, the ones responses are labelled with.
+// Servers can report any number they like, so everything else counts as "other"
+// rather than making a new series.
+var KNOWN_PROTOCOLS = []int{
+	4, 5, // 1.7
+	47,                 // 1.8
+	107, 108, 109, 110, // 1.9
+	210,      // 1.10
+	315, 316, // 1.11
+	335, 338, 340, // 1.12
+	393, 401, 404, // 1.13
+	477, 480, 485, 490, 498, // 1.14
+	573, 575, 578, // 1.15
+	735, 736, 751, 753, 754, // 1.16
+	755, 756, // 1.17
+	757, 758, // 1.18
+	759, 760, 761, 762, // 1.19
+	763, 764, 765, 766, // 1.20
+	767, 768, 769, 770, 771, 772, 773, // 1.21
+}
+
+func protocolLabel(protocol int) string {
+	if !slices.Contains(KNOWN_PROTOCOLS, protocol) {
+		return "other"
+	}
+	return strconv.Itoa(protocol)
+}
+
+// registerChannelDepth exports how full a channel is, as a gauge named after it
+func registerChannelDepth(name string, depth func() int) {
+	prometheus.MustRegister(prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Name:        "scanner_channel_depth",
+		Help:        "Items waiting in a pipeline channel.",
+		ConstLabels: prometheus.Labels{"channel": name},
+	}, func() float64 { return float64(depth()) }))
+}
+
+// registerLimiterMetrics exports the limiter state
+func registerLimiterMetrics(l *Limiter) {
+	prometheus.MustRegister(
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Name: "scanner_connections_in_flight",
+			Help: "Connections open right now.",
+		}, func() float64 { return float64(l.Stats().InFlight) }),
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Name: "scanner_rate_limit",
+			Help: "Target connections per second, 0 when unlimited.",
+		}, l.Rate),
+	)
+}
+
+// registerBadgerMetrics exports the size of the database on disk
+func registerBadgerMetrics(db *badger.DB) {
+	size := func(part int) func() float64 {
+		return func() float64 {
+			lsm, vlog := db.Size()
+			return float64([]int64{lsm, vlog}[part])
+		}
+	}
+	prometheus.MustRegister(
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Name:        "scanner_db_size_bytes",
+			Help:        "Size of the badger database.",
+			ConstLabels: prometheus.Labels{"part": "lsm"},
+		}, size(0)),
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Name:        "scanner_db_size_bytes",
+			Help:        "Size of the badger database.",
+			ConstLabels: prometheus.Labels{"part": "vlog"},
+		}, size(1)),
+	)
+}
+
+// serveMetrics serves /metrics until ctx is done
+func serveMetrics(ctx context.Context, addr string) {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+	server := &http.Server{Addr: addr, Handler: mux}
+	go func() {
+		<-ctx.Done()
+		server.Close()
+	}()
+	slog.Info("Metrics listening", "addr", addr)
+	if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+		slog.Error("Metrics server failed", "error", err)
+	}
+}
@@ -0,0 +1,17 @@
+package main
+
+import "testing"
+
+func TestProtocolLabel(t *testing.T) {
+	for protocol, want := range map[int]string{
+		767:        "767",
+		47:         "47",
+		-1:         "other",
+		0:          "other",
+		1073741824: "other",
+	} {
+		if got := protocolLabel(protocol); got != want {
+			t.Errorf("protocolLabel(%d) = %q, want %q", protocol, got, want)
+		}
+	}
+}
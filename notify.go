@@ -0,0 +1,724 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	badger "github.com/dgraph-io/badger/v4"
+)
+
+// Events the notifier can send
+const (
+	EVENT_NEW_SERVER     = "new_server"     // a server that isn't in the database yet
+	EVENT_ONLINE         = "online"         // a watched server answering again
+	EVENT_OFFLINE        = "offline"        // a watched server that stopped answering
+	EVENT_VERSION_CHANGE = "version_change" // a server reporting a different version than last time
+	EVENT_PLAYER_SEEN    = "player_seen"    // a watched player in a sample
+	EVENT_MOTD_MATCH     = "motd_match"     // a MOTD matching one of the patterns
+)
+
+var EVENT_TYPES = []string{EVENT_NEW_SERVER, EVENT_ONLINE, EVENT_OFFLINE, EVENT_VERSION_CHANGE, EVENT_PLAYER_SEEN, EVENT_MOTD_MATCH}
+
+// Webhook body formats
+const (
+	WEBHOOK_JSON    = "json"    // {"events": [...]}
+	WEBHOOK_DISCORD = "discord" // one embed per event
+)
+
+// Events are posted in batches, whichever of these is reached first
+const DEFAULT_WEBHOOK_BATCH = 10
+const DEFAULT_WEBHOOK_FLUSH = 5 * time.Second
+
+// shortest time between two requests to the same webhook
+const DEFAULT_WEBHOOK_INTERVAL = time.Second
+
+// a failed request is retried this many times, waiting twice as long each time
+const WEBHOOK_RETRIES = 5
+const WEBHOOK_BACKOFF = time.Second
+const WEBHOOK_TIMEOUT = 10 * time.Second
+
+// events waiting for a webhook, more than this and new ones are dropped
+const WEBHOOK_QUEUE = 1000
+
+// Discord takes at most this many embeds per message
+const DISCORD_MAX_EMBEDS = 10
+
+// and rejects embeds with longer text than this, in characters
+const (
+	DISCORD_MAX_TITLE       = 256
+	DISCORD_MAX_DESCRIPTION = 4096
+	DISCORD_MAX_FIELD_VALUE = 1024
+	DISCORD_MAX_MESSAGE     = 6000 // all embeds of a message together
+)
+
+// a watched server counts as offline after this many failed probes in a row
+const OFFLINE_AFTER_FAILURES = 2
+
+// the same player or MOTD match on the same server isn't sent again for this long
+const NOTIFY_REPEAT_AFTER = time.Hour
+
+// past that many remembered events the expired ones are forgotten
+const NOTIFY_REMEMBERED = 10000
+
+// Duration is a time.Duration written as a string like "5s" in config files
+type Duration time.Duration
+
+func (d *Duration) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return err
+	}
+	parsed, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = Duration(parsed)
+	return nil
+}
+
+type WebhookConfig struct {
+	URL      string   `json:"url"`
+	Format   string   `json:"format"`   // WEBHOOK_JSON or WEBHOOK_DISCORD
+	Events   []string `json:"events"`   // event types to send, all of them when empty
+	Batch    int      `json:"batch"`    // events per request
+	Flush    Duration `json:"flush"`    // longest an event waits for its batch
+	Interval Duration `json:"interval"` // shortest time between requests
+}
+
+// NotifyConfig is the file given to -notify
+type NotifyConfig struct {
+	Webhooks []WebhookConfig `json:"webhooks"`
+	Servers  []string        `json:"servers"` // watched servers, ip:port
+	Players  []string        `json:"players"` // watched players, UUIDs or names
+	MOTD     []string        `json:"motd"`    // regular expressions
+}
+
+func LoadNotifyConfig(path string) (NotifyConfig, error) {
+	var cfg NotifyConfig
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return cfg, err
+	}
+	if err := json.Unmarshal(data, &cfg); err != nil {
+		return cfg, fmt.Errorf("%s: %w", path, err)
+	}
+	return cfg, nil
+}
+
+type Event struct {
+	Type       string    `json:"type"`
+	Time       time.Time `json:"time"`
+	Server     string    `json:"server"`
+	Message    string    `json:"message"`
+	Version    string    `json:"version,omitempty"`
+	OldVersion string    `json:"oldVersion,omitempty"`
+	Online     *int      `json:"online,omitempty"`
+	Max        *int      `json:"max,omitempty"`
+	MOTD       string    `json:"motd,omitempty"`
+	Player     string    `json:"player,omitempty"`
+	PlayerID   string    `json:"playerId,omitempty"`
+	Pattern    string    `json:"pattern,omitempty"`
+
+	watchedPlayer string // the watch a player_seen event matched, as stored in the watchlist
+}
+
+// watchState is what the notifier knows about a watched server
+type watchState struct {
+	known    bool
+	online   bool
+	failures int // failed probes in a row
+}
+
+// Notifier turns results into events and hands them to the webhooks, and to the
+// timeline when they're about something on the watchlist. Every method works on a
+// nil Notifier, which notifies nobody.
+type Notifier struct {
+	store Storage
+	db    *badger.DB // where timelines go, nil unless the store is badger
+	hooks []*Webhook
+	wants map[string]bool // events at least one webhook takes
+
+	motd       []*regexp.Regexp
+	configured []WatchEntry // watches from the -notify file
+
+	mu      sync.RWMutex
+	watched map[string]*watchState // by ip:port
+	servers []WatchEntry           // the watched servers' entries
+	players map[string]bool        // watched UUIDs and lowercase names
+	sent    map[string]time.Time   // when each repeatable event was last sent
+}
+
+func NewNotifier(cfg NotifyConfig, store Storage) (*Notifier, error) {
+	n := &Notifier{
+		store:   store,
+		wants:   make(map[string]bool),
+		watched: make(map[string]*watchState),
+		players: make(map[string]bool),
+		sent:    make(map[string]time.Time),
+	}
+	if badgerStore, ok := store.(*BadgerStorage); ok {
+		n.db = badgerStore.DB
+	}
+	for _, hookCfg := range cfg.Webhooks {
+		hook, err := NewWebhook(hookCfg)
+		if err != nil {
+			return nil, err
+		}
+		n.hooks = append(n.hooks, hook)
+		for event := range hook.events {
+			n.wants[event] = true
+		}
+	}
+	for _, watches := range []struct {
+		kind    string
+		targets []string
+	}{{WATCH_SERVER, cfg.Servers}, {WATCH_PLAYER, cfg.Players}} {
+		for _, arg := range watches.targets {
+			kind, target, err := ParseWatchTarget(arg)
+			if err != nil {
+				return nil, err
+			}
+			if kind != watches.kind {
+				return nil, fmt.Errorf("%q isn't a %s", arg, watches.kind)
+			}
+			n.configured = append(n.configured, WatchEntry{Kind: kind, Target: target})
+		}
+	}
+	for _, pattern := range cfg.MOTD {
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("invalid MOTD pattern %q: %w", pattern, err)
+		}
+		n.motd = append(n.motd, re)
+	}
+	n.SetWatchlist(nil)
+	return n, nil
+}
+
+// SetWatchlist replaces the watches from the database, the -notify ones stay
+func (n *Notifier) SetWatchlist(entries []WatchEntry) {
+	if n == nil {
+		return
+	}
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	watched := make(map[string]*watchState)
+	n.servers = nil
+	n.players = make(map[string]bool)
+	// the watchlist comes first so its intervals win over the -notify file
+	for _, entry := range append(slices.Clone(entries), n.configured...) {
+		switch entry.Kind {
+		case WATCH_SERVER:
+			if watched[entry.Target] != nil {
+				continue
+			}
+			// servers that stay watched keep what's known about them
+			state := n.watched[entry.Target]
+			if state == nil {
+				state = &watchState{}
+			}
+			watched[entry.Target] = state
+			n.servers = append(n.servers, entry)
+		case WATCH_PLAYER:
+			n.players[entry.Target] = true
+		}
+	}
+	n.watched = watched
+}
+
+// WatchedServers returns every server the scheduler should keep pinging
+func (n *Notifier) WatchedServers() []WatchEntry {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return slices.Clone(n.servers)
+}
+
+// loadNotifier sets up the notifier from a -notify file, exiting if it's broken
+func loadNotifier(path string, store Storage) *Notifier {
+	cfg, err := LoadNotifyConfig(path)
+	if err != nil {
+		log.Fatal(err)
+	}
+	n, err := NewNotifier(cfg, store)
+	if err != nil {
+		log.Fatalf("%s: %v", path, err)
+	}
+	slog.Info("Notifications enabled", "webhooks", len(n.hooks), "servers", len(n.watched), "players", len(n.players), "motdPatterns", len(n.motd))
+	return n
+}
+
+// Close sends whatever the webhooks still have queued and waits for them
+func (n *Notifier) Close() {
+	if n == nil {
+		return
+	}
+	for _, hook := range n.hooks {
+		hook.Close()
+	}
+}
+
+// repeated reports whether an event like this went out recently, and remembers it if not
+func (n *Notifier) repeated(event Event, detail string) bool {
+	key := event.Type + " " + event.Server + " " + detail
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if last, ok := n.sent[key]; ok && event.Time.Sub(last) < NOTIFY_REPEAT_AFTER {
+		return true
+	}
+	n.sent[key] = event.Time
+	if len(n.sent) > NOTIFY_REMEMBERED {
+		for key, last := range n.sent {
+			if event.Time.Sub(last) >= NOTIFY_REPEAT_AFTER {
+				delete(n.sent, key)
+			}
+		}
+	}
+	return false
+}
+
+func (n *Notifier) notify(event Event) {
+	if n.db != nil {
+		n.mu.Lock()
+		_, watchedServer := n.watched[event.Server]
+		n.mu.Unlock()
+		if watchedServer {
+			if err := RecordTimeline(n.db, WATCH_SERVER, event.Server, event); err != nil {
+				slog.Error("Failed to record timeline", "server", event.Server, "error", err)
+			}
+		}
+		if event.watchedPlayer != "" {
+			if err := RecordTimeline(n.db, WATCH_PLAYER, event.watchedPlayer, event); err != nil {
+				slog.Error("Failed to record timeline", "player", event.watchedPlayer, "error", err)
+			}
+		}
+	}
+	for _, hook := range n.hooks {
+		hook.Send(event)
+	}
+}
+
+// Observe checks a result for anything worth telling someone about
+func (n *Notifier) Observe(status *ServerStatus) {
+	if n == nil {
+		return
+	}
+	tcpAddr, ok := status.Address.(*net.TCPAddr)
+	if !ok {
+		return
+	}
+	base := Event{
+		Time:    status.Time,
+		Server:  tcpAddr.String(),
+		Version: status.Version.Name,
+		MOTD:    stripFormatting(string(status.Description)),
+	}
+	if base.Time.IsZero() {
+		base.Time = time.Now()
+	}
+	if status.Players != nil {
+		base.Online, base.Max = &status.Players.Online, &status.Players.Max
+	}
+
+	n.mu.Lock()
+	state := n.watched[base.Server]
+	n.mu.Unlock()
+
+	// version changes of watched servers go in their timeline even without a webhook for them
+	if n.wants[EVENT_NEW_SERVER] || n.wants[EVENT_VERSION_CHANGE] || (state != nil && n.db != nil) {
+		previous, err := n.store.Latest(tcpAddr.IP, uint16(tcpAddr.Port))
+		switch {
+		case err != nil:
+			slog.Error("Failed to look up previous observation", "server", base.Server, "error", err)
+		case previous == nil:
+			event := base
+			event.Type = EVENT_NEW_SERVER
+			event.Message = fmt.Sprintf("New server %s running %s", base.Server, base.Version)
+			n.notify(event)
+		case previous.Version.Name != status.Version.Name:
+			event := base
+			event.Type = EVENT_VERSION_CHANGE
+			event.OldVersion = previous.Version.Name
+			event.Message = fmt.Sprintf("%s changed version from %s to %s", base.Server, previous.Version.Name, base.Version)
+			n.notify(event)
+		}
+	}
+
+	n.mu.Lock()
+	cameOnline := state != nil && state.known && !state.online
+	if state != nil {
+		state.known, state.online, state.failures = true, true, 0
+	}
+	n.mu.Unlock()
+	if cameOnline {
+		event := base
+		event.Type = EVENT_ONLINE
+		event.Message = fmt.Sprintf("%s is back online", base.Server)
+		n.notify(event)
+	}
+
+	if status.Players != nil && status.Players.Sample != nil && !status.IsFakeSample {
+		for _, player := range *status.Players.Sample {
+			watch := n.watchesPlayer(player)
+			if watch == "" {
+				continue
+			}
+			event := base
+			event.watchedPlayer = watch
+			event.Type = EVENT_PLAYER_SEEN
+			if player.Name != nil {
+				event.Player = *player.Name
+			}
+			if player.ID != nil {
+				event.PlayerID = player.ID.String()
+			}
+			event.Message = fmt.Sprintf("%s is on %s", event.Player, base.Server)
+			if !n.repeated(event, event.PlayerID+event.Player) {
+				n.notify(event)
+			}
+		}
+	}
+
+	for _, re := range n.motd {
+		if re.MatchString(base.MOTD) {
+			event := base
+			event.Type = EVENT_MOTD_MATCH
+			event.Pattern = re.String()
+			event.Message = fmt.Sprintf("%s has a MOTD matching %s", base.Server, re)
+			if !n.repeated(event, event.Pattern) {
+				n.notify(event)
+			}
+		}
+	}
+}
+
+// watchesPlayer returns the watch a sample player matches, empty if none
+func (n *Notifier) watchesPlayer(player SamplePlayer) string {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if player.ID != nil && n.players[player.ID.String()] {
+		return player.ID.String()
+	}
+	if player.Name != nil && n.players[strings.ToLower(*player.Name)] {
+		return strings.ToLower(*player.Name)
+	}
+	return ""
+}
+
+// ProbeFailed tells the notifier a server didn't answer, only watched servers matter
+func (n *Notifier) ProbeFailed(ip net.IP, port int) {
+	if n == nil {
+		return
+	}
+	addr := Target{IP: ip, Port: port}.String()
+	// every failed probe of the sweep ends up here, so only lock for writing when it's watched
+	n.mu.RLock()
+	_, watched := n.watched[addr]
+	n.mu.RUnlock()
+	if !watched {
+		return
+	}
+	n.mu.Lock()
+	state := n.watched[addr]
+	wentOffline := false
+	if state != nil {
+		state.failures++
+		if state.failures == OFFLINE_AFTER_FAILURES {
+			wentOffline = state.known && state.online
+			state.known, state.online = true, false
+		}
+	}
+	n.mu.Unlock()
+	if wentOffline {
+		n.notify(Event{
+			Type:    EVENT_OFFLINE,
+			Time:    time.Now(),
+			Server:  addr,
+			Message: fmt.Sprintf("%s stopped answering", addr),
+		})
+	}
+}
+
+// notifyStage passes results through to the writer, telling n about each of them
+func notifyStage(results <-chan *ServerStatus, n *Notifier) <-chan *ServerStatus {
+	if n == nil {
+		return results
+	}
+	out := make(chan *ServerStatus, cap(results))
+	go func() {
+		defer close(out)
+		for result := range results {
+			n.Observe(result)
+			out <- result
+		}
+	}()
+	return out
+}
+
+// Webhook posts batches of events to one URL
+type Webhook struct {
+	cfg    WebhookConfig
+	client *http.Client
+	events map[string]bool
+	queue  chan Event
+	done   chan struct{}
+
+	backoff time.Duration // first wait before a retry, doubled every time
+
+	closeOnce sync.Once
+}
+
+func NewWebhook(cfg WebhookConfig) (*Webhook, error) {
+	if cfg.URL == "" {
+		return nil, fmt.Errorf("webhook without a url")
+	}
+	if cfg.Format == "" {
+		cfg.Format = WEBHOOK_JSON
+	}
+	if cfg.Format != WEBHOOK_JSON && cfg.Format != WEBHOOK_DISCORD {
+		return nil, fmt.Errorf("unknown webhook format %q", cfg.Format)
+	}
+	if cfg.Batch <= 0 {
+		cfg.Batch = DEFAULT_WEBHOOK_BATCH
+	}
+	if cfg.Format == WEBHOOK_DISCORD {
+		cfg.Batch = min(cfg.Batch, DISCORD_MAX_EMBEDS)
+	}
+	if cfg.Flush <= 0 {
+		cfg.Flush = Duration(DEFAULT_WEBHOOK_FLUSH)
+	}
+	if cfg.Interval <= 0 {
+		cfg.Interval = Duration(DEFAULT_WEBHOOK_INTERVAL)
+	}
+	events := make(map[string]bool)
+	for _, event := range cfg.Events {
+		if !slices.Contains(EVENT_TYPES, event) {
+			return nil, fmt.Errorf("unknown event %q, expected one of %s", event, strings.Join(EVENT_TYPES, ", "))
+		}
+		events[event] = true
+	}
+	if len(events) == 0 {
+		for _, event := range EVENT_TYPES {
+			events[event] = true
+		}
+	}
+	h := &Webhook{
+		cfg:    cfg,
+		client: &http.Client{Timeout: WEBHOOK_TIMEOUT},
+		events: events,
+		queue:  make(chan Event, WEBHOOK_QUEUE),
+		done:   make(chan struct{}),
+
+		backoff: WEBHOOK_BACKOFF,
+	}
+	go h.run()
+	return h, nil
+}
+
+// Send queues an event if the webhook takes it, it never blocks the scan
+func (h *Webhook) Send(event Event) {
+	if !h.events[event.Type] {
+		return
+	}
+	select {
+	case h.queue <- event:
+	default:
+		slog.Warn("Webhook queue full, dropping event", "url", h.cfg.URL, "type", event.Type, "server", event.Server)
+	}
+}
+
+// Close posts everything still queued and waits for it
+func (h *Webhook) Close() {
+	h.closeOnce.Do(func() { close(h.queue) })
+	<-h.done
+}
+
+func (h *Webhook) run() {
+	defer close(h.done)
+	ticker := time.NewTicker(time.Duration(h.cfg.Flush))
+	defer ticker.Stop()
+
+	var batch []Event
+	var last time.Time
+	send := func() {
+		if len(batch) == 0 {
+			return
+		}
+		if wait := time.Duration(h.cfg.Interval) - time.Since(last); wait > 0 {
+			time.Sleep(wait)
+		}
+		if err := h.post(batch); err != nil {
+			slog.Error("Failed to send webhook", "url", h.cfg.URL, "events", len(batch), "error", err)
+		}
+		last = time.Now()
+		batch = nil
+	}
+	for {
+		select {
+		case event, ok := <-h.queue:
+			if !ok {
+				send()
+				return
+			}
+			batch = append(batch, event)
+			if len(batch) >= h.cfg.Batch {
+				send()
+			}
+		case <-ticker.C:
+			send()
+		}
+	}
+}
+
+// post sends one batch, which discord may need split over several messages
+func (h *Webhook) post(events []Event) error {
+	bodies, err := h.bodies(events)
+	if err != nil {
+		return err
+	}
+	var errs []error
+	for _, body := range bodies {
+		errs = append(errs, h.postBody(body))
+	}
+	return errors.Join(errs...)
+}
+
+// postBody sends one request, retrying server errors and rate limiting with backoff
+func (h *Webhook) postBody(body []byte) error {
+	backoff := h.backoff
+	for attempt := 0; ; attempt++ {
+		resp, err := h.client.Post(h.cfg.URL, "application/json", bytes.NewReader(body))
+		wait := backoff
+		if err == nil {
+			io.Copy(io.Discard, resp.Body)
+			resp.Body.Close()
+			switch {
+			case resp.StatusCode < 300:
+				return nil
+			case resp.StatusCode == http.StatusTooManyRequests:
+				if seconds, parseErr := strconv.ParseFloat(resp.Header.Get("Retry-After"), 64); parseErr == nil {
+					wait = time.Duration(seconds * float64(time.Second))
+				}
+			case resp.StatusCode < 500:
+				// our fault, sending it again won't help
+				return fmt.Errorf("webhook returned %s", resp.Status)
+			}
+			err = fmt.Errorf("webhook returned %s", resp.Status)
+		}
+		if attempt == WEBHOOK_RETRIES {
+			return err
+		}
+		slog.Warn("Webhook failed, retrying", "url", h.cfg.URL, "error", err, "wait", wait)
+		time.Sleep(wait)
+		backoff *= 2
+	}
+}
+
+// Discord embed colours by event
+var DISCORD_COLOURS = map[string]int{
+	EVENT_NEW_SERVER:     0x2ecc71,
+	EVENT_ONLINE:         0x27ae60,
+	EVENT_OFFLINE:        0xe74c3c,
+	EVENT_VERSION_CHANGE: 0x3498db,
+	EVENT_PLAYER_SEEN:    0x9b59b6,
+	EVENT_MOTD_MATCH:     0xf1c40f,
+}
+
+type discordField struct {
+	Name   string `json:"name"`
+	Value  string `json:"value"`
+	Inline bool   `json:"inline"`
+}
+
+type discordEmbed struct {
+	Title       string         `json:"title"`
+	Description string         `json:"description,omitempty"`
+	Color       int            `json:"color"`
+	Timestamp   string         `json:"timestamp"`
+	Fields      []discordField `json:"fields,omitempty"`
+}
+
+// truncate cuts s down to max characters, marking that it did
+func truncate(s string, max int) string {
+	if utf8.RuneCountInString(s) <= max {
+		return s
+	}
+	return string([]rune(s)[:max-1]) + "…"
+}
+
+// size is how much of a message's character limit the embed takes
+func (e discordEmbed) size() int {
+	n := utf8.RuneCountInString(e.Title) + utf8.RuneCountInString(e.Description)
+	for _, field := range e.Fields {
+		n += utf8.RuneCountInString(field.Name) + utf8.RuneCountInString(field.Value)
+	}
+	return n
+}
+
+func discordEmbedFor(event Event) discordEmbed {
+	// everything but the colour and time can come from a server, so it's all cut to what discord takes
+	field := func(name, value string) discordField {
+		return discordField{Name: name, Value: truncate(value, DISCORD_MAX_FIELD_VALUE), Inline: true}
+	}
+	embed := discordEmbed{
+		Title:       truncate(event.Message, DISCORD_MAX_TITLE),
+		Description: truncate(event.MOTD, DISCORD_MAX_DESCRIPTION),
+		Color:       DISCORD_COLOURS[event.Type],
+		Timestamp:   event.Time.UTC().Format(time.RFC3339),
+		Fields:      []discordField{field("Server", event.Server)},
+	}
+	if event.Version != "" {
+		embed.Fields = append(embed.Fields, field("Version", event.Version))
+	}
+	if event.Online != nil && event.Max != nil {
+		embed.Fields = append(embed.Fields, field("Players", fmt.Sprintf("%d/%d", *event.Online, *event.Max)))
+	}
+	return embed
+}
+
+// bodies encodes a batch as one request body, or for discord as many as its
+// message size limit takes
+func (h *Webhook) bodies(events []Event) ([][]byte, error) {
+	if h.cfg.Format == WEBHOOK_JSON {
+		body, err := json.Marshal(struct {
+			Events []Event `json:"events"`
+		}{events})
+		return [][]byte{body}, err
+	}
+	var messages [][]discordEmbed
+	size := 0
+	for _, event := range events {
+		embed := discordEmbedFor(event)
+		if len(messages) == 0 || size+embed.size() > DISCORD_MAX_MESSAGE || len(messages[len(messages)-1]) == DISCORD_MAX_EMBEDS {
+			messages = append(messages, nil)
+			size = 0
+		}
+		messages[len(messages)-1] = append(messages[len(messages)-1], embed)
+		size += embed.size()
+	}
+	var bodies [][]byte
+	for _, embeds := range messages {
+		body, err := json.Marshal(struct {
+			Embeds []discordEmbed `json:"embeds"`
+		}{embeds})
+		if err != nil {
+			return nil, err
+		}
+		bodies = append(bodies, body)
+	}
+	return bodies, nil
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+	"unicode/utf8"
+)
+
+type webhookRequest struct {
+	at   time.Time
+	body []byte
+}
+
+// webhookReceiver answers requests with statuses in turn, then 204s, and records every request
+type webhookReceiver struct {
+	mu       sync.Mutex
+	requests []webhookRequest
+	statuses []int
+	server   *httptest.Server
+}
+
+func newWebhookReceiver(t *testing.T, statuses ...int) *webhookReceiver {
+	t.Helper()
+	rcv := &webhookReceiver{statuses: statuses}
+	rcv.server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		rcv.mu.Lock()
+		defer rcv.mu.Unlock()
+		rcv.requests = append(rcv.requests, webhookRequest{time.Now(), body})
+		status := http.StatusNoContent
+		if len(rcv.statuses) > 0 {
+			status, rcv.statuses = rcv.statuses[0], rcv.statuses[1:]
+		}
+		if status == http.StatusTooManyRequests {
+			w.Header().Set("Retry-After", "0.2")
+		}
+		w.WriteHeader(status)
+	}))
+	t.Cleanup(rcv.server.Close)
+	return rcv
+}
+
+func (rcv *webhookReceiver) received() []webhookRequest {
+	rcv.mu.Lock()
+	defer rcv.mu.Unlock()
+	return append([]webhookRequest{}, rcv.requests...)
+}
+
+// testWebhook sends events through a webhook that never flushes on its own, and waits for it to finish
+func testWebhook(t *testing.T, cfg WebhookConfig, events []Event) {
+	t.Helper()
+	cfg.Flush = Duration(time.Hour)
+	cfg.Interval = Duration(time.Millisecond)
+	h, err := NewWebhook(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h.backoff = 10 * time.Millisecond
+	for _, event := range events {
+		h.Send(event)
+	}
+	h.Close()
+}
+
+func testEvents(n int) []Event {
+	var events []Event
+	for i := 0; i < n; i++ {
+		online, max := i, 20
+		events = append(events, Event{
+			Type:    EVENT_NEW_SERVER,
+			Time:    time.Date(2025, 3, 14, 15, 9, i, 0, time.UTC),
+			Server:  "192.0.2.10:25565",
+			Message: "New server",
+			Version: "Paper 1.21.1",
+			Online:  &online,
+			Max:     &max,
+			MOTD:    "§aA Minecraft Server",
+		})
+	}
+	return events
+}
+
+func TestWebhookBatchesJSON(t *testing.T) {
+	rcv := newWebhookReceiver(t)
+	testWebhook(t, WebhookConfig{URL: rcv.server.URL, Batch: 3}, testEvents(7))
+
+	var sizes []int
+	for _, req := range rcv.received() {
+		var body struct {
+			Events []Event `json:"events"`
+		}
+		if err := json.Unmarshal(req.body, &body); err != nil {
+			t.Fatal(err)
+		}
+		sizes = append(sizes, len(body.Events))
+	}
+	if len(sizes) != 3 || sizes[0] != 3 || sizes[1] != 3 || sizes[2] != 1 {
+		t.Errorf("batches of %v, want [3 3 1]", sizes)
+	}
+}
+
+func TestWebhookRetries(t *testing.T) {
+	rcv := newWebhookReceiver(t, http.StatusServiceUnavailable, http.StatusTooManyRequests, http.StatusOK)
+	testWebhook(t, WebhookConfig{URL: rcv.server.URL}, testEvents(1))
+
+	reqs := rcv.received()
+	if len(reqs) != 3 {
+		t.Fatalf("%d requests, want 3", len(reqs))
+	}
+	for _, req := range reqs[1:] {
+		if string(req.body) != string(reqs[0].body) {
+			t.Errorf("retry sent a different body: %s", req.body)
+		}
+	}
+	// a 429 waits as long as Retry-After says, not the backoff
+	if gap := reqs[2].at.Sub(reqs[1].at); gap < 200*time.Millisecond {
+		t.Errorf("retried %v after a 429 with Retry-After 0.2", gap)
+	}
+}
+
+func TestWebhookGivesUpOnClientErrors(t *testing.T) {
+	rcv := newWebhookReceiver(t, http.StatusBadRequest)
+	testWebhook(t, WebhookConfig{URL: rcv.server.URL}, testEvents(1))
+	if n := len(rcv.received()); n != 1 {
+		t.Errorf("%d requests for a 400, want 1", n)
+	}
+}
+
+func TestWebhookDiscord(t *testing.T) {
+	rcv := newWebhookReceiver(t)
+	events := testEvents(12)
+	// long enough that two don't fit in one message, and cut to discord's limits
+	events[0].MOTD = strings.Repeat("é", 5000)
+	events[1].MOTD = strings.Repeat("a", 3000)
+	events[1].Message = strings.Repeat("Title ", 100)
+	testWebhook(t, WebhookConfig{URL: rcv.server.URL, Format: WEBHOOK_DISCORD, Batch: 50}, events)
+
+	var counts []int
+	for _, req := range rcv.received() {
+		var body struct {
+			Embeds []discordEmbed `json:"embeds"`
+		}
+		if err := json.Unmarshal(req.body, &body); err != nil {
+			t.Fatal(err)
+		}
+		size := 0
+		for _, embed := range body.Embeds {
+			if n := utf8.RuneCountInString(embed.Title); n > DISCORD_MAX_TITLE {
+				t.Errorf("title of %d characters", n)
+			}
+			if n := utf8.RuneCountInString(embed.Description); n > DISCORD_MAX_DESCRIPTION {
+				t.Errorf("description of %d characters", n)
+			}
+			if len(embed.Fields) != 3 || embed.Fields[2].Value == "" {
+				t.Errorf("embed fields %+v", embed.Fields)
+			}
+			size += embed.size()
+		}
+		if size > DISCORD_MAX_MESSAGE {
+			t.Errorf("message of %d characters", size)
+		}
+		counts = append(counts, len(body.Embeds))
+	}
+	// the batch is capped at ten embeds, and the first two need a message each
+	if len(counts) != 3 || counts[0] != 1 || counts[1] != 9 || counts[2] != 2 {
+		t.Errorf("messages with %v embeds, want [1 9 2]", counts)
+	}
+}
@@ -0,0 +1,729 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"log/slog"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	badger "github.com/dgraph-io/badger/v4"
+	"github.com/fxamacker/cbor/v2"
+	"github.com/google/uuid"
+)
+
+// Every player in a sample is stored twice so both directions are a prefix scan:
+//
+//	sighting:<uuid><timestamp><ip><port> -> name   where has this player been seen
+//	seen:<ip><port><uuid><timestamp>     -> name   who has been seen on this server
+//
+// Names are tracked per UUID so renames show up:
+//
+//	playername:<uuid><name>          -> cbor PlayerName
+//	namelookup:<lowercase name>\x00<uuid> -> nothing
+const SIGHTING_PREFIX = "sighting:"
+const SERVER_PLAYERS_PREFIX = "seen:"
+const PLAYER_NAME_PREFIX = "playername:"
+const NAME_LOOKUP_PREFIX = "namelookup:"
+
+// how often the scanner prunes sightings when -player-retention is set
+const PLAYER_PRUNE_INTERVAL = time.Hour
+
+// names PrunePlayers deletes per transaction
+const PLAYER_PRUNE_BATCH = 256
+
+// Sighting is one player seen in one server's sample
+type Sighting struct {
+	UUID uuid.UUID `json:"uuid"`
+	Name string    `json:"name"`
+	IP   net.IP    `json:"ip"`
+	Port uint16    `json:"port"`
+	Time time.Time `json:"time"`
+}
+
+func (s Sighting) Addr() string {
+	return net.JoinHostPort(s.IP.String(), strconv.Itoa(int(s.Port)))
+}
+
+// PlayerName is one name a UUID has used, and when it was seen under it
+type PlayerName struct {
+	Name      string    `cbor:"name" json:"name"`
+	FirstSeen time.Time `cbor:"firstSeen" json:"firstSeen"`
+	LastSeen  time.Time `cbor:"lastSeen" json:"lastSeen"`
+}
+
+func sightingKey(s Sighting) []byte {
+	key := make([]byte, 0, len(SIGHTING_PREFIX)+16+8+4+2)
+	key = append(key, SIGHTING_PREFIX...)
+	key = append(key, s.UUID[:]...)
+	key = binary.BigEndian.AppendUint64(key, uint64(s.Time.Unix()))
+	key = append(key, s.IP.To4()...)
+	return binary.BigEndian.AppendUint16(key, s.Port)
+}
+
+func serverPlayersKey(s Sighting) []byte {
+	key := make([]byte, 0, len(SERVER_PLAYERS_PREFIX)+4+2+16+8)
+	key = append(key, SERVER_PLAYERS_PREFIX...)
+	key = append(key, s.IP.To4()...)
+	key = binary.BigEndian.AppendUint16(key, s.Port)
+	key = append(key, s.UUID[:]...)
+	return binary.BigEndian.AppendUint64(key, uint64(s.Time.Unix()))
+}
+
+func parseSightingKey(key, name []byte) (Sighting, bool) {
+	rest, ok := bytes.CutPrefix(key, []byte(SIGHTING_PREFIX))
+	if !ok || len(rest) != 16+8+4+2 {
+		return Sighting{}, false
+	}
+	s := Sighting{
+		Name: string(name),
+		Time: time.Unix(int64(binary.BigEndian.Uint64(rest[16:24])), 0),
+		IP:   net.IP(append([]byte(nil), rest[24:28]...)),
+		Port: binary.BigEndian.Uint16(rest[28:30]),
+	}
+	copy(s.UUID[:], rest[:16])
+	return s, true
+}
+
+func parseServerPlayersKey(key, name []byte) (Sighting, bool) {
+	rest, ok := bytes.CutPrefix(key, []byte(SERVER_PLAYERS_PREFIX))
+	if !ok || len(rest) != 4+2+16+8 {
+		return Sighting{}, false
+	}
+	s := Sighting{
+		Name: string(name),
+		IP:   net.IP(append([]byte(nil), rest[:4]...)),
+		Port: binary.BigEndian.Uint16(rest[4:6]),
+		Time: time.Unix(int64(binary.BigEndian.Uint64(rest[22:30])), 0),
+	}
+	copy(s.UUID[:], rest[6:22])
+	return s, true
+}
+
+func playerNameKey(id uuid.UUID, name string) []byte {
+	key := append([]byte(PLAYER_NAME_PREFIX), id[:]...)
+	return append(key, name...)
+}
+
+func nameLookupKey(name string, id uuid.UUID) []byte {
+	key := append([]byte(NAME_LOOKUP_PREFIX), strings.ToLower(name)...)
+	key = append(key, 0)
+	return append(key, id[:]...)
+}
+
+// RecordSightings lists the real players in a record's sample
+func RecordSightings(r *ServerRecord) []Sighting {
+	// fake samples are server made, they aren't people
+	if r.IsFakeSample || r.Players == nil || r.Players.Sample == nil {
+		return nil
+	}
+	var sightings []Sighting
+	for _, player := range *r.Players.Sample {
+		if player.ID == nil || player.Name == nil || *player.ID == uuid.Nil || *player.Name == ANONYMOUS_PLAYER_NAME {
+			continue
+		}
+		sightings = append(sightings, Sighting{UUID: *player.ID, Name: *player.Name, IP: r.IP, Port: r.Port, Time: r.ObservedAt})
+	}
+	return sightings
+}
+
+// writeSightings stores the players of r inside the transaction that stores it
+func writeSightings(txn *badger.Txn, r *ServerRecord, ttl time.Duration) error {
+	for _, s := range RecordSightings(r) {
+		if err := txn.SetEntry(observationEntry(sightingKey(s), []byte(s.Name), s.Time, ttl)); err != nil {
+			return err
+		}
+		if err := txn.SetEntry(observationEntry(serverPlayersKey(s), []byte(s.Name), s.Time, ttl)); err != nil {
+			return err
+		}
+		if err := updatePlayerName(txn, s); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func updatePlayerName(txn *badger.Txn, s Sighting) error {
+	key := playerNameKey(s.UUID, s.Name)
+	entry := PlayerName{Name: s.Name, FirstSeen: s.Time, LastSeen: s.Time}
+	item, err := txn.Get(key)
+	switch {
+	case errors.Is(err, badger.ErrKeyNotFound):
+	case err != nil:
+		return err
+	default:
+		var stored PlayerName
+		if err := item.Value(func(val []byte) error { return cbor.Unmarshal(val, &stored) }); err != nil {
+			return err
+		}
+		if stored.FirstSeen.Before(entry.FirstSeen) {
+			entry.FirstSeen = stored.FirstSeen
+		}
+		if stored.LastSeen.After(entry.LastSeen) {
+			entry.LastSeen = stored.LastSeen
+		}
+		if entry.FirstSeen.Equal(stored.FirstSeen) && entry.LastSeen.Equal(stored.LastSeen) {
+			return nil
+		}
+	}
+	val, err := recordEncMode.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	if err := txn.Set(key, val); err != nil {
+		return err
+	}
+	return txn.Set(nameLookupKey(s.Name, s.UUID), nil)
+}
+
+func inTimeWindow(t, since, until time.Time) bool {
+	return (since.IsZero() || !t.Before(since)) && (until.IsZero() || !t.After(until))
+}
+
+// PlayerSightings calls fn for every sighting of a player inside the window, oldest first
+func PlayerSightings(txn *badger.Txn, id uuid.UUID, since, until time.Time, fn func(Sighting) error) error {
+	prefix := append([]byte(SIGHTING_PREFIX), id[:]...)
+	opts := badger.DefaultIteratorOptions
+	opts.Prefix = prefix
+	it := txn.NewIterator(opts)
+	defer it.Close()
+
+	seek := prefix
+	if !since.IsZero() {
+		seek = binary.BigEndian.AppendUint64(append([]byte(nil), prefix...), uint64(since.Unix()))
+	}
+	for it.Seek(seek); it.Valid(); it.Next() {
+		item := it.Item()
+		name, err := item.ValueCopy(nil)
+		if err != nil {
+			return err
+		}
+		s, ok := parseSightingKey(item.Key(), name)
+		if !ok {
+			continue
+		}
+		if !until.IsZero() && s.Time.After(until) {
+			break
+		}
+		if err := fn(s); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ServerPlayers calls fn for every player sighting on a server inside the window, grouped by player
+func ServerPlayers(txn *badger.Txn, ip net.IP, port uint16, since, until time.Time, fn func(Sighting) error) error {
+	prefix := append([]byte(SERVER_PLAYERS_PREFIX), ip.To4()...)
+	prefix = binary.BigEndian.AppendUint16(prefix, port)
+	opts := badger.DefaultIteratorOptions
+	opts.Prefix = prefix
+	it := txn.NewIterator(opts)
+	defer it.Close()
+
+	for it.Rewind(); it.Valid(); it.Next() {
+		item := it.Item()
+		name, err := item.ValueCopy(nil)
+		if err != nil {
+			return err
+		}
+		s, ok := parseServerPlayersKey(item.Key(), name)
+		if !ok || !inTimeWindow(s.Time, since, until) {
+			continue
+		}
+		if err := fn(s); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// PlayerNames returns every name a UUID has been seen with, oldest first
+func PlayerNames(txn *badger.Txn, id uuid.UUID) ([]PlayerName, error) {
+	opts := badger.DefaultIteratorOptions
+	opts.Prefix = append([]byte(PLAYER_NAME_PREFIX), id[:]...)
+	it := txn.NewIterator(opts)
+	defer it.Close()
+
+	var names []PlayerName
+	for it.Rewind(); it.Valid(); it.Next() {
+		var name PlayerName
+		if err := it.Item().Value(func(val []byte) error { return cbor.Unmarshal(val, &name) }); err != nil {
+			return nil, err
+		}
+		names = append(names, name)
+	}
+	sort.Slice(names, func(i, j int) bool { return names[i].FirstSeen.Before(names[j].FirstSeen) })
+	return names, nil
+}
+
+// ResolvePlayerName finds every UUID that has been seen using a name, case-insensitively
+func ResolvePlayerName(txn *badger.Txn, name string) ([]uuid.UUID, error) {
+	prefix := append([]byte(NAME_LOOKUP_PREFIX), strings.ToLower(name)...)
+	prefix = append(prefix, 0)
+	opts := badger.DefaultIteratorOptions
+	opts.PrefetchValues = false
+	opts.Prefix = prefix
+	it := txn.NewIterator(opts)
+	defer it.Close()
+
+	var ids []uuid.UUID
+	for it.Rewind(); it.Valid(); it.Next() {
+		key := it.Item().Key()
+		if len(key) != len(prefix)+16 {
+			continue
+		}
+		var id uuid.UUID
+		copy(id[:], key[len(prefix):])
+		ids = append(ids, id)
+	}
+	return ids, nil
+}
+
+// PlayerSummary is a player's sightings on one server folded together
+type PlayerSummary struct {
+	UUID      uuid.UUID `json:"uuid"`
+	Name      string    `json:"name"` // most recently seen name
+	Server    string    `json:"server"`
+	FirstSeen time.Time `json:"firstSeen"`
+	LastSeen  time.Time `json:"lastSeen"`
+	Sightings int       `json:"sightings"`
+}
+
+// SummarizeSightings folds sightings into one summary per player and server, most recent first
+func SummarizeSightings(sightings []Sighting) []PlayerSummary {
+	byKey := make(map[string]*PlayerSummary)
+	var summaries []*PlayerSummary
+	for _, s := range sightings {
+		key := s.UUID.String() + " " + s.Addr()
+		summary, ok := byKey[key]
+		if !ok {
+			summary = &PlayerSummary{UUID: s.UUID, Name: s.Name, Server: s.Addr(), FirstSeen: s.Time, LastSeen: s.Time}
+			byKey[key] = summary
+			summaries = append(summaries, summary)
+		}
+		summary.Sightings++
+		if s.Time.Before(summary.FirstSeen) {
+			summary.FirstSeen = s.Time
+		}
+		if !s.Time.Before(summary.LastSeen) {
+			summary.LastSeen = s.Time
+			summary.Name = s.Name
+		}
+	}
+	sort.SliceStable(summaries, func(i, j int) bool { return summaries[i].LastSeen.After(summaries[j].LastSeen) })
+	out := make([]PlayerSummary, len(summaries))
+	for i, s := range summaries {
+		out[i] = *s
+	}
+	return out
+}
+
+// RebuildSightings drops every sighting and name and recreates them from the stored samples
+func RebuildSightings(db *badger.DB) (int, error) {
+	for _, prefix := range []string{SIGHTING_PREFIX, SERVER_PLAYERS_PREFIX, PLAYER_NAME_PREFIX, NAME_LOOKUP_PREFIX} {
+		if err := db.DropPrefix([]byte(prefix)); err != nil {
+			return 0, err
+		}
+	}
+
+	names := make(map[[2]string]PlayerName)
+	wb := db.NewWriteBatch()
+	defer wb.Cancel()
+	sightings := 0
+	all := NewRecordFilter()
+	err := ScanRecords(db, &all, false, func(r *ServerRecord) error {
+		for _, s := range RecordSightings(r) {
+			if err := wb.SetEntry(observationEntry(sightingKey(s), []byte(s.Name), s.Time, 0)); err != nil {
+				return err
+			}
+			if err := wb.SetEntry(observationEntry(serverPlayersKey(s), []byte(s.Name), s.Time, 0)); err != nil {
+				return err
+			}
+			// names are folded in memory, a write batch can't read back what it wrote
+			key := [2]string{string(s.UUID[:]), s.Name}
+			name, ok := names[key]
+			if !ok {
+				name = PlayerName{Name: s.Name, FirstSeen: s.Time, LastSeen: s.Time}
+			}
+			if s.Time.Before(name.FirstSeen) {
+				name.FirstSeen = s.Time
+			}
+			if s.Time.After(name.LastSeen) {
+				name.LastSeen = s.Time
+			}
+			names[key] = name
+			sightings++
+		}
+		return nil
+	})
+	if err != nil {
+		return sightings, err
+	}
+	for key, name := range names {
+		id := uuid.UUID([]byte(key[0]))
+		val, err := recordEncMode.Marshal(name)
+		if err != nil {
+			return sightings, err
+		}
+		if err := wb.Set(playerNameKey(id, name.Name), val); err != nil {
+			return sightings, err
+		}
+		if err := wb.Set(nameLookupKey(name.Name, id), nil); err != nil {
+			return sightings, err
+		}
+	}
+	return sightings, wb.Flush()
+}
+
+type PruneReport struct {
+	Sightings int
+	Names     int
+	Scrubbed  int
+}
+
+// PrunePlayers forgets sightings and names last seen before cutoff.
+// With scrub set the samples are also stripped from observations made before cutoff,
+// otherwise the stored records would still say who was online.
+func PrunePlayers(db *badger.DB, cutoff time.Time, scrub bool) (PruneReport, error) {
+	var report PruneReport
+	// sightings are only ever added, never updated, so they can go in a write batch
+	wb := db.NewWriteBatch()
+	defer wb.Cancel()
+
+	err := db.View(func(txn *badger.Txn) error {
+		// the keys have everything needed
+		opts := badger.DefaultIteratorOptions
+		opts.PrefetchValues = false
+		opts.Prefix = []byte(SIGHTING_PREFIX)
+		it := txn.NewIterator(opts)
+		defer it.Close()
+		for it.Rewind(); it.Valid(); it.Next() {
+			s, ok := parseSightingKey(it.Item().Key(), nil)
+			if !ok || !s.Time.Before(cutoff) {
+				continue
+			}
+			if err := wb.Delete(it.Item().KeyCopy(nil)); err != nil {
+				return err
+			}
+			if err := wb.Delete(serverPlayersKey(s)); err != nil {
+				return err
+			}
+			report.Sightings++
+		}
+		return nil
+	})
+	if err != nil {
+		return report, err
+	}
+	if err := wb.Flush(); err != nil {
+		return report, err
+	}
+
+	stale, err := staleNames(db, cutoff)
+	if err != nil {
+		return report, err
+	}
+	for len(stale) > 0 {
+		batch := stale[:min(len(stale), PLAYER_PRUNE_BATCH)]
+		stale = stale[len(batch):]
+		pruned, err := pruneNames(db, batch, cutoff)
+		report.Names += pruned
+		if err != nil {
+			return report, err
+		}
+	}
+
+	if !scrub {
+		return report, nil
+	}
+
+	// the player name and UUID index entries go with the sample
+	report.Scrubbed, _, err = RewriteHistory(db, func(r *ServerRecord) (RewriteAction, error) {
+		if !r.ObservedAt.Before(cutoff) || r.Players == nil || r.Players.Sample == nil {
+			return REWRITE_KEEP, nil
+		}
+		r.Players.Sample = nil
+		return REWRITE_UPDATE, nil
+	})
+	return report, err
+}
+
+// staleNames lists the name keys of players last seen before cutoff
+func staleNames(db *badger.DB, cutoff time.Time) ([][]byte, error) {
+	var keys [][]byte
+	err := db.View(func(txn *badger.Txn) error {
+		opts := badger.DefaultIteratorOptions
+		opts.Prefix = []byte(PLAYER_NAME_PREFIX)
+		names := txn.NewIterator(opts)
+		defer names.Close()
+		for names.Rewind(); names.Valid(); names.Next() {
+			var name PlayerName
+			if err := names.Item().Value(func(val []byte) error { return cbor.Unmarshal(val, &name) }); err != nil {
+				return err
+			}
+			if name.LastSeen.Before(cutoff) {
+				keys = append(keys, names.Item().KeyCopy(nil))
+			}
+		}
+		return nil
+	})
+	return keys, err
+}
+
+// pruneNames deletes the names in keys that still weren't seen since cutoff. Each
+// one is read again in the transaction deleting it, so a player the writer saw in
+// the meantime is kept, and a conflict with the writer is retried.
+func pruneNames(db *badger.DB, keys [][]byte, cutoff time.Time) (int, error) {
+	var pruned int
+	var err error
+	for attempt := 0; attempt <= MAX_WRITE_RETRIES; attempt++ {
+		err = db.Update(func(txn *badger.Txn) error {
+			pruned = 0
+			for _, key := range keys {
+				item, err := txn.Get(key)
+				if errors.Is(err, badger.ErrKeyNotFound) {
+					continue
+				}
+				if err != nil {
+					return err
+				}
+				var name PlayerName
+				if err := item.Value(func(val []byte) error { return cbor.Unmarshal(val, &name) }); err != nil {
+					return err
+				}
+				if !name.LastSeen.Before(cutoff) {
+					continue
+				}
+				id := uuid.UUID(key[len(PLAYER_NAME_PREFIX) : len(PLAYER_NAME_PREFIX)+16])
+				if err := txn.Delete(key); err != nil {
+					return err
+				}
+				if err := txn.Delete(nameLookupKey(name.Name, id)); err != nil {
+					return err
+				}
+				pruned++
+			}
+			return nil
+		})
+		if !errors.Is(err, badger.ErrConflict) {
+			break
+		}
+	}
+	return pruned, err
+}
+
+// prunePlayersPeriodically enforces -player-retention while the scanner runs. It only
+// goes through the sighting and name keys, scrubbing samples rewrites every observation
+// so that's left to players prune -scrub-samples.
+func prunePlayersPeriodically(ctx context.Context, db *badger.DB, retention time.Duration) {
+	ticker := time.NewTicker(PLAYER_PRUNE_INTERVAL)
+	defer ticker.Stop()
+	for {
+		report, err := PrunePlayers(db, time.Now().Add(-retention), false)
+		if err != nil {
+			slog.Error("Failed to prune player sightings", "error", err)
+		} else {
+			slog.Info("Pruned player sightings", "sightings", report.Sightings, "names", report.Names, "scrubbed", report.Scrubbed)
+		}
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// parseServerArg accepts ip or ip:port, the port defaulting to DEFAULT_PORT
+func parseServerArg(s string) (net.IP, uint16, error) {
+	host, portStr, err := net.SplitHostPort(s)
+	if err != nil {
+		host, portStr = s, strconv.Itoa(DEFAULT_PORT)
+	}
+	ip := net.ParseIP(host).To4()
+	if ip == nil {
+		return nil, 0, fmt.Errorf("%q is not an IPv4 address", host)
+	}
+	port, err := strconv.ParseUint(portStr, 10, 16)
+	if err != nil {
+		return nil, 0, fmt.Errorf("invalid port %q", portStr)
+	}
+	return ip, uint16(port), nil
+}
+
+func runPlayers(args []string) {
+	if len(args) > 0 && (args[0] == "prune" || args[0] == "rebuild") {
+		runPlayersMaintenance(args)
+		return
+	}
+
+	fs := flag.NewFlagSet("players", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s players -uuid UUID | -name NAME | -server IP[:PORT] [flags]\n", os.Args[0])
+		fmt.Fprintf(fs.Output(), "       %s players prune -older-than AGE [-scrub-samples]\n", os.Args[0])
+		fmt.Fprintf(fs.Output(), "       %s players rebuild\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	dir := fs.String("db", BADGER_DIR, "badger directory to read")
+	idArg := fs.String("uuid", "", "where has the player with this UUID been seen")
+	nameArg := fs.String("name", "", "where has anyone using this name been seen, case-insensitive")
+	serverArg := fs.String("server", "", "which players have been seen on this server")
+	sinceArg := fs.String("since", "", "only sightings after this time, or this long ago (e.g. 7d)")
+	untilArg := fs.String("until", "", "only sightings before this time, or this long ago")
+	all := fs.Bool("all", false, "list every sighting instead of one line per player and server")
+	format := fs.String("format", "table", "table or json")
+	fs.Parse(args)
+
+	set := 0
+	for _, arg := range []string{*idArg, *nameArg, *serverArg} {
+		if arg != "" {
+			set++
+		}
+	}
+	if set != 1 {
+		fs.Usage()
+		os.Exit(2)
+	}
+	since, err := ParseTimeArg(*sinceArg)
+	if err != nil {
+		log.Fatal(err)
+	}
+	until, err := ParseTimeArg(*untilArg)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	db := openReadOnly(*dir)
+	defer db.Close()
+
+	var sightings []Sighting
+	var names map[uuid.UUID][]PlayerName
+	collect := func(s Sighting) error {
+		sightings = append(sightings, s)
+		return nil
+	}
+	err = db.View(func(txn *badger.Txn) error {
+		if *serverArg != "" {
+			ip, port, err := parseServerArg(*serverArg)
+			if err != nil {
+				return err
+			}
+			return ServerPlayers(txn, ip, port, since, until, collect)
+		}
+
+		var ids []uuid.UUID
+		if *idArg != "" {
+			id, err := uuid.Parse(*idArg)
+			if err != nil {
+				return err
+			}
+			ids = []uuid.UUID{id}
+		} else {
+			var err error
+			if ids, err = ResolvePlayerName(txn, *nameArg); err != nil {
+				return err
+			}
+		}
+		names = make(map[uuid.UUID][]PlayerName)
+		for _, id := range ids {
+			history, err := PlayerNames(txn, id)
+			if err != nil {
+				return err
+			}
+			names[id] = history
+			if err := PlayerSightings(txn, id, since, until, collect); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if *format == "json" {
+		out := map[string]any{}
+		if names != nil {
+			byID := make(map[string][]PlayerName, len(names))
+			for id, history := range names {
+				byID[id.String()] = history
+			}
+			out["names"] = byID
+		}
+		if *all {
+			out["sightings"] = sightings
+		} else {
+			out["players"] = SummarizeSightings(sightings)
+		}
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(out); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	defer tw.Flush()
+	for id, history := range names {
+		fmt.Fprintf(tw, "%s is known as:\n", id)
+		for _, name := range history {
+			fmt.Fprintf(tw, "  %s\t%s\t%s\n", name.Name, name.FirstSeen.Format(time.DateTime), name.LastSeen.Format(time.DateTime))
+		}
+	}
+	if *all {
+		fmt.Fprintln(tw, "SEEN\tSERVER\tUUID\tNAME")
+		for _, s := range sightings {
+			fmt.Fprintf(tw, "%s\t%s\t%s\t%s\n", s.Time.Format(time.DateTime), s.Addr(), s.UUID, s.Name)
+		}
+		return
+	}
+	fmt.Fprintln(tw, "SERVER\tUUID\tNAME\tFIRST SEEN\tLAST SEEN\tSIGHTINGS")
+	for _, s := range SummarizeSightings(sightings) {
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%d\n", s.Server, s.UUID, s.Name, s.FirstSeen.Format(time.DateTime), s.LastSeen.Format(time.DateTime), s.Sightings)
+	}
+}
+
+func runPlayersMaintenance(args []string) {
+	fs := flag.NewFlagSet("players "+args[0], flag.ExitOnError)
+	dir := fs.String("db", BADGER_DIR, "badger directory")
+	olderThan := fs.String("older-than", "", "forget sightings older than this, e.g. 90d")
+	scrub := fs.Bool("scrub-samples", false, "also strip the player sample from observations older than -older-than")
+	fs.Parse(args[1:])
+
+	db, err := badger.Open(badger.DefaultOptions(*dir))
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer db.Close()
+
+	if args[0] == "rebuild" {
+		sightings, err := RebuildSightings(db)
+		if err != nil {
+			log.Fatal(err)
+		}
+		slog.Info("Rebuilt player sightings", "sightings", sightings)
+		return
+	}
+
+	age, err := ParseAge(*olderThan)
+	if err != nil || age <= 0 {
+		log.Fatal("players prune needs a positive -older-than")
+	}
+	report, err := PrunePlayers(db, time.Now().Add(-age), *scrub)
+	if err != nil {
+		log.Fatal(err)
+	}
+	slog.Info("Pruned player sightings", "sightings", report.Sightings, "names", report.Names, "scrubbed", report.Scrubbed)
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+var jebID = uuid.MustParse("853c80ef-3c37-49fd-aa49-938b674adae6")
+
+// playersRecord is a server with Notch online, and jeb_ too when jeb is set
+func playersRecord(at time.Time, jeb bool) *ServerRecord {
+	r := fullRecord()
+	r.IsFakeSample = false
+	r.ObservedAt = at
+	if jeb {
+		name := "jeb_"
+		*r.Players.Sample = append(*r.Players.Sample, SamplePlayer{Name: &name, ID: &jebID})
+	}
+	return r
+}
+
+func resolves(t *testing.T, store *BadgerStorage, name string) bool {
+	t.Helper()
+	ids, err := store.ResolvePlayerName(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return len(ids) > 0
+}
+
+func TestPrunePlayers(t *testing.T) {
+	store := openTestBadger(t)
+	old := time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+	cutoff := old.AddDate(0, 1, 0)
+	if err := store.PutObservations([]*ServerRecord{playersRecord(old, true), playersRecord(cutoff.Add(time.Hour), false)}); err != nil {
+		t.Fatal(err)
+	}
+
+	report, err := PrunePlayers(store.DB, cutoff, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Sightings != 2 || report.Names != 1 {
+		t.Errorf("report %+v, want 2 sightings and 1 name", report)
+	}
+	if resolves(t, store, "jeb_") || !resolves(t, store, "Notch") {
+		t.Error("pruned the wrong names")
+	}
+	notch := *(*fullRecord().Players.Sample)[0].ID
+	sightings := collectSightings(t, func(fn func(Sighting) error) error {
+		return store.PlayerSightings(notch, time.Time{}, time.Time{}, fn)
+	})
+	if len(sightings) != 1 || !sightings[0].Time.After(cutoff) {
+		t.Errorf("sightings left %+v", sightings)
+	}
+}
+
+func TestPruneKeepsPlayersSeenMeanwhile(t *testing.T) {
+	store := openTestBadger(t)
+	old := time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+	cutoff := old.AddDate(0, 1, 0)
+	if err := store.PutObservations([]*ServerRecord{playersRecord(old, true)}); err != nil {
+		t.Fatal(err)
+	}
+	stale, err := staleNames(store.DB, cutoff)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(stale) != 2 {
+		t.Fatalf("%d stale names, want 2", len(stale))
+	}
+
+	// the scanner sees Notch again between picking the names and deleting them
+	if err := store.PutObservations([]*ServerRecord{playersRecord(cutoff.Add(time.Hour), false)}); err != nil {
+		t.Fatal(err)
+	}
+	pruned, err := pruneNames(store.DB, stale, cutoff)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pruned != 1 || resolves(t, store, "jeb_") || !resolves(t, store, "Notch") {
+		t.Errorf("pruned %d names, Notch should have been kept", pruned)
+	}
+}
@@ -7,6 +7,7 @@ import (
 	"time"
 
 	"github.com/google/uuid"
+	"go.opentelemetry.io/otel/trace"
 )
 
 const FAKE_SAMPLE_DESCRIPTION = "To protect the privacy of this server and its\nusers, you must log in once to see ping data."
@@ -63,6 +64,34 @@ type ServerStatus struct {
 	// IsFakeSample should take precedence over IsOnlineMode
 	IsFakeSample bool  `json:"isFakeSample"`
 	IsOnlineMode *bool `json:"isOnlineMode,omitempty"`
+
+	// filled in after discovery
+	Enrichment *Enrichment `json:"enrichment,omitempty"`
+	Hostnames  []Hostname  `json:"hostnames,omitempty"`
+
+	// observation metadata
+	Latency time.Duration `json:"latency,omitempty"`
+	Source  string        `json:"source,omitempty"`
+
+	// the probe's span, so enrichment and the database write join its trace
+	span trace.SpanContext
+}
+
+// UnmarshalJSON exists because Address is an interface, results sent between
+// agents and the coordinator always carry a TCP address
+func (s *ServerStatus) UnmarshalJSON(data []byte) error {
+	type serverStatus ServerStatus
+	aux := struct {
+		*serverStatus
+		Address *net.TCPAddr `json:"addr,omitempty"`
+	}{serverStatus: (*serverStatus)(s)}
+	if err := json.Unmarshal(data, &aux); err != nil {
+		return err
+	}
+	if aux.Address != nil {
+		s.Address = aux.Address
+	}
+	return nil
 }
 
 type VersionInfo struct {
@@ -82,11 +111,23 @@ type SamplePlayer struct {
 }
 
 type ForgeDataInfo struct {
-	int `json:"fmlNetworkVersion"`
+	FMLNetworkVersion int        `json:"fmlNetworkVersion"`
+	Mods              []ForgeMod `json:"mods,omitempty"`
+}
+
+type ForgeMod struct {
+	ID     string `json:"modId"`
+	Marker string `json:"modmarker,omitempty"`
 }
 
 type ModInfo struct {
-	Type string `json:"type"`
+	Type    string         `json:"type"`
+	ModList []ModInfoEntry `json:"modList,omitempty"`
+}
+
+type ModInfoEntry struct {
+	ID      string `json:"modid"`
+	Version string `json:"version,omitempty"`
 }
 
 type ModpackDataInfo struct {
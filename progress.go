@@ -0,0 +1,210 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+const PROGRESS_LOG_INTERVAL = 10 * time.Second
+
+// Error categories counted by ScanProgress
+const (
+	ERROR_TIMEOUT     = "timeout"
+	ERROR_REFUSED     = "refused"
+	ERROR_RESET       = "reset"
+	ERROR_UNREACHABLE = "unreachable"
+	ERROR_CLOSED      = "closed" // the server hung up mid status
+	ERROR_PROTOCOL    = "protocol"
+	ERROR_OTHER       = "other"
+)
+
+var ERROR_CATEGORIES = []string{ERROR_TIMEOUT, ERROR_REFUSED, ERROR_RESET, ERROR_UNREACHABLE, ERROR_CLOSED, ERROR_PROTOCOL, ERROR_OTHER}
+
+// errorCategory sorts a failed probe into one of ERROR_CATEGORIES
+func errorCategory(err error) string {
+	var netErr net.Error
+	switch {
+	case errors.As(err, &netErr) && netErr.Timeout():
+		return ERROR_TIMEOUT
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return ERROR_REFUSED
+	case errors.Is(err, syscall.ECONNRESET), errors.Is(err, syscall.EPIPE):
+		return ERROR_RESET
+	case errors.Is(err, syscall.EHOSTUNREACH), errors.Is(err, syscall.ENETUNREACH):
+		return ERROR_UNREACHABLE
+	case errors.Is(err, io.EOF), errors.Is(err, io.ErrUnexpectedEOF), errors.Is(err, net.ErrClosed):
+		return ERROR_CLOSED
+	case strings.HasPrefix(err.Error(), "dial tcp"), strings.HasPrefix(err.Error(), "read tcp"):
+		return ERROR_OTHER
+	default:
+		// everything that isn't the network is the server sending something we can't read
+		return ERROR_PROTOCOL
+	}
+}
+
+// ScanProgress counts what the generator and the workers get through, and lets the
+// generator be paused. Every method works on a nil ScanProgress, which counts nothing.
+type ScanProgress struct {
+	start time.Time
+	sent  atomic.Uint64
+	total atomic.Uint64 // targets the generator will send, 0 when it doesn't know
+
+	mu     sync.Mutex
+	errors map[string]uint64
+	resume chan struct{} // closed when the scan is unpaused, nil while running
+}
+
+type ProgressStats struct {
+	Elapsed time.Duration
+	Sent    uint64
+	Total   uint64
+	Paused  bool
+	Errors  map[string]uint64
+}
+
+func NewScanProgress() *ScanProgress {
+	return &ScanProgress{start: time.Now(), errors: make(map[string]uint64)}
+}
+
+// rangeSize is how many addresses ranges cover
+func rangeSize(ranges []IPRange) uint64 {
+	var total uint64
+	for _, r := range ranges {
+		start, _ := ipv4ToUint32(r.start)
+		end, _ := ipv4ToUint32(r.end)
+		total += uint64(end-start) + 1
+	}
+	return total
+}
+
+func (p *ScanProgress) SetTotal(total uint64) {
+	if p != nil {
+		p.total.Store(total)
+	}
+}
+
+func (p *ScanProgress) CountSent() {
+	if p != nil {
+		p.sent.Add(1)
+	}
+}
+
+func (p *ScanProgress) CountError(err error) {
+	if p == nil {
+		return
+	}
+	category := errorCategory(err)
+	p.mu.Lock()
+	p.errors[category]++
+	p.mu.Unlock()
+}
+
+// Pause stops the generator handing out targets, probes already running finish
+func (p *ScanProgress) Pause() {
+	if p == nil {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.resume == nil {
+		p.resume = make(chan struct{})
+	}
+}
+
+func (p *ScanProgress) Resume() {
+	if p == nil {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.resume != nil {
+		close(p.resume)
+		p.resume = nil
+	}
+}
+
+func (p *ScanProgress) Paused() bool {
+	if p == nil {
+		return false
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.resume != nil
+}
+
+// wait blocks while the scan is paused, it returns false if done closes first
+func (p *ScanProgress) wait(done <-chan struct{}) bool {
+	if p == nil {
+		return true
+	}
+	p.mu.Lock()
+	resume := p.resume
+	p.mu.Unlock()
+	if resume == nil {
+		return true
+	}
+	select {
+	case <-resume:
+		return true
+	case <-done:
+		return false
+	}
+}
+
+func (p *ScanProgress) Stats() ProgressStats {
+	if p == nil {
+		return ProgressStats{Errors: map[string]uint64{}}
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	stats := ProgressStats{
+		Elapsed: time.Since(p.start),
+		Sent:    p.sent.Load(),
+		Total:   p.total.Load(),
+		Paused:  p.resume != nil,
+		Errors:  make(map[string]uint64, len(p.errors)),
+	}
+	for category, n := range p.errors {
+		stats.Errors[category] = n
+	}
+	return stats
+}
+
+// ETA extrapolates from rate targets per second, 0 when there's nothing to go on
+func (s ProgressStats) ETA(rate float64) time.Duration {
+	if s.Total == 0 || rate <= 0 || s.Sent >= s.Total {
+		return 0
+	}
+	return time.Duration(float64(s.Total-s.Sent) / rate * float64(time.Second)).Round(time.Second)
+}
+
+// LogProgress periodically logs how far the generator got
+func LogProgress(ctx context.Context, p *ScanProgress) {
+	ticker := time.NewTicker(PROGRESS_LOG_INTERVAL)
+	defer ticker.Stop()
+	var previous uint64
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			stats := p.Stats()
+			rate := float64(stats.Sent-previous) / PROGRESS_LOG_INTERVAL.Seconds()
+			slog.Info("Progress",
+				"sent", stats.Sent,
+				"total", stats.Total,
+				"sendRate", rate,
+				"eta", stats.ETA(rate),
+				"paused", stats.Paused)
+			previous = stats.Sent
+		}
+	}
+}
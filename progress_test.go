@@ -0,0 +1,24 @@
+package main
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestNilScanProgress(t *testing.T) {
+	var p *ScanProgress
+	p.SetTotal(10)
+	p.CountSent()
+	p.CountError(errors.New("nope"))
+	p.Pause()
+	p.Resume()
+	if p.Paused() {
+		t.Error("a nil ScanProgress is paused")
+	}
+	if !p.wait(nil) {
+		t.Error("a nil ScanProgress waited")
+	}
+	if stats := p.Stats(); stats.Sent != 0 || stats.Errors == nil {
+		t.Errorf("unexpected stats %+v", stats)
+	}
+}
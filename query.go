@@ -0,0 +1,574 @@
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	badger "github.com/dgraph-io/badger/v4"
+)
+
+const MOTD_TABLE_WIDTH = 60
+
+// errStopScan ends ScanRecords early without it reporting an error
+var errStopScan = errors.New("stop scan")
+
+// OptionalBool is a flag that is either unset, true or false
+type OptionalBool struct {
+	IsSet bool
+	Value bool
+}
+
+func (b *OptionalBool) String() string {
+	if b == nil || !b.IsSet {
+		return "any"
+	}
+	return strconv.FormatBool(b.Value)
+}
+
+func (b *OptionalBool) Set(s string) error {
+	if s == "any" || s == "" {
+		*b = OptionalBool{}
+		return nil
+	}
+	v, err := strconv.ParseBool(s)
+	if err != nil {
+		return err
+	}
+	*b = OptionalBool{IsSet: true, Value: v}
+	return nil
+}
+
+func (b *OptionalBool) matches(v bool) bool {
+	return !b.IsSet || b.Value == v
+}
+
+// RecordFilter selects observations, zero values match everything
+type RecordFilter struct {
+	Network *net.IPNet
+	Since   time.Time
+	Until   time.Time
+	After   *net.TCPAddr // only servers after this one in serverOrder, for paging
+
+	Version       string // substring, or a glob when it contains *
+	Protocol      int    // -1 for any
+	MinOnline     int    // -1 for any
+	MaxOnline     int    // -1 for any
+	MinMaxPlayers int    // -1 for any
+	OnlineMode    OptionalBool
+	FakeSample    OptionalBool
+	Modded        OptionalBool
+	MOTD          string // case insensitive substring
+	MOTDRegex     *regexp.Regexp
+}
+
+func NewRecordFilter() RecordFilter {
+	return RecordFilter{Protocol: -1, MinOnline: -1, MaxOnline: -1, MinMaxPlayers: -1}
+}
+
+// serverOrder is how servers are listed, the order badger keys sort in
+func serverOrder(ip net.IP, port uint16) uint64 {
+	// only IPv4 servers are stored, anything else sorts first
+	n, _ := ipv4ToUint32(ip)
+	return uint64(n)<<16 | uint64(port)
+}
+
+// pastCursor checks a server comes after f.After
+func (f *RecordFilter) pastCursor(ip net.IP, port uint16) bool {
+	return f.After == nil || serverOrder(ip, port) > serverOrder(f.After.IP, uint16(f.After.Port))
+}
+
+// inWindow checks the parts of the filter that apply before picking the latest observation
+func (f *RecordFilter) inWindow(t time.Time) bool {
+	if !f.Since.IsZero() && t.Before(f.Since) {
+		return false
+	}
+	if !f.Until.IsZero() && t.After(f.Until) {
+		return false
+	}
+	return true
+}
+
+func (f *RecordFilter) Match(r *ServerRecord) bool {
+	if f.Network != nil && !f.Network.Contains(r.IP) {
+		return false
+	}
+	if !f.pastCursor(r.IP, r.Port) {
+		return false
+	}
+	if !f.inWindow(r.ObservedAt) {
+		return false
+	}
+	if f.Version != "" && !matchVersion(f.Version, r.Version.Name) {
+		return false
+	}
+	if f.Protocol >= 0 && r.Version.Protocol != f.Protocol {
+		return false
+	}
+	online, max := -1, -1
+	if r.Players != nil {
+		online, max = r.Players.Online, r.Players.Max
+	}
+	if f.MinOnline >= 0 && online < f.MinOnline {
+		return false
+	}
+	if f.MaxOnline >= 0 && (online < 0 || online > f.MaxOnline) {
+		return false
+	}
+	if f.MinMaxPlayers >= 0 && max < f.MinMaxPlayers {
+		return false
+	}
+	if f.OnlineMode.IsSet && (r.IsOnlineMode == nil || *r.IsOnlineMode != f.OnlineMode.Value) {
+		return false
+	}
+	if !f.FakeSample.matches(r.IsFakeSample) || !f.Modded.matches(r.Modded()) {
+		return false
+	}
+	if f.MOTD != "" && !strings.Contains(strings.ToLower(r.Description), strings.ToLower(f.MOTD)) {
+		return false
+	}
+	if f.MOTDRegex != nil && !f.MOTDRegex.MatchString(r.Description) {
+		return false
+	}
+	return true
+}
+
+// matchVersion checks a version name against a substring, or a glob when the pattern has a *
+func matchVersion(pattern, name string) bool {
+	name, pattern = strings.ToLower(name), strings.ToLower(pattern)
+	if strings.Contains(pattern, "*") {
+		ok, _ := path.Match(pattern, name)
+		return ok
+	}
+	return strings.Contains(name, pattern)
+}
+
+// Modded reports whether the server advertises any kind of mod loader
+func (r *ServerRecord) Modded() bool {
+	return (r.IsModded != nil && *r.IsModded) || r.ForgeData != nil || r.ModInfo != nil || r.ModpackData != nil
+}
+
+// ModIDs lists the mods a server advertises, from whichever format it uses
+func (r *ServerRecord) ModIDs() []string {
+	var ids []string
+	if r.ForgeData != nil {
+		for _, mod := range r.ForgeData.Mods {
+			ids = append(ids, mod.ID)
+		}
+	}
+	if r.ModInfo != nil {
+		for _, mod := range r.ModInfo.ModList {
+			ids = append(ids, mod.ID)
+		}
+	}
+	return ids
+}
+
+func (r *ServerRecord) SampleNames() []string {
+	if r.Players == nil || r.Players.Sample == nil {
+		return nil
+	}
+	var names []string
+	for _, player := range *r.Players.Sample {
+		if player.Name != nil {
+			names = append(names, *player.Name)
+		}
+	}
+	return names
+}
+
+// serverRange returns the first key and the last IP to visit for a network
+func serverRange(network *net.IPNet) ([]byte, net.IP) {
+	if network == nil {
+		return []byte(SERVER_PREFIX), nil
+	}
+	start := network.IP.To4().Mask(network.Mask)
+	ones, _ := network.Mask.Size()
+	n, _ := ipv4ToUint32(start)
+	end := uint32ToIP(n | (uint32(0xFFFFFFFF) >> ones))
+	return append([]byte(SERVER_PREFIX), start...), end
+}
+
+// ScanRecords calls fn for every observation matching filter, in key order.
+// With latest set only the newest observation of each server inside the time window is considered.
+func ScanRecords(db *badger.DB, filter *RecordFilter, latest bool, fn func(*ServerRecord) error) error {
+	start, end := serverRange(filter.Network)
+	if filter.After != nil {
+		// past every observation of the cursor's server
+		after := append(ServerKeyPrefix(filter.After.IP, uint16(filter.After.Port)), bytes.Repeat([]byte{0xFF}, 8)...)
+		if bytes.Compare(after, start) > 0 {
+			start = after
+		}
+	}
+	err := db.View(func(txn *badger.Txn) error {
+		opts := badger.DefaultIteratorOptions
+		opts.Prefix = []byte(SERVER_PREFIX)
+		it := txn.NewIterator(opts)
+		defer it.Close()
+
+		replay := &recordReplay{}
+		contiguous := false
+		var pending *ServerRecord
+		var pendingServer []byte
+		flush := func() error {
+			if pending != nil && filter.Match(pending) {
+				if err := fn(pending); err != nil {
+					return err
+				}
+			}
+			pending = nil
+			return nil
+		}
+
+		for it.Seek(start); it.Valid(); it.Next() {
+			item := it.Item()
+			ip, _, observedAt, ok := ParseServerKey(item.Key())
+			if !ok {
+				// legacy keys are left for the migrate command
+				continue
+			}
+			if end != nil && bytes.Compare(ip, end) > 0 {
+				break
+			}
+			if !filter.inWindow(observedAt) {
+				contiguous = false
+				continue
+			}
+			record, err := replay.decode(txn, item, contiguous)
+			if errors.Is(err, errOrphanDelta) {
+				// expiring along with its keyframe
+				contiguous = false
+				continue
+			}
+			if err != nil {
+				return err
+			}
+			contiguous = true
+			if !latest {
+				if filter.Match(record) {
+					if err := fn(record); err != nil {
+						return err
+					}
+				}
+				continue
+			}
+			// keys sort by time within a server, so the last one seen is the newest
+			server := item.Key()[:serverKeyLength-8]
+			if pending != nil && !bytes.Equal(server, pendingServer) {
+				if err := flush(); err != nil {
+					return err
+				}
+			}
+			pending = record
+			pendingServer = append(pendingServer[:0], server...)
+		}
+		return flush()
+	})
+	if errors.Is(err, errStopScan) {
+		return nil
+	}
+	return err
+}
+
+// RecordWriter renders records in one of the output formats
+type RecordWriter interface {
+	Write(*ServerRecord) error
+	Flush() error
+}
+
+func NewRecordWriter(format string, w io.Writer) (RecordWriter, error) {
+	switch format {
+	case "table":
+		return newTableWriter(w), nil
+	case "json", "jsonl":
+		return &jsonLinesWriter{enc: json.NewEncoder(w)}, nil
+	case "csv":
+		return newCSVWriter(w), nil
+	default:
+		return nil, fmt.Errorf("unknown format %q", format)
+	}
+}
+
+type jsonLinesWriter struct {
+	enc *json.Encoder
+}
+
+func (w *jsonLinesWriter) Write(r *ServerRecord) error { return w.enc.Encode(r) }
+func (w *jsonLinesWriter) Flush() error                { return nil }
+
+var legacyFormatting = regexp.MustCompile("§.")
+
+// PlainMOTD strips legacy formatting codes and collapses the MOTD onto one line
+func PlainMOTD(motd string) string {
+	return strings.Join(strings.Fields(legacyFormatting.ReplaceAllString(motd, "")), " ")
+}
+
+type tableWriter struct {
+	tw *tabwriter.Writer
+}
+
+func newTableWriter(w io.Writer) *tableWriter {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "ADDRESS\tSEEN\tVERSION\tPLAYERS\tMODE\tMOTD")
+	return &tableWriter{tw: tw}
+}
+
+func (w *tableWriter) Write(r *ServerRecord) error {
+	players := "-"
+	if r.Players != nil {
+		players = fmt.Sprintf("%d/%d", r.Players.Online, r.Players.Max)
+	}
+	mode := "?"
+	switch {
+	case r.IsFakeSample:
+		mode = "fake"
+	case r.IsOnlineMode != nil && *r.IsOnlineMode:
+		mode = "online"
+	case r.IsOnlineMode != nil:
+		mode = "offline"
+	}
+	if r.Modded() {
+		mode += "+mods"
+	}
+	motd := []rune(PlainMOTD(r.Description))
+	if len(motd) > MOTD_TABLE_WIDTH {
+		motd = append(motd[:MOTD_TABLE_WIDTH-1], '…')
+	}
+	_, err := fmt.Fprintf(w.tw, "%s\t%s\t%s\t%s\t%s\t%s\n",
+		r.Addr(), r.ObservedAt.Format(time.DateTime), r.Version.Name, players, mode, string(motd))
+	return err
+}
+
+func (w *tableWriter) Flush() error { return w.tw.Flush() }
+
+var RECORD_CSV_HEADER = []string{
+	"ip", "port", "observed_at", "source", "latency_ms",
+	"version_name", "protocol", "players_online", "players_max", "sample_names",
+	"description", "has_favicon", "enforces_secure_chat", "prevents_chat_reports",
+	"online_mode", "fake_sample", "modded", "mods", "modpack",
+	"asn", "as_name", "prefix", "country", "hostnames",
+}
+
+func formatOptionalBool(b *bool) string {
+	if b == nil {
+		return ""
+	}
+	return strconv.FormatBool(*b)
+}
+
+// RecordCSVRow flattens a record into the RECORD_CSV_HEADER columns
+func RecordCSVRow(r *ServerRecord) []string {
+	var online, max string
+	if r.Players != nil {
+		online, max = strconv.Itoa(r.Players.Online), strconv.Itoa(r.Players.Max)
+	}
+	var modpack string
+	if r.ModpackData != nil {
+		modpack = r.ModpackData.Name
+	}
+	var asn, asName, prefix, country string
+	if r.Enrichment != nil {
+		if r.Enrichment.ASN != 0 {
+			asn = strconv.FormatUint(uint64(r.Enrichment.ASN), 10)
+		}
+		asName, prefix, country = r.Enrichment.ASName, r.Enrichment.Prefix, r.Enrichment.Country
+	}
+	var hostnames []string
+	for _, h := range r.Hostnames {
+		hostnames = append(hostnames, h.Name)
+	}
+	return []string{
+		r.IP.String(), strconv.Itoa(int(r.Port)), r.ObservedAt.UTC().Format(time.RFC3339), r.Source, strconv.FormatInt(r.Latency.Milliseconds(), 10),
+		r.Version.Name, strconv.Itoa(r.Version.Protocol), online, max, strings.Join(r.SampleNames(), ";"),
+		r.Description, strconv.FormatBool(r.Favicon != nil), formatOptionalBool(r.EnforcesSecureChat), formatOptionalBool(r.PreventsChatReports),
+		formatOptionalBool(r.IsOnlineMode), strconv.FormatBool(r.IsFakeSample), strconv.FormatBool(r.Modded()), strings.Join(r.ModIDs(), ";"), modpack,
+		asn, asName, prefix, country, strings.Join(hostnames, ";"),
+	}
+}
+
+type csvWriter struct {
+	w *csv.Writer
+}
+
+func newCSVWriter(w io.Writer) *csvWriter {
+	cw := csv.NewWriter(w)
+	cw.Write(RECORD_CSV_HEADER)
+	return &csvWriter{w: cw}
+}
+
+func (w *csvWriter) Write(r *ServerRecord) error { return w.w.Write(RecordCSVRow(r)) }
+
+func (w *csvWriter) Flush() error {
+	w.w.Flush()
+	return w.w.Error()
+}
+
+// ParseAge is time.ParseDuration plus d and w suffixes for days and weeks
+func ParseAge(s string) (time.Duration, error) {
+	for suffix, unit := range map[string]time.Duration{"d": 24 * time.Hour, "w": 7 * 24 * time.Hour} {
+		if n, ok := strings.CutSuffix(s, suffix); ok {
+			count, err := strconv.ParseFloat(n, 64)
+			if err != nil {
+				return 0, fmt.Errorf("invalid duration %q", s)
+			}
+			return time.Duration(count * float64(unit)), nil
+		}
+	}
+	return time.ParseDuration(s)
+}
+
+// ParseTimeArg accepts RFC 3339 times, dates, or durations meaning that long ago
+func ParseTimeArg(s string) (time.Time, error) {
+	if s == "" {
+		return time.Time{}, nil
+	}
+	if d, err := ParseAge(s); err == nil {
+		return time.Now().Add(-d), nil
+	}
+	for _, layout := range []string{time.RFC3339, time.DateTime, time.DateOnly} {
+		if t, err := time.ParseInLocation(layout, s, time.Local); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("can't parse time %q", s)
+}
+
+// ParseNetwork accepts a CIDR or a single address
+func ParseNetwork(s string) (*net.IPNet, error) {
+	if !strings.Contains(s, "/") {
+		s += "/32"
+	}
+	_, network, err := net.ParseCIDR(s)
+	if err != nil {
+		return nil, err
+	}
+	if network.IP.To4() == nil {
+		return nil, fmt.Errorf("%s is not an IPv4 network", s)
+	}
+	return network, nil
+}
+
+// addFilterFlags registers the record filter flags shared by the read-only commands
+func addFilterFlags(fs *flag.FlagSet, filter *RecordFilter) func() error {
+	network := fs.String("ip", "", "only servers in this IP or CIDR")
+	since := fs.String("since", "", "only observations after this time, or this long ago (e.g. 24h)")
+	until := fs.String("until", "", "only observations before this time, or this long ago")
+	motdRegex := fs.String("motd-regex", "", "only servers whose MOTD matches this regular expression")
+	fs.StringVar(&filter.Version, "version", "", "version name substring, or glob with *")
+	fs.IntVar(&filter.Protocol, "protocol", -1, "protocol version number")
+	fs.IntVar(&filter.MinOnline, "min-online", -1, "minimum players online")
+	fs.IntVar(&filter.MaxOnline, "max-online", -1, "maximum players online")
+	fs.IntVar(&filter.MinMaxPlayers, "min-max-players", -1, "minimum player slots")
+	fs.Var(&filter.OnlineMode, "online-mode", "true, false or any")
+	fs.Var(&filter.FakeSample, "fake", "whether the player sample is fake: true, false or any")
+	fs.Var(&filter.Modded, "modded", "true, false or any")
+	fs.StringVar(&filter.MOTD, "motd", "", "MOTD substring, case insensitive")
+
+	// called after fs.Parse to finish the flags that need parsing
+	return func() error {
+		var err error
+		if *network != "" {
+			if filter.Network, err = ParseNetwork(*network); err != nil {
+				return err
+			}
+		}
+		if filter.Since, err = ParseTimeArg(*since); err != nil {
+			return err
+		}
+		if filter.Until, err = ParseTimeArg(*until); err != nil {
+			return err
+		}
+		if *motdRegex != "" {
+			if filter.MOTDRegex, err = regexp.Compile(*motdRegex); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+}
+
+// openStorageReadOnly opens a backend for the commands that only read
+func openStorageReadOnly(kind, location string) Storage {
+	store, err := OpenStorage(kind, location, true)
+	if err != nil {
+		log.Fatal(err)
+	}
+	return store
+}
+
+// openReadOnly opens the database without taking the writer lock
+func openReadOnly(dir string) *badger.DB {
+	opts := badger.DefaultOptions(dir).WithReadOnly(true).WithLogger(nil)
+	db, err := badger.Open(opts)
+	if err != nil {
+		log.Fatalf("opening %s read-only: %v", dir, err)
+	}
+	return db
+}
+
+func runQuery(args []string) {
+	fs := flag.NewFlagSet("query", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s query [flags]\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	storage, location := addStorageFlags(fs)
+	format := fs.String("format", "table", "output format: table, json or csv")
+	history := fs.Bool("history", false, "show every observation instead of the latest per server")
+	limit := fs.Int("limit", 0, "stop after this many rows, 0 for no limit")
+	text := fs.String("q", "", `query, e.g. 'version:1.20.* players>10 motd:"survival games" -fake', on top of the other filters`)
+	explain := fs.Bool("explain", false, "print how -q would be run instead of running it")
+	filter := NewRecordFilter()
+	finishFilter := addFilterFlags(fs, &filter)
+	fs.Parse(args)
+	if err := finishFilter(); err != nil {
+		log.Fatal(err)
+	}
+	query, err := ParseQuery(*text, filter)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if *explain {
+		fmt.Println(query.Plan())
+		return
+	}
+
+	out, err := NewRecordWriter(*format, os.Stdout)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	store := openStorageReadOnly(*storage, *location)
+	defer store.Close()
+
+	rows := 0
+	err = query.Run(store, !*history, func(r *ServerRecord) error {
+		if err := out.Write(r); err != nil {
+			return err
+		}
+		rows++
+		if *limit > 0 && rows >= *limit {
+			return errStopScan
+		}
+		return nil
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+	if err := out.Flush(); err != nil {
+		log.Fatal(err)
+	}
+}
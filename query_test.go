@@ -0,0 +1,163 @@
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"flag"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseAge(t *testing.T) {
+	for s, want := range map[string]time.Duration{
+		"7d":   7 * 24 * time.Hour,
+		"2w":   14 * 24 * time.Hour,
+		"1.5d": 36 * time.Hour,
+		"90m":  90 * time.Minute,
+	} {
+		if got, err := ParseAge(s); err != nil || got != want {
+			t.Errorf("%q is %v (%v), want %v", s, got, err, want)
+		}
+	}
+	for _, s := range []string{"", "d", "7 days", "1x"} {
+		if _, err := ParseAge(s); err == nil {
+			t.Errorf("%q parsed", s)
+		}
+	}
+}
+
+func TestParseNetwork(t *testing.T) {
+	for s, want := range map[string]string{"192.0.2.10": "192.0.2.10/32", "192.0.2.10/24": "192.0.2.0/24"} {
+		if network, err := ParseNetwork(s); err != nil || network.String() != want {
+			t.Errorf("%q is %v (%v), want %s", s, network, err, want)
+		}
+	}
+	for _, s := range []string{"2001:db8::/32", "192.0.2.0/33", "nowhere"} {
+		if _, err := ParseNetwork(s); err == nil {
+			t.Errorf("%q parsed", s)
+		}
+	}
+}
+
+// filterFromFlags builds a filter the way the query command does
+func filterFromFlags(t *testing.T, args string) RecordFilter {
+	t.Helper()
+	fs := flag.NewFlagSet("query", flag.ContinueOnError)
+	filter := NewRecordFilter()
+	finish := addFilterFlags(fs, &filter)
+	if err := fs.Parse(strings.Fields(args)); err != nil {
+		t.Fatal(err)
+	}
+	if err := finish(); err != nil {
+		t.Fatalf("%s: %v", args, err)
+	}
+	return filter
+}
+
+func TestRecordFilterMatch(t *testing.T) {
+	vanilla := fullRecord()
+	vanilla.ForgeData, vanilla.ModInfo, vanilla.IsModded, vanilla.ModpackData = nil, nil, nil, nil
+	vanilla.Players = nil
+	vanilla.IsOnlineMode, vanilla.IsFakeSample = nil, false
+
+	for _, c := range []struct {
+		args          string
+		full, vanilla bool
+	}{
+		{"", true, true},
+		{"-ip 192.0.2.0/24", true, true},
+		{"-ip 192.0.2.11", false, false},
+		{"-version paper", true, true},
+		{"-version 1.21*", false, false},
+		{"-version paper*1.21.?", true, true},
+		{"-protocol 767", true, true},
+		{"-protocol 47", false, false},
+		// a server that didn't list its players has none to count
+		{"-min-online 1", true, false},
+		{"-max-online 5", true, false},
+		{"-min-max-players 21", false, false},
+		{"-online-mode false", true, false},
+		{"-online-mode any", true, true},
+		{"-fake false", false, true},
+		{"-modded false", false, true},
+		{"-motd MINECRAFT", true, true},
+		{"-motd-regex ^§a", true, true},
+		{"-until 2025-03-14", false, false},
+		{"-since 2025-03-14", true, true},
+	} {
+		filter := filterFromFlags(t, c.args)
+		if got := filter.Match(fullRecord()); got != c.full {
+			t.Errorf("%q matches the full record: %v, want %v", c.args, got, c.full)
+		}
+		if got := filter.Match(vanilla); got != c.vanilla {
+			t.Errorf("%q matches the vanilla record: %v, want %v", c.args, got, c.vanilla)
+		}
+	}
+
+	fs := flag.NewFlagSet("query", flag.ContinueOnError)
+	filter := NewRecordFilter()
+	finish := addFilterFlags(fs, &filter)
+	if err := fs.Parse([]string{"-motd-regex", "("}); err != nil {
+		t.Fatal(err)
+	}
+	if err := finish(); err == nil {
+		t.Error("invalid -motd-regex accepted")
+	}
+}
+
+func TestRecordWriters(t *testing.T) {
+	write := func(format string) string {
+		t.Helper()
+		var buf bytes.Buffer
+		w, err := NewRecordWriter(format, &buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := w.Write(fullRecord()); err != nil {
+			t.Fatal(err)
+		}
+		if err := w.Flush(); err != nil {
+			t.Fatal(err)
+		}
+		return buf.String()
+	}
+
+	table := strings.Split(write("table"), "\n")
+	if len(table) != 3 || strings.Join(strings.Fields(table[1]), " ") != "192.0.2.10:25566 2025-03-14 15:09:26 Paper 1.21.1 1/20 fake+mods A Minecraft Server" {
+		t.Errorf("table:\n%s", strings.Join(table, "\n"))
+	}
+
+	rows, err := csv.NewReader(strings.NewReader(write("csv"))).ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rows) != 2 || len(rows[1]) != len(RECORD_CSV_HEADER) {
+		t.Fatalf("csv has %d rows", len(rows))
+	}
+	got := make(map[string]string)
+	for i, column := range RECORD_CSV_HEADER {
+		got[column] = rows[1][i]
+	}
+	for column, want := range map[string]string{
+		"observed_at": "2025-03-14T15:09:26Z", "latency_ms": "42", "sample_names": "Notch", "online_mode": "false",
+		"mods": "forge;mcp", "modpack": "All the Mods", "asn": "64496", "hostnames": "mc.example.com",
+	} {
+		if got[column] != want {
+			t.Errorf("csv %s is %q, want %q", column, got[column], want)
+		}
+	}
+
+	var decoded ServerRecord
+	if err := json.Unmarshal([]byte(write("jsonl")), &decoded); err != nil {
+		t.Fatal(err)
+	}
+	// JSON addresses come back in their 16 byte form
+	decoded.IP = decoded.IP.To4()
+	assertSameRecord(t, &decoded, fullRecord())
+
+	if _, err := NewRecordWriter("xml", &bytes.Buffer{}); err == nil {
+		t.Error("unknown format accepted")
+	}
+}
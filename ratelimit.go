@@ -0,0 +1,309 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"math"
+	"net"
+	"sync"
+	"time"
+)
+
+// Connection rate defaults, 0 means unlimited
+const DEFAULT_RATE = 0
+const DEFAULT_RAMP_UP = 30 * time.Second
+const DEFAULT_MAX_PER_24 = 0
+const DEFAULT_MAX_PER_ASN = 0
+
+// During ramp-up the rate never drops below this fraction of the target
+const MIN_RAMP_FRACTION = 0.01
+
+const RATE_LOG_INTERVAL = 10 * time.Second
+
+type RateLimitConfig struct {
+	Rate      float64 // new connections per second
+	Burst     int
+	RampUp    time.Duration
+	MaxPer24  int // concurrent connections per /24
+	MaxPerASN int // concurrent connections per origin ASN
+}
+
+type RateLimitStats struct {
+	CurrentRate float64
+	InFlight    int
+	Acquired    uint64
+	Throttled   uint64 // acquisitions that waited for the token bucket
+	Blocked24   uint64 // acquisitions that waited for the /24 cap
+	BlockedASN  uint64 // acquisitions that waited for the ASN cap
+}
+
+// waitQueue holds the goroutines waiting for room under a cap, by /24 or ASN.
+// Each freed slot wakes only the first in line.
+type waitQueue map[uint32][]chan struct{}
+
+func (q waitQueue) add(key uint32) chan struct{} {
+	woken := make(chan struct{})
+	q[key] = append(q[key], woken)
+	return woken
+}
+
+func (q waitQueue) wake(key uint32) {
+	waiters := q[key]
+	if len(waiters) == 0 {
+		return
+	}
+	close(waiters[0])
+	if len(waiters) == 1 {
+		delete(q, key)
+	} else {
+		q[key] = waiters[1:]
+	}
+}
+
+// remove takes a waiter that gave up out of the queue, if it hasn't been woken already
+func (q waitQueue) remove(key uint32, woken chan struct{}) {
+	waiters := q[key]
+	for i, w := range waiters {
+		if w == woken {
+			waiters = append(waiters[:i], waiters[i+1:]...)
+			break
+		}
+	}
+	if len(waiters) == 0 {
+		delete(q, key)
+	} else {
+		q[key] = waiters
+	}
+}
+
+// Limiter is a token bucket for new connections plus concurrency caps per /24 and per ASN
+type Limiter struct {
+	mu     sync.Mutex
+	cfg    RateLimitConfig
+	start  time.Time
+	last   time.Time
+	tokens float64
+
+	inFlight    int
+	inFlight24  map[uint32]int
+	inFlightASN map[uint32]int
+	waiting24   waitQueue
+	waitingASN  waitQueue
+
+	asnLookup func(net.IP) uint32
+	stats     RateLimitStats
+
+	// the clock, which tests replace
+	now   func() time.Time
+	sleep func(ctx context.Context, d time.Duration) error
+}
+
+func NewLimiter(cfg RateLimitConfig) *Limiter {
+	if cfg.Burst <= 0 {
+		cfg.Burst = 1
+	}
+	now := time.Now()
+	return &Limiter{
+		cfg:         cfg,
+		start:       now,
+		last:        now,
+		inFlight24:  make(map[uint32]int),
+		inFlightASN: make(map[uint32]int),
+		waiting24:   make(waitQueue),
+		waitingASN:  make(waitQueue),
+		now:         time.Now,
+		sleep:       sleepContext,
+	}
+}
+
+// sleepContext waits for d, or until ctx is done
+func sleepContext(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// SetASNLookup sets how the ASN cap resolves addresses, a result of 0 is never capped
+func (l *Limiter) SetASNLookup(lookup func(net.IP) uint32) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.asnLookup = lookup
+}
+
+// SetRate changes the target rate without restarting the ramp-up
+func (l *Limiter) SetRate(rate float64) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.refill(l.now())
+	l.cfg.Rate = rate
+}
+
+func (l *Limiter) Rate() float64 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.cfg.Rate
+}
+
+// currentRate is the target rate scaled down linearly during the ramp-up period
+func (l *Limiter) currentRate(now time.Time) float64 {
+	if l.cfg.RampUp <= 0 {
+		return l.cfg.Rate
+	}
+	fraction := float64(now.Sub(l.start)) / float64(l.cfg.RampUp)
+	return l.cfg.Rate * math.Max(MIN_RAMP_FRACTION, math.Min(1, fraction))
+}
+
+func (l *Limiter) refill(now time.Time) {
+	rate := l.currentRate(now)
+	l.tokens = math.Min(float64(l.cfg.Burst), l.tokens+rate*now.Sub(l.last).Seconds())
+	l.last = now
+}
+
+// Acquire blocks until a connection to ip is allowed, the returned func must be called once it closes
+func (l *Limiter) Acquire(ctx context.Context, ip net.IP) (func(), error) {
+	var slash24 uint32
+	if n, ok := ipv4ToUint32(ip); ok {
+		slash24 = n >> 8
+	}
+
+	l.mu.Lock()
+	var asn uint32
+	if l.asnLookup != nil && l.cfg.MaxPerASN > 0 {
+		asn = l.asnLookup(ip)
+	}
+	// each kind of wait is counted once, however many times it takes
+	var blocked24, blockedASN, throttled bool
+	for {
+		now := l.now()
+		var wait time.Duration
+		var queue waitQueue
+		var key uint32
+
+		switch {
+		case l.cfg.MaxPer24 > 0 && l.inFlight24[slash24] >= l.cfg.MaxPer24:
+			if !blocked24 {
+				blocked24 = true
+				l.stats.Blocked24++
+			}
+			queue, key = l.waiting24, slash24
+		case asn != 0 && l.inFlightASN[asn] >= l.cfg.MaxPerASN:
+			if !blockedASN {
+				blockedASN = true
+				l.stats.BlockedASN++
+			}
+			queue, key = l.waitingASN, asn
+		case l.cfg.Rate > 0:
+			l.refill(now)
+			if l.tokens < 1 {
+				if !throttled {
+					throttled = true
+					l.stats.Throttled++
+				}
+				wait = time.Duration((1 - l.tokens) / l.currentRate(now) * float64(time.Second))
+			}
+		}
+
+		if wait == 0 && queue == nil {
+			if l.cfg.Rate > 0 {
+				l.tokens--
+			}
+			l.inFlight++
+			l.inFlight24[slash24]++
+			if asn != 0 {
+				l.inFlightASN[asn]++
+			}
+			l.stats.Acquired++
+			l.mu.Unlock()
+			return func() { l.release(slash24, asn) }, nil
+		}
+		// if this goroutine was woken for a slot it's not taking, the next in line gets it
+		l.passOn(slash24, asn)
+		var woken chan struct{}
+		if queue != nil {
+			woken = queue.add(key)
+		}
+		l.mu.Unlock()
+
+		if woken != nil {
+			select {
+			case <-woken:
+			case <-ctx.Done():
+				l.mu.Lock()
+				queue.remove(key, woken)
+				// it may have been woken just as it gave up
+				l.passOn(slash24, asn)
+				l.mu.Unlock()
+				return nil, ctx.Err()
+			}
+		} else if err := l.sleep(ctx, wait); err != nil {
+			return nil, err
+		}
+		l.mu.Lock()
+	}
+}
+
+func (l *Limiter) release(slash24 uint32, asn uint32) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.inFlight--
+	if l.inFlight24[slash24]--; l.inFlight24[slash24] <= 0 {
+		delete(l.inFlight24, slash24)
+	}
+	if asn != 0 {
+		if l.inFlightASN[asn]--; l.inFlightASN[asn] <= 0 {
+			delete(l.inFlightASN, asn)
+		}
+	}
+	l.waiting24.wake(slash24)
+	if asn != 0 {
+		l.waitingASN.wake(asn)
+	}
+}
+
+// passOn wakes the next waiter of a /24 or ASN that has room
+func (l *Limiter) passOn(slash24 uint32, asn uint32) {
+	if l.cfg.MaxPer24 <= 0 || l.inFlight24[slash24] < l.cfg.MaxPer24 {
+		l.waiting24.wake(slash24)
+	}
+	if asn != 0 && l.inFlightASN[asn] < l.cfg.MaxPerASN {
+		l.waitingASN.wake(asn)
+	}
+}
+
+func (l *Limiter) Stats() RateLimitStats {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	stats := l.stats
+	stats.CurrentRate = l.currentRate(l.now())
+	stats.InFlight = l.inFlight
+	return stats
+}
+
+// LogRateLimitStats periodically logs the limiter state until ctx is cancelled
+func LogRateLimitStats(ctx context.Context, l *Limiter) {
+	ticker := time.NewTicker(RATE_LOG_INTERVAL)
+	defer ticker.Stop()
+	var previous uint64
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			stats := l.Stats()
+			slog.Info("Rate limiter",
+				"targetRate", l.Rate(),
+				"currentRate", stats.CurrentRate,
+				"achievedRate", float64(stats.Acquired-previous)/RATE_LOG_INTERVAL.Seconds(),
+				"inFlight", stats.InFlight,
+				"throttled", stats.Throttled,
+				"blocked24", stats.Blocked24,
+				"blockedASN", stats.BlockedASN)
+			previous = stats.Acquired
+		}
+	}
+}
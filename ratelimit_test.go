@@ -0,0 +1,208 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeClock only moves when the limiter sleeps on it
+type fakeClock struct {
+	mu    sync.Mutex
+	now   time.Time
+	slept []time.Duration
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) Sleep(ctx context.Context, d time.Duration) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(d)
+	c.slept = append(c.slept, d)
+	return ctx.Err()
+}
+
+func fakeLimiter(cfg RateLimitConfig) (*Limiter, *fakeClock) {
+	clock := &fakeClock{now: time.Date(2025, 3, 14, 0, 0, 0, 0, time.UTC)}
+	l := NewLimiter(cfg)
+	l.now, l.sleep = clock.Now, clock.Sleep
+	l.start, l.last = clock.now, clock.now
+	return l, clock
+}
+
+type acquisition struct {
+	ip      string
+	release func()
+	err     error
+}
+
+// acquireLater acquires ip in the background, and returns once it is waiting in queue
+func acquireLater(t *testing.T, ctx context.Context, l *Limiter, ip string, queue func() int, done chan<- acquisition) {
+	t.Helper()
+	l.mu.Lock()
+	before := queue()
+	l.mu.Unlock()
+	go func() {
+		release, err := l.Acquire(ctx, net.ParseIP(ip))
+		done <- acquisition{ip, release, err}
+	}()
+	waitQueued(t, l, queue, before+1)
+}
+
+// waitQueued waits until queue holds n waiters
+func waitQueued(t *testing.T, l *Limiter, queue func() int, n int) {
+	t.Helper()
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(time.Millisecond) {
+		l.mu.Lock()
+		queued := queue()
+		l.mu.Unlock()
+		if queued == n {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%d waiting, want %d", queued, n)
+		}
+	}
+}
+
+func slash24Of(ip string) uint32 {
+	n, _ := ipv4ToUint32(net.ParseIP(ip))
+	return n >> 8
+}
+
+func mustAcquire(t *testing.T, l *Limiter, ip string) func() {
+	t.Helper()
+	release, err := l.Acquire(context.Background(), net.ParseIP(ip))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return release
+}
+
+func expectAcquired(t *testing.T, done <-chan acquisition, ip string) acquisition {
+	t.Helper()
+	select {
+	case a := <-done:
+		if a.ip != ip || a.err != nil {
+			t.Fatalf("%s acquired (%v), want %s", a.ip, a.err, ip)
+		}
+		return a
+	case <-time.After(5 * time.Second):
+		t.Fatalf("%s never acquired", ip)
+		return acquisition{}
+	}
+}
+
+func TestLimiterPer24Cap(t *testing.T) {
+	l, _ := fakeLimiter(RateLimitConfig{MaxPer24: 2})
+	slash24 := slash24Of("192.0.2.0")
+	queued := func() int { return len(l.waiting24[slash24]) }
+
+	first := mustAcquire(t, l, "192.0.2.1")
+	second := mustAcquire(t, l, "192.0.2.2")
+	// other /24s aren't affected
+	mustAcquire(t, l, "198.51.100.1")
+
+	done := make(chan acquisition, 3)
+	for _, ip := range []string{"192.0.2.3", "192.0.2.4", "192.0.2.5"} {
+		acquireLater(t, context.Background(), l, ip, queued, done)
+	}
+	// each freed slot goes to the longest waiting, and only to them
+	first()
+	w1 := expectAcquired(t, done, "192.0.2.3")
+	waitQueued(t, l, queued, 2)
+	second()
+	expectAcquired(t, done, "192.0.2.4")
+	w1.release()
+	expectAcquired(t, done, "192.0.2.5")
+
+	stats := l.Stats()
+	if stats.Acquired != 6 || stats.Blocked24 != 3 || stats.InFlight != 3 || stats.Throttled != 0 {
+		t.Errorf("stats %+v", stats)
+	}
+}
+
+func TestLimiterPassesOn(t *testing.T) {
+	l, _ := fakeLimiter(RateLimitConfig{MaxPer24: 1, MaxPerASN: 1})
+	l.SetASNLookup(func(ip net.IP) uint32 {
+		return map[string]uint32{"192.0.2.1": 300, "192.0.2.2": 100, "192.0.2.3": 200, "198.51.100.1": 100}[ip.String()]
+	})
+	slash24, asn := slash24Of("192.0.2.0"), uint32(100)
+	queued24 := func() int { return len(l.waiting24[slash24]) }
+	queuedASN := func() int { return len(l.waitingASN[asn]) }
+
+	holds24 := mustAcquire(t, l, "192.0.2.1")
+	holdsASN := mustAcquire(t, l, "198.51.100.1")
+	done := make(chan acquisition, 2)
+	acquireLater(t, context.Background(), l, "192.0.2.2", queued24, done)
+	acquireLater(t, context.Background(), l, "192.0.2.3", queued24, done)
+
+	// the first in line is woken but its ASN is full, so it hands the /24 slot on
+	holds24()
+	second := expectAcquired(t, done, "192.0.2.3")
+	waitQueued(t, l, queuedASN, 1)
+	// now its ASN has room but the /24 doesn't, so it waits for that again
+	holdsASN()
+	waitQueued(t, l, queuedASN, 0)
+	waitQueued(t, l, queued24, 1)
+	second.release()
+	expectAcquired(t, done, "192.0.2.2")
+
+	// every wait is counted once, however many times it happened
+	stats := l.Stats()
+	if stats.Blocked24 != 2 || stats.BlockedASN != 1 || stats.Acquired != 4 {
+		t.Errorf("stats %+v", stats)
+	}
+}
+
+func TestLimiterGiveUp(t *testing.T) {
+	l, _ := fakeLimiter(RateLimitConfig{MaxPer24: 1})
+	slash24 := slash24Of("192.0.2.0")
+	queued := func() int { return len(l.waiting24[slash24]) }
+
+	hold := mustAcquire(t, l, "192.0.2.1")
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan acquisition, 2)
+	acquireLater(t, ctx, l, "192.0.2.2", queued, done)
+	acquireLater(t, context.Background(), l, "192.0.2.3", queued, done)
+
+	cancel()
+	if a := <-done; a.ip != "192.0.2.2" || !errors.Is(a.err, context.Canceled) {
+		t.Fatalf("%s gave up with %v", a.ip, a.err)
+	}
+	waitQueued(t, l, queued, 1)
+	// the slot isn't lost on the waiter that left
+	hold()
+	expectAcquired(t, done, "192.0.2.3")
+}
+
+func TestLimiterRampUp(t *testing.T) {
+	l, clock := fakeLimiter(RateLimitConfig{Rate: 10, RampUp: 10 * time.Second})
+	if rate := l.Stats().CurrentRate; rate != 10*MIN_RAMP_FRACTION {
+		t.Errorf("starting rate %v", rate)
+	}
+	// the first token takes as long as the ramp-up's floor says, the next the full rate
+	mustAcquire(t, l, "192.0.2.1")
+	mustAcquire(t, l, "192.0.2.2")
+	if len(clock.slept) != 2 || clock.slept[0] != 10*time.Second || clock.slept[1] != 100*time.Millisecond {
+		t.Errorf("slept %v, want [10s 100ms]", clock.slept)
+	}
+	stats := l.Stats()
+	if stats.CurrentRate != 10 || stats.Throttled != 2 || stats.Acquired != 2 {
+		t.Errorf("stats %+v", stats)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := l.Acquire(ctx, net.ParseIP("192.0.2.3")); !errors.Is(err, context.Canceled) {
+		t.Errorf("throttled acquire after cancel: %v", err)
+	}
+}
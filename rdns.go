@@ -0,0 +1,98 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"net"
+	"strings"
+	"time"
+)
+
+const DEFAULT_RDNS_CONCURRENCY = 64
+const DEFAULT_RDNS_TIMEOUT = 3 * time.Second
+
+type ReverseDNSConfig struct {
+	Enabled bool
+	// host:port of the DNS server to ask, the system resolver is used when empty
+	Resolver    string
+	Concurrency int
+	Timeout     time.Duration
+}
+
+type Hostname struct {
+	Name string `json:"name"`
+	// the name resolves back to the server's address
+	ForwardConfirmed bool `json:"forwardConfirmed"`
+}
+
+type ReverseDNS struct {
+	resolver *net.Resolver
+	timeout  time.Duration
+	sem      chan struct{}
+}
+
+func NewReverseDNS(cfg ReverseDNSConfig) *ReverseDNS {
+	if cfg.Concurrency <= 0 {
+		cfg.Concurrency = DEFAULT_RDNS_CONCURRENCY
+	}
+	if cfg.Timeout <= 0 {
+		cfg.Timeout = DEFAULT_RDNS_TIMEOUT
+	}
+	resolver := net.DefaultResolver
+	if cfg.Resolver != "" {
+		server := cfg.Resolver
+		resolver = &net.Resolver{
+			PreferGo: true,
+			Dial: func(ctx context.Context, network, _ string) (net.Conn, error) {
+				var d net.Dialer
+				return d.DialContext(ctx, network, server)
+			},
+		}
+	}
+	return &ReverseDNS{
+		resolver: resolver,
+		timeout:  cfg.Timeout,
+		sem:      make(chan struct{}, cfg.Concurrency),
+	}
+}
+
+// Lookup returns the PTR names for ip, each checked against its forward lookup
+func (r *ReverseDNS) Lookup(ctx context.Context, ip net.IP) []Hostname {
+	ctx, cancel := context.WithTimeout(ctx, r.timeout)
+	defer cancel()
+
+	names, err := r.resolver.LookupAddr(ctx, ip.String())
+	if err != nil {
+		// NXDOMAIN is the usual answer, so only unexpected failures are worth logging
+		if dnsErr, ok := err.(*net.DNSError); !ok || !dnsErr.IsNotFound {
+			slog.Debug("PTR lookup failed", "ip", ip, "error", err)
+		}
+		return nil
+	}
+
+	hostnames := make([]Hostname, 0, len(names))
+	for _, name := range names {
+		name = strings.TrimSuffix(name, ".")
+		if name == "" {
+			continue
+		}
+		hostnames = append(hostnames, Hostname{
+			Name:             name,
+			ForwardConfirmed: r.forwardConfirms(ctx, name, ip),
+		})
+	}
+	return hostnames
+}
+
+func (r *ReverseDNS) forwardConfirms(ctx context.Context, name string, ip net.IP) bool {
+	addrs, err := r.resolver.LookupIPAddr(ctx, name)
+	if err != nil {
+		return false
+	}
+	for _, addr := range addrs {
+		if addr.IP.Equal(ip) {
+			return true
+		}
+	}
+	return false
+}
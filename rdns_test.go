@@ -0,0 +1,122 @@
+package main
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// fakeDNS is a stand-in resolver on 127.0.0.1. It answers PTR and A questions from its
+// maps, NXDOMAIN for anything else, and never answers questions about silent.
+type fakeDNS struct {
+	ptr    map[string]string
+	a      map[string]net.IP
+	silent string
+}
+
+func (d *fakeDNS) serve(t *testing.T) string {
+	t.Helper()
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	go func() {
+		buf := make([]byte, 1500)
+		for {
+			n, addr, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			if reply, ok := d.answer(buf[:n]); ok {
+				conn.WriteTo(reply, addr)
+			}
+		}
+	}()
+	return conn.LocalAddr().String()
+}
+
+func (d *fakeDNS) answer(query []byte) ([]byte, bool) {
+	var p dnsmessage.Parser
+	header, err := p.Start(query)
+	if err != nil {
+		return nil, false
+	}
+	q, err := p.Question()
+	if err != nil {
+		return nil, false
+	}
+	name := q.Name.String()
+	if name == d.silent {
+		return nil, false
+	}
+
+	b := dnsmessage.NewBuilder(nil, dnsmessage.Header{ID: header.ID, Response: true, RecursionAvailable: true})
+	b.EnableCompression()
+	b.StartQuestions()
+	b.Question(q)
+	b.StartAnswers()
+	rr := dnsmessage.ResourceHeader{Name: q.Name, Type: q.Type, Class: dnsmessage.ClassINET, TTL: 60}
+	ptr, isPTR := d.ptr[name]
+	ip, isA := d.a[name]
+	switch {
+	case q.Type == dnsmessage.TypePTR && isPTR:
+		b.PTRResource(rr, dnsmessage.PTRResource{PTR: dnsmessage.MustNewName(ptr)})
+	case q.Type == dnsmessage.TypeA && isA:
+		var a dnsmessage.AResource
+		copy(a.A[:], ip.To4())
+		b.AResource(rr, a)
+	case isA:
+		// the name exists, just not with this type
+	default:
+		b = dnsmessage.NewBuilder(nil, dnsmessage.Header{ID: header.ID, Response: true, RecursionAvailable: true, RCode: dnsmessage.RCodeNameError})
+		b.StartQuestions()
+		b.Question(q)
+	}
+	reply, err := b.Finish()
+	return reply, err == nil
+}
+
+func TestReverseDNS(t *testing.T) {
+	dns := &fakeDNS{
+		ptr: map[string]string{
+			"1.2.0.192.in-addr.arpa.": "mc.example.net.",
+			"2.2.0.192.in-addr.arpa.": "spoofed.example.net.",
+		},
+		a: map[string]net.IP{
+			"mc.example.net.":      net.IPv4(192, 0, 2, 1),
+			"spoofed.example.net.": net.IPv4(198, 51, 100, 9),
+		},
+		silent: "4.2.0.192.in-addr.arpa.",
+	}
+	rdns := NewReverseDNS(ReverseDNSConfig{Resolver: dns.serve(t), Timeout: 500 * time.Millisecond})
+
+	for _, c := range []struct {
+		ip   net.IP
+		want []Hostname
+	}{
+		{net.IPv4(192, 0, 2, 1), []Hostname{{Name: "mc.example.net", ForwardConfirmed: true}}},
+		// a PTR anyone can set, the forward lookup is what ties the name to the server
+		{net.IPv4(192, 0, 2, 2), []Hostname{{Name: "spoofed.example.net", ForwardConfirmed: false}}},
+		{net.IPv4(192, 0, 2, 3), nil},
+		{net.IPv4(192, 0, 2, 4), nil},
+	} {
+		start := time.Now()
+		got := rdns.Lookup(context.Background(), c.ip)
+		if len(got) != len(c.want) {
+			t.Errorf("%v: got %+v, want %+v", c.ip, got, c.want)
+			continue
+		}
+		for i := range got {
+			if got[i] != c.want[i] {
+				t.Errorf("%v: got %+v, want %+v", c.ip, got[i], c.want[i])
+			}
+		}
+		if took := time.Since(start); took > 2*time.Second {
+			t.Errorf("%v: lookup took %v with a 500ms timeout", c.ip, took)
+		}
+	}
+}
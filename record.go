@@ -0,0 +1,352 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"log/slog"
+	"net"
+	"os"
+	"time"
+
+	badger "github.com/dgraph-io/badger/v4"
+	"github.com/fxamacker/cbor/v2"
+)
+
+// Bump this whenever a ServerRecord field changes meaning, and teach DecodeRecord the old layout
+const RECORD_SCHEMA_VERSION = 1
+
+const SERVER_PREFIX = "server:"
+
+// ServerRecord is the on-disk form of one observation of a server.
+// Unlike ServerStatus it has no interface fields, so it decodes back losslessly.
+type ServerRecord struct {
+	SchemaVersion int       `cbor:"schema" json:"schema"`
+	IP            net.IP    `cbor:"ip" json:"ip"`
+	Port          uint16    `cbor:"port" json:"port"`
+	ObservedAt    time.Time `cbor:"observedAt" json:"observedAt"`
+
+	// observation metadata
+	Source  string        `cbor:"source,omitempty" json:"source,omitempty"` // scanner or agent that made the observation
+	Latency time.Duration `cbor:"latency,omitempty" json:"latency,omitempty"`
+
+	Version             VersionInfo      `cbor:"version" json:"version"`
+	Players             *PlayersInfo     `cbor:"players,omitempty" json:"players,omitempty"`
+	Description         string           `cbor:"description" json:"description"`
+	Favicon             *string          `cbor:"favicon,omitempty" json:"favicon,omitempty"`
+	EnforcesSecureChat  *bool            `cbor:"enforcesSecureChat,omitempty" json:"enforcesSecureChat,omitempty"`
+	PreviewsChat        *bool            `cbor:"previewsChat,omitempty" json:"previewsChat,omitempty"`
+	PreventsChatReports *bool            `cbor:"preventsChatReports,omitempty" json:"preventsChatReports,omitempty"`
+	ForgeData           *ForgeDataInfo   `cbor:"forgeData,omitempty" json:"forgeData,omitempty"`
+	ModInfo             *ModInfo         `cbor:"modinfo,omitempty" json:"modinfo,omitempty"`
+	IsModded            *bool            `cbor:"isModded,omitempty" json:"isModded,omitempty"`
+	ModpackData         *ModpackDataInfo `cbor:"modpackData,omitempty" json:"modpackData,omitempty"`
+
+	IsFakeSample bool  `cbor:"isFakeSample" json:"isFakeSample"`
+	IsOnlineMode *bool `cbor:"isOnlineMode,omitempty" json:"isOnlineMode,omitempty"`
+
+	Enrichment *Enrichment `cbor:"enrichment,omitempty" json:"enrichment,omitempty"`
+	Hostnames  []Hostname  `cbor:"hostnames,omitempty" json:"hostnames,omitempty"`
+}
+
+// legacyServerStatus is how records were stored before schema versions existed:
+// a plain CBOR dump of ServerStatus, keyed by "server:<ip>:<timestamp>"
+type legacyServerStatus struct {
+	ServerStatusDTO
+	Address struct {
+		IP   net.IP `cbor:"IP"`
+		Port int    `cbor:"Port"`
+	} `json:"addr"`
+	Time         time.Time `json:"time"`
+	IsFakeSample bool      `json:"isFakeSample"`
+	IsOnlineMode *bool     `json:"isOnlineMode,omitempty"`
+}
+
+var recordEncMode = func() cbor.EncMode {
+	mode, err := cbor.EncOptions{
+		Time:    cbor.TimeRFC3339Nano,
+		TimeTag: cbor.EncTagRequired,
+	}.EncMode()
+	if err != nil {
+		panic(err)
+	}
+	return mode
+}()
+
+// observations without a source were made by this machine
+var defaultSource, _ = os.Hostname()
+
+func NewServerRecord(status *ServerStatus) (*ServerRecord, error) {
+	tcpAddr, ok := status.Address.(*net.TCPAddr)
+	if !ok {
+		return nil, fmt.Errorf("address %v is not a TCPAddr", status.Address)
+	}
+	ip := tcpAddr.IP.To4()
+	if ip == nil {
+		return nil, fmt.Errorf("address %v is not IPv4", status.Address)
+	}
+	source := status.Source
+	if source == "" {
+		source = defaultSource
+	}
+	return &ServerRecord{
+		SchemaVersion: RECORD_SCHEMA_VERSION,
+		IP:            ip,
+		Port:          uint16(tcpAddr.Port),
+		ObservedAt:    status.Time,
+		Source:        source,
+		Latency:       status.Latency,
+
+		Version:             status.Version,
+		Players:             status.Players,
+		Description:         string(status.Description),
+		Favicon:             status.Favicon,
+		EnforcesSecureChat:  status.EnforcesSecureChat,
+		PreviewsChat:        status.PreviewsChat,
+		PreventsChatReports: status.PreventsChatReports,
+		ForgeData:           status.ForgeDataInfo,
+		ModInfo:             status.ModinfoType,
+		IsModded:            status.IsModded,
+		ModpackData:         status.ModpackData,
+
+		IsFakeSample: status.IsFakeSample,
+		IsOnlineMode: status.IsOnlineMode,
+		Enrichment:   status.Enrichment,
+		Hostnames:    status.Hostnames,
+	}, nil
+}
+
+func (r *ServerRecord) ServerStatus() *ServerStatus {
+	return &ServerStatus{
+		ServerStatusDTO: ServerStatusDTO{
+			Version:             r.Version,
+			Players:             r.Players,
+			Description:         Description(r.Description),
+			Favicon:             r.Favicon,
+			EnforcesSecureChat:  r.EnforcesSecureChat,
+			PreviewsChat:        r.PreviewsChat,
+			PreventsChatReports: r.PreventsChatReports,
+			ForgeDataInfo:       r.ForgeData,
+			ModinfoType:         r.ModInfo,
+			IsModded:            r.IsModded,
+			ModpackData:         r.ModpackData,
+		},
+		Address:      r.Addr(),
+		Time:         r.ObservedAt,
+		IsFakeSample: r.IsFakeSample,
+		IsOnlineMode: r.IsOnlineMode,
+		Enrichment:   r.Enrichment,
+		Hostnames:    r.Hostnames,
+		Latency:      r.Latency,
+		Source:       r.Source,
+	}
+}
+
+func (r *ServerRecord) Addr() *net.TCPAddr {
+	return &net.TCPAddr{IP: r.IP, Port: int(r.Port)}
+}
+
+func (r *ServerRecord) Key() []byte {
+	return ServerKey(r.IP, r.Port, r.ObservedAt)
+}
+
+func EncodeRecord(r *ServerRecord) ([]byte, error) {
+	return recordEncMode.Marshal(r)
+}
+
+// DecodeRecord decodes any full record that has ever been written, upgrading it to the current schema.
+// Deltas can't be decoded on their own, they go through LoadRecordAt or ScanRecords.
+func DecodeRecord(data []byte) (*ServerRecord, error) {
+	record, _, err := decodeRecordVersion(data)
+	return record, err
+}
+
+// decodeRecordVersion also returns the schema version the record was stored with
+func decodeRecordVersion(data []byte) (*ServerRecord, int, error) {
+	var probe struct {
+		SchemaVersion int  `cbor:"schema"`
+		Delta         bool `cbor:"delta"`
+	}
+	if err := cbor.Unmarshal(data, &probe); err != nil {
+		return nil, 0, err
+	}
+	if probe.Delta {
+		return nil, probe.SchemaVersion, errDeltaRecord
+	}
+
+	switch probe.SchemaVersion {
+	case 0:
+		record, err := decodeLegacyRecord(data)
+		return record, 0, err
+	case RECORD_SCHEMA_VERSION:
+		record := &ServerRecord{}
+		if err := cbor.Unmarshal(data, record); err != nil {
+			return nil, 0, err
+		}
+		return record, probe.SchemaVersion, nil
+	default:
+		return nil, 0, fmt.Errorf("unknown record schema version %d", probe.SchemaVersion)
+	}
+}
+
+func decodeLegacyRecord(data []byte) (*ServerRecord, error) {
+	var legacy legacyServerStatus
+	if err := cbor.Unmarshal(data, &legacy); err != nil {
+		return nil, err
+	}
+	ip := legacy.Address.IP.To4()
+	if ip == nil {
+		return nil, errors.New("legacy record has no IPv4 address")
+	}
+	status := &ServerStatus{
+		ServerStatusDTO: legacy.ServerStatusDTO,
+		Address:         &net.TCPAddr{IP: ip, Port: legacy.Address.Port},
+		Time:            legacy.Time,
+		IsFakeSample:    legacy.IsFakeSample,
+		IsOnlineMode:    legacy.IsOnlineMode,
+	}
+	record, err := NewServerRecord(status)
+	if err != nil {
+		return nil, err
+	}
+	// nobody recorded where legacy observations came from
+	record.Source = ""
+	return record, nil
+}
+
+// ServerKey is "server:<ip>:<port>:<timestamp>" with a 4 byte IP, 2 byte port and 8 byte unix time.
+// Everything is big endian so keys sort by address, then port, then time.
+func ServerKey(ip net.IP, port uint16, t time.Time) []byte {
+	key := make([]byte, 0, len(SERVER_PREFIX)+4+1+2+1+8)
+	key = append(key, SERVER_PREFIX...)
+	key = append(key, ip.To4()...)
+	key = append(key, ':')
+	key = binary.BigEndian.AppendUint16(key, port)
+	key = append(key, ':')
+	key = binary.BigEndian.AppendUint64(key, uint64(t.Unix()))
+	return key
+}
+
+// ServerKeyPrefix is the prefix shared by every observation of one server
+func ServerKeyPrefix(ip net.IP, port uint16) []byte {
+	key := ServerKey(ip, port, time.Time{})
+	return key[:len(key)-8]
+}
+
+// legacy keys are "server:<ip>:<timestamp>" without a port
+var legacyServerKeyLength = len(SERVER_PREFIX) + 4 + 1 + 8
+var serverKeyLength = len(SERVER_PREFIX) + 4 + 1 + 2 + 1 + 8
+
+// ParseServerKey splits a current layout key, ok is false for legacy or foreign keys
+func ParseServerKey(key []byte) (ip net.IP, port uint16, t time.Time, ok bool) {
+	if len(key) != serverKeyLength || !bytes.HasPrefix(key, []byte(SERVER_PREFIX)) {
+		return nil, 0, time.Time{}, false
+	}
+	rest := key[len(SERVER_PREFIX):]
+	ip = net.IP(append([]byte(nil), rest[:4]...))
+	port = binary.BigEndian.Uint16(rest[5:7])
+	t = time.Unix(int64(binary.BigEndian.Uint64(rest[8:16])), 0)
+	return ip, port, t, true
+}
+
+// MigrateRecords rewrites legacy keys and values into the current schema.
+// Records that already use the current schema are left alone, so it is safe to run repeatedly.
+func MigrateRecords(db *badger.DB) (migrated int, err error) {
+	type rewrite struct {
+		oldKey []byte
+		record *ServerRecord
+	}
+	var rewrites []rewrite
+
+	err = db.View(func(txn *badger.Txn) error {
+		opts := badger.DefaultIteratorOptions
+		opts.Prefix = []byte(SERVER_PREFIX)
+		it := txn.NewIterator(opts)
+		defer it.Close()
+
+		for it.Rewind(); it.Valid(); it.Next() {
+			item := it.Item()
+			var record *ServerRecord
+			var version int
+			err := item.Value(func(val []byte) error {
+				var err error
+				record, version, err = decodeRecordVersion(val)
+				return err
+			})
+			if errors.Is(err, errDeltaRecord) {
+				// deltas only ever existed with the current schema
+				continue
+			}
+			if err != nil {
+				slog.Warn("Skipping undecodable record", "key", item.KeyCopy(nil), "error", err)
+				continue
+			}
+			if version == RECORD_SCHEMA_VERSION && len(item.Key()) == serverKeyLength {
+				continue
+			}
+			// the key's timestamp is authoritative, record times were never more precise
+			if len(item.Key()) == legacyServerKeyLength {
+				ts := binary.BigEndian.Uint64(item.Key()[legacyServerKeyLength-8:])
+				record.ObservedAt = time.Unix(int64(ts), 0)
+			}
+			rewrites = append(rewrites, rewrite{oldKey: item.KeyCopy(nil), record: record})
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	wb := db.NewWriteBatch()
+	defer wb.Cancel()
+	for _, rw := range rewrites {
+		value, err := EncodeRecord(rw.record)
+		if err != nil {
+			return migrated, err
+		}
+		newKey := rw.record.Key()
+		if !bytes.Equal(newKey, rw.oldKey) {
+			if err := wb.Delete(rw.oldKey); err != nil {
+				return migrated, err
+			}
+		}
+		if err := wb.SetEntry(observationEntry(newKey, value, rw.record.ObservedAt, 0)); err != nil {
+			return migrated, err
+		}
+		migrated++
+	}
+	return migrated, wb.Flush()
+}
+
+func runMigrate(args []string) {
+	fs := flag.NewFlagSet("migrate", flag.ExitOnError)
+	dir := fs.String("db", BADGER_DIR, "badger directory to migrate")
+	dedup := fs.Bool("dedup", false, "also re-encode every server's history as keyframes and deltas")
+	fs.Parse(args)
+
+	db, err := badger.Open(badger.DefaultOptions(*dir))
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer db.Close()
+
+	migrated, err := MigrateRecords(db)
+	if err != nil {
+		log.Fatal(err)
+	}
+	slog.Info("Migration finished", "migrated", migrated, "schema", RECORD_SCHEMA_VERSION)
+
+	if *dedup {
+		// updating every observation makes RewriteHistory encode each one against the one before it
+		rewritten, _, err := RewriteHistory(db, func(r *ServerRecord) (RewriteAction, error) {
+			return REWRITE_UPDATE, nil
+		})
+		if err != nil {
+			log.Fatal(err)
+		}
+		slog.Info("Deduplicated observations", "rewritten", rewritten)
+	}
+}
@@ -0,0 +1,377 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+
+	badger "github.com/dgraph-io/badger/v4"
+	"github.com/fxamacker/cbor/v2"
+	"github.com/google/uuid"
+)
+
+// fullRecord has every field set, so a field that doesn't survive storage shows up
+func fullRecord() *ServerRecord {
+	name := "Notch"
+	id := uuid.MustParse("069a79f4-44e9-4726-a5be-fca90e38aaf5")
+	favicon := "data:image/png;base64,iVBORw0KGgo="
+	return &ServerRecord{
+		SchemaVersion: RECORD_SCHEMA_VERSION,
+		IP:            net.IPv4(192, 0, 2, 10).To4(),
+		Port:          25566,
+		ObservedAt:    time.Date(2025, 3, 14, 15, 9, 26, 0, time.UTC),
+		Source:        "agent-1",
+		Latency:       42 * time.Millisecond,
+
+		Version:             VersionInfo{Name: "Paper 1.21.1", Protocol: 767},
+		Players:             &PlayersInfo{Max: 20, Online: 1, Sample: &[]SamplePlayer{{Name: &name, ID: &id}}},
+		Description:         "§aA Minecraft Server",
+		Favicon:             &favicon,
+		EnforcesSecureChat:  newTrue(),
+		PreviewsChat:        newFalse(),
+		PreventsChatReports: newTrue(),
+		ForgeData:           &ForgeDataInfo{FMLNetworkVersion: 3, Mods: []ForgeMod{{ID: "forge", Marker: "47.2.0"}}},
+		ModInfo:             &ModInfo{Type: "FML", ModList: []ModInfoEntry{{ID: "mcp", Version: "9.42"}}},
+		IsModded:            newTrue(),
+		ModpackData:         &ModpackDataInfo{ProjectID: 123, Name: "All the Mods", Version: "9"},
+
+		IsFakeSample: true,
+		IsOnlineMode: newFalse(),
+		Enrichment:   &Enrichment{ASN: 64496, ASName: "EXAMPLE-AS", Prefix: "192.0.2.0/24", Country: "NL"},
+		Hostnames:    []Hostname{{Name: "mc.example.com", ForwardConfirmed: true}},
+	}
+}
+
+func assertSameRecord(t *testing.T, got, want *ServerRecord) {
+	t.Helper()
+	if got == nil {
+		t.Fatal("got no record")
+	}
+	if !got.ObservedAt.Equal(want.ObservedAt) {
+		t.Errorf("ObservedAt = %v, want %v", got.ObservedAt, want.ObservedAt)
+	}
+	// time zones don't survive, instants do
+	g, w := *got, *want
+	g.ObservedAt, w.ObservedAt = time.Time{}, time.Time{}
+	if !reflect.DeepEqual(g, w) {
+		t.Errorf("records differ\n got %+v\nwant %+v", g, w)
+	}
+}
+
+func TestFullRecordSetsEveryField(t *testing.T) {
+	v := reflect.ValueOf(*fullRecord())
+	for i := 0; i < v.NumField(); i++ {
+		if v.Field(i).IsZero() {
+			t.Errorf("fullRecord doesn't set %s, round trips won't cover it", v.Type().Field(i).Name)
+		}
+	}
+}
+
+func TestRecordRoundTrip(t *testing.T) {
+	want := fullRecord()
+	data, err := EncodeRecord(want)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := DecodeRecord(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertSameRecord(t, got, want)
+
+	// and through ServerStatus, which is how results reach the writer
+	again, err := NewServerRecord(got.ServerStatus())
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertSameRecord(t, again, want)
+}
+
+func legacyValue(t *testing.T, want *ServerRecord) []byte {
+	t.Helper()
+	legacy := legacyServerStatus{
+		ServerStatusDTO: want.ServerStatus().ServerStatusDTO,
+		Time:            want.ObservedAt,
+		IsFakeSample:    want.IsFakeSample,
+		IsOnlineMode:    want.IsOnlineMode,
+	}
+	legacy.Address.IP = want.IP
+	legacy.Address.Port = int(want.Port)
+	data, err := cbor.Marshal(legacy)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+// legacyRecord is fullRecord without what the old layout never stored
+func legacyRecord() *ServerRecord {
+	r := fullRecord()
+	r.Source = ""
+	r.Latency = 0
+	r.Enrichment = nil
+	r.Hostnames = nil
+	return r
+}
+
+func TestDecodeLegacyRecord(t *testing.T) {
+	want := legacyRecord()
+	got, err := DecodeRecord(legacyValue(t, want))
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertSameRecord(t, got, want)
+}
+
+func TestMigrateLegacyRecords(t *testing.T) {
+	store := openTestBadger(t)
+	want := legacyRecord()
+	// "server:<ip>:<timestamp>", with no port
+	key := append([]byte(SERVER_PREFIX), want.IP...)
+	key = append(key, ':')
+	key = binary.BigEndian.AppendUint64(key, uint64(want.ObservedAt.Unix()))
+	err := store.DB.Update(func(txn *badger.Txn) error {
+		return txn.Set(key, legacyValue(t, want))
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for run, wantMigrated := range []int{1, 0} {
+		migrated, err := MigrateRecords(store.DB)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if migrated != wantMigrated {
+			t.Errorf("run %d migrated %d records, want %d", run, migrated, wantMigrated)
+		}
+	}
+
+	err = store.DB.View(func(txn *badger.Txn) error {
+		if _, err := txn.Get(key); !errors.Is(err, badger.ErrKeyNotFound) {
+			t.Errorf("legacy key is still there: %v", err)
+		}
+		item, err := txn.Get(want.Key())
+		if err != nil {
+			return err
+		}
+		return item.Value(func(val []byte) error {
+			got, version, err := decodeRecordVersion(val)
+			if err != nil {
+				return err
+			}
+			if version != RECORD_SCHEMA_VERSION {
+				t.Errorf("migrated record has schema %d", version)
+			}
+			assertSameRecord(t, got, want)
+			return nil
+		})
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// history is a server pinged every minute, changing now and then
+func history() []*ServerRecord {
+	var records []*ServerRecord
+	for i := 0; i < 6; i++ {
+		r := fullRecord()
+		r.ObservedAt = r.ObservedAt.Add(time.Duration(i) * time.Minute)
+		r.Latency = time.Duration(40+i) * time.Millisecond
+		switch i {
+		case 2:
+			r.Players.Online = 5
+		case 3:
+			r.Favicon = nil
+			r.Description = "§cmaintenance"
+		case 4:
+			r.Hostnames = append(r.Hostnames, Hostname{Name: "play.example.com"})
+		}
+		records = append(records, r)
+	}
+	return records
+}
+
+func TestDeltaChainReplay(t *testing.T) {
+	store := openTestBadger(t)
+	records := history()
+	for _, r := range records {
+		err := store.DB.Update(func(txn *badger.Txn) error {
+			return storeRecord(txn, r, nil, 0)
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	err := store.DB.View(func(txn *badger.Txn) error {
+		for i, want := range records {
+			item, err := txn.Get(want.Key())
+			if err != nil {
+				return err
+			}
+			// only the first one is a keyframe
+			err = item.Value(func(val []byte) error {
+				_, err := DecodeRecord(val)
+				if delta := errors.Is(err, errDeltaRecord); delta != (i > 0) {
+					t.Errorf("observation %d: delta = %v, %v", i, delta, err)
+				}
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+			got, err := LoadRecordAt(txn, want.IP, want.Port, want.ObservedAt)
+			if err != nil {
+				return err
+			}
+			assertSameRecord(t, got, want)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// replaying the whole chain in order gives the same records
+	i := 0
+	err = store.History(records[0].IP, records[0].Port, time.Time{}, END_OF_TIME, func(got *ServerRecord) error {
+		assertSameRecord(t, got, records[i])
+		i++
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if i != len(records) {
+		t.Errorf("history has %d records, want %d", i, len(records))
+	}
+}
+
+func TestDeltaChainOutOfOrder(t *testing.T) {
+	store := openTestBadger(t)
+	records := history()
+	// an agent reports the middle observation late
+	late := records[2]
+	for _, r := range append(append(append([]*ServerRecord{}, records[:2]...), records[3:]...), late) {
+		err := store.DB.Update(func(txn *badger.Txn) error {
+			return storeRecord(txn, r, nil, 0)
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	i := 0
+	err := store.History(records[0].IP, records[0].Port, time.Time{}, END_OF_TIME, func(got *ServerRecord) error {
+		assertSameRecord(t, got, records[i])
+		i++
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if i != len(records) {
+		t.Errorf("history has %d records, want %d", i, len(records))
+	}
+}
+
+// dumpDB lists every key, with the value for anything but observations, whose
+// deltas encode their fields in no particular order. Observations are marked as
+// keyframes or deltas instead.
+func dumpDB(t *testing.T, store *BadgerStorage) map[string]string {
+	t.Helper()
+	kv := make(map[string]string)
+	err := store.DB.View(func(txn *badger.Txn) error {
+		it := txn.NewIterator(badger.DefaultIteratorOptions)
+		defer it.Close()
+		for it.Rewind(); it.Valid(); it.Next() {
+			val, err := it.Item().ValueCopy(nil)
+			if err != nil {
+				return err
+			}
+			if _, _, _, ok := ParseServerKey(it.Item().Key()); ok {
+				if _, err := DecodeRecord(val); errors.Is(err, errDeltaRecord) {
+					val = []byte("delta")
+				} else {
+					val = []byte("keyframe")
+				}
+			}
+			kv[string(it.Item().Key())] = string(val)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return kv
+}
+
+func TestChainCacheStoresTheSame(t *testing.T) {
+	records := history()
+	late := records[2]
+	order := append(append(append([]*ServerRecord{}, records[:2]...), records[3:]...), late)
+	// and a few more after the late one, in one batch
+	for i := 0; i < 3; i++ {
+		r := fullRecord()
+		r.ObservedAt = records[len(records)-1].ObservedAt.Add(time.Duration(i+1) * time.Minute)
+		r.Players.Online = i
+		order = append(order, r)
+	}
+
+	uncached := openTestBadger(t)
+	for _, r := range order {
+		err := uncached.DB.Update(func(txn *badger.Txn) error {
+			if err := storeRecord(txn, r, nil, 0); err != nil {
+				return err
+			}
+			return writeSightings(txn, r, 0)
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	cached := openTestBadger(t)
+	for _, r := range order[:len(order)-3] {
+		if err := cached.PutObservations([]*ServerRecord{r}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := cached.PutObservations(order[len(order)-3:]); err != nil {
+		t.Fatal(err)
+	}
+	if state := cached.chains.get(string(ServerKeyPrefix(late.IP, late.Port))); state == nil || !state.at.Equal(order[len(order)-1].ObservedAt) {
+		t.Errorf("newest state isn't cached: %+v", state)
+	}
+
+	want, got := dumpDB(t, uncached), dumpDB(t, cached)
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("the cache changed what was stored: %d keys, want %d", len(got), len(want))
+	}
+	var wantHistory []*ServerRecord
+	err := uncached.History(late.IP, late.Port, time.Time{}, END_OF_TIME, func(r *ServerRecord) error {
+		wantHistory = append(wantHistory, r)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	i := 0
+	err = cached.History(late.IP, late.Port, time.Time{}, END_OF_TIME, func(r *ServerRecord) error {
+		if i < len(wantHistory) {
+			assertSameRecord(t, r, wantHistory[i])
+		}
+		i++
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if i != len(wantHistory) || i != len(order) {
+		t.Errorf("history has %d records, want %d", i, len(order))
+	}
+}
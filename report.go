@@ -0,0 +1,420 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"html/template"
+	"io"
+	"log"
+	"log/slog"
+	"math"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const DEFAULT_REPORT_WINDOW = "7d"
+
+// rows per breakdown
+const DEFAULT_REPORT_TOP = 15
+
+// MOTD phrases are single words and pairs of words, words shorter than this are skipped
+const MIN_PHRASE_WORD = 3
+
+// words that would top the MOTD phrases without saying anything
+var PHRASE_STOPWORDS = map[string]bool{
+	"the": true, "and": true, "for": true, "you": true, "our": true, "with": true,
+	"are": true, "your": true, "now": true, "all": true, "has": true, "not": true,
+}
+
+// Breakdowns in a census, in the order they're reported
+const (
+	BREAKDOWN_VERSION  = "Versions"
+	BREAKDOWN_PROTOCOL = "Protocols"
+	BREAKDOWN_SOFTWARE = "Software"
+	BREAKDOWN_MOTD     = "MOTD phrases"
+	BREAKDOWN_COUNTRY  = "Countries"
+	BREAKDOWN_ASN      = "Networks"
+)
+
+var BREAKDOWNS = []string{BREAKDOWN_VERSION, BREAKDOWN_PROTOCOL, BREAKDOWN_SOFTWARE, BREAKDOWN_MOTD, BREAKDOWN_COUNTRY, BREAKDOWN_ASN}
+
+// Census is what the servers that answered inside a window looked like, each
+// server counted once as it was the last time it answered
+type Census struct {
+	Since, Until  time.Time
+	Servers       int
+	PlayersOnline int
+	PlayerSlots   int
+	OnlineMode    int
+	OfflineMode   int
+	FakeSample    int
+	Modded        int
+	online        []int
+	counts        map[string]map[string]int // by breakdown
+}
+
+// TakeCensus scans every server that answered between since and until
+func TakeCensus(store Storage, since, until time.Time) (*Census, error) {
+	c := &Census{Since: since, Until: until, counts: make(map[string]map[string]int)}
+	for _, breakdown := range BREAKDOWNS {
+		c.counts[breakdown] = make(map[string]int)
+	}
+	filter := NewRecordFilter()
+	filter.Since, filter.Until = since, until
+	err := store.Scan(&filter, true, func(r *ServerRecord) error {
+		c.add(r)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	slices.Sort(c.online)
+	return c, nil
+}
+
+func (c *Census) add(r *ServerRecord) {
+	c.Servers++
+	online := 0
+	if r.Players != nil {
+		online = r.Players.Online
+		c.PlayerSlots += r.Players.Max
+	}
+	c.PlayersOnline += online
+	c.online = append(c.online, online)
+	// servers that didn't say which mode they're in count as neither
+	if r.IsOnlineMode != nil && *r.IsOnlineMode {
+		c.OnlineMode++
+	} else if r.IsOnlineMode != nil {
+		c.OfflineMode++
+	}
+	if r.IsFakeSample {
+		c.FakeSample++
+	}
+	if r.Modded() {
+		c.Modded++
+	}
+
+	c.counts[BREAKDOWN_VERSION][r.Version.Name]++
+	c.counts[BREAKDOWN_PROTOCOL][strconv.Itoa(r.Version.Protocol)]++
+	c.counts[BREAKDOWN_SOFTWARE][SoftwareFamily(r)]++
+	for _, phrase := range motdPhrases(r.Description) {
+		c.counts[BREAKDOWN_MOTD][phrase]++
+	}
+	if e := r.Enrichment; e != nil {
+		if e.Country != "" {
+			c.counts[BREAKDOWN_COUNTRY][e.Country]++
+		}
+		if e.ASN != 0 {
+			c.counts[BREAKDOWN_ASN][strings.TrimSpace(fmt.Sprintf("AS%d %s", e.ASN, e.ASName))]++
+		}
+	}
+}
+
+// MedianOnline is the player count of the server in the middle
+func (c *Census) MedianOnline() float64 {
+	n := len(c.online)
+	switch {
+	case n == 0:
+		return 0
+	case n%2 == 1:
+		return float64(c.online[n/2])
+	default:
+		return float64(c.online[n/2-1]+c.online[n/2]) / 2
+	}
+}
+
+// motdPhrases returns the words and pairs of words in a MOTD, each once
+func motdPhrases(motd string) []string {
+	words := motdWords(motd)
+	seen := make(map[string]bool)
+	var phrases []string
+	add := func(phrase string) {
+		if !seen[phrase] {
+			seen[phrase] = true
+			phrases = append(phrases, phrase)
+		}
+	}
+	useful := func(word string) bool {
+		return len([]rune(word)) >= MIN_PHRASE_WORD && !PHRASE_STOPWORDS[word]
+	}
+	for i, word := range words {
+		if !useful(word) {
+			continue
+		}
+		add(word)
+		if i+1 < len(words) && useful(words[i+1]) {
+			add(word + " " + words[i+1])
+		}
+	}
+	return phrases
+}
+
+// ReportMetric is one headline number, this window against the one before
+type ReportMetric struct {
+	Name     string  `json:"name"`
+	Value    float64 `json:"value"`
+	Previous float64 `json:"previous"`
+}
+
+// ReportRow is one line of a breakdown, Share is of the servers in the window
+type ReportRow struct {
+	Name     string  `json:"name"`
+	Count    int     `json:"count"`
+	Share    float64 `json:"share"`
+	Previous int     `json:"previous"`
+}
+
+type ReportSection struct {
+	Title string      `json:"title"`
+	Rows  []ReportRow `json:"rows"`
+}
+
+type Report struct {
+	GeneratedAt   time.Time       `json:"generatedAt"`
+	Since         time.Time       `json:"since"`
+	Until         time.Time       `json:"until"`
+	PreviousSince time.Time       `json:"previousSince"` // the window compared against ends at Since
+	Metrics       []ReportMetric  `json:"metrics"`
+	Sections      []ReportSection `json:"sections"`
+}
+
+// NewReport compares current with previous, the census of the window before it
+func NewReport(current, previous *Census, top int) *Report {
+	report := &Report{
+		GeneratedAt:   time.Now(),
+		Since:         current.Since,
+		Until:         current.Until,
+		PreviousSince: previous.Since,
+	}
+	metric := func(name string, value func(*Census) float64) {
+		report.Metrics = append(report.Metrics, ReportMetric{name, value(current), value(previous)})
+	}
+	metric("Servers", func(c *Census) float64 { return float64(c.Servers) })
+	metric("Players online", func(c *Census) float64 { return float64(c.PlayersOnline) })
+	metric("Median players online", (*Census).MedianOnline)
+	metric("Player slots", func(c *Census) float64 { return float64(c.PlayerSlots) })
+	metric("Online mode", func(c *Census) float64 { return float64(c.OnlineMode) })
+	metric("Offline mode", func(c *Census) float64 { return float64(c.OfflineMode) })
+	metric("Fake player sample", func(c *Census) float64 { return float64(c.FakeSample) })
+	metric("Modded", func(c *Census) float64 { return float64(c.Modded) })
+	metric("Vanilla", func(c *Census) float64 { return float64(c.Servers - c.Modded) })
+
+	for _, breakdown := range BREAKDOWNS {
+		section := ReportSection{Title: breakdown}
+		for _, count := range topCounts(current.counts[breakdown], top) {
+			row := ReportRow{Name: count.Name, Count: count.Count, Previous: previous.counts[breakdown][count.Name]}
+			if current.Servers > 0 {
+				row.Share = float64(count.Count) / float64(current.Servers)
+			}
+			section.Rows = append(section.Rows, row)
+		}
+		report.Sections = append(report.Sections, section)
+	}
+	return report
+}
+
+// formatNumber drops the decimals from whole numbers
+func formatNumber(n float64) string {
+	if n == math.Trunc(n) {
+		return strconv.FormatFloat(n, 'f', 0, 64)
+	}
+	return strconv.FormatFloat(n, 'f', 1, 64)
+}
+
+// formatChange is the difference from previous, and how big it is relative to it
+func formatChange(value, previous float64) string {
+	change := value - previous
+	sign := ""
+	if change > 0 {
+		sign = "+"
+	}
+	if previous == 0 {
+		if change == 0 {
+			return "0"
+		}
+		return sign + formatNumber(change) + " (new)"
+	}
+	return fmt.Sprintf("%s%s (%s%.1f%%)", sign, formatNumber(change), sign, 100*change/previous)
+}
+
+func formatShare(share float64) string {
+	return fmt.Sprintf("%.1f%%", 100*share)
+}
+
+func (r *Report) window() string {
+	return r.Since.Format(time.DateOnly) + " to " + r.Until.Format(time.DateOnly)
+}
+
+func (r *Report) WriteMarkdown(w io.Writer) error {
+	bw := bufio.NewWriter(w)
+	fmt.Fprintf(bw, "# Census %s\n\n", r.window())
+	fmt.Fprintf(bw, "Servers that answered between %s and %s, compared with %s to %s.\n\n",
+		r.Since.Format(time.DateTime), r.Until.Format(time.DateTime), r.PreviousSince.Format(time.DateTime), r.Since.Format(time.DateTime))
+	fmt.Fprintln(bw, "| | This period | Previous period | Change |")
+	fmt.Fprintln(bw, "|---|---:|---:|---:|")
+	for _, m := range r.Metrics {
+		fmt.Fprintf(bw, "| %s | %s | %s | %s |\n", m.Name, formatNumber(m.Value), formatNumber(m.Previous), formatChange(m.Value, m.Previous))
+	}
+	for _, section := range r.Sections {
+		fmt.Fprintf(bw, "\n## %s\n\n", section.Title)
+		if len(section.Rows) == 0 {
+			fmt.Fprintln(bw, "Nothing to show.")
+			continue
+		}
+		fmt.Fprintln(bw, "| | Servers | Share | Change |")
+		fmt.Fprintln(bw, "|---|---:|---:|---:|")
+		for _, row := range section.Rows {
+			fmt.Fprintf(bw, "| %s | %d | %s | %s |\n", markdownCell(row.Name), row.Count, formatShare(row.Share), formatChange(float64(row.Count), float64(row.Previous)))
+		}
+	}
+	fmt.Fprintf(bw, "\nGenerated %s\n", r.GeneratedAt.Format(time.DateTime))
+	return bw.Flush()
+}
+
+// markdownCell keeps a value from breaking out of its table cell
+func markdownCell(s string) string {
+	if s == "" {
+		return "(empty)"
+	}
+	return strings.ReplaceAll(s, "|", `\|`)
+}
+
+func (r *Report) WriteJSON(w io.Writer) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(r)
+}
+
+var reportTemplate = template.Must(template.New("report").Funcs(template.FuncMap{
+	"number": formatNumber,
+	"change": formatChange,
+	"share":  formatShare,
+	"float":  func(n int) float64 { return float64(n) },
+	"width":  func(share float64) string { return fmt.Sprintf("%.1f%%", 100*share) },
+	"date":   func(t time.Time) string { return t.Format(time.DateTime) },
+}).Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>Census {{.Window}}</title>
+<style>
+body { font-family: system-ui, sans-serif; max-width: 60rem; margin: 2rem auto; padding: 0 1rem; color: #222; }
+table { border-collapse: collapse; width: 100%; margin-bottom: 2rem; }
+th, td { padding: 0.3rem 0.6rem; border-bottom: 1px solid #ddd; text-align: right; }
+th:first-child, td:first-child { text-align: left; }
+.bar { position: relative; }
+.bar span { position: absolute; left: 0; top: 15%; bottom: 15%; background: #cde; z-index: -1; }
+.up { color: #1a7f37; }
+.down { color: #cf222e; }
+footer { color: #888; font-size: 0.9rem; }
+</style>
+</head>
+<body>
+<h1>Census {{.Window}}</h1>
+<p>Servers that answered between {{date .Since}} and {{date .Until}}, compared with {{date .PreviousSince}} to {{date .Since}}.</p>
+<table>
+<tr><th></th><th>This period</th><th>Previous period</th><th>Change</th></tr>
+{{range .Metrics}}<tr><td>{{.Name}}</td><td>{{number .Value}}</td><td>{{number .Previous}}</td><td class="{{if gt .Value .Previous}}up{{else if lt .Value .Previous}}down{{end}}">{{change .Value .Previous}}</td></tr>
+{{end}}</table>
+{{range .Sections}}<h2>{{.Title}}</h2>
+{{if .Rows}}<table>
+<tr><th></th><th>Servers</th><th>Share</th><th>Change</th></tr>
+{{range .Rows}}<tr><td class="bar"><span style="width: {{width .Share}}"></span>{{if .Name}}{{.Name}}{{else}}(empty){{end}}</td><td>{{.Count}}</td><td>{{share .Share}}</td><td class="{{if gt .Count .Previous}}up{{else if lt .Count .Previous}}down{{end}}">{{change (float .Count) (float .Previous)}}</td></tr>
+{{end}}</table>
+{{else}}<p>Nothing to show.</p>
+{{end}}{{end}}<footer>Generated {{date .GeneratedAt}}</footer>
+</body>
+</html>
+`))
+
+func (r *Report) WriteHTML(w io.Writer) error {
+	return reportTemplate.Execute(w, struct {
+		*Report
+		Window string
+	}{r, r.window()})
+}
+
+func runReport(args []string) {
+	fs := flag.NewFlagSet("report", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s report [flags]\n", os.Args[0])
+		fmt.Fprintln(fs.Output(), "Takes a census of the servers that answered in a window and compares it with the window before.")
+		fs.PrintDefaults()
+	}
+	storage, location := addStorageFlags(fs)
+	sinceArg := fs.String("since", DEFAULT_REPORT_WINDOW, "start of the window, a time or how long ago (e.g. 7d)")
+	untilArg := fs.String("until", "", "end of the window, defaults to now")
+	format := fs.String("format", "", "markdown, json or html, defaults to the output file extension")
+	output := fs.String("o", "", "output file, stdout when empty")
+	top := fs.Int("top", DEFAULT_REPORT_TOP, "rows in each breakdown")
+	fs.Parse(args)
+
+	since, err := ParseTimeArg(*sinceArg)
+	if err != nil {
+		log.Fatal(err)
+	}
+	until := time.Now()
+	if *untilArg != "" {
+		if until, err = ParseTimeArg(*untilArg); err != nil {
+			log.Fatal(err)
+		}
+	}
+	if since.IsZero() || !since.Before(until) {
+		log.Fatal("report needs a -since before -until")
+	}
+
+	kind := *format
+	if kind == "" {
+		switch {
+		case strings.HasSuffix(*output, ".json"):
+			kind = "json"
+		case strings.HasSuffix(*output, ".html"), strings.HasSuffix(*output, ".htm"):
+			kind = "html"
+		default:
+			kind = "markdown"
+		}
+	}
+	write := map[string]func(*Report, io.Writer) error{
+		"markdown": (*Report).WriteMarkdown,
+		"md":       (*Report).WriteMarkdown,
+		"json":     (*Report).WriteJSON,
+		"html":     (*Report).WriteHTML,
+	}[kind]
+	if write == nil {
+		log.Fatalf("unknown report format %q", kind)
+	}
+
+	store := openStorageReadOnly(*storage, *location)
+	defer store.Close()
+
+	current, err := TakeCensus(store, since, until)
+	if err != nil {
+		log.Fatal(err)
+	}
+	// the previous window is the same length and ends where this one starts,
+	// its last second excluded so no observation counts in both
+	previous, err := TakeCensus(store, since.Add(-until.Sub(since)), since.Add(-time.Nanosecond))
+	if err != nil {
+		log.Fatal(err)
+	}
+	report := NewReport(current, previous, *top)
+
+	var w io.Writer = os.Stdout
+	if *output != "" {
+		f, err := os.Create(*output)
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer f.Close()
+		w = f
+	}
+	if err := write(report, w); err != nil {
+		log.Fatal(err)
+	}
+	slog.Info("Report finished", "servers", current.Servers, "previousServers", previous.Servers)
+}
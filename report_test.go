@@ -0,0 +1,133 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMotdPhrases(t *testing.T) {
+	for motd, want := range map[string]string{
+		"§aA Minecraft Server":                   "[minecraft minecraft server server]",
+		"Join the best server, the BEST server!": "[join best best server server]",
+		"to be or not":                           "[]",
+	} {
+		if got := fmt.Sprint(motdPhrases(motd)); got != want {
+			t.Errorf("%q has phrases %s, want %s", motd, got, want)
+		}
+	}
+}
+
+// censusRecord is an unmodded server at 192.0.2.i with online players
+func censusRecord(i byte, at time.Time, online int) *ServerRecord {
+	r := fullRecord()
+	r.IP, r.Port = net.IPv4(192, 0, 2, i).To4(), DEFAULT_PORT
+	r.ObservedAt = at
+	r.Players.Online = online
+	r.IsFakeSample, r.IsOnlineMode = false, newTrue()
+	r.ForgeData, r.ModInfo, r.IsModded, r.ModpackData = nil, nil, nil, nil
+	return r
+}
+
+func TestCensusReport(t *testing.T) {
+	store := openTestBadger(t)
+	until := time.Date(2025, 3, 21, 0, 0, 0, 0, time.UTC)
+	since, previousSince := until.AddDate(0, 0, -7), until.AddDate(0, 0, -14)
+
+	// .1 upgraded to paper since the previous week, .2 is modded and .3 doesn't say much
+	upgraded := censusRecord(1, until.AddDate(0, 0, -10), 2)
+	upgraded.Version = VersionInfo{Name: "1.20.4", Protocol: 765}
+	modded := fullRecord()
+	modded.IP, modded.Port = net.IPv4(192, 0, 2, 2).To4(), DEFAULT_PORT
+	modded.ObservedAt = until.AddDate(0, 0, -1)
+	quiet := censusRecord(3, until.AddDate(0, 0, -3), 4)
+	quiet.Version.Name = "1.21.1"
+	quiet.IsOnlineMode, quiet.Enrichment = nil, nil
+	quiet.Description = "Join the best server"
+	records := []*ServerRecord{upgraded, censusRecord(1, until.AddDate(0, 0, -4), 6), censusRecord(1, until.AddDate(0, 0, -2), 10), modded, quiet}
+	if err := store.PutObservations(records); err != nil {
+		t.Fatal(err)
+	}
+
+	current, err := TakeCensus(store, since, until)
+	if err != nil {
+		t.Fatal(err)
+	}
+	previous, err := TakeCensus(store, previousSince, since)
+	if err != nil {
+		t.Fatal(err)
+	}
+	report := NewReport(current, previous, 2)
+	report.GeneratedAt = until
+
+	metrics := make(map[string][2]float64)
+	for _, m := range report.Metrics {
+		metrics[m.Name] = [2]float64{m.Value, m.Previous}
+	}
+	// each server counts once, as it was last seen in the window
+	for name, want := range map[string][2]float64{
+		"Servers":               {3, 1},
+		"Players online":        {15, 2},
+		"Median players online": {4, 2},
+		"Player slots":          {60, 20},
+		"Online mode":           {1, 1},
+		"Offline mode":          {1, 0},
+		"Fake player sample":    {1, 0},
+		"Modded":                {1, 0},
+		"Vanilla":               {2, 1},
+	} {
+		if metrics[name] != want {
+			t.Errorf("%s is %v, want %v", name, metrics[name], want)
+		}
+	}
+
+	sections := make(map[string]string)
+	for _, section := range report.Sections {
+		var rows []string
+		for _, row := range section.Rows {
+			rows = append(rows, fmt.Sprintf("%s %d %.2f %d", row.Name, row.Count, row.Share, row.Previous))
+		}
+		sections[section.Title] = strings.Join(rows, ", ")
+	}
+	for title, want := range map[string]string{
+		BREAKDOWN_VERSION:  "Paper 1.21.1 2 0.67 0, 1.21.1 1 0.33 0",
+		BREAKDOWN_PROTOCOL: "767 3 1.00 0",
+		BREAKDOWN_MOTD:     "server 3 1.00 1, minecraft 2 0.67 1",
+		BREAKDOWN_COUNTRY:  "NL 2 0.67 1",
+		BREAKDOWN_ASN:      "AS64496 EXAMPLE-AS 2 0.67 1",
+	} {
+		if sections[title] != want {
+			t.Errorf("%s are %q, want %q", title, sections[title], want)
+		}
+	}
+
+	var md bytes.Buffer
+	if err := report.WriteMarkdown(&md); err != nil {
+		t.Fatal(err)
+	}
+	for _, line := range []string{
+		"# Census 2025-03-14 to 2025-03-21\n",
+		"| Servers | 3 | 1 | +2 (+200.0%) |\n",
+		"| Modded | 1 | 0 | +1 (new) |\n",
+		"| Paper 1.21.1 | 2 | 66.7% | +2 (new) |\n",
+		"| NL | 2 | 66.7% | +1 (+100.0%) |\n",
+		"\nGenerated 2025-03-21 00:00:00\n",
+	} {
+		if !strings.Contains(md.String(), line) {
+			t.Errorf("markdown is missing %q:\n%s", line, md.String())
+		}
+	}
+
+	var html bytes.Buffer
+	if err := report.WriteHTML(&html); err != nil {
+		t.Fatal(err)
+	}
+	for _, part := range []string{"<title>Census 2025-03-14 to 2025-03-21</title>", "<h2>Networks</h2>", `<td>Servers</td><td>3</td><td>1</td><td class="up">&#43;2 (&#43;200.0%)</td>`} {
+		if !strings.Contains(html.String(), part) {
+			t.Errorf("html is missing %q", part)
+		}
+	}
+}
@@ -0,0 +1,240 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/fs"
+	"log"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"time"
+
+	badger "github.com/dgraph-io/badger/v4"
+)
+
+const (
+	DOWNSAMPLE_NONE = "none"
+	DOWNSAMPLE_DAY  = "day"
+	DOWNSAMPLE_WEEK = "week"
+)
+
+// value log files with at least this fraction of garbage get rewritten
+const DEFAULT_GC_RATIO = 0.5
+
+// observationEntry is a key written for an observation made at observedAt. With a
+// ttl it expires that long after, 0 keeps it until maintain removes it. Rebuilds and
+// other maintenance rewrites pass 0, they don't take -ttl.
+func observationEntry(key, val []byte, observedAt time.Time, ttl time.Duration) *badger.Entry {
+	entry := badger.NewEntry(key, val)
+	if ttl > 0 {
+		entry.ExpiresAt = uint64(observedAt.Add(ttl).Unix())
+	}
+	return entry
+}
+
+// addTTLFlag registers -ttl for the modes that write observations, the returned func
+// reads it once the flags are parsed
+func addTTLFlag(fs *flag.FlagSet) func() time.Duration {
+	ttl := fs.String("ttl", "", "let badger expire observations this long after they were made (e.g. 180d), empty keeps them")
+	return func() time.Duration {
+		if *ttl == "" {
+			return 0
+		}
+		age, err := ParseAge(*ttl)
+		if err != nil || age <= 0 {
+			log.Fatalf("invalid ttl %q", *ttl)
+		}
+		return age
+	}
+}
+
+type RetentionConfig struct {
+	FullDetail  time.Duration // observations younger than this are all kept, 0 keeps everything
+	Downsample  string        // what older observations are thinned to
+	ExpireAfter time.Duration // servers not seen for this long are deleted, 0 keeps them
+}
+
+type RetentionReport struct {
+	Downsampled    int // observations dropped by downsampling
+	ExpiredServers int
+	Expired        int // observations of expired servers
+}
+
+// downsampleBucket is the period an observation falls into, only the first one of each is kept
+func downsampleBucket(t time.Time, downsample string) int64 {
+	switch downsample {
+	case DOWNSAMPLE_WEEK:
+		return t.Unix() / int64(7*24*time.Hour/time.Second)
+	case DOWNSAMPLE_DAY:
+		return t.Unix() / int64(24*time.Hour/time.Second)
+	default:
+		return t.Unix()
+	}
+}
+
+// serverLastSeen maps every server's key prefix to the time of its newest observation
+func serverLastSeen(db *badger.DB) (map[string]time.Time, error) {
+	lastSeen := make(map[string]time.Time)
+	err := db.View(func(txn *badger.Txn) error {
+		opts := badger.DefaultIteratorOptions
+		opts.PrefetchValues = false
+		opts.Prefix = []byte(SERVER_PREFIX)
+		it := txn.NewIterator(opts)
+		defer it.Close()
+		for it.Rewind(); it.Valid(); it.Next() {
+			if _, _, t, ok := ParseServerKey(it.Item().Key()); ok {
+				// keys sort by time within a server, so the last write wins
+				lastSeen[string(it.Item().Key()[:serverKeyLength-8])] = t
+			}
+		}
+		return nil
+	})
+	return lastSeen, err
+}
+
+// ApplyRetention downsamples old observations and deletes servers that haven't been seen in a while
+func ApplyRetention(db *badger.DB, cfg RetentionConfig, now time.Time) (RetentionReport, error) {
+	var report RetentionReport
+	var lastSeen map[string]time.Time
+	if cfg.ExpireAfter > 0 {
+		var err error
+		if lastSeen, err = serverLastSeen(db); err != nil {
+			return report, err
+		}
+	}
+	detailCutoff := now.Add(-cfg.FullDetail)
+	expiryCutoff := now.Add(-cfg.ExpireAfter)
+
+	var server string
+	var bucket int64
+	expired := false
+	_, _, err := RewriteHistory(db, func(r *ServerRecord) (RewriteAction, error) {
+		if prefix := string(ServerKeyPrefix(r.IP, r.Port)); prefix != server {
+			server = prefix
+			bucket = -1
+			expired = cfg.ExpireAfter > 0 && lastSeen[prefix].Before(expiryCutoff)
+			if expired {
+				report.ExpiredServers++
+			}
+		}
+		if expired {
+			report.Expired++
+			return REWRITE_DELETE, nil
+		}
+		if cfg.FullDetail <= 0 || cfg.Downsample == DOWNSAMPLE_NONE || !r.ObservedAt.Before(detailCutoff) {
+			return REWRITE_KEEP, nil
+		}
+		b := downsampleBucket(r.ObservedAt, cfg.Downsample)
+		if b == bucket {
+			report.Downsampled++
+			return REWRITE_DELETE, nil
+		}
+		bucket = b
+		return REWRITE_KEEP, nil
+	})
+	return report, err
+}
+
+// dirSize is how much space the database takes on disk
+func dirSize(dir string) (int64, error) {
+	var size int64
+	err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !d.IsDir() {
+			info, err := d.Info()
+			if err != nil {
+				return err
+			}
+			size += info.Size()
+		}
+		return nil
+	})
+	return size, err
+}
+
+// CompactDB flattens the LSM tree so deleted and expired keys are dropped, then
+// rewrites value log files until none has enough garbage left to be worth it
+func CompactDB(db *badger.DB, gcRatio float64) (int, error) {
+	if err := db.Flatten(2); err != nil {
+		return 0, err
+	}
+	rewritten := 0
+	for {
+		err := db.RunValueLogGC(gcRatio)
+		if err == badger.ErrNoRewrite {
+			return rewritten, nil
+		}
+		if err != nil {
+			return rewritten, err
+		}
+		rewritten++
+	}
+}
+
+func runMaintain(args []string) {
+	flags := flag.NewFlagSet("maintain", flag.ExitOnError)
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: %s maintain [flags]\n", os.Args[0])
+		flags.PrintDefaults()
+	}
+	dir := flags.String("db", BADGER_DIR, "badger directory")
+	fullDetail := flags.String("full-detail", "", "keep every observation younger than this (e.g. 30d) and downsample older ones, empty keeps full detail forever")
+	downsample := flags.String("downsample", DOWNSAMPLE_DAY, "keep one observation per server per day, week or none once past -full-detail")
+	expire := flags.String("expire", "", "delete servers that haven't been seen for this long (e.g. 180d), empty keeps them")
+	gcRatio := flags.Float64("gc-ratio", DEFAULT_GC_RATIO, "rewrite value log files with at least this fraction of garbage")
+	flags.Parse(args)
+
+	var cfg RetentionConfig
+	cfg.Downsample = *downsample
+	if cfg.Downsample != DOWNSAMPLE_NONE && cfg.Downsample != DOWNSAMPLE_DAY && cfg.Downsample != DOWNSAMPLE_WEEK {
+		log.Fatalf("unknown downsample period %q", cfg.Downsample)
+	}
+	for _, arg := range []struct {
+		value string
+		out   *time.Duration
+	}{{*fullDetail, &cfg.FullDetail}, {*expire, &cfg.ExpireAfter}} {
+		if arg.value == "" {
+			continue
+		}
+		age, err := ParseAge(arg.value)
+		if err != nil || age <= 0 {
+			log.Fatalf("invalid age %q", arg.value)
+		}
+		*arg.out = age
+	}
+
+	before, err := dirSize(*dir)
+	if err != nil {
+		log.Fatal(err)
+	}
+	db, err := badger.Open(badger.DefaultOptions(*dir))
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer db.Close()
+
+	if cfg.FullDetail > 0 || cfg.ExpireAfter > 0 {
+		report, err := ApplyRetention(db, cfg, time.Now())
+		if err != nil {
+			log.Fatal(err)
+		}
+		slog.Info("Applied retention", "downsampled", report.Downsampled, "expiredServers", report.ExpiredServers, "expired", report.Expired)
+	}
+
+	rewritten, err := CompactDB(db, *gcRatio)
+	if err != nil {
+		log.Fatal(err)
+	}
+	// sizes are only final once badger has closed its files
+	if err := db.Close(); err != nil {
+		log.Fatal(err)
+	}
+	after, err := dirSize(*dir)
+	if err != nil {
+		log.Fatal(err)
+	}
+	slog.Info("Compaction finished", "vlogFilesRewritten", rewritten, "before", before, "after", after, "reclaimed", before-after)
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestObservationTTL(t *testing.T) {
+	store := openTestBadger(t)
+	store.TTL = 2 * time.Hour
+	// badger expires keys by the wall clock, so the history is laid out around it
+	now := time.Now().UTC().Truncate(time.Second)
+	record := func(age time.Duration, online int) *ServerRecord {
+		r := fullRecord()
+		r.ObservedAt = now.Add(-age)
+		r.Players.Online = online
+		return r
+	}
+	// the first is already past the ttl and never shows up, the keyframe after it
+	// expires a second from now and takes the two deltas on it along
+	keyframe := record(store.TTL-time.Second, 2)
+	old := []*ServerRecord{record(3*time.Hour, 1), keyframe, record(time.Hour, 3), record(30*time.Minute, 4)}
+	if err := store.PutObservations(old); err != nil {
+		t.Fatal(err)
+	}
+	ip, port := keyframe.IP, keyframe.Port
+	history := collectRecords(t, func(fn func(*ServerRecord) error) error {
+		return store.History(ip, port, time.Time{}, time.Time{}, fn)
+	})
+	if len(history) != 3 || !history[0].ObservedAt.Equal(keyframe.ObservedAt) {
+		t.Fatalf("history has %d observations, want the 3 inside the ttl", len(history))
+	}
+
+	for expiry := keyframe.ObservedAt.Add(store.TTL).Unix(); time.Now().Unix() < expiry; {
+		time.Sleep(50 * time.Millisecond)
+	}
+	latest, err := store.Latest(ip, port)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if latest != nil {
+		t.Errorf("deltas without their keyframe still read as %+v", latest)
+	}
+
+	// the next observation can't build on what's left, even though the chain was
+	// cached when the keyframe was still there, so it starts a new one
+	next := record(0, 5)
+	if err := store.PutObservations([]*ServerRecord{next}); err != nil {
+		t.Fatal(err)
+	}
+	servers := make(map[string]string)
+	for key, val := range dumpDB(t, store) {
+		if _, _, _, ok := ParseServerKey([]byte(key)); ok {
+			servers[key] = val
+		}
+	}
+	if len(servers) != 3 || servers[string(next.Key())] != "keyframe" {
+		t.Errorf("stored %v, want the two live deltas and a keyframe", servers)
+	}
+	latest, err = store.Latest(ip, port)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertSameRecord(t, latest, next)
+	history = collectRecords(t, func(fn func(*ServerRecord) error) error {
+		return store.History(ip, port, time.Time{}, time.Time{}, fn)
+	})
+	if len(history) != 1 || !history[0].ObservedAt.Equal(next.ObservedAt) {
+		t.Errorf("history has %d observations, want only the new one", len(history))
+	}
+
+	// index entries expire with the observations that wrote them
+	var entries []IndexEntry
+	err = store.LookupIndex(INDEX_PROTOCOL, "767", false, func(entry IndexEntry) error {
+		entries = append(entries, entry)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 || !entries[0].Time.Equal(next.ObservedAt) {
+		t.Errorf("index has %+v, want only the new observation", entries)
+	}
+}
@@ -0,0 +1,639 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"path"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/google/uuid"
+)
+
+// The query language used by `query -q`, /api/servers?q= and the dashboard:
+//
+//	version:1.20.* players.online>10 motd:"survival games" mod:create -fake
+//
+// Terms are separated by spaces and all have to match, a leading - negates one.
+// Bare words and quoted phrases are searched for in the MOTD, bare flags like fake
+// or modded mean fake:true. Terms an index can answer pick the candidate servers,
+// everything else is checked against them, and with nothing indexable every server
+// is scanned.
+
+// Comparison operators, longest first so >= isn't read as >
+var QUERY_OPS = []string{">=", "<=", ":", "=", ">", "<"}
+
+const QUERY_EQ = ":"
+
+// fields that can be written on their own, meaning field:true
+var QUERY_FLAGS = []string{"fake", "modded", "online-mode"}
+
+var QUERY_ALIASES = map[string]string{
+	"players": "players.online",
+	"online":  "players.online",
+	"max":     "players.max",
+	"mods":    "mod",
+}
+
+// QUERY_FIELDS set up a term's check, and the index lookups that find every server it can match
+var QUERY_FIELDS = map[string]func(q *Query, t *QueryTerm) error{
+	"version":  compileVersion,
+	"protocol": compileProtocol,
+	"software": compileSoftware,
+	"players.online": compareField(func(r *ServerRecord) (int, bool) {
+		if r.Players == nil {
+			return 0, false
+		}
+		return r.Players.Online, true
+	}),
+	"players.max": compareField(func(r *ServerRecord) (int, bool) {
+		if r.Players == nil {
+			return 0, false
+		}
+		return r.Players.Max, true
+	}),
+	"player":      compilePlayer,
+	"motd":        compileMOTD,
+	"mod":         compileMod,
+	"modpack":     compileModpack,
+	"favicon":     compileFavicon,
+	"country":     compileCountry,
+	"asn":         compileASN,
+	"hostname":    compileHostname,
+	"ip":          compileIP,
+	"since":       compileWindow,
+	"until":       compileWindow,
+	"fake":        boolField(func(r *ServerRecord) bool { return r.IsFakeSample }),
+	"modded":      boolField((*ServerRecord).Modded),
+	"online-mode": boolField(func(r *ServerRecord) bool { return r.IsOnlineMode != nil && *r.IsOnlineMode }),
+}
+
+// QueryTerm is one condition of a query
+type QueryTerm struct {
+	Field  string // empty for words searched in the MOTD
+	Op     string
+	Value  string
+	Negate bool
+
+	match   func(*ServerRecord) bool // nil for terms that only narrow the window
+	lookups []IndexLookup            // every server the term matches is under all of these
+}
+
+func (t QueryTerm) String() string {
+	s := t.Value
+	if s == "" || strings.ContainsAny(s, " \t\"\\") {
+		s = `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(s) + `"`
+	}
+	switch {
+	case t.Field != "" && t.Op == "":
+		s = t.Field
+	case t.Field != "":
+		s = t.Field + t.Op + s
+	}
+	if t.Negate {
+		s = "-" + s
+	}
+	return s
+}
+
+// IndexLookup is one LookupIndex call
+type IndexLookup struct {
+	Kind   string `json:"kind"`
+	Term   string `json:"term"`
+	Prefix bool   `json:"prefix,omitempty"`
+}
+
+// Query is a parsed query, ready to run
+type Query struct {
+	Filter RecordFilter // the network and time window, plus whatever the flags set
+	Terms  []QueryTerm
+}
+
+// ParseQuery parses text on top of filter, which a query with no terms returns unchanged
+func ParseQuery(text string, filter RecordFilter) (*Query, error) {
+	tokens, err := tokenizeQuery(text)
+	if err != nil {
+		return nil, err
+	}
+	q := &Query{Filter: filter}
+	for _, token := range tokens {
+		t, err := parseTerm(token)
+		if err != nil {
+			return nil, err
+		}
+		compile := compileMOTD
+		if t.Field != "" {
+			compile = QUERY_FIELDS[t.Field]
+		}
+		if err := compile(q, &t); err != nil {
+			return nil, fmt.Errorf("%s: %w", t, err)
+		}
+		q.Terms = append(q.Terms, t)
+	}
+	return q, nil
+}
+
+// queryToken is a term with its quotes taken out
+type queryToken struct {
+	text   string
+	quoted int // where the first quoted part of text starts, -1 when nothing was quoted
+}
+
+// tokenizeQuery splits at spaces outside double quotes, inside them \ escapes the next character
+func tokenizeQuery(text string) ([]queryToken, error) {
+	var tokens []queryToken
+	var b strings.Builder
+	quoted, inQuotes, escaped, started := -1, false, false, false
+	for _, c := range text {
+		switch {
+		case escaped:
+			b.WriteRune(c)
+			escaped = false
+		case inQuotes && c == '\\':
+			escaped = true
+		case c == '"':
+			if !inQuotes && quoted < 0 {
+				quoted = b.Len()
+			}
+			inQuotes = !inQuotes
+			started = true
+		case !inQuotes && unicode.IsSpace(c):
+			if started {
+				tokens = append(tokens, queryToken{b.String(), quoted})
+			}
+			b.Reset()
+			quoted, started = -1, false
+		default:
+			b.WriteRune(c)
+			started = true
+		}
+	}
+	if inQuotes {
+		return nil, errors.New("unterminated quote")
+	}
+	if started {
+		tokens = append(tokens, queryToken{b.String(), quoted})
+	}
+	return tokens, nil
+}
+
+func parseTerm(token queryToken) (QueryTerm, error) {
+	var t QueryTerm
+	text, quoted := token.text, token.quoted
+	if len(text) > 1 && text[0] == '-' && quoted != 0 {
+		t.Negate = true
+		text = text[1:]
+		if quoted > 0 {
+			quoted--
+		}
+	}
+	// only the unquoted start can be a field, so "a:b" searches for a:b
+	head := text
+	if quoted >= 0 {
+		head = text[:quoted]
+	}
+	field := strings.ToLower(head[:strings.IndexFunc(head+" ", func(c rune) bool {
+		return !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c == '.' || c == '-')
+	})])
+	if field != "" {
+		for _, op := range QUERY_OPS {
+			if !strings.HasPrefix(head[len(field):], op) {
+				continue
+			}
+			t.Value = text[len(field)+len(op):]
+			if canonical, ok := QUERY_ALIASES[field]; ok {
+				field = canonical
+			}
+			if _, ok := QUERY_FIELDS[field]; !ok {
+				return t, fmt.Errorf("unknown field %q, quote it to search the MOTD for it", field)
+			}
+			t.Field, t.Op = field, op
+			if op == "=" {
+				t.Op = QUERY_EQ
+			}
+			if t.Value == "" {
+				return t, fmt.Errorf("%s has no value", t.Field)
+			}
+			return t, nil
+		}
+		if quoted < 0 && slices.Contains(QUERY_FLAGS, field) && len(field) == len(text) {
+			t.Field = field
+			return t, nil
+		}
+	}
+	t.Value = text
+	return t, nil
+}
+
+// equalsOnly rejects comparisons on fields that can't be ordered
+func equalsOnly(t *QueryTerm) error {
+	if t.Op != QUERY_EQ {
+		return fmt.Errorf("%s can't be compared with %s", t.Field, t.Op)
+	}
+	return nil
+}
+
+// compareField checks a number, get returns false when the record doesn't have one
+func compareField(get func(*ServerRecord) (int, bool)) func(q *Query, t *QueryTerm) error {
+	return func(q *Query, t *QueryTerm) error {
+		n, err := strconv.Atoi(t.Value)
+		if err != nil {
+			return fmt.Errorf("%s needs a number", t.Field)
+		}
+		compare := map[string]func(int) bool{
+			QUERY_EQ: func(v int) bool { return v == n },
+			">":      func(v int) bool { return v > n },
+			">=":     func(v int) bool { return v >= n },
+			"<":      func(v int) bool { return v < n },
+			"<=":     func(v int) bool { return v <= n },
+		}[t.Op]
+		t.match = func(r *ServerRecord) bool {
+			v, ok := get(r)
+			return ok && compare(v)
+		}
+		return nil
+	}
+}
+
+func boolField(get func(*ServerRecord) bool) func(q *Query, t *QueryTerm) error {
+	return func(q *Query, t *QueryTerm) error {
+		want := true
+		if t.Op != "" {
+			if err := equalsOnly(t); err != nil {
+				return err
+			}
+			var err error
+			if want, err = strconv.ParseBool(t.Value); err != nil {
+				return fmt.Errorf("%s is true or false", t.Field)
+			}
+		}
+		t.match = func(r *ServerRecord) bool { return get(r) == want }
+		return nil
+	}
+}
+
+func compileVersion(q *Query, t *QueryTerm) error {
+	t.match = func(r *ServerRecord) bool { return matchVersion(t.Value, r.Version.Name) }
+	return equalsOnly(t)
+}
+
+func compileProtocol(q *Query, t *QueryTerm) error {
+	if err := compareField(func(r *ServerRecord) (int, bool) { return r.Version.Protocol, true })(q, t); err != nil {
+		return err
+	}
+	if t.Op == QUERY_EQ {
+		t.lookups = []IndexLookup{{Kind: INDEX_PROTOCOL, Term: t.Value}}
+	}
+	return nil
+}
+
+func compileSoftware(q *Query, t *QueryTerm) error {
+	family := strings.ToLower(t.Value)
+	t.match = func(r *ServerRecord) bool { return SoftwareFamily(r) == family }
+	t.lookups = []IndexLookup{{Kind: INDEX_SOFTWARE, Term: family}}
+	return equalsOnly(t)
+}
+
+// compilePlayer takes a UUID or a name, which ends in * to match the start of one.
+// Like the player index it ignores fake samples.
+func compilePlayer(q *Query, t *QueryTerm) error {
+	if err := equalsOnly(t); err != nil {
+		return err
+	}
+	if id, err := uuid.Parse(t.Value); err == nil {
+		t.lookups = []IndexLookup{{Kind: INDEX_PLAYER_UUID, Term: id.String()}}
+		t.match = func(r *ServerRecord) bool {
+			return r.Players != nil && r.Players.Sample != nil && !r.IsFakeSample && slices.ContainsFunc(*r.Players.Sample, func(p SamplePlayer) bool {
+				return p.ID != nil && *p.ID == id
+			})
+		}
+		return nil
+	}
+	name, prefix := strings.CutSuffix(strings.ToLower(t.Value), "*")
+	t.lookups = []IndexLookup{{Kind: INDEX_PLAYER_NAME, Term: name, Prefix: prefix}}
+	t.match = func(r *ServerRecord) bool {
+		if r.IsFakeSample {
+			return false
+		}
+		return slices.ContainsFunc(r.SampleNames(), func(sampled string) bool {
+			sampled = strings.ToLower(sampled)
+			return sampled == name || prefix && strings.HasPrefix(sampled, name)
+		})
+	}
+	return nil
+}
+
+// compileMOTD matches whole words in order, so "survival games" doesn't match "games
+// survival" or "nosurvival games". A * at the end matches the start of the last word.
+// The index skips very long words and MOTDs past MAX_MOTD_TOKENS words, so searches
+// using it can miss those.
+func compileMOTD(q *Query, t *QueryTerm) error {
+	if t.Field != "" {
+		if err := equalsOnly(t); err != nil {
+			return err
+		}
+	}
+	words := motdWords(t.Value)
+	if len(words) == 0 {
+		return errors.New("no words to search for")
+	}
+	prefix := strings.HasSuffix(t.Value, "*")
+	t.match = func(r *ServerRecord) bool { return containsPhrase(motdWords(r.Description), words, prefix) }
+	for i, word := range words {
+		if n := len([]rune(word)); n < MIN_MOTD_TOKEN || n > MAX_MOTD_TOKEN {
+			continue
+		}
+		t.lookups = append(t.lookups, IndexLookup{Kind: INDEX_MOTD, Term: word, Prefix: prefix && i == len(words)-1})
+	}
+	return nil
+}
+
+// containsPhrase looks for phrase as consecutive words, the last only needing to start with its word when prefix is set
+func containsPhrase(words, phrase []string, prefix bool) bool {
+	last := len(phrase) - 1
+	for start := 0; start+len(phrase) <= len(words); start++ {
+		if slices.Equal(words[start:start+last], phrase[:last]) &&
+			(words[start+last] == phrase[last] || prefix && strings.HasPrefix(words[start+last], phrase[last])) {
+			return true
+		}
+	}
+	return false
+}
+
+// compileMod matches a mod ID, or a glob of them
+func compileMod(q *Query, t *QueryTerm) error {
+	pattern := strings.ToLower(t.Value)
+	t.match = func(r *ServerRecord) bool {
+		return slices.ContainsFunc(r.ModIDs(), func(id string) bool {
+			ok, _ := path.Match(pattern, strings.ToLower(id))
+			return ok
+		})
+	}
+	return equalsOnly(t)
+}
+
+func compileModpack(q *Query, t *QueryTerm) error {
+	name := strings.ToLower(t.Value)
+	t.match = func(r *ServerRecord) bool {
+		return r.ModpackData != nil && strings.Contains(strings.ToLower(r.ModpackData.Name), name)
+	}
+	return equalsOnly(t)
+}
+
+func compileFavicon(q *Query, t *QueryTerm) error {
+	hash := strings.ToLower(t.Value)
+	t.match = func(r *ServerRecord) bool { return r.Favicon != nil && FaviconHash(*r.Favicon) == hash }
+	t.lookups = []IndexLookup{{Kind: INDEX_FAVICON, Term: hash}}
+	return equalsOnly(t)
+}
+
+func compileCountry(q *Query, t *QueryTerm) error {
+	t.match = func(r *ServerRecord) bool {
+		return r.Enrichment != nil && strings.EqualFold(r.Enrichment.Country, t.Value)
+	}
+	return equalsOnly(t)
+}
+
+func compileASN(q *Query, t *QueryTerm) error {
+	t.Value = strings.TrimPrefix(strings.ToUpper(t.Value), "AS")
+	return compareField(func(r *ServerRecord) (int, bool) {
+		if r.Enrichment == nil || r.Enrichment.ASN == 0 {
+			return 0, false
+		}
+		return int(r.Enrichment.ASN), true
+	})(q, t)
+}
+
+func compileHostname(q *Query, t *QueryTerm) error {
+	name := strings.ToLower(t.Value)
+	t.match = func(r *ServerRecord) bool {
+		return slices.ContainsFunc(r.Hostnames, func(h Hostname) bool { return strings.Contains(strings.ToLower(h.Name), name) })
+	}
+	return equalsOnly(t)
+}
+
+// compileIP also narrows the scan to the network, unless the flags already did
+func compileIP(q *Query, t *QueryTerm) error {
+	network, err := ParseNetwork(t.Value)
+	if err != nil {
+		return err
+	}
+	t.match = func(r *ServerRecord) bool { return network.Contains(r.IP) }
+	if !t.Negate && q.Filter.Network == nil {
+		q.Filter.Network = network
+	}
+	return equalsOnly(t)
+}
+
+// compileWindow sets since or until, which work like the flags of the same name
+func compileWindow(q *Query, t *QueryTerm) error {
+	if t.Negate {
+		return fmt.Errorf("%s can't be negated", t.Field)
+	}
+	if err := equalsOnly(t); err != nil {
+		return err
+	}
+	at, err := ParseTimeArg(t.Value)
+	if err != nil {
+		return err
+	}
+	if t.Field == "since" {
+		q.Filter.Since = at
+	} else {
+		q.Filter.Until = at
+	}
+	return nil
+}
+
+// Match checks the filter and every term
+func (q *Query) Match(r *ServerRecord) bool {
+	return q.Filter.Match(r) && q.matchTerms(r)
+}
+
+func (q *Query) matchTerms(r *ServerRecord) bool {
+	for _, t := range q.Terms {
+		if t.match != nil && t.match(r) == t.Negate {
+			return false
+		}
+	}
+	return true
+}
+
+// QueryPlan is how a query will be run
+type QueryPlan struct {
+	// candidates are the servers found by every lookup, no lookups means scanning every server
+	Lookups []IndexLookup `json:"lookups,omitempty"`
+	Network string        `json:"network,omitempty"`
+	Since   string        `json:"since,omitempty"`
+	Until   string        `json:"until,omitempty"`
+	// terms checked against each candidate
+	Check []string `json:"check"`
+}
+
+func (q *Query) Plan() QueryPlan {
+	plan := QueryPlan{Check: []string{}}
+	if q.Filter.Network != nil {
+		plan.Network = q.Filter.Network.String()
+	}
+	if !q.Filter.Since.IsZero() {
+		plan.Since = q.Filter.Since.Format(time.RFC3339)
+	}
+	if !q.Filter.Until.IsZero() {
+		plan.Until = q.Filter.Until.Format(time.RFC3339)
+	}
+	for _, t := range q.Terms {
+		// a negated term can match servers that aren't in its index
+		if !t.Negate {
+			for _, lookup := range t.lookups {
+				if !slices.Contains(plan.Lookups, lookup) {
+					plan.Lookups = append(plan.Lookups, lookup)
+				}
+			}
+		}
+		if t.match != nil {
+			plan.Check = append(plan.Check, t.String())
+		}
+	}
+	return plan
+}
+
+func (p QueryPlan) String() string {
+	var b strings.Builder
+	if len(p.Lookups) == 0 {
+		b.WriteString("scan every server")
+	} else {
+		b.WriteString("look up")
+		for i, lookup := range p.Lookups {
+			if i > 0 {
+				b.WriteString(" and")
+			}
+			fmt.Fprintf(&b, " %s %q", lookup.Kind, lookup.Term)
+			if lookup.Prefix {
+				b.WriteString("*")
+			}
+		}
+	}
+	if p.Network != "" {
+		b.WriteString(" in " + p.Network)
+	}
+	if p.Since != "" {
+		b.WriteString(" seen since " + p.Since)
+	}
+	if p.Until != "" {
+		b.WriteString(" until " + p.Until)
+	}
+	if len(p.Check) > 0 {
+		b.WriteString(", then check " + strings.Join(p.Check, " "))
+	}
+	return b.String()
+}
+
+// Run calls fn for every record matching the query, like Storage.Scan. Without
+// index lookups it is a scan, otherwise the candidates are read one at a time,
+// in the same order a scan would find them.
+func (q *Query) Run(store Storage, latest bool, fn func(*ServerRecord) error) error {
+	plan := q.Plan()
+	if len(plan.Lookups) == 0 {
+		return store.Scan(&q.Filter, latest, func(r *ServerRecord) error {
+			if !q.matchTerms(r) {
+				return nil
+			}
+			return fn(r)
+		})
+	}
+	candidates, err := q.candidates(store, plan.Lookups)
+	if err != nil {
+		return err
+	}
+	stopped := false
+	emit := func(r *ServerRecord) error {
+		if !q.Match(r) {
+			return nil
+		}
+		err := fn(r)
+		stopped = errors.Is(err, errStopScan)
+		return err
+	}
+	for _, order := range candidates {
+		ip, port := uint32ToIP(uint32(order>>16)), uint16(order)
+		if latest && q.Filter.Since.IsZero() && q.Filter.Until.IsZero() {
+			record, err := store.Latest(ip, port)
+			if err == nil && record != nil {
+				err = emit(record)
+			}
+			if stopped {
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+			continue
+		}
+		var newest *ServerRecord
+		err := store.History(ip, port, q.Filter.Since, q.Filter.Until, func(r *ServerRecord) error {
+			if latest {
+				newest = r
+				return nil
+			}
+			return emit(r)
+		})
+		if err == nil && newest != nil {
+			err = emit(newest)
+		}
+		// History swallows errStopScan, so stopping is noticed here
+		if stopped {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// candidates returns the servers, in serverOrder, with an observation inside the
+// window under every lookup. They're collected before anything else is read, since
+// SQLite can't run a second query while the lookup is still going.
+func (q *Query) candidates(store Storage, lookups []IndexLookup) ([]uint64, error) {
+	var found map[uint64]bool
+	for _, lookup := range lookups {
+		hits := make(map[uint64]bool)
+		err := store.LookupIndex(lookup.Kind, lookup.Term, lookup.Prefix, func(e IndexEntry) error {
+			// badger entries mark where a term started to apply, which for an observation
+			// inside the window is no earlier than the start of the window's index period
+			if !q.Filter.Since.IsZero() && e.Time.Before(indexPeriodStart(q.Filter.Since)) {
+				return nil
+			}
+			if !q.Filter.Until.IsZero() && e.Time.After(q.Filter.Until) {
+				return nil
+			}
+			if q.Filter.Network != nil && !q.Filter.Network.Contains(e.IP) {
+				return nil
+			}
+			if !q.Filter.pastCursor(e.IP, e.Port) {
+				return nil
+			}
+			order := serverOrder(e.IP, e.Port)
+			if found == nil || found[order] {
+				hits[order] = true
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+		found = hits
+		if len(found) == 0 {
+			break
+		}
+	}
+	candidates := make([]uint64, 0, len(found))
+	for order := range found {
+		candidates = append(candidates, order)
+	}
+	slices.Sort(candidates)
+	return candidates, nil
+}
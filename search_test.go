@@ -0,0 +1,236 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTokenizeQuery(t *testing.T) {
+	for _, c := range []struct {
+		text string
+		want []queryToken
+		err  bool
+	}{
+		{"  paper   fake ", []queryToken{{"paper", -1}, {"fake", -1}}, false},
+		{`motd:"survival games" mod:create`, []queryToken{{"motd:survival games", 5}, {"mod:create", -1}}, false},
+		{`-"hello world"`, []queryToken{{"-hello world", 1}}, false},
+		{`"say \"hi\" \\o/"`, []queryToken{{`say "hi" \o/`, 0}}, false},
+		{`""`, []queryToken{{"", 0}}, false},
+		{`motd:"open`, nil, true},
+		{`a"b c`, nil, true},
+		{"", nil, false},
+	} {
+		got, err := tokenizeQuery(c.text)
+		if (err != nil) != c.err {
+			t.Errorf("%q: error %v, want one %v", c.text, err, c.err)
+			continue
+		}
+		if !reflect.DeepEqual(got, c.want) {
+			t.Errorf("%q: tokens %+v, want %+v", c.text, got, c.want)
+		}
+	}
+}
+
+// describe lists the terms of a query the way they were read, without their compiled checks
+func describe(q *Query) string {
+	var terms []string
+	for _, t := range q.Terms {
+		s := fmt.Sprintf("%s%s%q", t.Field, t.Op, t.Value)
+		if t.Negate {
+			s = "-" + s
+		}
+		terms = append(terms, s)
+	}
+	return strings.Join(terms, ", ")
+}
+
+func TestParseQuery(t *testing.T) {
+	for _, c := range []struct {
+		text    string
+		terms   string
+		lookups []IndexLookup
+	}{
+		// aliases and operators
+		{"players>10", `players.online>"10"`, nil},
+		{"Online>=5 max<100", `players.online>="5", players.max<"100"`, nil},
+		{"mods=create", `mod:"create"`, nil},
+		{"protocol:767", `protocol:"767"`, []IndexLookup{{INDEX_PROTOCOL, "767", false}}},
+		{"protocol>=767", `protocol>="767"`, nil},
+		{"asn<=AS64496", `asn<="64496"`, nil},
+		// flags and words
+		{"fake -modded", `fake"", -modded""`, nil},
+		{"hypixel", `"hypixel"`, []IndexLookup{{INDEX_MOTD, "hypixel", false}}},
+		{"hyp*", `"hyp*"`, []IndexLookup{{INDEX_MOTD, "hyp", true}}},
+		// quoted values, and quoted fields are MOTD searches
+		{`motd:"survival games"`, `motd:"survival games"`, []IndexLookup{{INDEX_MOTD, "survival", false}, {INDEX_MOTD, "games", false}}},
+		{`"version:1.20"`, `"version:1.20"`, []IndexLookup{{INDEX_MOTD, "version", false}}},
+		{`"fake"`, `"fake"`, []IndexLookup{{INDEX_MOTD, "fake", false}}},
+		{`-"survival games"`, `-"survival games"`, nil},
+		// negated terms are only checked, the servers they match aren't all in an index
+		{"-software:paper", `-software:"paper"`, nil},
+		{"software:paper -protocol:47 -hypixel", `software:"paper", -protocol:"47", -"hypixel"`, []IndexLookup{{INDEX_SOFTWARE, "paper", false}}},
+		{"player:Notch* software:paper software:paper", `player:"Notch*", software:"paper", software:"paper"`,
+			[]IndexLookup{{INDEX_PLAYER_NAME, "notch", true}, {INDEX_SOFTWARE, "paper", false}}},
+		{"", "", nil},
+	} {
+		q, err := ParseQuery(c.text, NewRecordFilter())
+		if err != nil {
+			t.Errorf("%q: %v", c.text, err)
+			continue
+		}
+		if got := describe(q); got != c.terms {
+			t.Errorf("%q: terms %s, want %s", c.text, got, c.terms)
+		}
+		if got := q.Plan().Lookups; !reflect.DeepEqual(got, c.lookups) {
+			t.Errorf("%q: lookups %+v, want %+v", c.text, got, c.lookups)
+		}
+	}
+}
+
+func TestParseQueryErrors(t *testing.T) {
+	for _, text := range []string{
+		`motd:"unterminated`,
+		"colour:red",
+		"players>",
+		"players>lots",
+		"players>>",
+		"version>1.20",
+		"software<paper",
+		"fake:maybe",
+		"-since:1d",
+		"until:whenever",
+		"ip:nowhere",
+		`"!!"`,
+		"-",
+		`""`,
+		"motd:",
+	} {
+		if q, err := ParseQuery(text, NewRecordFilter()); err == nil {
+			t.Errorf("%q parsed as %s", text, describe(q))
+		}
+	}
+}
+
+func TestParseQueryWindow(t *testing.T) {
+	q, err := ParseQuery("since:2025-03-14 until:2025-03-15 ip:192.0.2.0/24 -ip:192.0.2.7", NewRecordFilter())
+	if err != nil {
+		t.Fatal(err)
+	}
+	plan := q.Plan()
+	// the negated network doesn't narrow the scan
+	if plan.Network != "192.0.2.0/24" || !strings.HasPrefix(plan.Since, "2025-03-14") || !strings.HasPrefix(plan.Until, "2025-03-15") {
+		t.Errorf("plan %+v", plan)
+	}
+}
+
+// searchRecords is four servers pinged hourly for a day and a half from 01:00, with
+// the first switching from paper to purpur at 20:00 and the third only up on the second day
+func searchRecords() []*ServerRecord {
+	start := time.Date(2025, 3, 14, 1, 0, 0, 0, time.UTC)
+	var records []*ServerRecord
+	for hour := 0; hour < 36; hour++ {
+		for i, ip := range []net.IP{net.IPv4(192, 0, 2, 1), net.IPv4(192, 0, 2, 2), net.IPv4(192, 0, 2, 3), net.IPv4(198, 51, 100, 4)} {
+			r := fullRecord()
+			r.IP, r.Port = ip.To4(), 25565
+			r.ObservedAt = start.Add(time.Duration(hour) * time.Hour)
+			r.IsFakeSample = false
+			r.Players.Online = hour % 5
+			r.Description = "§6Survival Games"
+			switch i {
+			case 0:
+				if hour >= 19 {
+					r.Version.Name = "Purpur 1.21.1"
+				}
+			case 1:
+				r.Version = VersionInfo{Name: "1.8.9", Protocol: 47}
+				r.Description = "creative"
+				r.Players.Sample = nil
+			case 2:
+				if hour < 24 {
+					continue
+				}
+			case 3:
+				if hour >= 6 {
+					continue
+				}
+			}
+			records = append(records, r)
+		}
+	}
+	return records
+}
+
+// TestQueryRunMatchesScan runs queries through the index and checks they find
+// exactly what scanning everything and checking each record does
+func TestQueryRunMatchesScan(t *testing.T) {
+	store := openTestBadger(t)
+	if err := store.PutObservations(searchRecords()); err != nil {
+		t.Fatal(err)
+	}
+	day := time.Date(2025, 3, 14, 0, 0, 0, 0, time.UTC)
+	windows := []struct{ since, until time.Time }{
+		{},
+		// starts after the day's index entries were written
+		{day.Add(12 * time.Hour), time.Time{}},
+		{day.Add(12 * time.Hour), day.Add(18 * time.Hour)},
+		{day.Add(26 * time.Hour), time.Time{}},
+		{day.Add(2 * time.Hour), day.Add(3 * time.Hour)},
+	}
+	for _, text := range []string{
+		"software:paper",
+		"software:purpur",
+		"protocol:47",
+		"protocol:767 players>=3",
+		`motd:"survival games"`,
+		"surv*",
+		"player:notch",
+		"player:no*",
+		"software:paper -ip:198.51.100.0/24",
+		"-software:paper",
+	} {
+		for _, w := range windows {
+			for _, latest := range []bool{false, true} {
+				filter := NewRecordFilter()
+				filter.Since, filter.Until = w.since, w.until
+				q, err := ParseQuery(text, filter)
+				if err != nil {
+					t.Fatal(err)
+				}
+				var planned, scanned []string
+				err = q.Run(store, latest, func(r *ServerRecord) error {
+					planned = append(planned, r.Addr().String()+" "+r.ObservedAt.Format(time.RFC3339))
+					return nil
+				})
+				if err != nil {
+					t.Fatal(err)
+				}
+				err = store.Scan(&q.Filter, latest, func(r *ServerRecord) error {
+					if q.matchTerms(r) {
+						scanned = append(scanned, r.Addr().String()+" "+r.ObservedAt.Format(time.RFC3339))
+					}
+					return nil
+				})
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !reflect.DeepEqual(planned, scanned) {
+					t.Errorf("%q from %v to %v (latest %v): planned %d %v, scanned %d %v",
+						text, w.since, w.until, latest, len(planned), planned, len(scanned), scanned)
+				}
+			}
+		}
+	}
+
+	// and the index was used, not just a scan in disguise
+	q, err := ParseQuery("software:paper", NewRecordFilter())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(q.Plan().Lookups) == 0 {
+		t.Error("software:paper isn't looked up")
+	}
+}
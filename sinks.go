@@ -0,0 +1,394 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Kinds of -sink, written kind:where
+const (
+	SINK_STDOUT = "stdout" // stdout
+	SINK_FILE   = "file"   // file:results.ndjson, rotated by size
+	SINK_TCP    = "tcp"    // tcp:localhost:9000, every client that connects gets the stream
+	SINK_UNIX   = "unix"   // unix:/tmp/results.sock, the same over a unix socket
+)
+
+// rotated files are renamed to results-<time>.ndjson
+const SINK_ROTATE_TIME_FORMAT = "20060102T150405.000"
+const DEFAULT_SINK_MAX_SIZE = 100 << 20
+const DEFAULT_SINK_KEEP = 10
+
+// a stream client this many results behind starts missing them
+const STREAM_CLIENT_BUFFER = 1024
+
+// a stream client that takes longer than this to accept a result is dropped
+const STREAM_WRITE_TIMEOUT = 10 * time.Second
+
+// ResultSink gets every result as soon as the writer does, as well as the database
+type ResultSink interface {
+	Write(record *ServerRecord) error
+	Close() error
+}
+
+// OpenSink opens a sink from its -sink spec
+func OpenSink(spec string, maxSize int64, keep int) (ResultSink, error) {
+	kind, where, _ := strings.Cut(spec, ":")
+	switch kind {
+	case SINK_STDOUT:
+		return &lineSink{w: os.Stdout}, nil
+	case SINK_FILE:
+		if where == "" {
+			return nil, errors.New("file sink needs a path, e.g. file:results.ndjson")
+		}
+		f, err := OpenRotatingFile(where, maxSize, keep)
+		if err != nil {
+			return nil, err
+		}
+		return &lineSink{w: f, closer: f}, nil
+	case SINK_TCP, SINK_UNIX:
+		if where == "" {
+			return nil, fmt.Errorf("%s sink needs an address", kind)
+		}
+		return ListenStream(kind, where)
+	default:
+		return nil, fmt.Errorf("unknown sink %q, expected stdout, file:PATH, tcp:ADDR or unix:PATH", spec)
+	}
+}
+
+// encodeLine is a record the way `export` writes jsonl
+func encodeLine(record *ServerRecord) ([]byte, error) {
+	line, err := json.Marshal(record)
+	if err != nil {
+		return nil, err
+	}
+	return append(line, '\n'), nil
+}
+
+// lineSink writes NDJSON to a writer
+type lineSink struct {
+	mu     sync.Mutex
+	w      io.Writer
+	closer io.Closer
+}
+
+func (s *lineSink) Write(record *ServerRecord) error {
+	line, err := encodeLine(record)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, err = s.w.Write(line)
+	return err
+}
+
+func (s *lineSink) Close() error {
+	if s.closer == nil {
+		return nil
+	}
+	return s.closer.Close()
+}
+
+// RotatingFile starts a new file once the current one would grow past maxSize,
+// keeping the newest few old ones. Writes are never split across files.
+type RotatingFile struct {
+	path    string
+	maxSize int64
+	keep    int
+
+	f       *os.File
+	size    int64
+	rotated time.Time // when the last rotation was named for
+}
+
+func OpenRotatingFile(path string, maxSize int64, keep int) (*RotatingFile, error) {
+	r := &RotatingFile{path: path, maxSize: maxSize, keep: keep}
+	return r, r.open()
+}
+
+func (r *RotatingFile) open() error {
+	f, err := os.OpenFile(r.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	r.f, r.size = f, info.Size()
+	return nil
+}
+
+// rotatedPath is where the current file goes when it's rotated at t
+func (r *RotatingFile) rotatedPath(t time.Time) string {
+	ext := filepath.Ext(r.path)
+	return strings.TrimSuffix(r.path, ext) + "-" + t.UTC().Format(SINK_ROTATE_TIME_FORMAT) + ext
+}
+
+func (r *RotatingFile) Write(p []byte) (int, error) {
+	if r.maxSize > 0 && r.size > 0 && r.size+int64(len(p)) > r.maxSize {
+		if err := r.rotate(); err != nil {
+			return 0, err
+		}
+	}
+	n, err := r.f.Write(p)
+	r.size += int64(n)
+	return n, err
+}
+
+func (r *RotatingFile) rotate() error {
+	if err := r.f.Close(); err != nil {
+		return err
+	}
+	// names only go down to the millisecond, two rotations in one mustn't share a name
+	t := time.Now().Truncate(time.Millisecond)
+	if !t.After(r.rotated) {
+		t = r.rotated.Add(time.Millisecond)
+	}
+	r.rotated = t
+	if err := os.Rename(r.path, r.rotatedPath(t)); err != nil {
+		return err
+	}
+	if err := r.open(); err != nil {
+		return err
+	}
+	// the timestamps sort, so the oldest come first
+	ext := filepath.Ext(r.path)
+	old, err := filepath.Glob(strings.TrimSuffix(r.path, ext) + "-*" + ext)
+	if err != nil || len(old) <= r.keep {
+		return err
+	}
+	sort.Strings(old)
+	for _, path := range old[:len(old)-r.keep] {
+		if err := os.Remove(path); err != nil {
+			slog.Warn("Failed to remove old sink file", "path", path, "error", err)
+		}
+	}
+	return nil
+}
+
+func (r *RotatingFile) Close() error {
+	return r.f.Close()
+}
+
+// StreamSink serves NDJSON to whoever connects. Clients that can't keep up miss
+// results rather than holding up the scan.
+type StreamSink struct {
+	listener net.Listener
+
+	mu      sync.Mutex
+	clients map[chan []byte]struct{}
+	closed  bool
+}
+
+func ListenStream(network, addr string) (*StreamSink, error) {
+	if network == SINK_UNIX {
+		// a socket left behind by a previous run would make listening fail
+		os.Remove(addr)
+	}
+	listener, err := net.Listen(network, addr)
+	if err != nil {
+		return nil, err
+	}
+	s := &StreamSink{listener: listener, clients: make(map[chan []byte]struct{})}
+	slog.Info("Streaming results", "network", network, "addr", listener.Addr())
+	go s.accept()
+	return s, nil
+}
+
+func (s *StreamSink) Addr() net.Addr {
+	return s.listener.Addr()
+}
+
+func (s *StreamSink) accept() {
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+		lines := make(chan []byte, STREAM_CLIENT_BUFFER)
+		s.mu.Lock()
+		if s.closed {
+			s.mu.Unlock()
+			conn.Close()
+			return
+		}
+		s.clients[lines] = struct{}{}
+		s.mu.Unlock()
+		go s.serve(conn, lines)
+	}
+}
+
+func (s *StreamSink) serve(conn net.Conn, lines chan []byte) {
+	defer conn.Close()
+	slog.Info("Stream client connected", "remote", conn.RemoteAddr())
+	for line := range lines {
+		// a client that stopped reading would otherwise keep this goroutine forever
+		conn.SetWriteDeadline(time.Now().Add(STREAM_WRITE_TIMEOUT))
+		if _, err := conn.Write(line); err != nil {
+			slog.Info("Stream client went away", "remote", conn.RemoteAddr(), "error", err)
+			s.drop(lines)
+			// drain so Write never blocks on this client
+			for range lines {
+			}
+			return
+		}
+	}
+}
+
+func (s *StreamSink) drop(lines chan []byte) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.clients[lines]; ok {
+		delete(s.clients, lines)
+		close(lines)
+	}
+}
+
+func (s *StreamSink) Write(record *ServerRecord) error {
+	line, err := encodeLine(record)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for lines := range s.clients {
+		select {
+		case lines <- line:
+		default:
+			slog.Warn("Stream client is too slow, skipping a result")
+		}
+	}
+	return nil
+}
+
+func (s *StreamSink) Close() error {
+	s.mu.Lock()
+	s.closed = true
+	for lines := range s.clients {
+		delete(s.clients, lines)
+		close(lines)
+	}
+	s.mu.Unlock()
+	// a unix socket's file goes with it
+	return s.listener.Close()
+}
+
+// Publisher is the shape of a message queue client, Kafka or NATS style: messages go to
+// a topic, keyed so one server's results stay in order. MemoryPublisher is the only one
+// so far, a real client only needs these two methods to be handed to BatchWriter.AddSink
+// through NewPublisherSink. -sink has no kind for one until there's a client to build in.
+type Publisher interface {
+	Publish(topic string, key, value []byte) error
+	Close() error
+}
+
+type Message struct {
+	Topic string
+	Key   []byte
+	Value []byte
+}
+
+// MemoryPublisher keeps everything published in memory and hands it to subscribers
+type MemoryPublisher struct {
+	mu          sync.Mutex
+	messages    []Message
+	subscribers map[string][]chan Message
+	closed      bool
+}
+
+func NewMemoryPublisher() *MemoryPublisher {
+	return &MemoryPublisher{subscribers: make(map[string][]chan Message)}
+}
+
+// Subscribe returns messages published to topic from now on. A subscriber with a full
+// buffer misses messages, Messages still has them all.
+func (p *MemoryPublisher) Subscribe(topic string, buffer int) <-chan Message {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	ch := make(chan Message, buffer)
+	if p.closed {
+		close(ch)
+		return ch
+	}
+	p.subscribers[topic] = append(p.subscribers[topic], ch)
+	return ch
+}
+
+func (p *MemoryPublisher) Publish(topic string, key, value []byte) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.closed {
+		return errors.New("publisher is closed")
+	}
+	message := Message{Topic: topic, Key: key, Value: value}
+	p.messages = append(p.messages, message)
+	for _, ch := range p.subscribers[topic] {
+		select {
+		case ch <- message:
+		default:
+		}
+	}
+	return nil
+}
+
+// Messages returns everything published to topic so far
+func (p *MemoryPublisher) Messages(topic string) []Message {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	var messages []Message
+	for _, message := range p.messages {
+		if message.Topic == topic {
+			messages = append(messages, message)
+		}
+	}
+	return messages
+}
+
+func (p *MemoryPublisher) Close() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.closed {
+		return nil
+	}
+	p.closed = true
+	for _, subscribers := range p.subscribers {
+		for _, ch := range subscribers {
+			close(ch)
+		}
+	}
+	return nil
+}
+
+// publisherSink publishes each record as JSON, keyed by ip:port
+type publisherSink struct {
+	pub   Publisher
+	topic string
+}
+
+func NewPublisherSink(pub Publisher, topic string) ResultSink {
+	return &publisherSink{pub: pub, topic: topic}
+}
+
+func (s *publisherSink) Write(record *ServerRecord) error {
+	value, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	return s.pub.Publish(s.topic, []byte(record.Addr().String()), value)
+}
+
+func (s *publisherSink) Close() error {
+	return s.pub.Close()
+}
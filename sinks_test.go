@@ -0,0 +1,186 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+	"time"
+)
+
+// sinkWriter is a writer whose only sink is sink
+func sinkWriter(t *testing.T, sink ResultSink) *BatchWriter {
+	t.Helper()
+	w := NewBatchWriter(openTestBadger(t), WriterConfig{BatchSize: 100, FlushInterval: time.Minute})
+	w.AddSink(sink)
+	t.Cleanup(w.CloseSinks)
+	return w
+}
+
+func addResults(w *BatchWriter, n int) {
+	for i := 0; i < n; i++ {
+		w.Add(testStatus(net.IPv4(192, 0, 2, byte(i+1)), 25565, "agent"))
+	}
+}
+
+// readLines decodes every NDJSON line in data, failing on anything that isn't a whole record
+func readLines(t *testing.T, data []byte) []*ServerRecord {
+	t.Helper()
+	var records []*ServerRecord
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		var r ServerRecord
+		if err := json.Unmarshal(scanner.Bytes(), &r); err != nil {
+			t.Fatalf("bad line %q: %v", scanner.Text(), err)
+		}
+		records = append(records, &r)
+	}
+	return records
+}
+
+func TestLineSink(t *testing.T) {
+	var buf bytes.Buffer
+	addResults(sinkWriter(t, &lineSink{w: &buf}), 3)
+	records := readLines(t, buf.Bytes())
+	if len(records) != 3 {
+		t.Fatalf("%d lines, want 3", len(records))
+	}
+	if addr := records[2].Addr().String(); addr != "192.0.2.3:25565" {
+		t.Errorf("last line is %s", addr)
+	}
+}
+
+func TestFileSinkRotates(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "results.ndjson")
+	line, err := encodeLine(sinkRecord(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// two lines to a file, and three old files kept
+	sink, err := OpenSink("file:"+path, int64(len(line))*5/2, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	addResults(sinkWriter(t, sink), 10)
+
+	rotated, err := filepath.Glob(filepath.Join(filepath.Dir(path), "results-*.ndjson"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rotated) != 3 {
+		t.Errorf("%d rotated files, want 3: %v", len(rotated), rotated)
+	}
+	sort.Strings(rotated)
+	var addrs []string
+	for _, file := range append(rotated, path) {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		records := readLines(t, data)
+		if len(records) != 2 {
+			t.Errorf("%s has %d lines, want 2", file, len(records))
+		}
+		for _, r := range records {
+			addrs = append(addrs, r.Addr().String())
+		}
+	}
+	// the oldest file is gone, the rest are in order
+	if len(addrs) != 8 || addrs[0] != "192.0.2.3:25565" || addrs[7] != "192.0.2.10:25565" {
+		t.Errorf("kept %v", addrs)
+	}
+}
+
+// sinkRecord is what addResults' results turn into, give or take the address
+func sinkRecord(t *testing.T) *ServerRecord {
+	t.Helper()
+	r, err := NewServerRecord(testStatus(net.IPv4(192, 0, 2, 10), 25565, "agent"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return r
+}
+
+func TestStreamSink(t *testing.T) {
+	sink, err := ListenStream(SINK_TCP, "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := sinkWriter(t, sink)
+	conn, err := net.Dial("tcp", sink.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	// results before the client is accepted aren't for it
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(10 * time.Millisecond) {
+		sink.mu.Lock()
+		n := len(sink.clients)
+		sink.mu.Unlock()
+		if n == 1 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("stream client was never accepted")
+		}
+	}
+
+	addResults(w, 2)
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	reader := bufio.NewReader(conn)
+	for i := 1; i <= 2; i++ {
+		line, err := reader.ReadBytes('\n')
+		if err != nil {
+			t.Fatal(err)
+		}
+		records := readLines(t, line)
+		if len(records) != 1 || !records[0].IP.Equal(net.IPv4(192, 0, 2, byte(i))) {
+			t.Errorf("line %d is %s", i, line)
+		}
+	}
+	// closing the sink hangs up on its clients
+	w.CloseSinks()
+	if _, err := reader.ReadBytes('\n'); err == nil {
+		t.Error("stream is still open after the sink closed")
+	}
+}
+
+func TestPublisherSink(t *testing.T) {
+	pub := NewMemoryPublisher()
+	subscribed := pub.Subscribe("servers", 10)
+	w := sinkWriter(t, NewPublisherSink(pub, "servers"))
+	addResults(w, 3)
+
+	messages := pub.Messages("servers")
+	if len(messages) != 3 {
+		t.Fatalf("%d messages published, want 3", len(messages))
+	}
+	for i, message := range messages {
+		// keyed by server, so a partitioned queue keeps each server's results in order
+		if want := (&net.TCPAddr{IP: net.IPv4(192, 0, 2, byte(i+1)), Port: 25565}).String(); string(message.Key) != want {
+			t.Errorf("message %d has key %s, want %s", i, message.Key, want)
+		}
+		if records := readLines(t, message.Value); len(records) != 1 || records[0].Addr().String() != string(message.Key) {
+			t.Errorf("message %d is %s", i, message.Value)
+		}
+	}
+	if other := pub.Messages("elsewhere"); len(other) != 0 {
+		t.Errorf("other topic has %d messages", len(other))
+	}
+
+	w.CloseSinks()
+	received := 0
+	for range subscribed {
+		received++
+	}
+	if received != 3 {
+		t.Errorf("subscriber got %d messages, want 3", received)
+	}
+	if err := pub.Publish("servers", nil, nil); err == nil {
+		t.Error("published after the sink closed")
+	}
+}
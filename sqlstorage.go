@@ -0,0 +1,563 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	_ "github.com/jackc/pgx/v5/stdlib"
+	_ "modernc.org/sqlite"
+)
+
+// The relational layout, one row per observation with the interesting fields as
+// columns and the lists split into child tables. The record column keeps the whole
+// observation as JSON (minus the favicon, which lives in favicons) so nothing is lost.
+// {{...}} placeholders are filled in per dialect.
+const SQL_SCHEMA = `
+CREATE TABLE IF NOT EXISTS servers (
+	ip         TEXT NOT NULL,
+	port       INTEGER NOT NULL,
+	ip_int     BIGINT NOT NULL,
+	first_seen {{time}} NOT NULL,
+	last_seen  {{time}} NOT NULL,
+	PRIMARY KEY (ip, port)
+);
+CREATE INDEX IF NOT EXISTS servers_ip_int ON servers (ip_int, port);
+
+CREATE TABLE IF NOT EXISTS favicons (
+	hash TEXT PRIMARY KEY,
+	data TEXT NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS observations (
+	id                    {{id}},
+	ip                    TEXT NOT NULL,
+	port                  INTEGER NOT NULL,
+	ip_int                BIGINT NOT NULL,
+	observed_at           {{time}} NOT NULL,
+	source                TEXT,
+	latency_ms            BIGINT,
+	version_name          TEXT NOT NULL,
+	protocol              INTEGER NOT NULL,
+	software              TEXT NOT NULL,
+	players_online        INTEGER,
+	players_max           INTEGER,
+	description           TEXT NOT NULL,
+	favicon_hash          TEXT REFERENCES favicons (hash),
+	enforces_secure_chat  BOOLEAN,
+	previews_chat         BOOLEAN,
+	prevents_chat_reports BOOLEAN,
+	online_mode           BOOLEAN,
+	fake_sample           BOOLEAN NOT NULL,
+	modded                BOOLEAN NOT NULL,
+	modpack               TEXT,
+	asn                   BIGINT,
+	as_name               TEXT,
+	prefix                TEXT,
+	country               TEXT,
+	record                {{json}} NOT NULL,
+	UNIQUE (ip_int, port, observed_at),
+	FOREIGN KEY (ip, port) REFERENCES servers (ip, port)
+);
+CREATE INDEX IF NOT EXISTS observations_observed_at ON observations (observed_at);
+CREATE INDEX IF NOT EXISTS observations_protocol ON observations (protocol);
+CREATE INDEX IF NOT EXISTS observations_software ON observations (software);
+CREATE INDEX IF NOT EXISTS observations_favicon ON observations (favicon_hash);
+
+CREATE TABLE IF NOT EXISTS sightings (
+	observation_id BIGINT NOT NULL REFERENCES observations (id) ON DELETE CASCADE,
+	uuid           TEXT NOT NULL,
+	name           TEXT NOT NULL,
+	PRIMARY KEY (observation_id, uuid)
+);
+CREATE INDEX IF NOT EXISTS sightings_uuid ON sightings (uuid);
+CREATE INDEX IF NOT EXISTS sightings_name ON sightings (lower(name));
+
+CREATE TABLE IF NOT EXISTS players (
+	uuid       TEXT NOT NULL,
+	name       TEXT NOT NULL,
+	first_seen {{time}} NOT NULL,
+	last_seen  {{time}} NOT NULL,
+	PRIMARY KEY (uuid, name)
+);
+
+CREATE TABLE IF NOT EXISTS mods (
+	observation_id BIGINT NOT NULL REFERENCES observations (id) ON DELETE CASCADE,
+	mod_id         TEXT NOT NULL,
+	version        TEXT NOT NULL
+);
+CREATE INDEX IF NOT EXISTS mods_observation ON mods (observation_id);
+CREATE INDEX IF NOT EXISTS mods_mod_id ON mods (mod_id);
+
+CREATE TABLE IF NOT EXISTS hostnames (
+	observation_id    BIGINT NOT NULL REFERENCES observations (id) ON DELETE CASCADE,
+	name              TEXT NOT NULL,
+	forward_confirmed BOOLEAN NOT NULL
+);
+CREATE INDEX IF NOT EXISTS hostnames_observation ON hostnames (observation_id);
+
+CREATE TABLE IF NOT EXISTS motd_tokens (
+	observation_id BIGINT NOT NULL REFERENCES observations (id) ON DELETE CASCADE,
+	token          TEXT NOT NULL
+);
+CREATE INDEX IF NOT EXISTS motd_tokens_token ON motd_tokens (token);
+CREATE INDEX IF NOT EXISTS motd_tokens_observation ON motd_tokens (observation_id);
+`
+
+// sqlDialect covers the differences between SQLite and PostgreSQL that matter here
+type sqlDialect struct {
+	driver   string
+	schema   *strings.Replacer
+	least    string
+	greatest string
+	dollar   bool // $1 placeholders instead of ?
+}
+
+var SQL_DIALECTS = map[string]sqlDialect{
+	STORAGE_SQLITE: {
+		driver:   "sqlite",
+		schema:   strings.NewReplacer("{{id}}", "INTEGER PRIMARY KEY", "{{time}}", "TIMESTAMP", "{{json}}", "TEXT"),
+		least:    "min",
+		greatest: "max",
+	},
+	STORAGE_POSTGRES: {
+		driver:   "pgx",
+		schema:   strings.NewReplacer("{{id}}", "BIGSERIAL PRIMARY KEY", "{{time}}", "TIMESTAMPTZ", "{{json}}", "JSONB"),
+		least:    "LEAST",
+		greatest: "GREATEST",
+		dollar:   true,
+	},
+}
+
+// the columns each index kind is looked up in
+var SQL_INDEX_COLUMNS = map[string]struct{ join, column string }{
+	INDEX_PROTOCOL:    {"", "CAST(o.protocol AS TEXT)"},
+	INDEX_SOFTWARE:    {"", "o.software"},
+	INDEX_PLAYER_UUID: {"JOIN sightings s ON s.observation_id = o.id", "s.uuid"},
+	INDEX_PLAYER_NAME: {"JOIN sightings s ON s.observation_id = o.id", "lower(s.name)"},
+	INDEX_MOTD:        {"JOIN motd_tokens t ON t.observation_id = o.id", "t.token"},
+	INDEX_FAVICON:     {"", "o.favicon_hash"},
+}
+
+// Neither sqlite's text times nor postgres timestamps go past year 9999
+var SQL_MAX_TIME = time.Date(10000, 1, 1, 0, 0, 0, 0, time.UTC)
+
+const SQL_SELECT_RECORD = `SELECT o.record, f.data FROM observations o LEFT JOIN favicons f ON f.hash = o.favicon_hash`
+
+// SQLStorage keeps observations in SQLite or PostgreSQL
+type SQLStorage struct {
+	db      *sql.DB
+	dialect sqlDialect
+}
+
+func OpenSQLStorage(kind, dsn string) (*SQLStorage, error) {
+	dialect, ok := SQL_DIALECTS[kind]
+	if !ok {
+		return nil, fmt.Errorf("unknown SQL backend %q", kind)
+	}
+	if kind == STORAGE_SQLITE {
+		// foreign keys are off by default, and deleting observations relies on the cascades
+		separator := "?"
+		if strings.Contains(dsn, "?") {
+			separator = "&"
+		}
+		dsn += separator + "_pragma=foreign_keys(1)&_pragma=busy_timeout(10000)&_pragma=journal_mode(WAL)&_time_format=sqlite"
+	}
+	db, err := sql.Open(dialect.driver, dsn)
+	if err != nil {
+		return nil, err
+	}
+	if kind == STORAGE_SQLITE {
+		// SQLite only has one writer anyway
+		db.SetMaxOpenConns(1)
+	}
+	s := &SQLStorage{db: db, dialect: dialect}
+	if _, err := db.Exec(dialect.schema.Replace(SQL_SCHEMA)); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("creating schema: %w", err)
+	}
+	return s, nil
+}
+
+// q rewrites ? placeholders for dialects that number them
+func (s *SQLStorage) q(query string) string {
+	if !s.dialect.dollar {
+		return query
+	}
+	var b strings.Builder
+	n := 0
+	for _, c := range query {
+		if c == '?' {
+			n++
+			b.WriteString("$" + strconv.Itoa(n))
+			continue
+		}
+		b.WriteRune(c)
+	}
+	return b.String()
+}
+
+func (s *SQLStorage) PutObservations(records []*ServerRecord) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	for _, r := range records {
+		if err := s.putObservation(tx, r); err != nil {
+			return fmt.Errorf("%s: %w", r.Addr(), err)
+		}
+	}
+	return tx.Commit()
+}
+
+func (s *SQLStorage) putObservation(tx *sql.Tx, r *ServerRecord) error {
+	ip := r.IP.String()
+	n, ok := ipv4ToUint32(r.IP)
+	if !ok {
+		return fmt.Errorf("%v is not an IPv4 address", r.IP)
+	}
+	ipInt := int64(n)
+	observedAt := r.ObservedAt.UTC()
+
+	_, err := tx.Exec(s.q(`INSERT INTO servers (ip, port, ip_int, first_seen, last_seen) VALUES (?, ?, ?, ?, ?)
+		ON CONFLICT (ip, port) DO UPDATE SET
+			first_seen = `+s.dialect.least+`(servers.first_seen, excluded.first_seen),
+			last_seen = `+s.dialect.greatest+`(servers.last_seen, excluded.last_seen)`),
+		ip, r.Port, ipInt, observedAt, observedAt)
+	if err != nil {
+		return err
+	}
+
+	var faviconHash *string
+	if r.Favicon != nil {
+		hash := FaviconHash(*r.Favicon)
+		faviconHash = &hash
+		_, err := tx.Exec(s.q(`INSERT INTO favicons (hash, data) VALUES (?, ?) ON CONFLICT (hash) DO NOTHING`), hash, *r.Favicon)
+		if err != nil {
+			return err
+		}
+	}
+
+	// the favicon is only kept once, in favicons
+	stripped := *r
+	stripped.Favicon = nil
+	recordJSON, err := json.Marshal(&stripped)
+	if err != nil {
+		return err
+	}
+
+	// the same observation written twice replaces the first, children go with the cascade
+	_, err = tx.Exec(s.q(`DELETE FROM observations WHERE ip_int = ? AND port = ? AND observed_at = ?`), ipInt, r.Port, observedAt)
+	if err != nil {
+		return err
+	}
+
+	// the export flattening already works out the optional columns
+	row := newParquetRecord(r)
+	var id int64
+	err = tx.QueryRow(s.q(`INSERT INTO observations (
+			ip, port, ip_int, observed_at, source, latency_ms,
+			version_name, protocol, software, players_online, players_max, description, favicon_hash,
+			enforces_secure_chat, previews_chat, prevents_chat_reports, online_mode, fake_sample, modded, modpack,
+			asn, as_name, prefix, country, record
+		) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?) RETURNING id`),
+		ip, r.Port, ipInt, observedAt, r.Source, r.Latency.Milliseconds(),
+		r.Version.Name, r.Version.Protocol, SoftwareFamily(r), row.PlayersOnline, row.PlayersMax, r.Description, faviconHash,
+		r.EnforcesSecureChat, r.PreviewsChat, r.PreventsChatReports, r.IsOnlineMode, r.IsFakeSample, row.Modded, row.Modpack,
+		row.ASN, row.ASName, row.Prefix, row.Country, string(recordJSON),
+	).Scan(&id)
+	if err != nil {
+		return err
+	}
+
+	for _, sighting := range RecordSightings(r) {
+		_, err := tx.Exec(s.q(`INSERT INTO sightings (observation_id, uuid, name) VALUES (?, ?, ?) ON CONFLICT DO NOTHING`), id, sighting.UUID.String(), sighting.Name)
+		if err != nil {
+			return err
+		}
+		_, err = tx.Exec(s.q(`INSERT INTO players (uuid, name, first_seen, last_seen) VALUES (?, ?, ?, ?)
+			ON CONFLICT (uuid, name) DO UPDATE SET
+				first_seen = `+s.dialect.least+`(players.first_seen, excluded.first_seen),
+				last_seen = `+s.dialect.greatest+`(players.last_seen, excluded.last_seen)`),
+			sighting.UUID.String(), sighting.Name, observedAt, observedAt)
+		if err != nil {
+			return err
+		}
+	}
+	for _, mod := range row.Mods {
+		if _, err := tx.Exec(s.q(`INSERT INTO mods (observation_id, mod_id, version) VALUES (?, ?, ?)`), id, mod.ID, mod.Version); err != nil {
+			return err
+		}
+	}
+	for _, h := range r.Hostnames {
+		if _, err := tx.Exec(s.q(`INSERT INTO hostnames (observation_id, name, forward_confirmed) VALUES (?, ?, ?)`), id, h.Name, h.ForwardConfirmed); err != nil {
+			return err
+		}
+	}
+	for _, token := range MOTDTokens(r.Description) {
+		if _, err := tx.Exec(s.q(`INSERT INTO motd_tokens (observation_id, token) VALUES (?, ?)`), id, token); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func scanRecordRow(rows interface{ Scan(...any) error }) (*ServerRecord, error) {
+	var recordJSON []byte
+	var favicon sql.NullString
+	if err := rows.Scan(&recordJSON, &favicon); err != nil {
+		return nil, err
+	}
+	record := &ServerRecord{}
+	if err := json.Unmarshal(recordJSON, record); err != nil {
+		return nil, err
+	}
+	// JSON decodes addresses in their 16 byte form
+	record.IP = record.IP.To4()
+	if favicon.Valid {
+		record.Favicon = &favicon.String
+	}
+	return record, nil
+}
+
+// queryRecords calls fn with every record a query returns
+func (s *SQLStorage) queryRecords(query string, args []any, fn func(*ServerRecord) error) error {
+	rows, err := s.db.Query(s.q(query), args...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		record, err := scanRecordRow(rows)
+		if err != nil {
+			return err
+		}
+		if err := fn(record); err != nil {
+			if errors.Is(err, errStopScan) {
+				return nil
+			}
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+// Latest, History and ServerPlayers find nothing for addresses that aren't IPv4, since only those are stored
+func (s *SQLStorage) Latest(ip net.IP, port uint16) (*ServerRecord, error) {
+	n, ok := ipv4ToUint32(ip)
+	if !ok {
+		return nil, nil
+	}
+	row := s.db.QueryRow(s.q(SQL_SELECT_RECORD+` WHERE o.ip_int = ? AND o.port = ? ORDER BY o.observed_at DESC LIMIT 1`), int64(n), port)
+	record, err := scanRecordRow(row)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	}
+	return record, err
+}
+
+func (s *SQLStorage) History(ip net.IP, port uint16, since, until time.Time, fn func(*ServerRecord) error) error {
+	n, ok := ipv4ToUint32(ip)
+	if !ok {
+		return nil
+	}
+	query, args := observedWindow(SQL_SELECT_RECORD+` WHERE o.ip_int = ? AND o.port = ?`, []any{int64(n), port}, since, until)
+	return s.queryRecords(query+` ORDER BY o.observed_at`, args, fn)
+}
+
+func (s *SQLStorage) Scan(filter *RecordFilter, latest bool, fn func(*ServerRecord) error) error {
+	query := SQL_SELECT_RECORD + ` WHERE 1 = 1`
+	var args []any
+	if filter.Network != nil {
+		start, end := serverRange(filter.Network)
+		first, _ := ipv4ToUint32(net.IP(start[len(SERVER_PREFIX):]))
+		last, _ := ipv4ToUint32(end)
+		if end == nil {
+			last = math.MaxUint32
+		}
+		query += ` AND o.ip_int BETWEEN ? AND ?`
+		args = append(args, int64(first), int64(last))
+	}
+	if filter.After != nil {
+		n, _ := ipv4ToUint32(filter.After.IP)
+		ip := int64(n)
+		query += ` AND (o.ip_int > ? OR (o.ip_int = ? AND o.port > ?))`
+		args = append(args, ip, ip, filter.After.Port)
+	}
+	query, args = observedWindow(query, args, filter.Since, filter.Until)
+	query += ` ORDER BY o.ip_int, o.port, o.observed_at`
+
+	if !latest {
+		return s.queryRecords(query, args, func(r *ServerRecord) error {
+			if !filter.Match(r) {
+				return nil
+			}
+			return fn(r)
+		})
+	}
+	// rows sort by time within a server, so the last one seen is the newest
+	var pending *ServerRecord
+	flush := func() error {
+		// cleared first, so a server that stopped the scan isn't handed over again by the last flush
+		record := pending
+		pending = nil
+		if record != nil && filter.Match(record) {
+			return fn(record)
+		}
+		return nil
+	}
+	err := s.queryRecords(query, args, func(r *ServerRecord) error {
+		if pending != nil && (!pending.IP.Equal(r.IP) || pending.Port != r.Port) {
+			if err := flush(); err != nil {
+				return err
+			}
+		}
+		pending = r
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if err := flush(); !errors.Is(err, errStopScan) {
+		return err
+	}
+	return nil
+}
+
+func (s *SQLStorage) Servers(fn func(ip net.IP, port uint16) error) error {
+	rows, err := s.db.Query(`SELECT ip_int, port FROM servers ORDER BY ip_int, port`)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var ip int64
+		var port uint16
+		if err := rows.Scan(&ip, &port); err != nil {
+			return err
+		}
+		if err := fn(uint32ToIP(uint32(ip)), port); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+func (s *SQLStorage) LookupIndex(kind, term string, prefix bool, fn func(IndexEntry) error) error {
+	index, ok := SQL_INDEX_COLUMNS[kind]
+	if !ok {
+		return fmt.Errorf("unknown index %q", kind)
+	}
+	query := `SELECT DISTINCT o.ip_int, o.port, o.observed_at FROM observations o ` + index.join + ` WHERE ` + index.column
+	if prefix {
+		query += ` LIKE ? ESCAPE '\'`
+		term = strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`).Replace(term) + "%"
+	} else {
+		query += ` = ?`
+	}
+	rows, err := s.db.Query(s.q(query+` ORDER BY o.ip_int, o.port, o.observed_at`), term)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var ip int64
+		var entry IndexEntry
+		if err := rows.Scan(&ip, &entry.Port, &entry.Time); err != nil {
+			return err
+		}
+		entry.IP = uint32ToIP(uint32(ip))
+		if err := fn(entry); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+// querySightings calls fn with the sightings a query on sightings s joined with observations o returns
+func (s *SQLStorage) querySightings(where string, args []any, order string, fn func(Sighting) error) error {
+	rows, err := s.db.Query(s.q(`SELECT s.uuid, s.name, o.ip_int, o.port, o.observed_at
+		FROM sightings s JOIN observations o ON o.id = s.observation_id WHERE `+where+` ORDER BY `+order), args...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var id string
+		var ip int64
+		var sighting Sighting
+		if err := rows.Scan(&id, &sighting.Name, &ip, &sighting.Port, &sighting.Time); err != nil {
+			return err
+		}
+		if sighting.UUID, err = uuid.Parse(id); err != nil {
+			return err
+		}
+		sighting.IP = uint32ToIP(uint32(ip))
+		if err := fn(sighting); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+// observedWindow adds a time window on o.observed_at to a query. An end past
+// what the databases can store, like END_OF_TIME, is left open, sqlite would
+// compare its text as smaller than any real time.
+func observedWindow(where string, args []any, since, until time.Time) (string, []any) {
+	if !since.IsZero() {
+		where += ` AND o.observed_at >= ?`
+		args = append(args, since.UTC())
+	}
+	if !until.IsZero() && until.Before(SQL_MAX_TIME) {
+		where += ` AND o.observed_at <= ?`
+		args = append(args, until.UTC())
+	}
+	return where, args
+}
+
+func (s *SQLStorage) PlayerSightings(id uuid.UUID, since, until time.Time, fn func(Sighting) error) error {
+	where, args := observedWindow(`s.uuid = ?`, []any{id.String()}, since, until)
+	return s.querySightings(where, args, `o.observed_at, o.ip_int, o.port`, fn)
+}
+
+func (s *SQLStorage) ServerPlayers(ip net.IP, port uint16, since, until time.Time, fn func(Sighting) error) error {
+	n, ok := ipv4ToUint32(ip)
+	if !ok {
+		return nil
+	}
+	where, args := observedWindow(`o.ip_int = ? AND o.port = ?`, []any{int64(n), port}, since, until)
+	return s.querySightings(where, args, `o.observed_at, s.uuid`, fn)
+}
+
+func (s *SQLStorage) ResolvePlayerName(name string) ([]uuid.UUID, error) {
+	rows, err := s.db.Query(s.q(`SELECT DISTINCT uuid FROM sightings WHERE lower(name) = ? ORDER BY uuid`), strings.ToLower(name))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var ids []uuid.UUID
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		parsed, err := uuid.Parse(id)
+		if err != nil {
+			return nil, err
+		}
+		ids = append(ids, parsed)
+	}
+	return ids, rows.Err()
+}
+
+func (s *SQLStorage) Close() error {
+	return s.db.Close()
+}
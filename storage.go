@@ -0,0 +1,227 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	badger "github.com/dgraph-io/badger/v4"
+	"github.com/google/uuid"
+)
+
+// Storage backends, selected with -storage
+const (
+	STORAGE_BADGER   = "badger"
+	STORAGE_SQLITE   = "sqlite"
+	STORAGE_POSTGRES = "postgres"
+)
+
+var STORAGE_KINDS = []string{STORAGE_BADGER, STORAGE_SQLITE, STORAGE_POSTGRES}
+
+// later than any observation, for looking up the newest one
+var END_OF_TIME = time.Unix(1<<62, 0)
+
+// Storage is where observations are kept. Badger is the default, the SQL
+// backends lay the same data out relationally for other tools to query.
+type Storage interface {
+	// PutObservations stores a batch of observations and their index entries, all or nothing
+	PutObservations(records []*ServerRecord) error
+	// Latest returns the newest observation of a server, nil if it has never been seen
+	Latest(ip net.IP, port uint16) (*ServerRecord, error)
+	// History calls fn with a server's observations inside the window, oldest first
+	History(ip net.IP, port uint16, since, until time.Time, fn func(*ServerRecord) error) error
+	// Scan works like ScanRecords
+	Scan(filter *RecordFilter, latest bool, fn func(*ServerRecord) error) error
+	// Servers calls fn once for every server that has been seen
+	Servers(fn func(ip net.IP, port uint16) error) error
+	// LookupIndex works like the badger LookupIndex, with the same kinds and terms
+	LookupIndex(kind, term string, prefix bool, fn func(IndexEntry) error) error
+	// PlayerSightings calls fn for every sighting of a player inside the window, oldest first
+	PlayerSightings(id uuid.UUID, since, until time.Time, fn func(Sighting) error) error
+	// ServerPlayers calls fn for every player seen on a server inside the window, oldest first
+	ServerPlayers(ip net.IP, port uint16, since, until time.Time, fn func(Sighting) error) error
+	// ResolvePlayerName returns every player that has gone by name, ignoring case
+	ResolvePlayerName(name string) ([]uuid.UUID, error)
+	Close() error
+}
+
+// addStorageFlags registers -storage and -db, the location is a directory for
+// badger, a file for sqlite and a connection URL for postgres
+func addStorageFlags(fs *flag.FlagSet) (kind, location *string) {
+	kind = fs.String("storage", STORAGE_BADGER, "storage backend: "+strings.Join(STORAGE_KINDS, ", "))
+	location = fs.String("db", BADGER_DIR, "badger directory, sqlite file or postgres URL")
+	return kind, location
+}
+
+func OpenStorage(kind, location string, readOnly bool) (Storage, error) {
+	switch kind {
+	case STORAGE_BADGER:
+		opts := badger.DefaultOptions(location)
+		if readOnly {
+			opts = opts.WithReadOnly(true).WithLogger(nil)
+		}
+		db, err := badger.Open(opts)
+		if err != nil {
+			return nil, fmt.Errorf("opening %s: %w", location, err)
+		}
+		return &BadgerStorage{DB: db}, nil
+	case STORAGE_SQLITE, STORAGE_POSTGRES:
+		return OpenSQLStorage(kind, location)
+	default:
+		return nil, fmt.Errorf("unknown storage backend %q", kind)
+	}
+}
+
+// BadgerStorage is the key-value layout described in record.go, delta.go and index.go
+type BadgerStorage struct {
+	DB *badger.DB
+	// observations written expire this long after they were made, along with their
+	// index and sighting keys. 0 keeps them until maintain removes them.
+	TTL time.Duration
+
+	chainsOnce sync.Once
+	chains     *chainCache
+}
+
+func (s *BadgerStorage) PutObservations(records []*ServerRecord) error {
+	s.chainsOnce.Do(func() { s.chains = newChainCache(CHAIN_CACHE_SIZE) })
+	chains := s.chains.begin()
+	// write tuah
+	// set on that thang
+	err := s.DB.Update(func(txn *badger.Txn) error {
+		for _, record := range records {
+			// stored as a delta against the previous observation when there is one, indexes included
+			if err := storeRecord(txn, record, chains, s.TTL); err != nil {
+				return err
+			}
+			if err := writeSightings(txn, record, s.TTL); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	chains.commit()
+	return nil
+}
+
+func (s *BadgerStorage) Latest(ip net.IP, port uint16) (*ServerRecord, error) {
+	var record *ServerRecord
+	err := s.DB.View(func(txn *badger.Txn) error {
+		var err error
+		record, err = LoadRecordAt(txn, ip, port, END_OF_TIME)
+		return err
+	})
+	return record, err
+}
+
+func (s *BadgerStorage) History(ip net.IP, port uint16, since, until time.Time, fn func(*ServerRecord) error) error {
+	err := s.DB.View(func(txn *badger.Txn) error {
+		opts := badger.DefaultIteratorOptions
+		opts.Prefix = ServerKeyPrefix(ip, port)
+		it := txn.NewIterator(opts)
+		defer it.Close()
+
+		start := opts.Prefix
+		if !since.IsZero() {
+			start = ServerKey(ip, port, since)
+		}
+		replay := &recordReplay{}
+		contiguous := false
+		for it.Seek(start); it.Valid(); it.Next() {
+			_, _, observedAt, _ := ParseServerKey(it.Item().Key())
+			if !until.IsZero() && observedAt.After(until) {
+				break
+			}
+			record, err := replay.decode(txn, it.Item(), contiguous)
+			if errors.Is(err, errOrphanDelta) {
+				continue
+			}
+			if err != nil {
+				return err
+			}
+			contiguous = true
+			if err := fn(record); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if errors.Is(err, errStopScan) {
+		return nil
+	}
+	return err
+}
+
+func (s *BadgerStorage) Scan(filter *RecordFilter, latest bool, fn func(*ServerRecord) error) error {
+	return ScanRecords(s.DB, filter, latest, fn)
+}
+
+func (s *BadgerStorage) Servers(fn func(ip net.IP, port uint16) error) error {
+	return s.DB.View(func(txn *badger.Txn) error {
+		// the keys say everything needed, so values are never read
+		opts := badger.DefaultIteratorOptions
+		opts.PrefetchValues = false
+		opts.Prefix = []byte(SERVER_PREFIX)
+		it := txn.NewIterator(opts)
+		defer it.Close()
+
+		var previous []byte
+		for it.Rewind(); it.Valid(); it.Next() {
+			ip, port, _, ok := ParseServerKey(it.Item().Key())
+			if !ok {
+				// legacy keys are left for the migrate command
+				continue
+			}
+			// servers are stored once per observation, but should only be counted once
+			server := it.Item().Key()[:serverKeyLength-8]
+			if bytes.Equal(server, previous) {
+				continue
+			}
+			previous = append(previous[:0], server...)
+			if err := fn(ip, port); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (s *BadgerStorage) LookupIndex(kind, term string, prefix bool, fn func(IndexEntry) error) error {
+	return s.DB.View(func(txn *badger.Txn) error {
+		return LookupIndex(txn, kind, term, prefix, fn)
+	})
+}
+
+func (s *BadgerStorage) PlayerSightings(id uuid.UUID, since, until time.Time, fn func(Sighting) error) error {
+	return s.DB.View(func(txn *badger.Txn) error {
+		return PlayerSightings(txn, id, since, until, fn)
+	})
+}
+
+func (s *BadgerStorage) ServerPlayers(ip net.IP, port uint16, since, until time.Time, fn func(Sighting) error) error {
+	return s.DB.View(func(txn *badger.Txn) error {
+		return ServerPlayers(txn, ip, port, since, until, fn)
+	})
+}
+
+func (s *BadgerStorage) ResolvePlayerName(name string) ([]uuid.UUID, error) {
+	var ids []uuid.UUID
+	err := s.DB.View(func(txn *badger.Txn) error {
+		var err error
+		ids, err = ResolvePlayerName(txn, name)
+		return err
+	})
+	return ids, err
+}
+
+func (s *BadgerStorage) Close() error {
+	return s.DB.Close()
+}
@@ -0,0 +1,294 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	badger "github.com/dgraph-io/badger/v4"
+	"github.com/google/uuid"
+)
+
+// POSTGRES_TEST_DSN_ENV names the postgres URL the conformance tests use, they skip postgres without it
+const POSTGRES_TEST_DSN_ENV = "SERVERSCANNER_TEST_POSTGRES"
+
+func openTestBadger(t *testing.T) *BadgerStorage {
+	t.Helper()
+	db, err := badger.Open(badger.DefaultOptions("").WithInMemory(true).WithLogger(nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	return &BadgerStorage{DB: db}
+}
+
+func openTestSQLite(t *testing.T) *SQLStorage {
+	t.Helper()
+	store, err := OpenSQLStorage(STORAGE_SQLITE, filepath.Join(t.TempDir(), "servers.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { store.Close() })
+	return store
+}
+
+// openTestPostgres gives each test its own schema, dropped again afterwards
+func openTestPostgres(t *testing.T) *SQLStorage {
+	t.Helper()
+	dsn := os.Getenv(POSTGRES_TEST_DSN_ENV)
+	if dsn == "" {
+		t.Skip(POSTGRES_TEST_DSN_ENV + " isn't set")
+	}
+	admin, err := sql.Open(SQL_DIALECTS[STORAGE_POSTGRES].driver, dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { admin.Close() })
+	schema := "conformance_" + strings.ReplaceAll(uuid.NewString(), "-", "")
+	if _, err := admin.Exec(`CREATE SCHEMA ` + schema); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { admin.Exec(`DROP SCHEMA ` + schema + ` CASCADE`) })
+
+	separator := "?"
+	if strings.Contains(dsn, "?") {
+		separator = "&"
+	}
+	store, err := OpenSQLStorage(STORAGE_POSTGRES, dsn+separator+"search_path="+schema)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { store.Close() })
+	return store
+}
+
+var TEST_STORAGES = map[string]func(t *testing.T) Storage{
+	STORAGE_BADGER:   func(t *testing.T) Storage { return openTestBadger(t) },
+	STORAGE_SQLITE:   func(t *testing.T) Storage { return openTestSQLite(t) },
+	STORAGE_POSTGRES: func(t *testing.T) Storage { return openTestPostgres(t) },
+}
+
+// conformanceRecords is a server seen three times with a player online, and
+// another one seen once on a different version with nobody on
+func conformanceRecords() (a []*ServerRecord, b *ServerRecord) {
+	for i, r := range history()[:3] {
+		r.IsFakeSample = false
+		if i == 2 {
+			r.Version = VersionInfo{Name: "Purpur 1.21.1", Protocol: 767}
+		}
+		a = append(a, r)
+	}
+	b = fullRecord()
+	b.IP = net.IPv4(198, 51, 100, 7).To4()
+	b.Port = 25565
+	b.ObservedAt = a[1].ObservedAt
+	b.Version = VersionInfo{Name: "1.8.9", Protocol: 47}
+	b.Players = &PlayersInfo{Max: 100}
+	b.Description = "§6Hypixel"
+	return a, b
+}
+
+func collectRecords(t *testing.T, scan func(fn func(*ServerRecord) error) error) []*ServerRecord {
+	t.Helper()
+	var records []*ServerRecord
+	err := scan(func(r *ServerRecord) error {
+		records = append(records, r)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return records
+}
+
+func collectSightings(t *testing.T, scan func(fn func(Sighting) error) error) []Sighting {
+	t.Helper()
+	var sightings []Sighting
+	err := scan(func(s Sighting) error {
+		sightings = append(sightings, s)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return sightings
+}
+
+func TestStorageConformance(t *testing.T) {
+	for kind, open := range TEST_STORAGES {
+		t.Run(kind, func(t *testing.T) {
+			testStorage(t, open(t))
+		})
+	}
+}
+
+func testStorage(t *testing.T, store Storage) {
+	a, b := conformanceRecords()
+	if err := store.PutObservations(append(append([]*ServerRecord{}, a...), b)); err != nil {
+		t.Fatal(err)
+	}
+	ip, port := a[0].IP, a[0].Port
+	// windows given in another zone must select the same instants
+	zone := time.FixedZone("UTC+5", 5*60*60)
+	since, until := a[1].ObservedAt.In(zone), a[2].ObservedAt.In(zone)
+
+	t.Run("Latest", func(t *testing.T) {
+		latest, err := store.Latest(ip, port)
+		if err != nil {
+			t.Fatal(err)
+		}
+		assertSameRecord(t, latest, a[2])
+		if unseen, err := store.Latest(net.IPv4(203, 0, 113, 1).To4(), 25565); err != nil || unseen != nil {
+			t.Errorf("unseen server: %v %v", unseen, err)
+		}
+		if ipv6, err := store.Latest(net.ParseIP("2001:db8::1"), 25565); err != nil || ipv6 != nil {
+			t.Errorf("IPv6 server: %v %v", ipv6, err)
+		}
+	})
+
+	t.Run("History", func(t *testing.T) {
+		all := collectRecords(t, func(fn func(*ServerRecord) error) error {
+			return store.History(ip, port, time.Time{}, END_OF_TIME, fn)
+		})
+		if len(all) != len(a) {
+			t.Fatalf("history has %d records, want %d", len(all), len(a))
+		}
+		for i := range a {
+			assertSameRecord(t, all[i], a[i])
+		}
+		window := collectRecords(t, func(fn func(*ServerRecord) error) error {
+			return store.History(ip, port, since, until, fn)
+		})
+		if len(window) != 2 || !window[0].ObservedAt.Equal(a[1].ObservedAt) {
+			t.Errorf("window has %d records, want 2 starting at %v", len(window), a[1].ObservedAt)
+		}
+	})
+
+	t.Run("Scan", func(t *testing.T) {
+		filter := NewRecordFilter()
+		if n := len(collectRecords(t, func(fn func(*ServerRecord) error) error { return store.Scan(&filter, false, fn) })); n != 4 {
+			t.Errorf("scan found %d observations, want 4", n)
+		}
+		latest := collectRecords(t, func(fn func(*ServerRecord) error) error { return store.Scan(&filter, true, fn) })
+		if len(latest) != 2 {
+			t.Fatalf("latest scan found %d servers, want 2", len(latest))
+		}
+		assertSameRecord(t, latest[0], a[2])
+		assertSameRecord(t, latest[1], b)
+
+		filter.Protocol = 47
+		filter.Since, filter.Until = since, until
+		found := collectRecords(t, func(fn func(*ServerRecord) error) error { return store.Scan(&filter, false, fn) })
+		if len(found) != 1 {
+			t.Fatalf("filtered scan found %d observations, want 1", len(found))
+		}
+		assertSameRecord(t, found[0], b)
+
+		_, filter.Network, _ = net.ParseCIDR("192.0.2.0/24")
+		filter.Protocol = -1
+		if n := len(collectRecords(t, func(fn func(*ServerRecord) error) error { return store.Scan(&filter, false, fn) })); n != 2 {
+			t.Errorf("scan of a network found %d observations, want 2", n)
+		}
+
+		after := NewRecordFilter()
+		after.After = &net.TCPAddr{IP: ip, Port: int(port)}
+		rest := collectRecords(t, func(fn func(*ServerRecord) error) error { return store.Scan(&after, true, fn) })
+		if len(rest) != 1 {
+			t.Fatalf("scan after %v found %d servers, want 1", after.After, len(rest))
+		}
+		assertSameRecord(t, rest[0], b)
+	})
+
+	t.Run("Servers", func(t *testing.T) {
+		var servers []string
+		err := store.Servers(func(ip net.IP, port uint16) error {
+			servers = append(servers, net.JoinHostPort(ip.String(), fmt.Sprint(port)))
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := []string{"192.0.2.10:25566", "198.51.100.7:25565"}; fmt.Sprint(servers) != fmt.Sprint(want) {
+			t.Errorf("servers %v, want %v", servers, want)
+		}
+	})
+
+	// backends may index every observation or only the changes, but they agree on which servers match
+	t.Run("LookupIndex", func(t *testing.T) {
+		for _, c := range []struct {
+			kind, term string
+			prefix     bool
+			want       string
+		}{
+			{INDEX_SOFTWARE, "paper", false, "[192.0.2.10:25566]"},
+			{INDEX_SOFTWARE, "purpur", false, "[192.0.2.10:25566]"},
+			{INDEX_PROTOCOL, "47", false, "[198.51.100.7:25565]"},
+			{INDEX_PROTOCOL, "767", false, "[192.0.2.10:25566]"},
+			{INDEX_PROTOCOL, "76", true, "[192.0.2.10:25566]"},
+			{INDEX_SOFTWARE, "forge", false, "[]"},
+		} {
+			var servers []string
+			err := store.LookupIndex(c.kind, c.term, c.prefix, func(e IndexEntry) error {
+				addr := net.JoinHostPort(e.IP.String(), fmt.Sprint(e.Port))
+				if len(servers) == 0 || servers[len(servers)-1] != addr {
+					servers = append(servers, addr)
+				}
+				return nil
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if fmt.Sprint(servers) != c.want {
+				t.Errorf("%s:%s (prefix %v) found %v, want %s", c.kind, c.term, c.prefix, servers, c.want)
+			}
+		}
+	})
+
+	notch := *(*a[0].Players.Sample)[0].ID
+	t.Run("PlayerSightings", func(t *testing.T) {
+		all := collectSightings(t, func(fn func(Sighting) error) error {
+			return store.PlayerSightings(notch, time.Time{}, time.Time{}, fn)
+		})
+		if len(all) != 3 {
+			t.Errorf("player was seen %d times, want 3", len(all))
+		}
+		window := collectSightings(t, func(fn func(Sighting) error) error {
+			return store.PlayerSightings(notch, since, until, fn)
+		})
+		if len(window) != 2 || !window[0].Time.Equal(a[1].ObservedAt) || window[0].Name != "Notch" {
+			t.Errorf("window has sightings %+v, want 2 starting at %v", window, a[1].ObservedAt)
+		}
+	})
+
+	t.Run("ServerPlayers", func(t *testing.T) {
+		window := collectSightings(t, func(fn func(Sighting) error) error {
+			return store.ServerPlayers(ip, port, since, until, fn)
+		})
+		if len(window) != 2 || window[0].UUID != notch || !window[1].Time.Equal(a[2].ObservedAt) {
+			t.Errorf("window has sightings %+v, want 2 of %v", window, notch)
+		}
+		if empty := collectSightings(t, func(fn func(Sighting) error) error {
+			return store.ServerPlayers(b.IP, b.Port, time.Time{}, time.Time{}, fn)
+		}); len(empty) != 0 {
+			t.Errorf("server without players has sightings %+v", empty)
+		}
+	})
+
+	t.Run("ResolvePlayerName", func(t *testing.T) {
+		ids, err := store.ResolvePlayerName("nOTCH")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(ids) != 1 || ids[0] != notch {
+			t.Errorf("resolved %v, want [%v]", ids, notch)
+		}
+		if ids, err := store.ResolvePlayerName("jeb_"); err != nil || len(ids) != 0 {
+			t.Errorf("unknown name resolved to %v %v", ids, err)
+		}
+	})
+}
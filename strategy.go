@@ -0,0 +1,314 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"log/slog"
+	"net"
+	"slices"
+	"sort"
+)
+
+// Scan strategies, selected with -strategy
+const STRATEGY_UNIFORM = "uniform"
+const STRATEGY_ADAPTIVE = "adaptive"
+
+// Fraction of targets that the adaptive strategy still takes from the uniform sweep
+const DEFAULT_EXPLORE_FRACTION = 0.2
+
+// How far around a known server the adaptive strategy looks
+const NEIGHBOUR_PORT_SPREAD = 10
+const NEIGHBOUR_ADDRESS_SPREAD = 4
+
+// Only the densest neighbourhoods are swept in full, the rest is left to exploration
+const MAX_HOT_24S = 4096
+const MAX_HOT_16S = 64
+const MAX_HOT_PORTS = 8
+
+type Target struct {
+	IP   net.IP
+	Port int
+}
+
+func (t Target) String() string {
+	return net.JoinHostPort(t.IP.String(), fmt.Sprint(t.Port))
+}
+
+// HitStats is what the adaptive strategy learns from previous results
+type HitStats struct {
+	Slash24 map[uint32]int // keyed by the address with the last octet dropped
+	Slash16 map[uint32]int // keyed by the address with the last two octets dropped
+	Ports   map[int]int
+	Servers []Target
+}
+
+type StrategyConfig struct {
+	Name            string
+	ExploreFraction float64
+}
+
+// ipv4ToUint32 is the address as a number, ok is false for IPv6 and nil ones
+func ipv4ToUint32(ip net.IP) (n uint32, ok bool) {
+	ip4 := ip.To4()
+	if ip4 == nil {
+		return 0, false
+	}
+	return binary.BigEndian.Uint32(ip4), true
+}
+
+func uint32ToIP(n uint32) net.IP {
+	ip := make(net.IP, 4)
+	binary.BigEndian.PutUint32(ip, n)
+	return ip
+}
+
+// ipAllowed reports whether ip falls inside one of the sorted, non-overlapping ranges
+func ipAllowed(ranges []IPRange, ip net.IP) bool {
+	ip = ip.To4()
+	i := sort.Search(len(ranges), func(i int) bool {
+		return bytes.Compare(ranges[i].end, ip) >= 0
+	})
+	return i < len(ranges) && bytes.Compare(ranges[i].start, ip) <= 0
+}
+
+func LoadHitStats(store Storage) (*HitStats, error) {
+	stats := &HitStats{
+		Slash24: make(map[uint32]int),
+		Slash16: make(map[uint32]int),
+		Ports:   make(map[int]int),
+	}
+	skipped := 0
+	err := store.Servers(func(ip net.IP, port uint16) error {
+		n, ok := ipv4ToUint32(ip)
+		if !ok {
+			skipped++
+			return nil
+		}
+		stats.Slash24[n>>8]++
+		stats.Slash16[n>>16]++
+		stats.Ports[int(port)]++
+		stats.Servers = append(stats.Servers, Target{IP: ip, Port: int(port)})
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if skipped > 0 {
+		slog.Warn("Skipped servers that aren't IPv4", "count", skipped)
+	}
+	return stats, nil
+}
+
+// topKeys returns the keys of m ordered by descending count, at most limit of them
+func topKeys[K uint32 | int](m map[K]int, limit int) []K {
+	keys := make([]K, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if m[keys[i]] != m[keys[j]] {
+			return m[keys[i]] > m[keys[j]]
+		}
+		return keys[i] < keys[j]
+	})
+	if len(keys) > limit {
+		keys = keys[:limit]
+	}
+	return keys
+}
+
+// prioritizedTargets lazily yields targets near previous hits, densest neighbourhoods first.
+// It works through three phases:
+// 1. adjacent ports and addresses of known servers
+// 2. every address of the hottest /24s, on the most common ports
+// 3. every address of the hottest /16s, on the default port
+type prioritizedTargets struct {
+	stats  *HitStats
+	ranges []IPRange
+	ports  []int
+	queue  []Target
+	phase  int
+	hot24  []uint32
+	hot16  []uint32
+	cursor uint32
+	done   bool
+}
+
+func newPrioritizedTargets(stats *HitStats, ranges []IPRange) *prioritizedTargets {
+	p := &prioritizedTargets{
+		stats:  stats,
+		ranges: ranges,
+		ports:  topKeys(stats.Ports, MAX_HOT_PORTS),
+		hot24:  topKeys(stats.Slash24, MAX_HOT_24S),
+		hot16:  topKeys(stats.Slash16, MAX_HOT_16S),
+	}
+	if len(p.ports) == 0 {
+		p.ports = []int{DEFAULT_PORT}
+	}
+
+	// servers in dense /24s are the most likely to have neighbours, and only IPv4 ones have any
+	servers := slices.DeleteFunc(slices.Clone(stats.Servers), func(t Target) bool {
+		_, ok := ipv4ToUint32(t.IP)
+		return !ok
+	})
+	sort.SliceStable(servers, func(i, j int) bool {
+		a, _ := ipv4ToUint32(servers[i].IP)
+		b, _ := ipv4ToUint32(servers[j].IP)
+		return stats.Slash24[a>>8] > stats.Slash24[b>>8]
+	})
+	for _, s := range servers {
+		for d := 1; d <= NEIGHBOUR_PORT_SPREAD; d++ {
+			p.queue = append(p.queue, Target{IP: s.IP, Port: s.Port + d})
+			if s.Port-d > 0 {
+				p.queue = append(p.queue, Target{IP: s.IP, Port: s.Port - d})
+			}
+		}
+		n, _ := ipv4ToUint32(s.IP)
+		for d := uint32(1); d <= NEIGHBOUR_ADDRESS_SPREAD; d++ {
+			p.queue = append(p.queue, Target{IP: uint32ToIP(n + d), Port: s.Port})
+			p.queue = append(p.queue, Target{IP: uint32ToIP(n - d), Port: s.Port})
+		}
+	}
+	return p
+}
+
+func (p *prioritizedTargets) refill() {
+	switch p.phase {
+	case 0:
+		// neighbours were queued up front
+		p.phase++
+		p.cursor = 0
+		fallthrough
+	case 1:
+		if int(p.cursor) < len(p.hot24) {
+			base := p.hot24[p.cursor] << 8
+			for i := uint32(0); i < 256; i++ {
+				for _, port := range p.ports {
+					p.queue = append(p.queue, Target{IP: uint32ToIP(base | i), Port: port})
+				}
+			}
+			p.cursor++
+			return
+		}
+		p.phase++
+		p.cursor = 0
+		fallthrough
+	case 2:
+		if int(p.cursor) < len(p.hot16) {
+			base := p.hot16[p.cursor] << 16
+			for i := uint32(0); i < 1<<16; i++ {
+				p.queue = append(p.queue, Target{IP: uint32ToIP(base | i), Port: DEFAULT_PORT})
+			}
+			p.cursor++
+			return
+		}
+		p.done = true
+	}
+}
+
+func (p *prioritizedTargets) next() (Target, bool) {
+	for {
+		for len(p.queue) > 0 {
+			t := p.queue[0]
+			p.queue = p.queue[1:]
+			if t.Port <= 0 || t.Port > 65535 || !ipAllowed(p.ranges, t.IP) {
+				continue
+			}
+			return t, true
+		}
+		if p.done {
+			return Target{}, false
+		}
+		p.refill()
+	}
+}
+
+// uniformTargets walks the allowed ranges in order on the default port
+type uniformTargets struct {
+	ranges []IPRange
+	index  int
+	ip     net.IP
+}
+
+func (u *uniformTargets) next() (Target, bool) {
+	for u.index < len(u.ranges) {
+		r := u.ranges[u.index]
+		if u.ip == nil {
+			u.ip = r.start
+		}
+		if bytes.Compare(u.ip, r.end) <= 0 {
+			t := Target{IP: u.ip, Port: DEFAULT_PORT}
+			if u.ip.Equal(ABSOLUTE_MAX_IP) {
+				u.index++
+				u.ip = nil
+			} else {
+				u.ip = incrementIP(u.ip)
+			}
+			return t, true
+		}
+		u.index++
+		u.ip = nil
+	}
+	return Target{}, false
+}
+
+func SendAdaptiveTargetsToChannel(targets chan<- Target, ranges []IPRange, stats *HitStats, exploreFraction float64, done <-chan struct{}, progress *ScanProgress) {
+	defer close(targets)
+	// roughly, the prioritized targets are mostly addresses the sweep skips later
+	progress.SetTotal(rangeSize(ranges))
+
+	priority := newPrioritizedTargets(stats, ranges)
+	uniform := &uniformTargets{ranges: ranges}
+	// default port addresses already covered by the priority phases are skipped by the sweep
+	prioritized := make(map[uint32]struct{})
+
+	var counter, explored int
+	priorityDone := false
+	uniformDone := false
+	for !(priorityDone && uniformDone) {
+		var t Target
+		var ok bool
+		// keep the share of uniform targets at exploreFraction while there are still priorities
+		if priorityDone || (!uniformDone && float64(explored) < exploreFraction*float64(counter+1)) {
+			t, ok = uniform.next()
+			if !ok {
+				uniformDone = true
+				continue
+			}
+			n, _ := ipv4ToUint32(t.IP)
+			if _, seen := prioritized[n]; seen {
+				continue
+			}
+			explored++
+		} else {
+			t, ok = priority.next()
+			if !ok {
+				priorityDone = true
+				slog.Info("Adaptive strategy exhausted prioritized targets", "sent", counter)
+				continue
+			}
+			if t.Port == DEFAULT_PORT {
+				n, _ := ipv4ToUint32(t.IP)
+				if _, seen := prioritized[n]; seen {
+					continue
+				}
+				prioritized[n] = struct{}{}
+			}
+		}
+
+		if !progress.wait(done) {
+			slog.Info("Stopping IP generation", "sent", counter)
+			return
+		}
+		select {
+		case targets <- t:
+			counter++
+			progress.CountSent()
+			metricTargets.WithLabelValues(portLabel(t.Port)).Inc()
+		case <-done:
+			slog.Info("Stopping IP generation", "sent", counter)
+			return
+		}
+	}
+}
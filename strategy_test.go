@@ -0,0 +1,123 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+)
+
+// strategyStats is two servers in 192.0.2.0/24 and one in 198.51.100.0/24, plus an
+// IPv6 one that has no neighbours to try
+func strategyStats(t *testing.T) *HitStats {
+	t.Helper()
+	store := openTestBadger(t)
+	var records []*ServerRecord
+	for _, ip := range []net.IP{net.IPv4(198, 51, 100, 7), net.IPv4(192, 0, 2, 10), net.IPv4(192, 0, 2, 20)} {
+		r := fullRecord()
+		r.IP, r.Port = ip.To4(), DEFAULT_PORT
+		records = append(records, r)
+	}
+	if err := store.PutObservations(records); err != nil {
+		t.Fatal(err)
+	}
+	stats, err := LoadHitStats(store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stats.Servers = append(stats.Servers, Target{IP: net.ParseIP("2001:db8::1"), Port: DEFAULT_PORT})
+	return stats
+}
+
+func strategyRanges(t *testing.T) []IPRange {
+	t.Helper()
+	ranges, err := ParseCIDRs("192.0.2.0/24,198.51.100.0/24")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ranges
+}
+
+func targetString(t Target) string {
+	return fmt.Sprintf("%s:%d", t.IP, t.Port)
+}
+
+func TestPrioritizedTargetsOrder(t *testing.T) {
+	p := newPrioritizedTargets(strategyStats(t), strategyRanges(t))
+	var targets []Target
+	for {
+		target, ok := p.next()
+		if !ok {
+			break
+		}
+		targets = append(targets, target)
+	}
+
+	// neighbours of the servers in the denser /24 come first, ports then addresses
+	neighbours := 2*NEIGHBOUR_PORT_SPREAD + 2*NEIGHBOUR_ADDRESS_SPREAD
+	if len(targets) < 3*neighbours+512 {
+		t.Fatalf("only %d targets", len(targets))
+	}
+	for i, want := range map[int]string{
+		0:                         "192.0.2.10:25566",
+		1:                         "192.0.2.10:25564",
+		2 * NEIGHBOUR_PORT_SPREAD: "192.0.2.11:25565",
+		neighbours:                "192.0.2.20:25566",
+		2 * neighbours:            "198.51.100.7:25566",
+		3 * neighbours:            "192.0.2.0:25565",
+		3*neighbours + 255:        "192.0.2.255:25565",
+		3*neighbours + 256:        "198.51.100.0:25565",
+		3*neighbours + 511:        "198.51.100.255:25565",
+	} {
+		if got := targetString(targets[i]); got != want {
+			t.Errorf("target %d is %s, want %s", i, got, want)
+		}
+	}
+	for _, target := range targets {
+		if target.IP.To4() == nil || !ipAllowed(strategyRanges(t), target.IP) {
+			t.Fatalf("target %s is outside the ranges", targetString(target))
+		}
+	}
+}
+
+// sendAdaptive collects every target the adaptive strategy sends
+func sendAdaptive(t *testing.T, exploreFraction float64) []Target {
+	t.Helper()
+	targets := make(chan Target)
+	go SendAdaptiveTargetsToChannel(targets, strategyRanges(t), strategyStats(t), exploreFraction, make(chan struct{}), nil)
+	var sent []Target
+	for target := range targets {
+		sent = append(sent, target)
+	}
+	return sent
+}
+
+func TestAdaptiveTargetsExplore(t *testing.T) {
+	// a quarter of the targets come from the sweep, starting with the first of them
+	var first []string
+	for _, target := range sendAdaptive(t, 0.25)[:8] {
+		first = append(first, targetString(target))
+	}
+	want := "192.0.2.0:25565 192.0.2.10:25566 192.0.2.10:25564 192.0.2.10:25567 192.0.2.1:25565 192.0.2.10:25563 192.0.2.10:25568 192.0.2.10:25562"
+	if got := strings.Join(first, " "); got != want {
+		t.Errorf("started with %s, want %s", got, want)
+	}
+}
+
+func TestAdaptiveTargetsSkipPrioritized(t *testing.T) {
+	// with no exploring the sweep comes last, and skips every address the priorities had on the default port
+	tried := make(map[string]int)
+	for _, target := range sendAdaptive(t, 0) {
+		if target.Port == DEFAULT_PORT {
+			tried[target.IP.String()]++
+		}
+	}
+	if len(tried) != 512 {
+		t.Errorf("%d addresses tried on the default port, want 512", len(tried))
+	}
+	for ip, n := range tried {
+		if n != 1 {
+			t.Errorf("%s tried %d times on the default port", ip, n)
+		}
+	}
+}
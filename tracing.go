@@ -0,0 +1,90 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"log/slog"
+	"time"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const DEFAULT_TRACE_SAMPLE = 0.01
+
+// spans still queued at shutdown get this long to be exported
+const TRACE_SHUTDOWN_TIMEOUT = 5 * time.Second
+
+// Every span comes from this tracer. Until a provider is installed it does
+// nothing, so tracing costs nothing when it's off.
+var tracer = otel.Tracer("github.com/saturn-vi/serverscanner")
+
+type TracingConfig struct {
+	Endpoint   string  // OTLP/HTTP collector URL, empty disables tracing
+	SampleRate float64 // fraction of probes traced
+}
+
+func addTracingFlags(fs *flag.FlagSet, cfg *TracingConfig) {
+	fs.StringVar(&cfg.Endpoint, "otlp", "", "send traces to this OTLP/HTTP collector, e.g. http://localhost:4318")
+	fs.Float64Var(&cfg.SampleRate, "trace-sample", DEFAULT_TRACE_SAMPLE, "fraction of probes to trace")
+}
+
+// NewTracerProvider samples probes at sampleRate and hands finished spans to exporter.
+// Children follow their parent's decision, so a sampled probe is traced all the way to
+// the database. Any exporter works, tracetest.NewInMemoryExporter keeps them in process.
+func NewTracerProvider(exporter sdktrace.SpanExporter, sampleRate float64) *sdktrace.TracerProvider {
+	return sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(sampleRate))),
+		sdktrace.WithResource(resource.NewSchemaless(
+			semconv.ServiceName("serverscanner"),
+			semconv.ServiceInstanceID(defaultSource),
+		)),
+	)
+}
+
+// setupTracing installs the OTLP exporter, the returned func flushes it and must be called before exiting
+func setupTracing(ctx context.Context, cfg TracingConfig) func() {
+	if cfg.Endpoint == "" {
+		return func() {}
+	}
+	exporter, err := otlptracehttp.New(ctx, otlptracehttp.WithEndpointURL(cfg.Endpoint))
+	if err != nil {
+		slog.Error("Failed to set up tracing", "error", err)
+		return func() {}
+	}
+	provider := NewTracerProvider(exporter, cfg.SampleRate)
+	otel.SetTracerProvider(provider)
+	slog.Info("Tracing enabled", "endpoint", cfg.Endpoint, "sampleRate", cfg.SampleRate)
+	return func() {
+		ctx, cancel := context.WithTimeout(context.Background(), TRACE_SHUTDOWN_TIMEOUT)
+		defer cancel()
+		if err := provider.Shutdown(ctx); err != nil {
+			slog.Error("Failed to flush traces", "error", err)
+		}
+	}
+}
+
+// targetAttributes describe the server a span is about
+func targetAttributes(ip string, port int) trace.SpanStartOption {
+	return trace.WithAttributes(
+		semconv.ServerAddress(ip),
+		semconv.ServerPort(port),
+	)
+}
+
+// endSpan records err on span, if there is one, and ends it
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		span.SetAttributes(attribute.String("error.type", errorCategory(err)))
+	}
+	span.End()
+}
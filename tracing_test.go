@@ -0,0 +1,106 @@
+package main
+
+import (
+	"context"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+// fakeMCServer answers one status ping with response, the way a real server does
+func fakeMCServer(t *testing.T, response string) *net.TCPAddr {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		// the handshake and status request, which the reply doesn't depend on
+		buf := make([]byte, 512)
+		conn.Read(buf)
+		conn.Write(Packet{id: CreateVarInt(0x00), data: CreateString(response).bytes}.ToBytes())
+	}()
+	return ln.Addr().(*net.TCPAddr)
+}
+
+func TestProbeSpanTree(t *testing.T) {
+	exporter := tracetest.NewInMemoryExporter()
+	provider := NewTracerProvider(exporter, 1)
+	otel.SetTracerProvider(provider)
+	t.Cleanup(func() { provider.Shutdown(context.Background()) })
+
+	addr := fakeMCServer(t, `{"version":{"name":"Paper 1.21.1","protocol":767},"players":{"max":20,"online":1},"description":"hi"}`)
+	store := openTestBadger(t)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	// the same stages the scanner wires together, with one target
+	jobs := make(chan Target, 1)
+	results := make(chan *ServerStatus, 1)
+	errs := make(chan ErrorWithIP, 1)
+	jobs <- Target{IP: addr.IP, Port: addr.Port}
+	close(jobs)
+	var wg sync.WaitGroup
+	wg.Add(1)
+	worker(ctx, jobs, results, errs, NewLimiter(RateLimitConfig{}), nil, nil, &wg)
+	wg.Wait()
+	close(results)
+	select {
+	case err := <-errs:
+		t.Fatalf("probe failed: %v", err.Err)
+	default:
+	}
+
+	annotated := make(chan *ServerStatus, 1)
+	annotator(results, annotated, nil, nil)
+	writer := NewBatchWriter(store, WriterConfig{BatchSize: 10, FlushInterval: time.Minute})
+	for status := range annotated {
+		writer.Add(status)
+	}
+	writer.Flush()
+	if err := provider.ForceFlush(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	spans := make(map[string]tracetest.SpanStub)
+	for _, span := range exporter.GetSpans() {
+		if _, dup := spans[span.Name]; dup {
+			t.Errorf("more than one %s span", span.Name)
+		}
+		spans[span.Name] = span
+	}
+	probe, ok := spans["probe"]
+	if !ok {
+		t.Fatalf("no probe span in %v", exporter.GetSpans())
+	}
+	if probe.Parent.IsValid() {
+		t.Errorf("probe span has a parent %v", probe.Parent)
+	}
+	for _, name := range []string{"dial", "handshake", "read", "parse", "enrich", "db.write"} {
+		span, ok := spans[name]
+		if !ok {
+			t.Errorf("no %s span", name)
+			continue
+		}
+		if span.Parent.SpanID() != probe.SpanContext.SpanID() || span.SpanContext.TraceID() != probe.SpanContext.TraceID() {
+			t.Errorf("%s span's parent is %v, want the probe %v", name, span.Parent.SpanID(), probe.SpanContext.SpanID())
+		}
+	}
+	// the batch only wrote the probe it carries on from, so there's nothing to link
+	if links := spans["db.write"].Links; len(links) != 0 {
+		t.Errorf("db.write links %+v, want none", links)
+	}
+	if len(spans) != 7 {
+		t.Errorf("got spans %v", exporter.GetSpans())
+	}
+}
@@ -0,0 +1,284 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+	"unicode"
+
+	"golang.org/x/term"
+)
+
+const TUI_REFRESH = 500 * time.Millisecond
+
+// rates are averaged over this many refreshes
+const TUI_RATE_WINDOW = 10
+
+const TUI_LOG_LINES = 8
+
+// + and - multiply and divide the connection rate by this
+const TUI_RATE_STEP = 1.25
+
+// logRing keeps the last log lines so the TUI can show them instead of them scrolling the screen away
+type logRing struct {
+	mu    sync.Mutex
+	lines []string
+}
+
+func (l *logRing) Write(p []byte) (int, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for _, line := range strings.Split(strings.TrimRight(string(p), "\n"), "\n") {
+		l.lines = append(l.lines, line)
+	}
+	if len(l.lines) > TUI_LOG_LINES {
+		l.lines = l.lines[len(l.lines)-TUI_LOG_LINES:]
+	}
+	return len(p), nil
+}
+
+func (l *logRing) Lines() []string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return append([]string(nil), l.lines...)
+}
+
+// tuiSample is the counters at one refresh, rates are the difference between two
+type tuiSample struct {
+	at       time.Time
+	sent     uint64
+	acquired uint64
+	received uint64
+}
+
+// TUI draws the scan's progress over the whole terminal and takes keyboard controls
+type TUI struct {
+	progress *ScanProgress
+	limiter  *Limiter
+	writer   *BatchWriter
+	logs     *logRing
+
+	out      io.Writer
+	oldState *term.State
+
+	mu      sync.Mutex
+	samples []tuiSample
+	closed  bool
+}
+
+// StartTUI takes over the terminal, log output goes to the bottom of the screen
+// until Close gives the terminal back
+func StartTUI(ctx context.Context, progress *ScanProgress, limiter *Limiter, writer *BatchWriter) (*TUI, error) {
+	if !term.IsTerminal(int(os.Stdin.Fd())) || !term.IsTerminal(int(os.Stdout.Fd())) {
+		return nil, fmt.Errorf("-tui needs a terminal")
+	}
+	oldState, err := term.MakeRaw(int(os.Stdin.Fd()))
+	if err != nil {
+		return nil, err
+	}
+	t := &TUI{progress: progress, limiter: limiter, writer: writer, logs: &logRing{}, out: os.Stdout, oldState: oldState}
+	slog.SetDefault(slog.New(slog.NewTextHandler(t.logs, nil)))
+	// alternate screen, hidden cursor
+	fmt.Fprint(t.out, "\x1b[?1049h\x1b[?25l")
+
+	go t.readKeys()
+	go t.run(ctx)
+	return t, nil
+}
+
+// Close restores the terminal and logging, and prints the last log lines so they aren't lost
+func (t *TUI) Close() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.closed = true
+	fmt.Fprint(t.out, "\x1b[?25h\x1b[?1049l")
+	term.Restore(int(os.Stdin.Fd()), t.oldState)
+	slog.SetDefault(slog.New(slog.NewTextHandler(os.Stderr, nil)))
+	for _, line := range t.logs.Lines() {
+		fmt.Fprintln(os.Stderr, line)
+	}
+}
+
+func (t *TUI) run(ctx context.Context) {
+	ticker := time.NewTicker(TUI_REFRESH)
+	defer ticker.Stop()
+	for {
+		t.draw()
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (t *TUI) readKeys() {
+	buf := make([]byte, 16)
+	for {
+		n, err := os.Stdin.Read(buf)
+		if err != nil {
+			return
+		}
+		for _, key := range buf[:n] {
+			t.handleKey(key)
+		}
+	}
+}
+
+func (t *TUI) handleKey(key byte) {
+	switch key {
+	case 'p', ' ':
+		if t.progress.Paused() {
+			t.progress.Resume()
+			slog.Info("Resumed")
+		} else {
+			t.progress.Pause()
+			slog.Info("Paused, probes already running will finish")
+		}
+	case '+', '=':
+		if rate := t.limiter.Rate(); rate > 0 {
+			t.limiter.SetRate(rate * TUI_RATE_STEP)
+			slog.Info("Rate changed", "rate", t.limiter.Rate())
+		}
+	case '-', '_':
+		rate := t.limiter.Rate()
+		if rate <= 0 {
+			// unlimited, so start from what it's actually doing
+			t.mu.Lock()
+			rate = t.rate(func(s tuiSample) uint64 { return s.acquired })
+			t.mu.Unlock()
+		}
+		t.limiter.SetRate(max(1, rate/TUI_RATE_STEP))
+		slog.Info("Rate changed", "rate", t.limiter.Rate())
+	case 'u':
+		t.limiter.SetRate(0)
+		slog.Info("Rate changed", "rate", "unlimited")
+	case 'q', 3: // 3 is ctrl-c, which raw mode doesn't turn into a signal
+		// the same shutdown as a signal from outside, so everything queued is still written
+		syscall.Kill(os.Getpid(), syscall.SIGINT)
+	}
+}
+
+// rate is how fast a counter went up over the last few refreshes, t.mu must be held
+func (t *TUI) rate(counter func(tuiSample) uint64) float64 {
+	if len(t.samples) < 2 {
+		return 0
+	}
+	first, last := t.samples[0], t.samples[len(t.samples)-1]
+	return float64(counter(last)-counter(first)) / last.at.Sub(first.at).Seconds()
+}
+
+// stripFormatting drops § codes, line breaks and every other control character, so
+// text a server sent fits on one line and can't send escape sequences to the terminal
+func stripFormatting(motd string) string {
+	var b strings.Builder
+	skip := false
+	for _, r := range motd {
+		switch {
+		case skip:
+			skip = false
+		case r == '§':
+			skip = true
+		case r == '\n' || r == '\r' || r == '\t':
+			b.WriteRune(' ')
+		case unicode.IsControl(r):
+		default:
+			b.WriteRune(r)
+		}
+	}
+	return strings.Join(strings.Fields(b.String()), " ")
+}
+
+func (t *TUI) draw() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.closed {
+		return
+	}
+	progress := t.progress.Stats()
+	limits := t.limiter.Stats()
+	writes := t.writer.Stats()
+	t.samples = append(t.samples, tuiSample{time.Now(), progress.Sent, limits.Acquired, writes.Received})
+	if len(t.samples) > TUI_RATE_WINDOW {
+		t.samples = t.samples[1:]
+	}
+	sendRate := t.rate(func(s tuiSample) uint64 { return s.sent })
+
+	width, height, err := term.GetSize(int(os.Stdout.Fd()))
+	if err != nil {
+		width, height = 80, 24
+	}
+	var lines []string
+	add := func(format string, args ...any) {
+		lines = append(lines, fmt.Sprintf(format, args...))
+	}
+
+	state := "running"
+	if progress.Paused {
+		state = "PAUSED"
+	}
+	add("serverscanner  %s  %s", state, progress.Elapsed.Round(time.Second))
+	add("")
+	sent := fmt.Sprintf("%d", progress.Sent)
+	if progress.Total > 0 {
+		sent += fmt.Sprintf(" / %d (%.2f%%)", progress.Total, 100*float64(progress.Sent)/float64(progress.Total))
+	}
+	eta := "unknown"
+	if d := progress.ETA(sendRate); d > 0 {
+		eta = d.String()
+	}
+	add("targets      %s  %.0f/s  eta %s", sent, sendRate, eta)
+	limit := "unlimited"
+	if rate := t.limiter.Rate(); rate > 0 {
+		limit = fmt.Sprintf("%.0f/s (ramping %.0f/s)", rate, limits.CurrentRate)
+	}
+	add("connections  %d in flight  %.0f/s  limit %s", limits.InFlight, t.rate(func(s tuiSample) uint64 { return s.acquired }), limit)
+	add("responses    %d  %.1f/s", writes.Received, t.rate(func(s tuiSample) uint64 { return s.received }))
+	add("writer       %d queued  %d written  %d failed  last commit %s", writes.Pending, writes.Written, writes.Failed, writes.LastLatency.Round(time.Microsecond))
+	var errs []string
+	for _, category := range ERROR_CATEGORIES {
+		errs = append(errs, fmt.Sprintf("%s %d", category, progress.Errors[category]))
+	}
+	add("errors       %s", strings.Join(errs, "  "))
+
+	add("")
+	add("recent")
+	for _, r := range t.writer.Recent() {
+		online := "?"
+		if r.Players != nil {
+			online = fmt.Sprintf("%d/%d", r.Players.Online, r.Players.Max)
+		}
+		add("  %-21s %-16.16s %-9s %s", r.Addr(), stripFormatting(r.Version.Name), online, stripFormatting(r.Description))
+	}
+
+	add("")
+	add("log")
+	for _, line := range t.logs.Lines() {
+		add("  %s", line)
+	}
+	add("")
+	add("p pause/resume   + - rate   u unlimited   q quit")
+
+	var buf bytes.Buffer
+	buf.WriteString("\x1b[H")
+	for i, line := range lines {
+		// the last row stays empty, writing past it would scroll
+		if i >= height-1 {
+			break
+		}
+		if runes := []rune(line); len(runes) > width {
+			line = string(runes[:width])
+		}
+		// raw mode, so lines need their carriage return
+		buf.WriteString(line + "\x1b[K\r\n")
+	}
+	buf.WriteString("\x1b[J")
+	t.out.Write(buf.Bytes())
+}
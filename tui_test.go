@@ -0,0 +1,17 @@
+package main
+
+import "testing"
+
+func TestStripFormatting(t *testing.T) {
+	for _, c := range []struct{ in, want string }{
+		{"§aA §lMinecraft§r Server", "A Minecraft Server"},
+		{"line one\nline two\r\n\tthree", "line one line two three"},
+		// escape sequences lose the ESC, and the rest can't do anything on its own
+		{"\x1b]0;pwned\x07Survival\x1b[2J", "]0;pwnedSurvival[2J"},
+		{"Paper\x00 1.21\u0085", "Paper 1.21"},
+	} {
+		if got := stripFormatting(c.in); got != c.want {
+			t.Errorf("stripFormatting(%q) = %q, want %q", c.in, got, c.want)
+		}
+	}
+}
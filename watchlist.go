@@ -0,0 +1,469 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"log/slog"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	badger "github.com/dgraph-io/badger/v4"
+	"github.com/fxamacker/cbor/v2"
+	"github.com/google/uuid"
+)
+
+// Watched servers and players live in badger next to everything else:
+//
+//	watch:<kind>:<target>                      -> cbor WatchEntry
+//	timeline:<kind>:<target>\x00<timestamp><type>\x00<player or pattern> -> cbor Event
+//
+// where target is ip:port for servers, and a UUID or lowercase name for players
+const WATCH_PREFIX = "watch:"
+const TIMELINE_PREFIX = "timeline:"
+
+// Kinds of watch
+const (
+	WATCH_SERVER = "server"
+	WATCH_PLAYER = "player"
+)
+
+// how often watched servers are pinged unless their entry says otherwise
+const DEFAULT_WATCH_INTERVAL = time.Minute
+const MIN_WATCH_INTERVAL = 5 * time.Second
+
+// changes made through the API or CLI are picked up this often
+const WATCH_RELOAD_INTERVAL = 30 * time.Second
+
+// how often the scheduler checks for servers that are due
+const WATCH_TICK = time.Second
+
+// watched servers probed at once
+const WATCH_CONCURRENCY = 16
+
+var playerNamePattern = regexp.MustCompile(`^[A-Za-z0-9_]{1,16}$`)
+
+type WatchEntry struct {
+	Kind     string        `cbor:"kind" json:"kind"`
+	Target   string        `cbor:"target" json:"target"`
+	Note     string        `cbor:"note,omitempty" json:"note,omitempty"`
+	Interval time.Duration `cbor:"interval,omitempty" json:"interval,omitempty"` // servers only, 0 is DEFAULT_WATCH_INTERVAL
+	Added    time.Time     `cbor:"added" json:"added"`
+}
+
+// ParseWatchTarget works out what s is: ip[:port] is a server, anything else a
+// player's UUID or name. Targets come back in the form they're stored under.
+func ParseWatchTarget(s string) (kind, target string, err error) {
+	if strings.ContainsAny(s, ".:") {
+		ip, port, err := parseServerArg(s)
+		if err != nil {
+			return "", "", err
+		}
+		return WATCH_SERVER, Target{IP: ip, Port: int(port)}.String(), nil
+	}
+	if id, err := uuid.Parse(s); err == nil {
+		return WATCH_PLAYER, id.String(), nil
+	}
+	if playerNamePattern.MatchString(s) {
+		return WATCH_PLAYER, strings.ToLower(s), nil
+	}
+	return "", "", fmt.Errorf("%q is neither a server, a UUID nor a player name", s)
+}
+
+func watchKey(kind, target string) []byte {
+	return []byte(WATCH_PREFIX + kind + ":" + target)
+}
+
+func timelinePrefix(kind, target string) []byte {
+	return []byte(TIMELINE_PREFIX + kind + ":" + target + "\x00")
+}
+
+func timelineKey(kind, target string, event Event) []byte {
+	key := timelinePrefix(kind, target)
+	key = binary.BigEndian.AppendUint64(key, uint64(event.Time.UnixNano()))
+	// observations only have second precision, so this keeps two players seen at once apart
+	return append(key, event.Type+"\x00"+event.PlayerID+event.Player+event.Pattern...)
+}
+
+// AddWatch adds or replaces a watch, Added should be set
+func AddWatch(db *badger.DB, entry WatchEntry) error {
+	if entry.Kind == WATCH_PLAYER {
+		entry.Interval = 0
+	}
+	if entry.Interval != 0 && entry.Interval < MIN_WATCH_INTERVAL {
+		return fmt.Errorf("watch interval can't be under %s", MIN_WATCH_INTERVAL)
+	}
+	data, err := cbor.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	return db.Update(func(txn *badger.Txn) error {
+		return txn.Set(watchKey(entry.Kind, entry.Target), data)
+	})
+}
+
+// RemoveWatch stops watching target, its timeline is kept
+func RemoveWatch(db *badger.DB, kind, target string) (bool, error) {
+	found := false
+	err := db.Update(func(txn *badger.Txn) error {
+		key := watchKey(kind, target)
+		if _, err := txn.Get(key); errors.Is(err, badger.ErrKeyNotFound) {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		found = true
+		return txn.Delete(key)
+	})
+	return found, err
+}
+
+func ListWatches(db *badger.DB) ([]WatchEntry, error) {
+	var entries []WatchEntry
+	err := db.View(func(txn *badger.Txn) error {
+		opts := badger.DefaultIteratorOptions
+		opts.Prefix = []byte(WATCH_PREFIX)
+		it := txn.NewIterator(opts)
+		defer it.Close()
+		for it.Rewind(); it.Valid(); it.Next() {
+			var entry WatchEntry
+			err := it.Item().Value(func(val []byte) error {
+				return cbor.Unmarshal(val, &entry)
+			})
+			if err != nil {
+				return err
+			}
+			entries = append(entries, entry)
+		}
+		return nil
+	})
+	return entries, err
+}
+
+func RecordTimeline(db *badger.DB, kind, target string, event Event) error {
+	data, err := cbor.Marshal(event)
+	if err != nil {
+		return err
+	}
+	return db.Update(func(txn *badger.Txn) error {
+		return txn.Set(timelineKey(kind, target, event), data)
+	})
+}
+
+// Timeline calls fn with what happened to a watched target inside the window, oldest first
+func Timeline(db *badger.DB, kind, target string, since, until time.Time, fn func(Event) error) error {
+	prefix := timelinePrefix(kind, target)
+	return db.View(func(txn *badger.Txn) error {
+		opts := badger.DefaultIteratorOptions
+		opts.Prefix = prefix
+		it := txn.NewIterator(opts)
+		defer it.Close()
+		start := prefix
+		if !since.IsZero() {
+			start = binary.BigEndian.AppendUint64(bytes.Clone(prefix), uint64(since.UnixNano()))
+		}
+		for it.Seek(start); it.Valid(); it.Next() {
+			var event Event
+			err := it.Item().Value(func(val []byte) error {
+				return cbor.Unmarshal(val, &event)
+			})
+			if err != nil {
+				return err
+			}
+			if !until.IsZero() && event.Time.After(until) {
+				return nil
+			}
+			if err := fn(event); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// startNotifier sets up notifications from the -notify file, if there is one, and
+// the watchlist when the store is badger. It returns nil when there's neither.
+func startNotifier(ctx context.Context, notifyConfig string, store Storage) *Notifier {
+	badgerStore, isBadger := store.(*BadgerStorage)
+	var notifier *Notifier
+	switch {
+	case notifyConfig != "":
+		notifier = loadNotifier(notifyConfig, store)
+	case isBadger:
+		var err error
+		if notifier, err = NewNotifier(NotifyConfig{}, store); err != nil {
+			log.Fatal(err)
+		}
+	default:
+		return nil
+	}
+	if isBadger {
+		go reloadWatchlist(ctx, badgerStore.DB, notifier)
+	}
+	return notifier
+}
+
+// reloadWatchlist keeps the notifier's watchlist in step with db until ctx is done
+func reloadWatchlist(ctx context.Context, db *badger.DB, notifier *Notifier) {
+	ticker := time.NewTicker(WATCH_RELOAD_INTERVAL)
+	defer ticker.Stop()
+	for {
+		entries, err := ListWatches(db)
+		if err != nil {
+			slog.Error("Failed to load watchlist", "error", err)
+		} else {
+			notifier.SetWatchlist(entries)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// watchServers pings the notifier's watched servers on their own schedule, whatever
+// the generator is doing, until ctx is done
+func watchServers(ctx context.Context, notifier *Notifier, limiter *Limiter) <-chan *ServerStatus {
+	results := make(chan *ServerStatus, 100)
+	go func() {
+		defer close(results)
+		var wg sync.WaitGroup
+		defer wg.Wait()
+		sem := make(chan struct{}, WATCH_CONCURRENCY)
+		ticker := time.NewTicker(WATCH_TICK)
+		defer ticker.Stop()
+
+		next := make(map[string]time.Time)
+		for {
+			now := time.Now()
+			for _, entry := range notifier.WatchedServers() {
+				if now.Before(next[entry.Target]) {
+					continue
+				}
+				interval := entry.Interval
+				if interval == 0 {
+					interval = DEFAULT_WATCH_INTERVAL
+				}
+				next[entry.Target] = now.Add(interval)
+				ip, port, err := parseServerArg(entry.Target)
+				if err != nil {
+					continue
+				}
+				select {
+				case sem <- struct{}{}:
+				case <-ctx.Done():
+					return
+				}
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					defer func() { <-sem }()
+					if status := probeWatched(ctx, Target{IP: ip, Port: int(port)}, notifier, limiter); status != nil {
+						select {
+						case results <- status:
+						case <-ctx.Done():
+						}
+					}
+				}()
+			}
+
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+	return results
+}
+
+// probeWatched is what a worker does with a target, for one watched server
+func probeWatched(ctx context.Context, target Target, notifier *Notifier, limiter *Limiter) *ServerStatus {
+	release, err := limiter.Acquire(ctx, target.IP)
+	if err != nil {
+		return nil
+	}
+	probeCtx, span := tracer.Start(ctx, "probe", targetAttributes(target.IP.String(), target.Port))
+	status, err := GetServerStatus(probeCtx, target.IP, target.Port)
+	release()
+	endSpan(span, err)
+	if err != nil {
+		if ctx.Err() == nil {
+			slog.Info("Watched server didn't answer", "server", target.String(), "error", err)
+			notifier.ProbeFailed(target.IP, target.Port)
+		}
+		return nil
+	}
+	status.span = span.SpanContext()
+	return status
+}
+
+// mergeResults feeds the sweep's and the watchlist's results into one channel.
+// Once the sweep is done stop is called, and the output closes when both have.
+func mergeResults(sweep, watched <-chan *ServerStatus, stop func()) <-chan *ServerStatus {
+	out := make(chan *ServerStatus, cap(sweep))
+	go func() {
+		defer close(out)
+		for sweep != nil || watched != nil {
+			select {
+			case result, ok := <-sweep:
+				if !ok {
+					sweep = nil
+					stop()
+					continue
+				}
+				out <- result
+			case result, ok := <-watched:
+				if !ok {
+					watched = nil
+					continue
+				}
+				out <- result
+			}
+		}
+	}()
+	return out
+}
+
+func runWatch(args []string) {
+	usage := func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s watch add [-interval 1m] [-note TEXT] TARGET...\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "       %s watch remove TARGET...\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "       %s watch list\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "       %s watch timeline [-since TIME] [-until TIME] TARGET\n", os.Args[0])
+		fmt.Fprintln(os.Stderr, "TARGET is ip[:port] for a server, or a player's UUID or name.")
+		fmt.Fprintln(os.Stderr, "A running scanner keeps badger locked, change the watchlist through its -api instead.")
+	}
+	if len(args) == 0 {
+		usage()
+		os.Exit(2)
+	}
+	command := args[0]
+	fs := flag.NewFlagSet("watch "+command, flag.ExitOnError)
+	fs.Usage = func() {
+		usage()
+		fs.PrintDefaults()
+	}
+	dir := fs.String("db", BADGER_DIR, "badger directory")
+	format := fs.String("format", "table", "table or json")
+	interval := fs.Duration("interval", 0, "how often to ping watched servers, defaults to "+DEFAULT_WATCH_INTERVAL.String())
+	note := fs.String("note", "", "why it's being watched")
+	sinceArg := fs.String("since", "", "only events after this time, or this long ago (e.g. 7d)")
+	untilArg := fs.String("until", "", "only events before this time, or this long ago")
+	fs.Parse(args[1:])
+
+	var db *badger.DB
+	if command == "list" || command == "timeline" {
+		db = openReadOnly(*dir)
+	} else {
+		var err error
+		if db, err = badger.Open(badger.DefaultOptions(*dir).WithLogger(nil)); err != nil {
+			log.Fatal(err)
+		}
+	}
+	defer db.Close()
+
+	switch command {
+	case "add", "remove":
+		if fs.NArg() == 0 {
+			fs.Usage()
+			os.Exit(2)
+		}
+		for _, arg := range fs.Args() {
+			kind, target, err := ParseWatchTarget(arg)
+			if err != nil {
+				log.Fatal(err)
+			}
+			if command == "add" {
+				if err := AddWatch(db, WatchEntry{Kind: kind, Target: target, Note: *note, Interval: *interval, Added: time.Now()}); err != nil {
+					log.Fatal(err)
+				}
+				slog.Info("Watching", "kind", kind, "target", target)
+			} else if found, err := RemoveWatch(db, kind, target); err != nil {
+				log.Fatal(err)
+			} else if !found {
+				slog.Warn("Wasn't watching", "kind", kind, "target", target)
+			} else {
+				slog.Info("Stopped watching", "kind", kind, "target", target)
+			}
+		}
+
+	case "list":
+		entries, err := ListWatches(db)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if *format == "json" {
+			printJSON(entries)
+			return
+		}
+		tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		defer tw.Flush()
+		fmt.Fprintln(tw, "KIND\tTARGET\tINTERVAL\tADDED\tNOTE")
+		for _, entry := range entries {
+			every := ""
+			if entry.Kind == WATCH_SERVER {
+				every = DEFAULT_WATCH_INTERVAL.String()
+				if entry.Interval != 0 {
+					every = entry.Interval.String()
+				}
+			}
+			fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\n", entry.Kind, entry.Target, every, entry.Added.Format(time.DateTime), entry.Note)
+		}
+
+	case "timeline":
+		if fs.NArg() != 1 {
+			fs.Usage()
+			os.Exit(2)
+		}
+		kind, target, err := ParseWatchTarget(fs.Arg(0))
+		if err != nil {
+			log.Fatal(err)
+		}
+		since, err := ParseTimeArg(*sinceArg)
+		if err != nil {
+			log.Fatal(err)
+		}
+		until, err := ParseTimeArg(*untilArg)
+		if err != nil {
+			log.Fatal(err)
+		}
+		var events []Event
+		err = Timeline(db, kind, target, since, until, func(e Event) error {
+			events = append(events, e)
+			return nil
+		})
+		if err != nil {
+			log.Fatal(err)
+		}
+		if *format == "json" {
+			printJSON(events)
+			return
+		}
+		for _, event := range events {
+			fmt.Printf("%s  %-14s  %s\n", event.Time.Format(time.DateTime), event.Type, event.Message)
+		}
+
+	default:
+		usage()
+		os.Exit(2)
+	}
+}
+
+func printJSON(v any) {
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(v); err != nil {
+		log.Fatal(err)
+	}
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"encoding/json"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseWatchTarget(t *testing.T) {
+	for _, c := range []struct {
+		arg    string
+		kind   string
+		target string
+	}{
+		{"192.0.2.10", WATCH_SERVER, "192.0.2.10:25565"},
+		{"192.0.2.10:25566", WATCH_SERVER, "192.0.2.10:25566"},
+		{"853C80EF-3C37-49FD-AA49-938B674ADAE6", WATCH_PLAYER, "853c80ef-3c37-49fd-aa49-938b674adae6"},
+		{"Jeb_", WATCH_PLAYER, "jeb_"},
+		{"192.0.2.10:99999", "", ""},
+		{"not a player", "", ""},
+		{"averyveryverylongname", "", ""},
+	} {
+		kind, target, err := ParseWatchTarget(c.arg)
+		if kind != c.kind || target != c.target || (err != nil) != (c.kind == "") {
+			t.Errorf("%q is %s %q (%v), want %s %q", c.arg, kind, target, err, c.kind, c.target)
+		}
+	}
+}
+
+// watchedStatus is 192.0.2.10:25566 answering with Notch and jeb_ online
+func watchedStatus(at time.Time) *ServerStatus {
+	status := testStatus(net.IPv4(192, 0, 2, 10).To4(), 25566, "agent")
+	status.Time = at
+	notch, jeb := "Notch", "jeb_"
+	notchID := *(*fullRecord().Players.Sample)[0].ID
+	status.Players = &PlayersInfo{Max: 20, Online: 2, Sample: &[]SamplePlayer{{Name: &notch, ID: &notchID}, {Name: &jeb, ID: &jebID}}}
+	return status
+}
+
+func timelineTypes(t *testing.T, store *BadgerStorage, kind, target string) string {
+	t.Helper()
+	var types []string
+	err := Timeline(store.DB, kind, target, time.Time{}, time.Time{}, func(event Event) error {
+		types = append(types, event.Type)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return strings.Join(types, " ")
+}
+
+func TestWatchlistNotifies(t *testing.T) {
+	store := openTestBadger(t)
+	// the server was seen before, on another version
+	if err := store.PutObservations([]*ServerRecord{fullRecord()}); err != nil {
+		t.Fatal(err)
+	}
+	rcv := newWebhookReceiver(t)
+	n, err := NewNotifier(NotifyConfig{Webhooks: []WebhookConfig{{URL: rcv.server.URL, Flush: Duration(time.Hour)}}}, store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, arg := range []string{"192.0.2.10:25566", "Jeb_"} {
+		kind, target, err := ParseWatchTarget(arg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := AddWatch(store.DB, WatchEntry{Kind: kind, Target: target, Added: time.Now()}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	entries, err := ListWatches(store.DB)
+	if err != nil {
+		t.Fatal(err)
+	}
+	n.SetWatchlist(entries)
+	if watched := n.WatchedServers(); len(watched) != 1 || watched[0].Target != "192.0.2.10:25566" {
+		t.Fatalf("watching servers %+v", watched)
+	}
+
+	at := time.Now().Truncate(time.Second)
+	n.Observe(watchedStatus(at))
+	record, err := NewServerRecord(watchedStatus(at))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := store.PutObservations([]*ServerRecord{record}); err != nil {
+		t.Fatal(err)
+	}
+	// nothing changed, and jeb_ was only just announced
+	n.Observe(watchedStatus(at.Add(time.Minute)))
+	// it takes two missed probes to go offline
+	n.ProbeFailed(record.IP, int(record.Port))
+	n.ProbeFailed(record.IP, int(record.Port))
+	n.Observe(watchedStatus(at.Add(3 * time.Minute)))
+	// Notch isn't watched, and neither is this server
+	other := watchedStatus(at)
+	other.Address = &net.TCPAddr{IP: net.IPv4(192, 0, 2, 11), Port: 25565}
+	other.Players.Sample = &[]SamplePlayer{(*other.Players.Sample)[0]}
+	n.Observe(other)
+	n.Close()
+
+	// events at the same time sort by type
+	if got, want := timelineTypes(t, store, WATCH_SERVER, "192.0.2.10:25566"), "player_seen version_change offline online"; got != want {
+		t.Errorf("server timeline %q, want %q", got, want)
+	}
+	if got := timelineTypes(t, store, WATCH_PLAYER, "jeb_"); got != EVENT_PLAYER_SEEN {
+		t.Errorf("player timeline %q, want %q", got, EVENT_PLAYER_SEEN)
+	}
+	if got := timelineTypes(t, store, WATCH_SERVER, "192.0.2.11:25565"); got != "" {
+		t.Errorf("unwatched server has a timeline %q", got)
+	}
+
+	var sent []string
+	for _, req := range rcv.received() {
+		var body struct {
+			Events []Event `json:"events"`
+		}
+		if err := json.Unmarshal(req.body, &body); err != nil {
+			t.Fatal(err)
+		}
+		for _, event := range body.Events {
+			sent = append(sent, strings.TrimSpace(event.Type+" "+event.Server+" "+event.Player))
+		}
+	}
+	want := "version_change 192.0.2.10:25566, player_seen 192.0.2.10:25566 jeb_, offline 192.0.2.10:25566, online 192.0.2.10:25566, new_server 192.0.2.11:25565"
+	if got := strings.Join(sent, ", "); got != want {
+		t.Errorf("webhook got %s\nwant %s", got, want)
+	}
+}
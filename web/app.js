@@ -0,0 +1,343 @@
+"use strict";
+
+// The dashboard only talks to the JSON API, see api.go for the endpoints.
+
+const view = document.getElementById("view");
+
+// Minecraft's formatting codes, § followed by one of these
+const COLORS = {
+  "0": "#000000", "1": "#0000aa", "2": "#00aa00", "3": "#00aaaa",
+  "4": "#aa0000", "5": "#aa00aa", "6": "#ffaa00", "7": "#aaaaaa",
+  "8": "#555555", "9": "#5555ff", "a": "#55ff55", "b": "#55ffff",
+  "c": "#ff5555", "d": "#ff55ff", "e": "#ffff55", "f": "#ffffff",
+};
+const STYLES = { l: "b", o: "i", n: "u", m: "s", k: "k" };
+
+function el(tag, attrs, ...children) {
+  const node = document.createElement(tag);
+  for (const [key, value] of Object.entries(attrs || {})) {
+    if (key === "class") node.className = value;
+    else if (key.startsWith("on")) node.addEventListener(key.slice(2), value);
+    else node.setAttribute(key, value);
+  }
+  for (const child of children) {
+    if (child == null) continue;
+    node.append(child instanceof Node ? child : String(child));
+  }
+  return node;
+}
+
+function svg(tag, attrs) {
+  const node = document.createElementNS("http://www.w3.org/2000/svg", tag);
+  for (const [key, value] of Object.entries(attrs || {})) node.setAttribute(key, value);
+  return node;
+}
+
+// renderMOTD turns § codes into spans, everything is added as text so nothing in a MOTD is ever parsed as HTML
+function renderMOTD(text) {
+  const out = el("div", { class: "motd" });
+  let color = null;
+  let styles = new Set();
+  const parts = (text || "").split("§");
+  const emit = (s) => {
+    if (!s) return;
+    const span = el("span", { class: [...styles].join(" ") }, s);
+    if (color) span.style.color = color;
+    out.append(span);
+  };
+  emit(parts[0]);
+  for (const part of parts.slice(1)) {
+    const code = part.charAt(0).toLowerCase();
+    if (COLORS[code]) {
+      // a colour also resets the styles, like in the client
+      color = COLORS[code];
+      styles = new Set();
+    } else if (STYLES[code]) {
+      styles.add(STYLES[code]);
+    } else if (code === "r") {
+      color = null;
+      styles = new Set();
+    }
+    emit(part.slice(1));
+  }
+  return out;
+}
+
+// the API only sends the favicon's hash, the image comes from its own (cacheable) endpoint
+function favicon(record) {
+  if (record.faviconHash) return el("img", { class: "favicon", src: `/api/favicons/${encodeURIComponent(record.faviconHash)}`, alt: "" });
+  return el("div", { class: "favicon" });
+}
+
+function addr(record) {
+  return record.port === 25565 ? record.ip : `${record.ip}:${record.port}`;
+}
+
+function players(record) {
+  return record.players ? `${record.players.online}/${record.players.max}` : "?";
+}
+
+async function api(path) {
+  const res = await fetch(path);
+  const body = await res.json();
+  if (!res.ok) throw new Error(body.error || res.statusText);
+  return body;
+}
+
+function showError(err) {
+  view.append(el("p", { class: "error" }, err.message));
+}
+
+// search modes, query is the query language (see search.go), the next two are filters
+// on /api/servers and the others go through an index
+const SEARCH_MODES = {
+  query: { label: "query", param: "q", placeholder: "version:1.20.* players>10 motd:\"survival games\" -fake" },
+  motd: { label: "MOTD", param: "motd" },
+  version: { label: "version", param: "version" },
+  player: { label: "player", kind: "player-name" },
+  software: { label: "software", kind: "software" },
+};
+
+function searchURL(params, cursor) {
+  const query = new URLSearchParams();
+  const mode = SEARCH_MODES[params.get("mode")] || SEARCH_MODES.query;
+  const term = params.get("q") || "";
+  let path = "/api/servers";
+  if (term && mode.kind) {
+    path = "/api/search";
+    query.set("kind", mode.kind);
+    query.set("term", term);
+    query.set("prefix", "true");
+  } else if (term) {
+    query.set(mode.param, term);
+  }
+  if (params.get("min-online")) query.set("min-online", params.get("min-online"));
+  if (cursor) query.set("cursor", cursor);
+  return `${path}?${query}`;
+}
+
+// planSummary says whether a query used the indexes or had to look at every server
+function planSummary(plan) {
+  const lookups = (plan.lookups || []).map((l) => `${l.kind} "${l.term}${l.prefix ? "*" : ""}"`);
+  const found = lookups.length ? `looked up ${lookups.join(" and ")}` : "scanned every server";
+  return plan.check.length ? `${found}, then checked ${plan.check.join(" ")}` : found;
+}
+
+function serverRow(record) {
+  const meta = [record.version && record.version.name];
+  if (record.enrichment) meta.push(record.enrichment.country, record.enrichment.asName);
+  return el("a", { class: "server", href: `#/server/${addr(record)}` },
+    favicon(record),
+    el("div", { class: "info" },
+      el("div", null, addr(record)),
+      renderMOTD(record.description),
+      el("div", { class: "meta" }, meta.filter(Boolean).join(" · "))),
+    el("div", { class: "count" }, players(record)));
+}
+
+async function showServers(params) {
+  const mode = el("select", { name: "mode" },
+    ...Object.entries(SEARCH_MODES).map(([value, m]) => el("option", { value }, m.label)));
+  mode.value = params.get("mode") || "query";
+  const term = el("input", { type: "text", name: "q", value: params.get("q") || "" });
+  const placeholder = () => { term.placeholder = SEARCH_MODES[mode.value].placeholder || "search"; };
+  mode.addEventListener("change", placeholder);
+  placeholder();
+  const minOnline = el("input", { type: "number", name: "min-online", min: "0", placeholder: "min online", value: params.get("min-online") || "" });
+  const form = el("form", {
+    class: "search",
+    onsubmit: (e) => {
+      e.preventDefault();
+      const next = new URLSearchParams();
+      if (term.value) next.set("q", term.value);
+      next.set("mode", mode.value);
+      if (minOnline.value) next.set("min-online", minOnline.value);
+      location.hash = `#/?${next}`;
+    },
+  }, mode, term, minOnline, el("button", { type: "submit" }, "search"));
+
+  const list = el("div");
+  const more = el("div", { class: "more" });
+  view.append(form, list, more);
+
+  const load = async (cursor) => {
+    more.replaceChildren();
+    try {
+      const page = await api(searchURL(params, cursor));
+      if (!cursor && page.plan) list.append(el("p", { class: "muted plan" }, planSummary(page.plan)));
+      for (const record of page.servers) list.append(serverRow(record));
+      if (!cursor && page.servers.length === 0) list.append(el("p", { class: "muted" }, "nothing found"));
+      if (page.next) more.append(el("button", { onclick: () => load(page.next) }, "more"));
+    } catch (err) {
+      showError(err);
+    }
+  };
+  await load("");
+}
+
+// playerChart draws online and max players over time
+function playerChart(observations) {
+  const points = observations.filter((o) => o.players);
+  const box = el("div", { class: "panel chart" }, el("h2", null, "players"));
+  if (points.length < 2) {
+    box.append(el("p", { class: "muted" }, "not enough observations to draw"));
+    return box;
+  }
+  const W = 1000, H = 220, PAD = 30;
+  const times = points.map((o) => Date.parse(o.observedAt));
+  const t0 = Math.min(...times), t1 = Math.max(...times);
+  const top = Math.max(1, ...points.map((o) => Math.max(o.players.online, o.players.max)));
+  const x = (t) => PAD + ((t - t0) / (t1 - t0 || 1)) * (W - 2 * PAD);
+  const y = (v) => H - PAD - (v / top) * (H - 2 * PAD);
+  const line = (field) => points.map((o, i) => `${x(times[i]).toFixed(1)},${y(o.players[field]).toFixed(1)}`).join(" ");
+
+  const chart = svg("svg", { viewBox: `0 0 ${W} ${H}`, preserveAspectRatio: "none" });
+  chart.append(
+    svg("line", { class: "axis", x1: PAD, y1: H - PAD, x2: W - PAD, y2: H - PAD }),
+    svg("line", { class: "axis", x1: PAD, y1: PAD, x2: PAD, y2: H - PAD }),
+    svg("polyline", { class: "max", points: line("max") }),
+    svg("polyline", { class: "online", points: line("online") }));
+  const label = (text, attrs) => {
+    const node = svg("text", attrs);
+    node.textContent = text;
+    chart.append(node);
+  };
+  label(top, { x: 2, y: PAD + 4 });
+  label(0, { x: 2, y: H - PAD });
+  label(new Date(t0).toLocaleString(), { x: PAD, y: H - 8 });
+  label(new Date(t1).toLocaleString(), { x: W - PAD, y: H - 8, "text-anchor": "end" });
+  box.append(chart, el("p", { class: "muted" }, "online, dashed is the player limit"));
+  return box;
+}
+
+async function showServer(server, params) {
+  const since = params.get("since") || "30d";
+  let record;
+  try {
+    record = await api(`/api/servers/${server}`);
+  } catch (err) {
+    showError(err);
+    return;
+  }
+
+  const facts = [
+    ["address", addr(record)],
+    ["version", `${record.version.name} (protocol ${record.version.protocol})`],
+    ["players", players(record)],
+    ["last seen", new Date(record.observedAt).toLocaleString()],
+    ["online mode", record.isOnlineMode == null ? "unknown" : record.isOnlineMode ? "yes" : "no"],
+  ];
+  if (record.enrichment) {
+    facts.push(["country", record.enrichment.country || "?"]);
+    facts.push(["network", `AS${record.enrichment.asn} ${record.enrichment.asName || ""} ${record.enrichment.prefix || ""}`]);
+  }
+  for (const host of record.hostnames || []) facts.push(["hostname", host.name]);
+  const dl = el("dl");
+  for (const [k, v] of facts) dl.append(el("dt", null, k), el("dd", null, v));
+
+  view.append(el("div", { class: "panel detail-head" }, favicon(record),
+    el("div", { class: "info" }, renderMOTD(record.description), el("br"), dl)));
+
+  const range = el("select", { onchange: (e) => { location.hash = `#/server/${server}?since=${e.target.value}`; } },
+    ...["1d", "7d", "30d", "365d"].map((v) => el("option", { value: v }, `last ${v}`)));
+  range.value = since;
+  view.append(range);
+
+  try {
+    const history = await api(`/api/servers/${server}/history?since=${since}&limit=1000`);
+    view.append(playerChart(history.observations));
+    if (history.next) view.append(el("p", { class: "muted" }, "only the first 1000 observations are drawn"));
+
+    const seen = await api(`/api/servers/${server}/players?since=${since}`);
+    const table = el("table", null, el("tr", null, el("th", null, "player"), el("th", null, "first seen"), el("th", null, "last seen"), el("th", null, "sightings")));
+    for (const p of seen) {
+      table.append(el("tr", null,
+        el("td", null, el("a", { href: `#/player/${p.uuid}` }, p.name)),
+        el("td", null, new Date(p.firstSeen).toLocaleString()),
+        el("td", null, new Date(p.lastSeen).toLocaleString()),
+        el("td", null, p.sightings)));
+    }
+    view.append(el("div", { class: "panel" }, el("h2", null, "players seen"),
+      seen.length ? table : el("p", { class: "muted" }, "nobody in the samples")));
+  } catch (err) {
+    showError(err);
+  }
+}
+
+async function showPlayer(player) {
+  try {
+    const res = await api(`/api/players/${encodeURIComponent(player)}`);
+    const table = el("table", null, el("tr", null, el("th", null, "server"), el("th", null, "as"), el("th", null, "first seen"), el("th", null, "last seen"), el("th", null, "sightings")));
+    for (const s of res.servers) {
+      table.append(el("tr", null,
+        el("td", null, el("a", { href: `#/server/${s.server}` }, s.server)),
+        el("td", null, s.name),
+        el("td", null, new Date(s.firstSeen).toLocaleString()),
+        el("td", null, new Date(s.lastSeen).toLocaleString()),
+        el("td", null, s.sightings)));
+    }
+    view.append(el("div", { class: "panel" }, el("h2", null, res.uuids.join(", ")), table));
+  } catch (err) {
+    showError(err);
+  }
+}
+
+function bars(title, counts, label) {
+  const box = el("div", { class: "panel" }, el("h2", null, title));
+  if (!counts || counts.length === 0) {
+    box.append(el("p", { class: "muted" }, "no data"));
+    return box;
+  }
+  const top = counts[0].count;
+  const grid = el("div", { class: "bars" });
+  for (const c of counts) {
+    const bar = el("div", { class: "bar" });
+    bar.style.width = `${(100 * c.count) / top}%`;
+    grid.append(el("div", { class: "label", title: c.name }, label ? label(c.name) : c.name || "unknown"), el("div", null, bar), el("div", { class: "value" }, c.count));
+  }
+  box.append(grid);
+  return box;
+}
+
+// flag turns a country code into its flag emoji
+function flag(code) {
+  if (!/^[A-Z]{2}$/.test(code)) return code;
+  return String.fromCodePoint(...[...code].map((c) => 0x1f1e6 + c.charCodeAt(0) - 65)) + " " + code;
+}
+
+async function showStats() {
+  try {
+    const stats = await api("/api/stats");
+    const total = (label, value) => el("div", null, value.toLocaleString(), el("span", null, label));
+    view.append(
+      el("div", { class: "panel totals" },
+        total("servers", stats.servers),
+        total("players online", stats.playersOnline),
+        total("player slots", stats.playerSlots),
+        total("online mode", stats.onlineMode),
+        total("modded", stats.modded),
+        total("fake samples", stats.fakeSample)),
+      el("div", { class: "grid" },
+        bars("versions", stats.versions),
+        bars("software", stats.software),
+        bars("countries", stats.countries, flag),
+        bars("networks", stats.asns)),
+      el("p", { class: "muted" }, `computed ${new Date(stats.generatedAt).toLocaleString()}, countries and networks need a scan with enrichment`));
+  } catch (err) {
+    showError(err);
+  }
+}
+
+function route() {
+  view.replaceChildren();
+  const [path, query] = location.hash.replace(/^#/, "").split("?");
+  const params = new URLSearchParams(query || "");
+  const parts = path.split("/").filter(Boolean);
+  if (parts[0] === "server" && parts[1]) return showServer(parts[1], params);
+  if (parts[0] === "player" && parts[1]) return showPlayer(decodeURIComponent(parts[1]));
+  if (parts[0] === "stats") return showStats();
+  return showServers(params);
+}
+
+window.addEventListener("hashchange", route);
+route();
@@ -0,0 +1,370 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"log/slog"
+	"sync"
+	"time"
+
+	badger "github.com/dgraph-io/badger/v4"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Results are committed in groups, whichever of these is reached first
+const DEFAULT_WRITE_BATCH = 256
+const DEFAULT_WRITE_FLUSH = time.Second
+
+// a batch that keeps conflicting with other writers is retried this many times
+const MAX_WRITE_RETRIES = 5
+
+const WRITE_LOG_INTERVAL = 10 * time.Second
+
+// how many of the latest results Recent returns
+const RECENT_RESULTS = 10
+
+type WriterConfig struct {
+	BatchSize     int
+	FlushInterval time.Duration
+	Sinks         []string // -sink specs, see OpenSink
+	SinkMaxSize   int64    // bytes a file sink grows to before it's rotated
+	SinkKeep      int      // rotated files kept
+}
+
+type WriterStats struct {
+	Received      uint64 // results handed to the writer
+	Written       uint64
+	Failed        uint64
+	Batches       uint64
+	Retries       uint64
+	Pending       int
+	LastLatency   time.Duration // commit time of the last batch
+	MaxLatency    time.Duration
+	TotalLatency  time.Duration
+	MaxQueueDelay time.Duration // longest a result waited for its batch to be committed
+}
+
+// BatchWriter groups results into transactions. For badger each batch is one
+// transaction rather than a WriteBatch, because storing a delta reads the
+// previous observation, which may be earlier in the same batch.
+type BatchWriter struct {
+	store Storage
+	cfg   WriterConfig
+
+	pending []*ServerRecord
+	oldest  time.Time
+	traced  []trace.SpanContext // probe spans of the pending records that are being traced
+
+	sinks []ResultSink
+
+	mu     sync.Mutex
+	stats  WriterStats
+	recent []*ServerRecord // newest last
+
+	// results taken by Add, and how many of those have been through a Flush
+	added     uint64
+	committed uint64
+	waiters   []commitWaiter
+}
+
+type commitWaiter struct {
+	n    uint64
+	done chan struct{}
+}
+
+func NewBatchWriter(store Storage, cfg WriterConfig) *BatchWriter {
+	if cfg.BatchSize <= 0 {
+		cfg.BatchSize = 1
+	}
+	if cfg.FlushInterval <= 0 {
+		cfg.FlushInterval = DEFAULT_WRITE_FLUSH
+	}
+	return &BatchWriter{store: store, cfg: cfg}
+}
+
+func addWriterFlags(fs *flag.FlagSet, cfg *WriterConfig) {
+	fs.IntVar(&cfg.BatchSize, "write-batch", DEFAULT_WRITE_BATCH, "results committed per database transaction")
+	fs.DurationVar(&cfg.FlushInterval, "write-flush", DEFAULT_WRITE_FLUSH, "longest a result waits before its batch is committed")
+	fs.Func("sink", "also stream results as NDJSON to stdout, file:PATH, tcp:ADDR or unix:PATH, can be repeated", func(spec string) error {
+		cfg.Sinks = append(cfg.Sinks, spec)
+		return nil
+	})
+	fs.Int64Var(&cfg.SinkMaxSize, "sink-max-size", DEFAULT_SINK_MAX_SIZE, "bytes a file sink grows to before it's rotated, 0 never rotates")
+	fs.IntVar(&cfg.SinkKeep, "sink-keep", DEFAULT_SINK_KEEP, "rotated file sink files to keep")
+}
+
+// OpenSinks opens the -sink outputs, CloseSinks must be called once Run is done
+func (w *BatchWriter) OpenSinks() error {
+	for _, spec := range w.cfg.Sinks {
+		sink, err := OpenSink(spec, w.cfg.SinkMaxSize, w.cfg.SinkKeep)
+		if err != nil {
+			w.CloseSinks()
+			return err
+		}
+		w.AddSink(sink)
+	}
+	return nil
+}
+
+// AddSink sends every result from now on to sink as well
+func (w *BatchWriter) AddSink(sink ResultSink) {
+	w.sinks = append(w.sinks, sink)
+}
+
+func (w *BatchWriter) CloseSinks() {
+	for _, sink := range w.sinks {
+		if err := sink.Close(); err != nil {
+			slog.Error("Failed to close sink", "error", err)
+		}
+	}
+	w.sinks = nil
+}
+
+// Add queues a result, committing the batch once it is full
+func (w *BatchWriter) Add(result *ServerStatus) {
+	online, max := 0, 0
+	if result.Players != nil {
+		online, max = result.Players.Online, result.Players.Max
+	}
+	slog.Info("Result", "Address", result.Address, "Version", result.Version.Name, "Online", online, "Max", max)
+
+	w.mu.Lock()
+	w.added++
+	w.mu.Unlock()
+	record, err := NewServerRecord(result)
+	if err != nil {
+		slog.Error("Failed to build record", "error", err)
+		return
+	}
+	w.mu.Lock()
+	w.stats.Received++
+	w.recent = append(w.recent, record)
+	if len(w.recent) > RECENT_RESULTS {
+		w.recent = w.recent[1:]
+	}
+	w.mu.Unlock()
+	for _, sink := range w.sinks {
+		if err := sink.Write(record); err != nil {
+			slog.Error("Failed to write to sink", "error", err)
+		}
+	}
+
+	if len(w.pending) == 0 {
+		w.oldest = time.Now()
+	}
+	w.pending = append(w.pending, record)
+	if result.span.IsSampled() {
+		w.traced = append(w.traced, result.span)
+	}
+	w.setPending()
+	if len(w.pending) >= w.cfg.BatchSize {
+		w.Flush()
+	}
+}
+
+func (w *BatchWriter) setPending() {
+	w.mu.Lock()
+	w.stats.Pending = len(w.pending)
+	w.mu.Unlock()
+}
+
+// Flush commits everything queued so far
+func (w *BatchWriter) Flush() {
+	if len(w.pending) == 0 {
+		// results that never made it into a record still count as done
+		w.mu.Lock()
+		w.setCommitted()
+		w.mu.Unlock()
+		return
+	}
+	span := w.startWriteSpan()
+	start := time.Now()
+	written, failed, batches, retries := w.commit(w.pending)
+	latency := time.Since(start)
+	span.SetAttributes(
+		attribute.Int("db.records", len(w.pending)),
+		attribute.Int("db.failed", failed),
+		attribute.Int("db.retries", retries),
+	)
+	span.End()
+	metricWritten.WithLabelValues("written").Add(float64(written))
+	metricWritten.WithLabelValues("failed").Add(float64(failed))
+
+	w.mu.Lock()
+	w.stats.Written += uint64(written)
+	w.stats.Failed += uint64(failed)
+	w.stats.Batches += uint64(batches)
+	w.stats.Retries += uint64(retries)
+	w.stats.LastLatency = latency
+	w.stats.TotalLatency += latency
+	w.stats.MaxLatency = max(w.stats.MaxLatency, latency)
+	w.stats.MaxQueueDelay = max(w.stats.MaxQueueDelay, time.Since(w.oldest))
+	w.stats.Pending = 0
+	w.setCommitted()
+	w.mu.Unlock()
+
+	clear(w.pending)
+	w.pending = w.pending[:0]
+	w.traced = w.traced[:0]
+}
+
+// setCommitted marks everything added so far as written and wakes whoever was waiting for it, w.mu must be held
+func (w *BatchWriter) setCommitted() {
+	w.committed = w.added
+	waiting := w.waiters[:0]
+	for _, waiter := range w.waiters {
+		if waiter.n <= w.committed {
+			close(waiter.done)
+		} else {
+			waiting = append(waiting, waiter)
+		}
+	}
+	w.waiters = waiting
+}
+
+// Added is how many results Add has been given so far
+func (w *BatchWriter) Added() uint64 {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.added
+}
+
+// WaitCommitted blocks until the first n results given to Add have been
+// through a Flush, so whatever could be written of them is on disk
+func (w *BatchWriter) WaitCommitted(ctx context.Context, n uint64) error {
+	w.mu.Lock()
+	if n <= w.committed {
+		w.mu.Unlock()
+		return nil
+	}
+	done := make(chan struct{})
+	w.waiters = append(w.waiters, commitWaiter{n: n, done: done})
+	w.mu.Unlock()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// startWriteSpan starts the span of a database write. It carries on the trace of the
+// first traced probe in the batch and links the others, a batch nobody traced starts
+// its own trace, sampled like a probe.
+func (w *BatchWriter) startWriteSpan() trace.Span {
+	if len(w.traced) == 0 {
+		_, span := tracer.Start(context.Background(), "db.write")
+		return span
+	}
+	var links []trace.Link
+	for _, sc := range w.traced[1:] {
+		links = append(links, trace.Link{SpanContext: sc})
+	}
+	parent := trace.ContextWithSpanContext(context.Background(), w.traced[0])
+	_, span := tracer.Start(parent, "db.write", trace.WithLinks(links...))
+	return span
+}
+
+// commit writes records in as few transactions as possible. Batches too big for
+// one transaction are split in half, and so are failing ones, so one bad record
+// doesn't take the rest of its batch down with it.
+func (w *BatchWriter) commit(records []*ServerRecord) (written, failed, batches, retries int) {
+	var err error
+	for attempt := 0; attempt <= MAX_WRITE_RETRIES; attempt++ {
+		start := time.Now()
+		err = w.store.PutObservations(records)
+		metricWriteLatency.Observe(time.Since(start).Seconds())
+		if !errors.Is(err, badger.ErrConflict) {
+			break
+		}
+		retries++
+	}
+	if err == nil {
+		return len(records), 0, 1, retries
+	}
+	if len(records) == 1 {
+		slog.Error("Failed to write to database", "server", records[0].Addr(), "error", err)
+		return 0, 1, 1, retries
+	}
+	half := len(records) / 2
+	w1, f1, b1, r1 := w.commit(records[:half])
+	w2, f2, b2, r2 := w.commit(records[half:])
+	return w1 + w2, f1 + f2, b1 + b2, retries + r1 + r2
+}
+
+// Recent returns the last few results, newest first
+func (w *BatchWriter) Recent() []*ServerRecord {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	recent := make([]*ServerRecord, len(w.recent))
+	for i, record := range w.recent {
+		recent[len(recent)-1-i] = record
+	}
+	return recent
+}
+
+func (w *BatchWriter) Stats() WriterStats {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.stats
+}
+
+// Run writes results until both channels are closed. Whatever is still queued
+// when they close is committed before it returns, so once Run is done every
+// result sent to it is on disk.
+func (w *BatchWriter) Run(results <-chan *ServerStatus, errors <-chan ErrorWithIP) {
+	ticker := time.NewTicker(w.cfg.FlushInterval)
+	defer ticker.Stop()
+	defer w.Flush()
+
+	for results != nil || errors != nil {
+		select {
+		case result, ok := <-results:
+			if !ok {
+				results = nil
+			} else {
+				w.Add(result)
+			}
+		case err, ok := <-errors:
+			if !ok {
+				errors = nil
+			} else {
+				slog.Error(err.Err.Error(), "IP", err.IP.String(), "Port", err.Port)
+			}
+		case <-ticker.C:
+			w.Flush()
+		}
+	}
+}
+
+func LogWriterStats(ctx context.Context, w *BatchWriter) {
+	ticker := time.NewTicker(WRITE_LOG_INTERVAL)
+	defer ticker.Stop()
+	var previous uint64
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			stats := w.Stats()
+			var average time.Duration
+			if stats.Batches > 0 {
+				average = stats.TotalLatency / time.Duration(stats.Batches)
+			}
+			slog.Info("Writer",
+				"written", stats.Written,
+				"writeRate", float64(stats.Written-previous)/WRITE_LOG_INTERVAL.Seconds(),
+				"failed", stats.Failed,
+				"pending", stats.Pending,
+				"batches", stats.Batches,
+				"retries", stats.Retries,
+				"lastLatency", stats.LastLatency,
+				"avgLatency", average,
+				"maxLatency", stats.MaxLatency,
+				"maxQueueDelay", stats.MaxQueueDelay)
+			previous = stats.Written
+		}
+	}
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+	"time"
+)
+
+// waitCommittedLater waits for n results in the background, and returns once it's waiting
+func waitCommittedLater(t *testing.T, w *BatchWriter, n uint64) <-chan error {
+	t.Helper()
+	waiters := func() int {
+		w.mu.Lock()
+		defer w.mu.Unlock()
+		return len(w.waiters)
+	}
+	before := waiters()
+	done := make(chan error, 1)
+	go func() { done <- w.WaitCommitted(context.Background(), n) }()
+	for deadline := time.Now().Add(5 * time.Second); waiters() == before; time.Sleep(time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("never started waiting")
+		}
+	}
+	return done
+}
+
+func TestBatchWriterWaitCommitted(t *testing.T) {
+	store := openTestBadger(t)
+	w := NewBatchWriter(store, WriterConfig{BatchSize: 3, FlushInterval: time.Minute})
+	all := NewRecordFilter()
+	cancelled, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	addResults(w, 2)
+	if err := w.WaitCommitted(cancelled, 2); !errors.Is(err, context.Canceled) {
+		t.Fatalf("waiting on a batch that isn't full: %v", err)
+	}
+	if servers := collectRecords(t, func(fn func(*ServerRecord) error) error {
+		return store.Scan(&all, true, fn)
+	}); len(servers) != 0 {
+		t.Fatalf("%d servers written before the batch was full", len(servers))
+	}
+
+	// filling the batch commits it, which wakes whoever waits for it
+	done := waitCommittedLater(t, w, 3)
+	w.Add(testStatus(net.IPv4(192, 0, 2, 3), 25565, "agent"))
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	if servers := collectRecords(t, func(fn func(*ServerRecord) error) error {
+		return store.Scan(&all, true, fn)
+	}); len(servers) != 3 {
+		t.Fatalf("%d servers written once committed, want 3", len(servers))
+	}
+	if err := w.WaitCommitted(cancelled, 3); err != nil {
+		t.Errorf("waiting on what's already committed: %v", err)
+	}
+
+	// results that never became records are done as soon as anything flushes
+	w.Add(testStatus(net.ParseIP("2001:db8::1"), 25565, "agent"))
+	done = waitCommittedLater(t, w, w.Added())
+	w.Flush()
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+
+	stats := w.Stats()
+	if stats.Received != 3 || stats.Written != 3 || stats.Batches != 1 || stats.Pending != 0 {
+		t.Errorf("stats %+v", stats)
+	}
+}